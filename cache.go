@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// cachingTransport is a http.RoundTripper that keeps successful GET responses
+// on disk, keyed by URL, so repeated runs over the same area don't download
+// the same tiles again. Entries older than ttl are refetched; a ttl of 0
+// never expires them. Query parameters in ignoreParams, such as cache
+// busters, are left out of the key.
+type cachingTransport struct {
+	dir          string
+	ttl          time.Duration
+	transport    http.RoundTripper
+	ignoreParams map[string]bool
+}
+
+func newCachingTransport(dir string, ttl time.Duration, transport http.RoundTripper, ignoreParams map[string]bool) (*cachingTransport, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	return &cachingTransport{dir: dir, ttl: ttl, transport: transport, ignoreParams: ignoreParams}, nil
+}
+
+func (cache *cachingTransport) path(requestUrl *url.URL) string {
+	key := *requestUrl
+	if len(cache.ignoreParams) > 0 {
+		query := key.Query()
+		for param := range cache.ignoreParams {
+			query.Del(param)
+		}
+		key.RawQuery = query.Encode()
+	}
+	sum := sha256.Sum256([]byte(key.String()))
+	return filepath.Join(cache.dir, hex.EncodeToString(sum[:]))
+}
+
+// CACHE_HEADERS are the response headers kept with a cached tile, in a
+// ".headers" file next to it, so conditional requests such as those of
+// -update-since are answered like the server would.
+var CACHE_HEADERS = []string{"Last-Modified", "ETag"}
+
+func (cache *cachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != "GET" {
+		return cache.transport.RoundTrip(req)
+	}
+
+	path := cache.path(req.URL)
+	info, err := os.Stat(path)
+	if err == nil && (cache.ttl == 0 || time.Since(info.ModTime()) < cache.ttl) {
+		content, err := ioutil.ReadFile(path)
+		if err == nil {
+			header := readCacheHeaders(path)
+			header.Set("X-From-Cache", "1")
+			// Otherwise the server has to decide.
+			if modified, decided := cachedModified(req, header); decided {
+				status, body := http.StatusOK, content
+				if !modified {
+					status, body = http.StatusNotModified, nil
+				}
+				return &http.Response{
+					Status:        fmt.Sprintf("%d %s", status, http.StatusText(status)),
+					StatusCode:    status,
+					Proto:         "HTTP/1.1",
+					ProtoMajor:    1,
+					ProtoMinor:    1,
+					Header:        header,
+					Body:          ioutil.NopCloser(bytes.NewReader(body)),
+					ContentLength: int64(len(body)),
+					Request:       req,
+				}, nil
+			}
+		}
+	}
+
+	resp, err := cache.transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(content))
+
+	header := make(map[string]string)
+	for _, name := range CACHE_HEADERS {
+		if value := resp.Header.Get(name); value != "" {
+			header[name] = value
+		}
+	}
+	headerContent, err := json.Marshal(header)
+	if err != nil {
+		return resp, nil
+	}
+	// The headers go first, so a tile is never read with those of the entry
+	// it replaced.
+	if cache.writeEntry(path+".headers", headerContent) {
+		cache.writeEntry(path, content)
+	}
+	return resp, nil
+}
+
+// writeEntry writes to a temporary file first so a concurrent reader or a
+// crash never sees a partial entry. It reports whether it succeeded.
+func (cache *cachingTransport) writeEntry(path string, content []byte) bool {
+	tmp, err := ioutil.TempFile(cache.dir, "tmp-")
+	if err != nil {
+		return false
+	}
+	_, err = tmp.Write(content)
+	tmp.Close()
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return false
+	}
+	return true
+}
+
+// readCacheHeaders returns the headers stored with the cached tile at path,
+// none for an entry cached before they were kept.
+func readCacheHeaders(path string) http.Header {
+	header := http.Header{}
+	content, err := ioutil.ReadFile(path + ".headers")
+	if err != nil {
+		return header
+	}
+	var stored map[string]string
+	if json.Unmarshal(content, &stored) == nil {
+		for name, value := range stored {
+			header.Set(name, value)
+		}
+	}
+	return header
+}
+
+// cachedModified answers a conditional request from the headers of a cached
+// response. It reports whether the tile is modified and whether the headers
+// allow deciding it; an unconditional request always gets the tile.
+func cachedModified(req *http.Request, header http.Header) (modified, decided bool) {
+	if match := req.Header.Get("If-None-Match"); match != "" {
+		etag := header.Get("ETag")
+		if etag == "" {
+			return false, false
+		}
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimSpace(candidate)
+			if candidate == "*" || strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return false, true
+			}
+		}
+		return true, true
+	}
+	if since := req.Header.Get("If-Modified-Since"); since != "" {
+		sinceTime, err := http.ParseTime(since)
+		if err != nil {
+			return false, false
+		}
+		lastModified, err := http.ParseTime(header.Get("Last-Modified"))
+		if err != nil {
+			return false, false
+		}
+		return lastModified.After(sinceTime), true
+	}
+	return true, true
+}
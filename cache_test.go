@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newLastModifiedServer serves tile z/x/y as "tile x", last modified x days
+// after the epoch, and counts the requests it gets.
+func newLastModifiedServer(t *testing.T, etags bool) (*httptest.Server, *int32) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		var z, x, y int
+		fmt.Sscanf(r.URL.Path, "/%d/%d/%d.png", &z, &x, &y)
+		modified := time.Unix(0, 0).UTC().AddDate(0, 0, x)
+		w.Header().Set("Last-Modified", modified.Format(http.TimeFormat))
+		if etags {
+			w.Header().Set("ETag", fmt.Sprintf(`"tile-%d"`, x))
+		}
+		fmt.Fprintf(w, "tile %d", x)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+// cachedGet fetches url through cache with the extra request headers.
+func cachedGet(t *testing.T, cache *cachingTransport, url string, header map[string]string) *http.Response {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range header {
+		req.Header.Set(name, value)
+	}
+	resp, err := cache.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestCacheConditionalRequests(t *testing.T) {
+	server, requests := newLastModifiedServer(t, true)
+	cache, err := newCachingTransport(t.TempDir(), 0, http.DefaultTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := server.URL + "/5/10/3.png"
+	cachedGet(t, cache, url, nil)
+	modified := time.Unix(0, 0).UTC().AddDate(0, 0, 10)
+
+	for _, test := range []struct {
+		header map[string]string
+		status int
+	}{
+		{nil, http.StatusOK},
+		{map[string]string{"If-Modified-Since": modified.Add(-time.Hour).Format(http.TimeFormat)}, http.StatusOK},
+		{map[string]string{"If-Modified-Since": modified.Format(http.TimeFormat)}, http.StatusNotModified},
+		{map[string]string{"If-Modified-Since": modified.Add(time.Hour).Format(http.TimeFormat)}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": `"tile-10"`}, http.StatusNotModified},
+		{map[string]string{"If-None-Match": `"tile-9"`}, http.StatusOK},
+	} {
+		resp := cachedGet(t, cache, url, test.header)
+		if resp.StatusCode != test.status {
+			t.Errorf("%v: status %d, want %d", test.header, resp.StatusCode, test.status)
+		}
+		if resp.Header.Get("X-From-Cache") == "" {
+			t.Errorf("%v: not answered from the cache", test.header)
+		}
+		if got := resp.Header.Get("Last-Modified"); got != modified.Format(http.TimeFormat) {
+			t.Errorf("%v: Last-Modified %q wasn't replayed", test.header, got)
+		}
+	}
+	if *requests != 1 {
+		t.Errorf("%d requests to the server, want 1", *requests)
+	}
+}
+
+func TestCacheUndecidedConditionalRequest(t *testing.T) {
+	server, requests := newLastModifiedServer(t, false)
+	cache, err := newCachingTransport(t.TempDir(), 0, http.DefaultTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := server.URL + "/5/10/3.png"
+	cachedGet(t, cache, url, nil)
+	// Without an ETag only the server can answer.
+	resp := cachedGet(t, cache, url, map[string]string{"If-None-Match": `"tile-10"`})
+	if resp.Header.Get("X-From-Cache") != "" || *requests != 2 {
+		t.Errorf("If-None-Match without a cached ETag was answered from the cache")
+	}
+}
+
+func TestCacheUpdateSince(t *testing.T) {
+	server, requests := newLastModifiedServer(t, false)
+	cache, err := newCachingTransport(t.TempDir(), 0, http.DefaultTransport, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func(client *http.Client, since time.Time) {
+		httpClient, updateSince = client, since
+	}(httpClient, updateSince)
+	httpClient = &http.Client{Transport: cache}
+	url_format := server.URL + "/{z}/{x}/{y}.png"
+
+	// A first run fills the cache.
+	for x := 1; x <= 20; x++ {
+		if _, err := fetchTile(context.Background(), 5, x, 3, url_format); err != nil {
+			t.Fatal(err)
+		}
+	}
+	updateSince = time.Unix(0, 0).UTC().AddDate(0, 0, 10)
+	for x := 1; x <= 20; x++ {
+		tile, err := fetchTile(context.Background(), 5, x, 3, url_format)
+		if x <= 10 && err != errNotModified {
+			t.Errorf("tile modified on day %d before -update-since on day 10: %v", x, err)
+		}
+		if x > 10 && (err != nil || string(tile.Content) != fmt.Sprintf("tile %d", x)) {
+			t.Errorf("tile modified on day %d: %q, %v", x, tile.Content, err)
+		}
+	}
+	if *requests != 20 {
+		t.Errorf("%d requests to the server, want only the 20 of the first run", *requests)
+	}
+}
+
+func TestCacheKeyIgnoresBusters(t *testing.T) {
+	server, requests := newLastModifiedServer(t, false)
+	useExtraQuery(t, "session=first")
+	template := server.URL + "/{z}/{x}/{y}.png?style=dark&t={time}&r={rand}"
+	busters := cacheBustingParams([]string{template})
+	for _, param := range []string{"t", "r", "session"} {
+		if !busters[param] {
+			t.Errorf("%s is part of the cache key", param)
+		}
+	}
+	if busters["style"] {
+		t.Error("style is left out of the cache key")
+	}
+	cache, err := newCachingTransport(t.TempDir(), 0, http.DefaultTransport, busters)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cachedGet(t, cache, getTileUrl(3, 1, 2, template), nil)
+	useExtraQuery(t, "session=second")
+	if resp := cachedGet(t, cache, getTileUrl(3, 1, 2, template), nil); resp.Header.Get("X-From-Cache") == "" {
+		t.Error("other cache busters missed the cache")
+	}
+	cachedGet(t, cache, getTileUrl(3, 1, 2, strings.Replace(template, "dark", "light", 1)), nil)
+	if count := atomic.LoadInt32(requests); count != 2 {
+		t.Errorf("%d requests, want one per style", count)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// EARTH_MEAN_RADIUS_KM is used for great-circle distances.
+const EARTH_MEAN_RADIUS_KM = 6371.0088
+
+// parseCenter parses the "lon,lat" of -center.
+func parseCenter(value string) (lon, lat float64, err error) {
+	parts := strings.Split(value, ",")
+	if len(parts) == 2 {
+		lon, err = strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+		if err == nil {
+			lat, err = strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+		}
+	}
+	if len(parts) != 2 || err != nil {
+		return 0, 0, fmt.Errorf("invalid -center %q, expected lon,lat", value)
+	}
+	if lon < -180 || lon > 180 || lat < -90 || lat > 90 {
+		return 0, 0, fmt.Errorf("-center %q is out of range", value)
+	}
+	return lon, lat, nil
+}
+
+// radiusBounds returns a bounding box enclosing the circle of radius km
+// around lon, lat. Near the poles it spans all longitudes.
+func radiusBounds(lon, lat, km float64) (xmin, ymin, xmax, ymax float64) {
+	dLat := km / EARTH_MEAN_RADIUS_KM * RAD_TO_DEG
+	ymin, ymax = math.Max(lat-dLat, -90), math.Min(lat+dLat, 90)
+	cosLat := math.Cos(math.Max(math.Abs(ymin), math.Abs(ymax)) * DEG_TO_RAD)
+	if cosLat < 1e-9 || dLat/cosLat >= 180 {
+		return -180, ymin, 180, ymax
+	}
+	dLon := dLat / cosLat
+	return math.Max(lon-dLon, -180), ymin, math.Min(lon+dLon, 180), ymax
+}
+
+// greatCircleKm returns the haversine distance between two points.
+func greatCircleKm(lon1, lat1, lon2, lat2 float64) float64 {
+	dLat := (lat2 - lat1) * DEG_TO_RAD
+	dLon := (lon2 - lon1) * DEG_TO_RAD
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*DEG_TO_RAD)*math.Cos(lat2*DEG_TO_RAD)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * EARTH_MEAN_RADIUS_KM * math.Asin(math.Sqrt(math.Min(a, 1)))
+}
+
+// tilesInRadius keeps the tiles whose center is within km of lon, lat, and
+// the tile holding the point itself, so a circle smaller than a tile still
+// gets one.
+func tilesInRadius(proj *Projection, tiles []Tile, lon, lat, km float64) []Tile {
+	var kept []Tile
+	for _, tile := range tiles {
+		tileLon, tileLat := proj.TileCenter(tile.z, tile.x, tile.y)
+		xmin, ymin, xmax, ymax := proj.TileBounds(tile.z, tile.x, tile.y)
+		holdsCenter := lon >= xmin && lon < xmax && lat > ymin && lat <= ymax
+		if holdsCenter || greatCircleKm(lon, lat, tileLon, tileLat) <= km {
+			kept = append(kept, tile)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestTilesInRadius(t *testing.T) {
+	// 5 km around the Eiffel Tower.
+	lon, lat, km := 2.2945, 48.8584, 5.0
+	xmin, ymin, xmax, ymax := radiusBounds(lon, lat, km)
+	proj := NewProjection(xmin, ymin, xmax, ymax, 13, 13, nil, 0)
+	all := proj.TileList()
+	kept := tilesInRadius(proj, all, lon, lat, km)
+	if len(kept) == 0 || len(kept) >= len(all) {
+		t.Fatalf("kept %d of %d tiles, want the corners left out", len(kept), len(all))
+	}
+	inCircle := make(map[[3]int]bool)
+	for _, tile := range kept {
+		inCircle[[3]int{tile.z, tile.x, tile.y}] = true
+	}
+	for _, tile := range all {
+		tileLon, tileLat := proj.TileCenter(tile.z, tile.x, tile.y)
+		distance := greatCircleKm(lon, lat, tileLon, tileLat)
+		if kept := inCircle[[3]int{tile.z, tile.x, tile.y}]; kept != (distance <= km) {
+			t.Errorf("tile %s with its centre %.2f km away kept: %v", tile, distance, kept)
+		}
+	}
+	// The corner tiles of the bounding box are outside of the circle.
+	x0, x1, y0, y1 := proj.tileRange(xmin, ymin, xmax, ymax, 13)
+	for _, corner := range [][2]int{{x0, y0}, {x0, y1}, {x1, y0}, {x1, y1}} {
+		if inCircle[[3]int{13, corner[0], corner[1]}] {
+			t.Errorf("corner tile 13/%d/%d kept", corner[0], corner[1])
+		}
+	}
+}
+
+func TestTilesInSmallRadius(t *testing.T) {
+	// Far smaller than a z5 tile, which is still kept.
+	lon, lat := 2.2945, 48.8584
+	xmin, ymin, xmax, ymax := radiusBounds(lon, lat, 0.1)
+	proj := NewProjection(xmin, ymin, xmax, ymax, 5, 5, nil, 0)
+	if kept := tilesInRadius(proj, proj.TileList(), lon, lat, 0.1); len(kept) != 1 {
+		t.Errorf("kept %v, want the tile holding the centre", kept)
+	}
+}
+
+func TestGreatCircleKm(t *testing.T) {
+	// Paris to London.
+	if distance := greatCircleKm(2.3522, 48.8566, -0.1276, 51.5072); math.Abs(distance-343.6) > 1 {
+		t.Errorf("Paris to London is %.1f km, want about 343.6", distance)
+	}
+	xmin, ymin, xmax, ymax := radiusBounds(0, 89.9, 50)
+	if xmin != -180 || xmax != 180 || ymax != 90 || ymin >= 89.9 {
+		t.Errorf("bounds around the pole %f,%f,%f,%f", xmin, ymin, xmax, ymax)
+	}
+	for _, value := range []string{"2.29", "x,1", "200,10"} {
+		if _, _, err := parseCenter(value); err == nil {
+			t.Errorf("-center %s parsed", value)
+		}
+	}
+}
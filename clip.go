@@ -0,0 +1,93 @@
+package main
+
+import "math"
+
+// clipPolygon is an area made of rings of lon/lat points. Rings are combined
+// with the even-odd rule, so multi-part polygons and holes need no special
+// handling.
+type clipPolygon struct {
+	rings [][][2]float64
+}
+
+// Bounds returns the bounding box of all the rings.
+func (polygon clipPolygon) Bounds() (xmin, ymin, xmax, ymax float64) {
+	xmin, ymin, xmax, ymax = math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+	for _, ring := range polygon.rings {
+		for _, point := range ring {
+			xmin, xmax = math.Min(xmin, point[0]), math.Max(xmax, point[0])
+			ymin, ymax = math.Min(ymin, point[1]), math.Max(ymax, point[1])
+		}
+	}
+	return xmin, ymin, xmax, ymax
+}
+
+// Contains reports whether the point is inside the area.
+func (polygon clipPolygon) Contains(x, y float64) bool {
+	inside := false
+	for _, ring := range polygon.rings {
+		for i := range ring {
+			p, q := ring[i], ring[(i+1)%len(ring)]
+			if (p[1] > y) != (q[1] > y) && x < (q[0]-p[0])*(y-p[1])/(q[1]-p[1])+p[0] {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// IntersectsBox reports whether the area and the box overlap: either a
+// corner of the box is inside the area, or an edge of the area passes
+// through the box.
+func (polygon clipPolygon) IntersectsBox(xmin, ymin, xmax, ymax float64) bool {
+	for _, corner := range [][2]float64{{xmin, ymin}, {xmin, ymax}, {xmax, ymin}, {xmax, ymax}} {
+		if polygon.Contains(corner[0], corner[1]) {
+			return true
+		}
+	}
+	for _, ring := range polygon.rings {
+		for i := range ring {
+			if segmentIntersectsBox(ring[i], ring[(i+1)%len(ring)], xmin, ymin, xmax, ymax) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// segmentIntersectsBox clips the segment from p to q against the box
+// (Liang-Barsky) and reports whether anything is left.
+func segmentIntersectsBox(p, q [2]float64, xmin, ymin, xmax, ymax float64) bool {
+	dx, dy := q[0]-p[0], q[1]-p[1]
+	t0, t1 := 0.0, 1.0
+	for _, edge := range [][2]float64{{-dx, p[0] - xmin}, {dx, xmax - p[0]}, {-dy, p[1] - ymin}, {dy, ymax - p[1]}} {
+		direction, distance := edge[0], edge[1]
+		if direction == 0 {
+			if distance < 0 {
+				return false
+			}
+			continue
+		}
+		t := distance / direction
+		if direction < 0 {
+			t0 = math.Max(t0, t)
+		} else {
+			t1 = math.Min(t1, t)
+		}
+		if t0 > t1 {
+			return false
+		}
+	}
+	return true
+}
+
+// tilesInPolygon keeps the tiles that overlap the area.
+func tilesInPolygon(proj *Projection, tiles []Tile, polygon clipPolygon) []Tile {
+	var kept []Tile
+	for _, tile := range tiles {
+		xmin, ymin, xmax, ymax := proj.TileBounds(tile.z, tile.x, tile.y)
+		if polygon.IntersectsBox(xmin, ymin, xmax, ymax) {
+			kept = append(kept, tile)
+		}
+	}
+	return kept
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"database/sql"
+)
+
+// dropIndexes removes the indexes a -compact file does without: the one on
+// the tile coordinates and the one on the metadata names. Readers still
+// find every tile, but each lookup scans the whole table, so it suits
+// archives that are read rarely or in full. The final VACUUM gives their
+// pages back.
+func dropIndexes(db *sql.DB) error {
+	for _, index := range []string{"tile_index", "map_index", "map_tile_id", "name"} {
+		_, err := db.Exec("drop index if exists " + index + ";")
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ensureIndexes recreates the unique indexes of a -compact file before it is
+// written to again, since "insert or replace" and "insert or ignore" rely
+// on them.
+func ensureIndexes(db *sql.DB) error {
+	dedup, err := hasDedupLayout(db)
+	if err != nil {
+		return err
+	}
+	statements := []string{"create unique index if not exists name on metadata (name);"}
+	if dedup {
+		statements = append(statements, "create unique index if not exists map_index on map (zoom_level, tile_column, tile_row);")
+	} else {
+		statements = append(statements, "create unique index if not exists tile_index on tiles (zoom_level, tile_column, tile_row);")
+	}
+	for _, statement := range statements {
+		_, err = db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isCompact reports whether the file was written with -compact, which leaves
+// it without an index on the tile coordinates.
+func isCompact(db *sql.DB) (bool, error) {
+	var count int
+	err := db.QueryRow("select count(*) from sqlite_master where type = 'index' and name in ('tile_index', 'map_index');").Scan(&count)
+	return count == 0, err
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompact(t *testing.T) {
+	content := solidPNG(t, color.RGBA{128, 128, 128, 255})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	run := func(filename string, flags ...string) (string, error) {
+		args := append([]string{"-url", server.URL + "/{z}/{x}/{y}.png", "-zoomlevel", "0", "-max_zoomlevel", "5",
+			"-xmin", "-180", "-ymin", "-85", "-xmax", "180", "-ymax", "85", "-filename", filepath.Join(dir, filename)}, flags...)
+		return runMain(t, args...)
+	}
+	for _, filename := range []string{"plain.mbtiles", "compact.mbtiles"} {
+		var flags []string
+		if filename == "compact.mbtiles" {
+			flags = []string{"-compact"}
+		}
+		if output, err := run(filename, flags...); err != nil {
+			t.Fatalf("%v\n%s", err, output)
+		}
+	}
+	plain, err := os.Stat(filepath.Join(dir, "plain.mbtiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	compact, err := os.Stat(filepath.Join(dir, "compact.mbtiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compact.Size() >= plain.Size() {
+		t.Errorf("the compact file has %d bytes, the plain one %d", compact.Size(), plain.Size())
+	}
+
+	db, err := openMBTile(filepath.Join(dir, "compact.mbtiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var indexes int
+	if err = db.QueryRow("select count(*) from sqlite_master where type = 'index';").Scan(&indexes); err != nil || indexes != 0 {
+		t.Errorf("%d indexes left, %v", indexes, err)
+	}
+	// Still readable, by scanning.
+	var tile []byte
+	err = db.QueryRow("select tile_data from tiles where zoom_level = 5 and tile_column = 17 and tile_row = 20;").Scan(&tile)
+	if err != nil || !bytes.Equal(tile, content) {
+		t.Errorf("tile 5/17/20 read back as %d bytes, %v", len(tile), err)
+	}
+	var count int
+	if err = db.QueryRow("select count(*) from tiles;").Scan(&count); err != nil || count != 1365 {
+		t.Errorf("%d tiles, %v, want 1365", count, err)
+	}
+
+	output, err := run("both.mbtiles", "-compact", "-optimize-layout")
+	if err == nil || !strings.Contains(output, "-compact and -optimize-layout") {
+		t.Errorf("-compact with -optimize-layout ran: %v\n%s", err, output)
+	}
+}
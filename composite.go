@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+)
+
+// compositeTile draws overlay on top of base, respecting the overlay's
+// alpha, and returns the result as a PNG. The tiles may be in any format
+// image can decode.
+func compositeTile(base, overlay []byte) ([]byte, error) {
+	baseImage, _, err := image.Decode(bytes.NewReader(base))
+	if err != nil {
+		return nil, err
+	}
+	overlayImage, _, err := image.Decode(bytes.NewReader(overlay))
+	if err != nil {
+		return nil, err
+	}
+	bounds := baseImage.Bounds()
+	canvas := image.NewRGBA(bounds)
+	draw.Draw(canvas, bounds, baseImage, bounds.Min, draw.Src)
+	draw.Draw(canvas, bounds, overlayImage, overlayImage.Bounds().Min, draw.Over)
+	var out bytes.Buffer
+	err = png.Encode(&out, canvas)
+	if err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// checkImage decodes the whole image, so truncated or corrupt tiles are
+// caught while they can still be fetched again.
+func checkImage(content []byte) error {
+	_, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		return fmt.Errorf("malformed image: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+// newImageServer serves content as every tile.
+func newImageServer(t *testing.T, content []byte) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestCompositeTwoSources(t *testing.T) {
+	// Opaque blue labels on the left half of the overlay, the rest clear.
+	labels := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for x := 0; x < 128; x++ {
+		for y := 0; y < 256; y++ {
+			labels.Set(x, y, color.RGBA{0, 0, 255, 255})
+		}
+	}
+	var overlay bytes.Buffer
+	err := png.Encode(&overlay, labels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	base := newImageServer(t, solidPNG(t, color.RGBA{255, 0, 0, 255}))
+	top := newImageServer(t, overlay.Bytes())
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+
+	options := FetchOptions{UrlFormat: base.URL + "/{z}/{x}/{y}.png", OverlayFormat: top.URL + "/{z}/{x}/{y}.png"}
+	tile, err := fetchTileAndOverlay(Tile{z: 3, x: 2, y: 1}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tile.Overlay == nil {
+		t.Fatal("the overlay wasn't fetched")
+	}
+	tile, err = prepareTile(tile, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tile.Overlay != nil {
+		t.Error("the overlay is kept after compositing")
+	}
+	img, format, err := image.Decode(bytes.NewReader(tile.Content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format != "png" {
+		t.Errorf("composited tile is %s, want png", format)
+	}
+	for _, test := range []struct {
+		x    int
+		want color.RGBA
+	}{{10, color.RGBA{0, 0, 255, 255}}, {200, color.RGBA{255, 0, 0, 255}}} {
+		if got := color.RGBAModel.Convert(img.At(test.x, 100)); got != test.want {
+			t.Errorf("pixel %d,100 is %v, want %v", test.x, got, test.want)
+		}
+	}
+}
+
+func TestCompositeMalformedOverlay(t *testing.T) {
+	base := solidPNG(t, color.RGBA{255, 0, 0, 255})
+	if _, err := compositeTile(base, []byte("not an image")); err == nil {
+		t.Error("composited a malformed overlay")
+	}
+}
+
+func TestCorruptTileRetried(t *testing.T) {
+	good := solidPNG(t, color.RGBA{0, 255, 0, 255})
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A truncated PNG, then the whole one for tile 3/2/1.
+		if atomic.AddInt32(&requests, 1) == 2 && strings.HasSuffix(r.URL.Path, "/1.png") {
+			w.Write(good)
+			return
+		}
+		w.Write(good[:len(good)-20])
+	}))
+	defer server.Close()
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	options := FetchOptions{UrlFormat: server.URL + "/{z}/{x}/{y}.png", Retries: 1, DecodeImages: true}
+
+	tile, err := fetchTileWithRetry(Tile{z: 3, x: 2, y: 1}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tile.Content, good) {
+		t.Error("kept the truncated tile")
+	}
+	if _, err = fetchTileWithRetry(Tile{z: 3, x: 2, y: 2}, options); err == nil || !strings.Contains(err.Error(), "malformed image") {
+		t.Errorf("a truncated tile was accepted: %v", err)
+	}
+	// Without decoding the bytes are taken as they are.
+	options.DecodeImages = false
+	if _, err = fetchTileWithRetry(Tile{z: 3, x: 2, y: 2}, options); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// COMPRESSION_KEY is the metadata key of a -compress file: the codec the
+// tile_data of every tile is compressed with. Such a file is non-standard,
+// other readers get the compressed bytes; serve, dump and PMTiles output
+// decompress them.
+const COMPRESSION_KEY = "compression"
+
+// COMPRESSION_ZSTD is the only -compress codec. Brotli has no encoder in
+// the vendored libraries.
+const COMPRESSION_ZSTD = "zstd"
+
+// The zstd encoder and decoder are safe for concurrent EncodeAll and
+// DecodeAll calls, so every writer and request shares them.
+var zstdOnce sync.Once
+var zstdEncoder *zstd.Encoder
+var zstdDecoder *zstd.Decoder
+var zstdErr error
+
+func zstdCodec() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		zstdEncoder, zstdErr = zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+		if zstdErr == nil {
+			zstdDecoder, zstdErr = zstd.NewReader(nil)
+		}
+	})
+	return zstdEncoder, zstdDecoder, zstdErr
+}
+
+// validCompression checks a -compress value.
+func validCompression(compression string) error {
+	if compression != "" && compression != COMPRESSION_ZSTD {
+		return fmt.Errorf("invalid -compress %q, only %s is supported", compression, COMPRESSION_ZSTD)
+	}
+	return nil
+}
+
+// compressTile compresses the bytes of a tile for a file whose compression
+// metadata is compression.
+func compressTile(content []byte, compression string) ([]byte, error) {
+	if compression == "" {
+		return content, nil
+	}
+	if err := validCompression(compression); err != nil {
+		return nil, err
+	}
+	encoder, _, err := zstdCodec()
+	if err != nil {
+		return nil, err
+	}
+	return encoder.EncodeAll(content, nil), nil
+}
+
+// decompressTile reverses compressTile.
+func decompressTile(content []byte, compression string) ([]byte, error) {
+	if compression == "" {
+		return content, nil
+	}
+	if compression != COMPRESSION_ZSTD {
+		return nil, fmt.Errorf("tiles are compressed with %q, which isn't supported", compression)
+	}
+	_, decoder, err := zstdCodec()
+	if err != nil {
+		return nil, err
+	}
+	return decoder.DecodeAll(content, nil)
+}
+
+// tileLayout is how a file stores its tiles when not as plain bytes in
+// tile_data, from its metadata.
+type tileLayout struct {
+	// Dir holds the tiles of a -tile-files file.
+	Dir string
+	// Compression is the codec of a -compress file.
+	Compression string
+}
+
+func tileLayoutOf(filename string, metadata map[string]string) tileLayout {
+	return tileLayout{Dir: tileFilesDir(filename, metadata), Compression: metadata[COMPRESSION_KEY]}
+}
+
+// layoutConflict is an option that can't be used with a non-standard
+// layout, and whether it is set.
+type layoutConflict struct {
+	name string
+	set  bool
+}
+
+// checkTileLayout stops the run if any of conflicts is set along with the
+// layout option name, and warns that the file is non-standard: readers
+// other than serve and dump get stored instead of the tiles.
+func checkTileLayout(name, stored string, conflicts []layoutConflict) {
+	for _, conflict := range conflicts {
+		if conflict.set {
+			log.Fatal(conflict.name, " can't be used with ", name)
+		}
+	}
+	log.Println("WARNING: " + name + " writes a non-standard file; only serve and dump read the tiles back, other readers get " + stored)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompressTile(t *testing.T) {
+	content := solidPNG(t, color.RGBA{255, 0, 0, 255})
+	compressed, err := compressTile(content, COMPRESSION_ZSTD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(compressed, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		t.Errorf("compressed tile doesn't start with the zstd magic number: % x", compressed[:4])
+	}
+	decompressed, err := decompressTile(compressed, COMPRESSION_ZSTD)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, content) {
+		t.Error("decompressed tile differs from the original")
+	}
+	if plain, _ := compressTile(content, ""); !bytes.Equal(plain, content) {
+		t.Error("no compression changed the tile")
+	}
+	if _, err := compressTile(content, "brotli"); err == nil {
+		t.Error("compressing with brotli succeeded")
+	}
+}
+
+// newCompressedMBTiles stores content as tile 3/2/1 of a -compress zstd
+// file.
+func newCompressedMBTiles(t *testing.T, content []byte) string {
+	db, filename := newTestMBTiles(t, map[string]string{"format": "png", COMPRESSION_KEY: COMPRESSION_ZSTD})
+	err := storeTile(Tile{z: 3, x: 2, y: 1, Content: content}, db, WriterOptions{Compression: COMPRESSION_ZSTD})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []byte
+	err = db.QueryRow("select tile_data from tiles;").Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(stored, content) {
+		t.Fatal("tile_data was stored uncompressed")
+	}
+	db.Close()
+	return filename
+}
+
+func TestCompressedServe(t *testing.T) {
+	content := solidPNG(t, color.RGBA{0, 0, 255, 255})
+	filename := newCompressedMBTiles(t, content)
+	db, err := openMBTile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	server, err := newTileServer(db, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/xyz/3/2/1.png", "/tms/3/2/6.png"} {
+		recorder := httptest.NewRecorder()
+		server.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != 200 {
+			t.Fatalf("%s: status %d", path, recorder.Code)
+		}
+		if !bytes.Equal(recorder.Body.Bytes(), content) {
+			t.Errorf("%s: served tile differs from the original", path)
+		}
+	}
+}
+
+func TestCompressedDump(t *testing.T) {
+	content := solidPNG(t, color.RGBA{0, 255, 0, 255})
+	filename := newCompressedMBTiles(t, content)
+	out := filepath.Join(t.TempDir(), "tile.png")
+	runDump([]string{"-o", out, filename, "3", "2", "1"})
+	dumped, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dumped, content) {
+		t.Error("dumped tile differs from the original")
+	}
+}
+
+func TestCompressedRoundTrip(t *testing.T) {
+	tiles := map[[3]int][]byte{{0, 0, 0}: solidPNG(t, color.RGBA{255, 255, 255, 255})}
+	for x := 0; x < 2; x++ {
+		for y := 0; y < 2; y++ {
+			tiles[[3]int{1, x, y}] = solidPNG(t, color.RGBA{uint8(100 * x), uint8(100 * y), 0, 255})
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var z, x, y int
+		fmt.Sscanf(r.URL.Path, "/%d/%d/%d.png", &z, &x, &y)
+		w.Write(tiles[[3]int{z, x, y}])
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	run := func(filename string, flags ...string) (string, error) {
+		args := append([]string{"-url", server.URL + "/{z}/{x}/{y}.png", "-zoomlevel", "1", "-max_zoomlevel", "1",
+			"-xmin", "-180", "-ymin", "-85", "-xmax", "180", "-ymax", "85", "-filename", filepath.Join(dir, filename)}, flags...)
+		return runMain(t, args...)
+	}
+
+	output, err := run("out.pmtiles", "-compress", COMPRESSION_ZSTD, "-output-format", OUTPUT_PMTILES)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	content, err := ioutil.ReadFile(filepath.Join(dir, "out.pmtiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := pmtilesArchive{t: t, content: content, header: content[:PMTILES_HEADER_LENGTH]}
+	for key, tile := range tiles {
+		if key[0] == 0 {
+			continue
+		}
+		if got, ok := archive.Tile(key[0], key[1], key[2]); !ok || !bytes.Equal(got, tile) {
+			t.Errorf("PMTiles tile %v isn't the original", key)
+		}
+	}
+
+	filename := filepath.Join(dir, "out.mbtiles")
+	output, err = run("out.mbtiles", "-compress", COMPRESSION_ZSTD)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	out := filepath.Join(dir, "tile.png")
+	output, err = runMain(t, "dump", "-o", out, filename, "1", "1", "0")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	dumped, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dumped, tiles[[3]int{1, 1, 0}]) {
+		t.Error("dumped tile differs from the original")
+	}
+
+	// Adding to the file keeps its compression, and a plain file can't
+	// take compressed tiles.
+	output, err = run("out.mbtiles", "-append", "-zoomlevel", "0", "-max_zoomlevel", "0")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	db, err := openMBTile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var stored []byte
+	err = db.QueryRow("select tile_data from tiles where zoom_level = 0;").Scan(&stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(stored, []byte{0x28, 0xb5, 0x2f, 0xfd}) {
+		t.Error("the appended tile wasn't compressed")
+	}
+	output, err = run("plain.mbtiles")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	output, err = run("plain.mbtiles", "-append", "-compress", COMPRESSION_ZSTD)
+	if err == nil || !strings.Contains(output, "uncompressed") {
+		t.Errorf("-compress added to a plain file: %v\n%s", err, output)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	AUTO_START_WORKERS   = 2
+	AUTO_ADJUST_INTERVAL = 2 * time.Second
+	// Throughput has to grow by this fraction after a ramp to keep ramping.
+	AUTO_MIN_GAIN = 0.05
+	// Ramping stops while more than this fraction of attempts fail.
+	AUTO_MAX_ERROR_RATE = 0.02
+)
+
+// concurrencyController limits how many fetchers work at once for
+// -concurrency-auto. It is additive increase, multiplicative decrease:
+// every interval the limit goes up by one while the last ramp made
+// throughput (tiles per interval) grow and few attempts failed, is halved
+// when any attempt was throttled (429, 503 or a timeout), and otherwise
+// stays where it is. -workers is the ceiling.
+type concurrencyController struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	limit   int
+	max     int
+	running int
+
+	// Counters for the current interval.
+	done, failed, throttled int
+	lastDone                int
+	stop                    chan struct{}
+}
+
+func newConcurrencyController(max int) *concurrencyController {
+	c := &concurrencyController{limit: AUTO_START_WORKERS, max: max, stop: make(chan struct{})}
+	if c.limit > max {
+		c.limit = max
+	}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+// Start adjusts the limit every interval until Stop is called.
+func (c *concurrencyController) Start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.step()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *concurrencyController) Stop() {
+	if c != nil {
+		close(c.stop)
+	}
+}
+
+// Acquire blocks until the fetcher may start on a tile. A nil controller
+// never blocks.
+func (c *concurrencyController) Acquire() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	for c.running >= c.limit {
+		c.cond.Wait()
+	}
+	c.running++
+	c.mu.Unlock()
+}
+
+func (c *concurrencyController) Release() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.running--
+	c.mu.Unlock()
+	c.cond.Signal()
+}
+
+// Record counts the outcome of a single attempt.
+func (c *concurrencyController) Record(err error) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	switch {
+	case err == nil:
+		c.done++
+	case isThrottled(err):
+		c.throttled++
+		c.failed++
+	default:
+		c.failed++
+	}
+}
+
+// step applies the heuristic to the counters of the interval that just
+// ended and starts a new one.
+func (c *concurrencyController) step() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	previous := c.limit
+	attempts := c.done + c.failed
+	switch {
+	case c.throttled > 0:
+		c.limit /= 2
+		if c.limit < 1 {
+			c.limit = 1
+		}
+	case attempts > 0 && float64(c.failed)/float64(attempts) > AUTO_MAX_ERROR_RATE:
+	case c.limit < c.max && float64(c.done) >= float64(c.lastDone)*(1+AUTO_MIN_GAIN) && c.done > 0:
+		c.limit++
+	}
+	if c.limit != previous {
+		log.Println("Adjusting workers from", previous, "to", c.limit)
+	}
+	c.lastDone = c.done
+	c.done, c.failed, c.throttled = 0, 0, 0
+	c.cond.Broadcast()
+}
+
+// statusError is returned for a response other than 200 OK.
+type statusError struct {
+	Code   int
+	Status string
+}
+
+func (err *statusError) Error() string {
+	return "unexpected status " + err.Status
+}
+
+// isThrottled reports whether err means the server wants fewer requests.
+func isThrottled(err error) bool {
+	var status *statusError
+	if errors.As(err, &status) {
+		return status.Code == http.StatusTooManyRequests || status.Code == http.StatusServiceUnavailable
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// record counts done successful and failed attempts with err.
+func record(c *concurrencyController, done, failed int, err error) {
+	for i := 0; i < done; i++ {
+		c.Record(nil)
+	}
+	for i := 0; i < failed; i++ {
+		c.Record(err)
+	}
+}
+
+func TestConcurrencyRampAndBackOff(t *testing.T) {
+	c := newConcurrencyController(5)
+	if c.limit != AUTO_START_WORKERS {
+		t.Fatalf("starts with %d workers, want %d", c.limit, AUTO_START_WORKERS)
+	}
+	// Growing throughput ramps up to the ceiling of -workers.
+	for i, done := range []int{10, 20, 30, 40, 50} {
+		record(c, done, 0, nil)
+		c.step()
+		if want := minInt(AUTO_START_WORKERS+i+1, 5); c.limit != want {
+			t.Errorf("interval %d: %d workers, want %d", i, c.limit, want)
+		}
+	}
+	// Flat throughput holds.
+	c.limit = 4
+	record(c, 50, 0, nil)
+	c.step()
+	if c.limit != 4 {
+		t.Errorf("%d workers after flat throughput, want 4", c.limit)
+	}
+	// Errors stop the ramp without backing off.
+	record(c, 100, 10, errors.New("connection reset"))
+	c.step()
+	if c.limit != 4 {
+		t.Errorf("%d workers after errors, want 4", c.limit)
+	}
+	// Throttling halves, down to one.
+	for _, want := range []int{2, 1, 1} {
+		record(c, 100, 1, &statusError{Code: http.StatusTooManyRequests, Status: "429 Too Many Requests"})
+		c.step()
+		if c.limit != want {
+			t.Errorf("%d workers after a 429, want %d", c.limit, want)
+		}
+	}
+}
+
+func TestConcurrencyAcquire(t *testing.T) {
+	c := newConcurrencyController(5)
+	for i := 0; i < AUTO_START_WORKERS; i++ {
+		c.Acquire()
+	}
+	acquired := make(chan bool)
+	go func() {
+		c.Acquire()
+		acquired <- true
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired above the limit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.Release()
+	select {
+	case <-acquired:
+	case <-time.After(5 * time.Second):
+		t.Fatal("a release didn't let the waiting fetcher start")
+	}
+	var none *concurrencyController
+	none.Acquire()
+	none.Release()
+	none.Record(nil)
+}
+
+func TestIsThrottled(t *testing.T) {
+	for _, err := range []error{
+		&statusError{Code: http.StatusTooManyRequests},
+		&statusError{Code: http.StatusServiceUnavailable},
+		context.DeadlineExceeded,
+	} {
+		if !isThrottled(err) {
+			t.Errorf("%v isn't throttling", err)
+		}
+	}
+	for _, err := range []error{&statusError{Code: http.StatusNotFound}, errors.New("malformed image")} {
+		if isThrottled(err) {
+			t.Errorf("%v is throttling", err)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+)
+
+// Config is the JSON file given with -config.
+type Config struct {
+	Rules []ZoomRule `json:"rules"`
+}
+
+// ZoomRule limits the zoom levels minzoom..maxzoom to a bounding box given as
+// [xmin, ymin, xmax, ymax], so low zooms can cover a wide area while high
+// zooms only cover the places that need detail.
+type ZoomRule struct {
+	MinZoom int        `json:"minzoom"`
+	MaxZoom int        `json:"maxzoom"`
+	Bbox    [4]float64 `json:"bbox"`
+}
+
+func loadConfig(filename string) (Config, error) {
+	var config Config
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(content, &config)
+	if err != nil {
+		return config, fmt.Errorf("invalid config %s: %v", filename, err)
+	}
+	for i, rule := range config.Rules {
+		if rule.MinZoom < 0 || rule.MaxZoom > MAX_ZOOM_LEVEL_LIMIT || rule.MinZoom > rule.MaxZoom {
+			return config, fmt.Errorf("rule %d: invalid zoom range %d-%d", i, rule.MinZoom, rule.MaxZoom)
+		}
+		if rule.Bbox[0] >= rule.Bbox[2] || rule.Bbox[1] >= rule.Bbox[3] {
+			return config, fmt.Errorf("rule %d: invalid bbox %v", i, rule.Bbox)
+		}
+	}
+	return config, nil
+}
+
+// ZoomRange returns the lowest minzoom and highest maxzoom of the rules.
+func (config Config) ZoomRange() (int, int) {
+	minZoom, maxZoom := config.Rules[0].MinZoom, config.Rules[0].MaxZoom
+	for _, rule := range config.Rules {
+		minZoom = int(math.Min(float64(minZoom), float64(rule.MinZoom)))
+		maxZoom = int(math.Max(float64(maxZoom), float64(rule.MaxZoom)))
+	}
+	return minZoom, maxZoom
+}
+
+// Bounds returns the bounding box enclosing every rule.
+func (config Config) Bounds() (xmin, ymin, xmax, ymax float64) {
+	xmin, ymin, xmax, ymax = config.Rules[0].Bbox[0], config.Rules[0].Bbox[1], config.Rules[0].Bbox[2], config.Rules[0].Bbox[3]
+	for _, rule := range config.Rules {
+		xmin = math.Min(xmin, rule.Bbox[0])
+		ymin = math.Min(ymin, rule.Bbox[1])
+		xmax = math.Max(xmax, rule.Bbox[2])
+		ymax = math.Max(ymax, rule.Bbox[3])
+	}
+	return xmin, ymin, xmax, ymax
+}
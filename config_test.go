@@ -0,0 +1,80 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	err := ioutil.WriteFile(filename, []byte(content), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestZoomRuleTiles(t *testing.T) {
+	// California at z5-6, San Francisco and Oakland, which share tiles at
+	// z11, in detail.
+	config, err := loadConfig(writeTestConfig(t, `{"rules": [
+		{"minzoom": 5, "maxzoom": 6, "bbox": [-125, 32, -114, 42]},
+		{"minzoom": 10, "maxzoom": 11, "bbox": [-122.45, 37.76, -122.40, 37.80]},
+		{"minzoom": 11, "maxzoom": 11, "bbox": [-122.42, 37.78, -122.25, 37.82]}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	minZoom, maxZoom := config.ZoomRange()
+	if minZoom != 5 || maxZoom != 11 {
+		t.Fatalf("zoom range %d-%d, want 5-11", minZoom, maxZoom)
+	}
+	xmin, ymin, xmax, ymax := config.Bounds()
+	proj := NewProjection(xmin, ymin, xmax, ymax, minZoom, maxZoom, nil, 0)
+	proj.SetZoomRules(config.Rules)
+
+	want := make(map[[3]int]bool)
+	for _, rule := range config.Rules {
+		for z := rule.MinZoom; z <= rule.MaxZoom; z++ {
+			x0, x1, y0, y1 := bboxTileRange(rule.Bbox[0], rule.Bbox[1], rule.Bbox[2], rule.Bbox[3], z)
+			for x := x0; x <= x1; x++ {
+				for y := y0; y <= y1; y++ {
+					want[[3]int{z, x, y}] = true
+				}
+			}
+		}
+	}
+	got := make(map[[3]int]bool)
+	for _, tile := range proj.TileList() {
+		key := [3]int{tile.z, tile.x, tile.y}
+		if got[key] {
+			t.Errorf("tile %s listed twice", tile)
+		}
+		got[key] = true
+		if !want[key] {
+			t.Errorf("tile %s isn't covered by a rule", tile)
+		}
+	}
+	if len(got) != len(want) {
+		t.Errorf("%d tiles listed, want %d", len(got), len(want))
+	}
+	for z := 7; z <= 9; z++ {
+		if proj.TileCount(z) != 0 {
+			t.Errorf("%d tiles at z%d, which no rule covers", proj.TileCount(z), z)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, content := range []string{
+		`{"rules": [{"minzoom": 6, "maxzoom": 5, "bbox": [0, 0, 1, 1]}]}`,
+		`{"rules": [{"minzoom": 0, "maxzoom": 5, "bbox": [1, 0, 0, 1]}]}`,
+		`{"rules": [{"minzoom": -1, "maxzoom": 5, "bbox": [0, 0, 1, 1]}]}`,
+		`{"rules": `,
+	} {
+		if _, err := loadConfig(writeTestConfig(t, content)); err == nil {
+			t.Errorf("loaded %s", content)
+		}
+	}
+}
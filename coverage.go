@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"sort"
+)
+
+// GeoJSON types for the -coverage-geojson output.
+type FeatureCollection struct {
+	Type     string    `json:"type"`
+	Features []Feature `json:"features"`
+}
+
+type Feature struct {
+	Type       string                 `json:"type"`
+	Properties map[string]interface{} `json:"properties"`
+	Geometry   Geometry               `json:"geometry"`
+}
+
+type Geometry struct {
+	Type        string           `json:"type"`
+	Coordinates [][][][2]float64 `json:"coordinates"`
+}
+
+// gridPoint is a tile corner in XYZ tile coordinates, y pointing down.
+type gridPoint struct {
+	x, y int
+}
+
+type gridEdge struct {
+	from, to gridPoint
+}
+
+func (edge gridEdge) dir() gridPoint {
+	return gridPoint{edge.to.x - edge.from.x, edge.to.y - edge.from.y}
+}
+
+// writeCoverageGeoJSON writes the union of the tile bounds of coords as one
+// MultiPolygon feature per zoom level.
+func writeCoverageGeoJSON(filename string, coords map[[3]int]bool) error {
+	cells := make(map[int]map[gridPoint]bool)
+	for coord := range coords {
+		if cells[coord[0]] == nil {
+			cells[coord[0]] = make(map[gridPoint]bool)
+		}
+		cells[coord[0]][gridPoint{coord[1], coord[2]}] = true
+	}
+	var zooms []int
+	for z := range cells {
+		zooms = append(zooms, z)
+	}
+	sort.Ints(zooms)
+
+	collection := FeatureCollection{Type: "FeatureCollection", Features: []Feature{}}
+	for _, z := range zooms {
+		var polygons [][][][2]float64
+		for _, polygon := range coveragePolygons(cells[z]) {
+			var rings [][][2]float64
+			for _, ring := range polygon {
+				// Reversed, since GeoJSON wants outer rings counter-clockwise.
+				var lonLats [][2]float64
+				for i := len(ring) - 1; i >= 0; i-- {
+					lon, lat := tileToLonLat(z, float64(ring[i].x), float64(ring[i].y))
+					lonLats = append(lonLats, [2]float64{lon, lat})
+				}
+				rings = append(rings, append(lonLats, lonLats[0]))
+			}
+			polygons = append(polygons, rings)
+		}
+		collection.Features = append(collection.Features, Feature{
+			Type:       "Feature",
+			Properties: map[string]interface{}{"zoom": z, "tiles": len(cells[z])},
+			Geometry:   Geometry{Type: "MultiPolygon", Coordinates: polygons},
+		})
+	}
+	content, err := json.Marshal(collection)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, content, 0644)
+}
+
+// coveragePolygons traces the outline of a set of tiles. Every tile side
+// that doesn't border another tile is a boundary edge, directed so the
+// tiles are on its right; following the edges gives outer rings going
+// clockwise and holes going counter-clockwise.
+func coveragePolygons(cells map[gridPoint]bool) [][][]gridPoint {
+	outgoing := make(map[gridPoint][]gridEdge)
+	add := func(from, to gridPoint) {
+		outgoing[from] = append(outgoing[from], gridEdge{from, to})
+	}
+	for cell := range cells {
+		x, y := cell.x, cell.y
+		if !cells[gridPoint{x, y - 1}] {
+			add(gridPoint{x, y}, gridPoint{x + 1, y})
+		}
+		if !cells[gridPoint{x + 1, y}] {
+			add(gridPoint{x + 1, y}, gridPoint{x + 1, y + 1})
+		}
+		if !cells[gridPoint{x, y + 1}] {
+			add(gridPoint{x + 1, y + 1}, gridPoint{x, y + 1})
+		}
+		if !cells[gridPoint{x - 1, y}] {
+			add(gridPoint{x, y + 1}, gridPoint{x, y})
+		}
+	}
+
+	// Start points are sorted so the output doesn't depend on map order.
+	var starts []gridPoint
+	for point := range outgoing {
+		starts = append(starts, point)
+	}
+	sort.Slice(starts, func(i, j int) bool {
+		if starts[i].y != starts[j].y {
+			return starts[i].y < starts[j].y
+		}
+		return starts[i].x < starts[j].x
+	})
+
+	var outers, holes [][]gridPoint
+	var holeEdges []gridEdge
+	for _, start := range starts {
+		for len(outgoing[start]) > 0 {
+			first := takeEdge(outgoing, start, gridPoint{})
+			ring := []gridPoint{first.from}
+			edge := first
+			for edge.to != first.from {
+				next := takeEdge(outgoing, edge.to, edge.dir())
+				if next.dir() != edge.dir() {
+					ring = append(ring, next.from)
+				}
+				edge = next
+			}
+			if first.dir() == edge.dir() {
+				// The start point is in the middle of a straight side.
+				ring = ring[1:]
+			}
+			if ringArea(ring) > 0 {
+				outers = append(outers, ring)
+			} else {
+				holes = append(holes, ring)
+				holeEdges = append(holeEdges, first)
+			}
+		}
+	}
+
+	polygons := make([][][]gridPoint, len(outers))
+	for i, outer := range outers {
+		polygons[i] = [][]gridPoint{outer}
+	}
+	for i, hole := range holes {
+		// The tile right of a hole edge is covered, so the hole belongs to
+		// the smallest outer ring around that tile; bigger ones around an
+		// island in another hole contain it too.
+		edge := holeEdges[i]
+		d := edge.dir()
+		cx := float64(edge.from.x+edge.to.x)/2 - float64(d.y)/2
+		cy := float64(edge.from.y+edge.to.y)/2 + float64(d.x)/2
+		owner := -1
+		for j, outer := range outers {
+			if pointInRing(cx, cy, outer) && (owner < 0 || ringArea(outer) < ringArea(outers[owner])) {
+				owner = j
+			}
+		}
+		if owner >= 0 {
+			polygons[owner] = append(polygons[owner], hole)
+		}
+	}
+	return polygons
+}
+
+// takeEdge removes and returns an edge leaving point. Where two rings touch
+// at a corner it takes the right turn, keeping the rings apart.
+func takeEdge(outgoing map[gridPoint][]gridEdge, point gridPoint, dir gridPoint) gridEdge {
+	edges := outgoing[point]
+	pick := 0
+	right := gridPoint{-dir.y, dir.x}
+	for i, edge := range edges {
+		if edge.dir() == right {
+			pick = i
+		}
+	}
+	edge := edges[pick]
+	outgoing[point] = append(edges[:pick], edges[pick+1:]...)
+	if len(outgoing[point]) == 0 {
+		delete(outgoing, point)
+	}
+	return edge
+}
+
+// ringArea returns twice the signed area of ring, positive for clockwise
+// rings on the tile grid.
+func ringArea(ring []gridPoint) int {
+	area := 0
+	for i, p := range ring {
+		q := ring[(i+1)%len(ring)]
+		area += p.x*q.y - q.x*p.y
+	}
+	return area
+}
+
+func pointInRing(x, y float64, ring []gridPoint) bool {
+	inside := false
+	for i, p := range ring {
+		q := ring[(i+1)%len(ring)]
+		px, py, qx, qy := float64(p.x), float64(p.y), float64(q.x), float64(q.y)
+		if (py > y) != (qy > y) && x < (qx-px)*(y-py)/(qy-py)+px {
+			inside = !inside
+		}
+	}
+	return inside
+}
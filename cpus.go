@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// CGROUP_ROOT is where the CPU quota of a container is read from.
+const CGROUP_ROOT = "/sys/fs/cgroup"
+
+// setMaxProcs sets GOMAXPROCS and returns it with where it came from. An
+// explicit GOMAXPROCS environment variable, which the runtime has already
+// applied, is kept. Otherwise it is the CPU quota of the cgroup when there
+// is one below the CPU count, since runtime.NumCPU sees all the CPUs of the
+// host in a container. The number of fetchers doesn't depend on it: they
+// mostly wait on the network, see -workers.
+func setMaxProcs() (int, string) {
+	quota, limited := cgroupCPUQuota(CGROUP_ROOT)
+	procs, source := chooseMaxProcs(os.Getenv("GOMAXPROCS"), runtime.NumCPU(), quota, limited)
+	runtime.GOMAXPROCS(procs)
+	return procs, source
+}
+
+// chooseMaxProcs picks GOMAXPROCS from the environment variable env, the
+// CPU count and the cgroup quota in CPUs when limited.
+func chooseMaxProcs(env string, numCpus int, quota float64, limited bool) (int, string) {
+	if procs, err := strconv.Atoi(strings.TrimSpace(env)); err == nil && procs > 0 {
+		return procs, "GOMAXPROCS environment variable"
+	}
+	if limited {
+		procs := int(math.Ceil(quota))
+		if procs < 1 {
+			procs = 1
+		}
+		if procs < numCpus {
+			return procs, "cgroup CPU quota"
+		}
+	}
+	return numCpus, "CPU count"
+}
+
+// cgroupCPUQuota returns the CPU quota, in CPUs, of the cgroup under root:
+// cpu.max of cgroup v2, or cpu.cfs_quota_us and cpu.cfs_period_us of v1.
+// It reports false when there is none or it can't be read.
+func cgroupCPUQuota(root string) (float64, bool) {
+	if content, err := ioutil.ReadFile(filepath.Join(root, "cpu.max")); err == nil {
+		fields := strings.Fields(string(content))
+		if len(fields) != 2 || fields[0] == "max" {
+			return 0, false
+		}
+		return cpuQuota(fields[0], fields[1])
+	}
+	quota, err := ioutil.ReadFile(filepath.Join(root, "cpu", "cpu.cfs_quota_us"))
+	if err != nil {
+		return 0, false
+	}
+	period, err := ioutil.ReadFile(filepath.Join(root, "cpu", "cpu.cfs_period_us"))
+	if err != nil {
+		return 0, false
+	}
+	return cpuQuota(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period)))
+}
+
+// cpuQuota divides a quota by its period, both in microseconds. A v1
+// quota of -1 means no limit.
+func cpuQuota(quota, period string) (float64, bool) {
+	q, err := strconv.ParseFloat(quota, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseFloat(period, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	return q / p, true
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestChooseMaxProcs(t *testing.T) {
+	for _, test := range []struct {
+		env     string
+		quota   float64
+		limited bool
+		procs   int
+		source  string
+	}{
+		// The environment variable wins over the quota and the CPU count.
+		{"3", 1.5, true, 3, "GOMAXPROCS environment variable"},
+		{"12", 0, false, 12, "GOMAXPROCS environment variable"},
+		{"", 1.5, true, 2, "cgroup CPU quota"},
+		{"", 0.2, true, 1, "cgroup CPU quota"},
+		{"", 16, true, 8, "CPU count"},
+		{"", 0, false, 8, "CPU count"},
+		{"lots", 0, false, 8, "CPU count"},
+		{"0", 0, false, 8, "CPU count"},
+	} {
+		procs, source := chooseMaxProcs(test.env, 8, test.quota, test.limited)
+		if procs != test.procs || source != test.source {
+			t.Errorf("GOMAXPROCS=%q with a quota of %v, %v: %d from the %s, want %d from the %s",
+				test.env, test.quota, test.limited, procs, source, test.procs, test.source)
+		}
+	}
+
+	t.Setenv("GOMAXPROCS", "3")
+	output, err := runMain(t, "-list-maptypes")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if !strings.Contains(output, "GOMAXPROCS: 3 from the GOMAXPROCS environment variable") {
+		t.Errorf("the environment variable isn't used:\n%s", output)
+	}
+}
+
+func TestCgroupCPUQuota(t *testing.T) {
+	write := func(dir, name, content string) {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	v2 := t.TempDir()
+	write(v2, "cpu.max", "150000 100000\n")
+	if quota, limited := cgroupCPUQuota(v2); !limited || quota != 1.5 {
+		t.Errorf("cgroup v2 quota %v, %v, want 1.5", quota, limited)
+	}
+	write(v2, "cpu.max", "max 100000\n")
+	if _, limited := cgroupCPUQuota(v2); limited {
+		t.Error("cgroup v2 without a quota is limited")
+	}
+	v1 := t.TempDir()
+	write(v1, "cpu/cpu.cfs_quota_us", "200000\n")
+	write(v1, "cpu/cpu.cfs_period_us", "100000\n")
+	if quota, limited := cgroupCPUQuota(v1); !limited || quota != 2 {
+		t.Errorf("cgroup v1 quota %v, %v, want 2", quota, limited)
+	}
+	write(v1, "cpu/cpu.cfs_quota_us", "-1\n")
+	if _, limited := cgroupCPUQuota(v1); limited {
+		t.Error("cgroup v1 with a quota of -1 is limited")
+	}
+	if _, limited := cgroupCPUQuota(t.TempDir()); limited {
+		t.Error("limited without a cgroup")
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// CREDENTIALS_ENV_PREFIX and TOKEN_ENV_PREFIX name the environment variables
+// holding the credentials of a host: MBUTIL_AUTH_TILES_EXAMPLE_COM=user:pass
+// for basic auth, or MBUTIL_TOKEN_TILES_EXAMPLE_COM=token for a bearer token
+// to tiles.example.com. Unlike flags they don't show up in process
+// listings or the shell history.
+const CREDENTIALS_ENV_PREFIX = "MBUTIL_AUTH_"
+const TOKEN_ENV_PREFIX = "MBUTIL_TOKEN_"
+
+// credential is what is sent to a host: basic auth, or a bearer token.
+type credential struct {
+	login, password string
+	token           string
+}
+
+// credentialStore picks the credential of a request by its host, from the
+// environment first and then a netrc file. A nil store sends nothing.
+type credentialStore struct {
+	netrc map[string]credential
+	// fallback is the netrc "default" entry, for any other host.
+	fallback *credential
+	getenv   func(string) string
+}
+
+// sourceCredentials is applied to every request, set up from -netrc.
+var sourceCredentials = &credentialStore{getenv: os.Getenv}
+
+// loadNetrc reads a netrc file into the store.
+func (store *credentialStore) loadNetrc(filename string) error {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	store.netrc, store.fallback, err = parseNetrc(string(content))
+	if err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+	return nil
+}
+
+// parseNetrc parses the machine and default entries of a netrc file. Macro
+// definitions are skipped up to the blank line ending them.
+func parseNetrc(content string) (map[string]credential, *credential, error) {
+	machines := make(map[string]credential)
+	var fallback *credential
+	var current *credential
+	var currentHost string
+	save := func() {
+		if current == nil {
+			return
+		}
+		if currentHost == "" {
+			fallback = current
+		} else if _, ok := machines[currentHost]; !ok {
+			// Like other netrc readers, the first entry of a host wins.
+			machines[currentHost] = *current
+		}
+		current = nil
+	}
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		fields := strings.Fields(lines[i])
+		if len(fields) > 0 && strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		for j := 0; j < len(fields); j++ {
+			keyword := fields[j]
+			value := func() (string, error) {
+				if j+1 >= len(fields) {
+					return "", fmt.Errorf("line %d: %s needs a value", i+1, keyword)
+				}
+				j++
+				return fields[j], nil
+			}
+			var err error
+			switch keyword {
+			case "machine":
+				save()
+				currentHost, err = value()
+				currentHost = strings.ToLower(currentHost)
+				current = &credential{}
+			case "default":
+				save()
+				currentHost = ""
+				current = &credential{}
+			case "login", "password", "account":
+				var v string
+				v, err = value()
+				if current == nil {
+					return nil, nil, fmt.Errorf("line %d: %s outside of a machine entry", i+1, keyword)
+				}
+				if keyword == "login" {
+					current.login = v
+				} else if keyword == "password" {
+					current.password = v
+				}
+			case "macdef":
+				save()
+				for i+1 < len(lines) && strings.TrimSpace(lines[i+1]) != "" {
+					i++
+				}
+				j = len(fields)
+			default:
+				return nil, nil, fmt.Errorf("line %d: unexpected %q", i+1, keyword)
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	save()
+	return machines, fallback, nil
+}
+
+// hostEnvName turns a host name into the suffix of its environment
+// variables: upper case, with anything but letters and digits as "_".
+func hostEnvName(host string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, host)
+}
+
+// For returns the credential of host, a host name without port.
+func (store *credentialStore) For(host string) (credential, bool) {
+	if store == nil {
+		return credential{}, false
+	}
+	host = strings.ToLower(host)
+	if store.getenv != nil {
+		name := hostEnvName(host)
+		if token := store.getenv(TOKEN_ENV_PREFIX + name); token != "" {
+			return credential{token: token}, true
+		}
+		if auth := store.getenv(CREDENTIALS_ENV_PREFIX + name); auth != "" {
+			parts := strings.SplitN(auth, ":", 2)
+			if len(parts) == 2 {
+				return credential{login: parts[0], password: parts[1]}, true
+			}
+		}
+	}
+	if machine, ok := store.netrc[host]; ok {
+		return machine, true
+	}
+	if store.fallback != nil {
+		return *store.fallback, true
+	}
+	return credential{}, false
+}
+
+// Apply sets the Authorization header of req for its host.
+func (store *credentialStore) Apply(req *http.Request) {
+	found, ok := store.For(req.URL.Hostname())
+	if !ok {
+		return
+	}
+	if found.token != "" {
+		req.Header.Set("Authorization", "Bearer "+found.token)
+		return
+	}
+	req.SetBasicAuth(found.login, found.password)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+const SAMPLE_NETRC = `# tile sources
+machine tiles.example.com login alice password secret
+machine Private.Example.org
+	login bob
+	password hunter2
+	account ops
+
+macdef init
+cd /pub
+bin
+
+machine tiles.example.com login mallory password other
+default login anonymous password guest
+`
+
+func TestParseNetrc(t *testing.T) {
+	machines, fallback, err := parseNetrc(SAMPLE_NETRC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(machines) != 2 {
+		t.Errorf("machines %v, want 2", machines)
+	}
+	// The first entry of a host wins, and hosts are case insensitive.
+	if got := machines["tiles.example.com"]; got != (credential{login: "alice", password: "secret"}) {
+		t.Errorf("tiles.example.com: %+v", got)
+	}
+	if got := machines["private.example.org"]; got != (credential{login: "bob", password: "hunter2"}) {
+		t.Errorf("private.example.org: %+v", got)
+	}
+	if fallback == nil || *fallback != (credential{login: "anonymous", password: "guest"}) {
+		t.Errorf("default %+v", fallback)
+	}
+	for _, broken := range []string{"machine", "login alice", "machine a.com login", "machine a.com user alice"} {
+		if _, _, err := parseNetrc(broken); err == nil {
+			t.Errorf("parsed %q", broken)
+		}
+	}
+}
+
+func TestCredentialsForHost(t *testing.T) {
+	machines, _, err := parseNetrc(SAMPLE_NETRC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"MBUTIL_TOKEN_PRIVATE_EXAMPLE_ORG": "abc123",
+		"MBUTIL_AUTH_TILES_EXAMPLE_NET":    "carol:pw:with:colons",
+		"MBUTIL_AUTH_BROKEN_EXAMPLE_NET":   "nopassword",
+	}
+	store := &credentialStore{netrc: machines, getenv: func(name string) string { return env[name] }}
+	for _, test := range []struct {
+		host  string
+		want  credential
+		found bool
+	}{
+		{"tiles.example.com", credential{login: "alice", password: "secret"}, true},
+		{"TILES.example.com", credential{login: "alice", password: "secret"}, true},
+		// The environment takes precedence over the netrc file.
+		{"private.example.org", credential{token: "abc123"}, true},
+		{"tiles.example.net", credential{login: "carol", password: "pw:with:colons"}, true},
+		{"broken.example.net", credential{}, false},
+		{"a.tiles.example.com", credential{}, false},
+	} {
+		if got, found := store.For(test.host); got != test.want || found != test.found {
+			t.Errorf("%s: %+v, %v, want %+v, %v", test.host, got, found, test.want, test.found)
+		}
+	}
+	store.fallback = &credential{login: "anonymous", password: "guest"}
+	if got, _ := store.For("other.example.com"); got.login != "anonymous" {
+		t.Errorf("other hosts get %+v, want the default entry", got)
+	}
+	var none *credentialStore
+	if _, found := none.For("tiles.example.com"); found {
+		t.Error("a nil store found a credential")
+	}
+
+	// Apply goes by the host of the url, without its port.
+	req, err := http.NewRequest("GET", "https://tiles.example.com:8443/1/0/0.png", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Apply(req)
+	if login, password, ok := req.BasicAuth(); !ok || login != "alice" || password != "secret" {
+		t.Errorf("basic auth %q %q %v", login, password, ok)
+	}
+	req, err = http.NewRequest("GET", "https://private.example.org/1/0/0.png", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Apply(req)
+	if auth := req.Header.Get("Authorization"); auth != "Bearer abc123" {
+		t.Errorf("Authorization %q", auth)
+	}
+}
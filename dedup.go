@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"sort"
+	"strings"
+)
+
+// DEFAULT_HASH is non-cryptographic; tile ids only need to tell tiles
+// apart, not resist tampering. Its 128 bits keep collisions out of reach
+// for any tile count. xxhash is ten times faster but has 64 bits, see
+// BenchmarkHash*.
+const DEFAULT_HASH = "fnv"
+
+// DEDUP_TILES_VIEW keeps the deduplicated layout readable like any other
+// MBTiles file. Tiles kept inline by -dedupe-threshold have their data in
+// map instead of images.
+const DEDUP_TILES_VIEW = "create view if not exists tiles as select map.zoom_level as zoom_level, map.tile_column as tile_column, map.tile_row as tile_row, coalesce(map.tile_data, images.tile_data) as tile_data from map left join images on images.tile_id = map.tile_id;"
+
+// HASHES are the algorithms -hash accepts for the tile ids of -dedup.
+var HASHES = map[string]func() hash.Hash{
+	"fnv":    fnv.New128a,
+	"xxhash": newXXHash64,
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// Hasher computes the tile_id identical tiles share in the deduplicated
+// layout.
+type Hasher interface {
+	TileId(content []byte) string
+}
+
+type stdHasher struct {
+	new func() hash.Hash
+}
+
+func (hasher stdHasher) TileId(content []byte) string {
+	h := hasher.new()
+	h.Write(content)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newHasher returns the Hasher for one of the HASHES.
+func newHasher(name string) (Hasher, error) {
+	newHash, ok := HASHES[name]
+	if !ok {
+		var names []string
+		for name := range HASHES {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown hash %q, expected one of %s", name, strings.Join(names, ", "))
+	}
+	return stdHasher{newHash}, nil
+}
+
+// createDedupSchema creates the deduplicated layout: each distinct tile is
+// stored once in images and map points the coordinates at it.
+func createDedupSchema(db *sql.DB) error {
+	statements := []string{
+		"create table if not exists map (zoom_level integer, tile_column integer, tile_row integer, tile_id text, tile_data blob);",
+		"create table if not exists images (tile_data blob, tile_id text);",
+		"create table if not exists metadata (name text, value text);",
+		"create unique index if not exists map_index on map (zoom_level, tile_column, tile_row);",
+		"create unique index if not exists images_id on images (tile_id);",
+		"create unique index if not exists name on metadata (name);",
+		DEDUP_TILES_VIEW,
+	}
+	for _, statement := range statements {
+		_, err := db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasDedupLayout reports whether the file uses the deduplicated layout.
+func hasDedupLayout(db *sql.DB) (bool, error) {
+	var count int
+	err := db.QueryRow("select count(*) from sqlite_master where type = 'table' and name = 'map';").Scan(&count)
+	return count > 0, err
+}
+
+// addInlineColumn adds the tile_data column of inline tiles to the map of
+// a file created before -dedupe-threshold, and updates its view to read it.
+func addInlineColumn(db *sql.DB) error {
+	rows, err := db.Query("PRAGMA table_info(map);")
+	if err != nil {
+		return err
+	}
+	found := false
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, columnType string
+		var defaultValue interface{}
+		err = rows.Scan(&cid, &name, &columnType, &notNull, &defaultValue, &pk)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		found = found || name == "tile_data"
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || found {
+		return err
+	}
+	for _, statement := range []string{"alter table map add column tile_data blob;", "drop view if exists tiles;", DEDUP_TILES_VIEW} {
+		_, err = db.Exec(statement)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inlineCounter counts how often each tile id was stored, for
+// -dedupe-threshold: the first threshold copies of a tile are kept inline
+// in map, and only a tile seen more often moves to images. The counts only
+// cover the current run. A nil counter moves every tile to images.
+type inlineCounter struct {
+	threshold int
+	seen      map[string]int
+}
+
+func newInlineCounter(threshold int) *inlineCounter {
+	return &inlineCounter{threshold: threshold, seen: make(map[string]int)}
+}
+
+// Add counts a tile and reports whether it stays inline, and whether it is
+// the copy that moves the tile id to images.
+func (counter *inlineCounter) Add(tileId string) (inline, promote bool) {
+	if counter == nil {
+		return false, false
+	}
+	counter.seen[tileId]++
+	n := counter.seen[tileId]
+	return n <= counter.threshold, n == counter.threshold+1
+}
+
+// storeDedupTile stores the tile content once under its tile id and points
+// the coordinate at it. verb is the insert used for the map row, "insert",
+// "insert or replace" or "insert or ignore", as in storeTile.
+func storeDedupTile(tile Tile, db *sql.DB, hasher Hasher, inline *inlineCounter, verb string) error {
+	tileId := hasher.TileId(tile.Content)
+	keep, promote := inline.Add(tileId)
+	if keep {
+		_, err := db.Exec(verb+" into map (zoom_level, tile_column, tile_row, tile_id, tile_data) values (?, ?, ?, ?, ?);", tile.z, tile.x, tile.flipped_y(), tileId, tile.Content)
+		return err
+	}
+	_, err := db.Exec("insert or ignore into images (tile_data, tile_id) values (?, ?);", tile.Content, tileId)
+	if err != nil {
+		return err
+	}
+	if promote {
+		// The inline copies stored so far now point at images too.
+		_, err = db.Exec("update map set tile_data = null where tile_id = ? and tile_data is not null;", tileId)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = db.Exec(verb+" into map (zoom_level, tile_column, tile_row, tile_id) values (?, ?, ?, ?);", tile.z, tile.x, tile.flipped_y(), tileId)
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// storeSyntheticDedup stores the tiles of zoom 3, the western half the same
+// sea tile and the rest unique, with the given -dedupe-threshold.
+func storeSyntheticDedup(t *testing.T, threshold int) (map[[2]int][]byte, func(query string) int, func(x, y int) []byte) {
+	db, err := prepareDatabase(filepath.Join(t.TempDir(), "dedup.mbtiles"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if err = createDedupSchema(db); err != nil {
+		t.Fatal(err)
+	}
+	hasher, err := newHasher("sha1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := WriterOptions{Hasher: hasher}
+	if threshold > 0 {
+		options.Inline = newInlineCounter(threshold)
+	}
+	want := make(map[[2]int][]byte)
+	for x := 0; x < 8; x++ {
+		for y := 0; y < 8; y++ {
+			content := []byte(fmt.Sprintf("land %d/%d", x, y))
+			if x < 4 {
+				content = []byte("sea")
+			}
+			if err = storeTile(Tile{z: 3, x: x, y: y, Content: content}, db, options); err != nil {
+				t.Fatal(err)
+			}
+			want[[2]int{x, y}] = content
+		}
+	}
+	count := func(query string) int {
+		var n int
+		if err := db.QueryRow(query).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	read := func(x, y int) []byte {
+		tile := Tile{z: 3, x: x, y: y}
+		var content []byte
+		if err := db.QueryRow("select tile_data from tiles where zoom_level = ? and tile_column = ? and tile_row = ?;", tile.z, tile.x, tile.flipped_y()).Scan(&content); err != nil {
+			t.Fatal(err)
+		}
+		return content
+	}
+	return want, count, read
+}
+
+func TestDedupeThreshold(t *testing.T) {
+	for _, threshold := range []int{0, 2} {
+		want, count, read := storeSyntheticDedup(t, threshold)
+		for key, content := range want {
+			if got := read(key[0], key[1]); !bytes.Equal(got, content) {
+				t.Errorf("threshold %d: tile 3/%d/%d read back as %q", threshold, key[0], key[1], got)
+			}
+		}
+		images, inline := count("select count(*) from images;"), count("select count(*) from map where tile_data is not null;")
+		t.Logf("threshold %d: %d rows in images, %d tiles inline", threshold, images, inline)
+		switch threshold {
+		case 0:
+			// Every unique tile costs a lookup and a join.
+			if images != 33 || inline != 0 {
+				t.Errorf("full dedup: %d images and %d inline tiles", images, inline)
+			}
+		default:
+			// Only the repeated sea tile is shared.
+			if images != 1 || inline != 32 {
+				t.Errorf("threshold %d: %d images and %d inline tiles", threshold, images, inline)
+			}
+			if sea := count("select count(*) from map where tile_data is null;"); sea != 32 {
+				t.Errorf("threshold %d: %d sea tiles point at images, want all 32", threshold, sea)
+			}
+		}
+	}
+}
+
+func TestXXHash64(t *testing.T) {
+	for content, want := range map[string]string{
+		"":    "ef46db3751d8e999",
+		"a":   "d24ec4f1a98c6e5b",
+		"abc": "44bc2cf5ad770999",
+	} {
+		if got := (stdHasher{newXXHash64}).TileId([]byte(content)); got != want {
+			t.Errorf("xxhash of %q is %s, want %s", content, got, want)
+		}
+	}
+	// Written in pieces across the 32 byte stripes, the hash is the same.
+	content := bytes.Repeat([]byte("0123456789"), 10)
+	h := newXXHash64()
+	for _, piece := range [][]byte{content[:5], content[5:40], content[40:41], content[41:]} {
+		h.Write(piece)
+	}
+	if got, want := fmt.Sprintf("%x", h.Sum(nil)), (stdHasher{newXXHash64}).TileId(content); got != want {
+		t.Errorf("xxhash written in pieces is %s, at once %s", got, want)
+	}
+}
+
+// benchmarkHash computes the tile ids of 20 KB tiles, about a PNG of
+// satellite imagery.
+func benchmarkHash(b *testing.B, name string) {
+	hasher, err := newHasher(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	content := make([]byte, 20*1024)
+	rand.New(rand.NewSource(DETERMINISTIC_SEED)).Read(content)
+	b.SetBytes(int64(len(content)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		hasher.TileId(content)
+	}
+}
+
+func BenchmarkHashFnv(b *testing.B)    { benchmarkHash(b, "fnv") }
+func BenchmarkHashXXHash(b *testing.B) { benchmarkHash(b, "xxhash") }
+func BenchmarkHashMD5(b *testing.B)    { benchmarkHash(b, "md5") }
+func BenchmarkHashSHA1(b *testing.B)   { benchmarkHash(b, "sha1") }
+func BenchmarkHashSHA256(b *testing.B) { benchmarkHash(b, "sha256") }
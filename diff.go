@@ -0,0 +1,206 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+)
+
+// runDiff implements "diff a.mbtile b.mbtile": it reports the tiles added,
+// removed and changed in b compared to a, and exits 1 when they differ.
+func runDiff(args []string) {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	list := flags.Bool("list", false, "Print the coordinates of every added, removed and changed tile")
+	metadata := flags.Bool("metadata", false, "Also compare the metadata tables")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mbutil diff [options] a.mbtile b.mbtile")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	dbA, err := openMBTile(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dbA.Close()
+	dbB, err := openMBTile(flags.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer dbB.Close()
+
+	hashesA, err := readTileHashes(dbA)
+	if err != nil {
+		log.Fatal(err)
+	}
+	hashesB, err := readTileHashes(dbB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	diff := diffTileHashes(hashesA, hashesB)
+
+	if *list {
+		for _, tile := range diff.Added {
+			fmt.Println("added", tile)
+		}
+		for _, tile := range diff.Removed {
+			fmt.Println("removed", tile)
+		}
+		for _, tile := range diff.Changed {
+			fmt.Println("changed", tile)
+		}
+	}
+	fmt.Printf("%d added, %d removed, %d changed, %d unchanged\n", len(diff.Added), len(diff.Removed), len(diff.Changed), diff.Unchanged)
+	differs := len(diff.Added)+len(diff.Removed)+len(diff.Changed) > 0
+
+	if *metadata {
+		metaA, err := readMetadata(dbA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		metaB, err := readMetadata(dbB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, name := range diffMetadata(metaA, metaB) {
+			fmt.Printf("metadata %s: %q -> %q\n", name, metaA[name], metaB[name])
+			differs = true
+		}
+	}
+
+	if differs {
+		os.Exit(1)
+	}
+}
+
+// openMBTile opens an existing MBTiles file, unlike sql.Open which would
+// silently create a missing one.
+func openMBTile(filename string) (*sql.DB, error) {
+	_, err := os.Stat(filename)
+	if err != nil {
+		return nil, err
+	}
+	return sql.Open("sqlite3", filename)
+}
+
+func readMetadata(db *sql.DB) (map[string]string, error) {
+	rows, err := db.Query("select name, value from metadata;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	metadata := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		err = rows.Scan(&name, &value)
+		if err != nil {
+			return nil, err
+		}
+		metadata[name] = value
+	}
+	return metadata, rows.Err()
+}
+
+// readTileHashes returns the content hash of every tile keyed by its XYZ
+// coordinate. Files written with -store-hashes have them already. The tiles
+// of a -compress file are hashed decompressed, like -store-hashes does.
+func readTileHashes(db *sql.DB) (map[[3]int]string, error) {
+	stored, err := hasTileHashes(db)
+	if err != nil {
+		return nil, err
+	}
+	if stored {
+		return readStoredTileHashes(db)
+	}
+	metadata, err := readMetadata(db)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("select zoom_level, tile_column, tile_row, tile_data from tiles;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := make(map[[3]int]string)
+	for rows.Next() {
+		tile := Tile{}
+		err = rows.Scan(&tile.z, &tile.x, &tile.y, &tile.Content)
+		if err != nil {
+			return nil, err
+		}
+		tile.y = tile.flipped_y() // TMS row back to XYZ
+		tile.Content, err = decompressTile(tile.Content, metadata[COMPRESSION_KEY])
+		if err != nil {
+			return nil, err
+		}
+		hashes[[3]int{tile.z, tile.x, tile.y}] = tileHash(tile.Content)
+	}
+	return hashes, rows.Err()
+}
+
+// TileDiff lists the tiles that differ between two files.
+type TileDiff struct {
+	Added, Removed, Changed []Tile
+	Unchanged               int
+}
+
+func diffTileHashes(hashesA, hashesB map[[3]int]string) TileDiff {
+	var diff TileDiff
+	for key, hashB := range hashesB {
+		hashA, ok := hashesA[key]
+		tile := Tile{z: key[0], x: key[1], y: key[2]}
+		if !ok {
+			diff.Added = append(diff.Added, tile)
+		} else if hashA != hashB {
+			diff.Changed = append(diff.Changed, tile)
+		} else {
+			diff.Unchanged++
+		}
+	}
+	for key := range hashesA {
+		if _, ok := hashesB[key]; !ok {
+			diff.Removed = append(diff.Removed, Tile{z: key[0], x: key[1], y: key[2]})
+		}
+	}
+	sortTiles(diff.Added)
+	sortTiles(diff.Removed)
+	sortTiles(diff.Changed)
+	return diff
+}
+
+// diffMetadata returns the sorted names of the metadata keys whose values
+// differ or which are only present in one of the two tables.
+func diffMetadata(metaA, metaB map[string]string) []string {
+	var names []string
+	for name, value := range metaA {
+		if other, ok := metaB[name]; !ok || other != value {
+			names = append(names, name)
+		}
+	}
+	for name := range metaB {
+		if _, ok := metaA[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func sortTiles(tiles []Tile) {
+	sort.Slice(tiles, func(i, j int) bool {
+		if tiles[i].z != tiles[j].z {
+			return tiles[i].z < tiles[j].z
+		}
+		if tiles[i].x != tiles[j].x {
+			return tiles[i].x < tiles[j].x
+		}
+		return tiles[i].y < tiles[j].y
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+)
+
+// DISPLAY_MINZOOM_KEY is the metadata key of the lowest zoom a viewer
+// should show, set with -display-minzoom. The minzoom metadata stays the
+// lowest zoom with tiles; serve fills the levels between the two.
+const DISPLAY_MINZOOM_KEY = "display_minzoom"
+
+// MAX_UNDERZOOM_LEVELS limits how far below the data a served tile may be,
+// since it is built from 4^levels stored tiles.
+const MAX_UNDERZOOM_LEVELS = 4
+
+// underzoomTile builds the XYZ tile below dataMinZoom by shrinking the
+// tiles it covers at dataMinZoom into it. Missing tiles leave their part
+// transparent, or black in a jpg. It returns sql.ErrNoRows when none of
+// them are stored. layout is passed on to readTile.
+func underzoomTile(db *sql.DB, tile Tile, dataMinZoom int, layout tileLayout) ([]byte, error) {
+	scale := 1 << uint(dataMinZoom-tile.z)
+	var canvas *image.RGBA
+	var format string
+	for dx := 0; dx < scale; dx++ {
+		for dy := 0; dy < scale; dy++ {
+			child := Tile{z: dataMinZoom, x: tile.x*scale + dx, y: tile.y*scale + dy}
+			content, err := readTile(db, child, layout)
+			if err == sql.ErrNoRows {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			img, childFormat, err := image.Decode(bytes.NewReader(content))
+			if err != nil {
+				return nil, fmt.Errorf("tile %s: %v", child, err)
+			}
+			if canvas == nil {
+				size := img.Bounds().Size()
+				canvas = image.NewRGBA(image.Rect(0, 0, size.X, size.Y))
+				format = childFormat
+			}
+			shrinkInto(canvas, img, dx, dy, scale)
+		}
+	}
+	if canvas == nil {
+		return nil, sql.ErrNoRows
+	}
+	return encodeTile(canvas, format)
+}
+
+// shrinkInto draws img shrunk into the part (dx, dy) of dst cut into
+// scale x scale squares, taking the nearest pixel like enlargePart.
+func shrinkInto(dst *image.RGBA, img image.Image, dx, dy, scale int) {
+	width, height := dst.Bounds().Dx()/scale, dst.Bounds().Dy()/scale
+	src := img.Bounds()
+	for y := 0; y < height; y++ {
+		sy := src.Min.Y + y*src.Dy()/height
+		for x := 0; x < width; x++ {
+			sx := src.Min.X + x*src.Dx()/width
+			dst.Set(dx*width+x, dy*height+y, img.At(sx, sy))
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// runDump implements "dump file.mbtile z x y": it writes the bytes of one
+// tile, given in XYZ coordinates, to stdout or to -o. A terminal gets a
+// file named after the tile instead.
+func runDump(args []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	out := flags.String("o", "", "File to write the tile to (default stdout, or z-x-y.ext when stdout is a terminal)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mbutil dump [options] file.mbtile z x y")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 4 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	tile, err := parseTilePath(strings.Join(flags.Args()[1:], "/"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	db, err := openMBTile(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	metadata, err := readMetadata(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	content, err := readTile(db, tile, tileLayoutOf(flags.Arg(0), metadata))
+	if err == sql.ErrNoRows {
+		log.Fatalf("%s has no tile %s", flags.Arg(0), tile)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	filename := *out
+	if filename == "" || filename == STDOUT_FILENAME {
+		if info, err := os.Stdout.Stat(); err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			os.Stdout.Write(content)
+			return
+		}
+		extension := metadata["format"]
+		if extension == "" {
+			extension = extensionForFormat(sniffTileFormat(content))
+		}
+		filename = fmt.Sprintf("%d-%d-%d.%s", tile.z, tile.x, tile.y, extension)
+	}
+	err = ioutil.WriteFile(filename, content, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Wrote tile", tile, "to", filename)
+}
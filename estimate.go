@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ESTIMATE_SAMPLE_LIMIT caps the tiles -estimate-from-sample fetches per
+// zoom level, so an estimate stays quick.
+const ESTIMATE_SAMPLE_LIMIT = 100
+
+// ESTIMATE_WORKERS is how many sample tiles are fetched at once.
+const ESTIMATE_WORKERS = 4
+
+// zoomEstimate is the sample of one zoom level. Tiles the source doesn't
+// have count as sampled with no bytes, so empty areas lower the estimate
+// as they will lower the download; failed requests are left out.
+type zoomEstimate struct {
+	Zoom    int
+	Tiles   int
+	Sampled int
+	Missing int
+	Failed  int
+	Bytes   int64
+}
+
+// Estimate extrapolates the sampled bytes to all the tiles of the zoom
+// level. It reports false when no sample tile could be fetched.
+func (estimate zoomEstimate) Estimate() (int64, bool) {
+	if estimate.Sampled == 0 {
+		return 0, false
+	}
+	return estimate.Bytes * int64(estimate.Tiles) / int64(estimate.Sampled), true
+}
+
+// estimateFromSample fetches up to perZoom random tiles of every zoom level
+// in tiles, once each like the connectivity check, and measures them.
+func estimateFromSample(url_format string, tiles []Tile, perZoom int, timeout time.Duration, random *rand.Rand) []zoomEstimate {
+	if perZoom > ESTIMATE_SAMPLE_LIMIT {
+		perZoom = ESTIMATE_SAMPLE_LIMIT
+	}
+	var estimates []zoomEstimate
+	var sample []Tile
+	for _, batch := range groupByZoom(tiles) {
+		estimates = append(estimates, zoomEstimate{Zoom: batch[0].z, Tiles: len(batch)})
+		picked := append([]Tile(nil), batch...)
+		shuffleTiles(picked, random)
+		if len(picked) > perZoom {
+			picked = picked[:perZoom]
+		}
+		sample = append(sample, picked...)
+	}
+	sort.Slice(estimates, func(i, j int) bool { return estimates[i].Zoom < estimates[j].Zoom })
+	index := make(map[int]int)
+	for i, estimate := range estimates {
+		index[estimate.Zoom] = i
+	}
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	pipe := make(chan Tile, len(sample))
+	for _, tile := range sample {
+		pipe <- tile
+	}
+	close(pipe)
+	for w := 0; w < ESTIMATE_WORKERS; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tile := range pipe {
+				probe, err := probeTile(url_format, tile, timeout)
+				mutex.Lock()
+				estimate := &estimates[index[tile.z]]
+				switch {
+				case err == nil && probe.Status == http.StatusOK:
+					estimate.Sampled++
+					estimate.Bytes += int64(len(probe.Body))
+				case err == nil && (probe.Status == http.StatusNotFound || probe.Status == http.StatusNoContent):
+					estimate.Sampled++
+					estimate.Missing++
+				default:
+					estimate.Failed++
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return estimates
+}
+
+// printEstimate writes a line per zoom level and the total.
+func printEstimate(out io.Writer, estimates []zoomEstimate) {
+	var total int64
+	complete := true
+	for _, estimate := range estimates {
+		bytes, ok := estimate.Estimate()
+		if !ok {
+			complete = false
+			fmt.Fprintf(out, "zoom %d: %d tiles, no estimate, all %d sample tiles failed\n", estimate.Zoom, estimate.Tiles, estimate.Failed)
+			continue
+		}
+		total += bytes
+		line := fmt.Sprintf("zoom %d: %d tiles, %s per tile over %d sampled", estimate.Zoom, estimate.Tiles, formatBytes(estimate.Bytes/int64(estimate.Sampled)), estimate.Sampled)
+		if estimate.Missing > 0 {
+			line += fmt.Sprintf(" (%d missing)", estimate.Missing)
+		}
+		if estimate.Failed > 0 {
+			line += fmt.Sprintf(", %d failed", estimate.Failed)
+		}
+		fmt.Fprintf(out, "%s, about %s\n", line, formatBytes(bytes))
+	}
+	if complete {
+		fmt.Fprintf(out, "Estimated download: about %s of tiles\n", formatBytes(total))
+	} else {
+		fmt.Fprintf(out, "Estimated download: more than %s of tiles, some zoom levels couldn't be sampled\n", formatBytes(total))
+	}
+}
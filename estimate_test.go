@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestEstimateFromSample(t *testing.T) {
+	var requests [5]int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var z, x, y int
+		if _, err := fmt.Sscanf(r.URL.Path, "/%d/%d/%d.png", &z, &x, &y); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		atomic.AddInt32(&requests[z], 1)
+		switch {
+		case z == 3:
+			http.Error(w, "overloaded", http.StatusServiceUnavailable)
+		case z == 2 && x%2 == 1:
+			// Ocean.
+			http.NotFound(w, r)
+		default:
+			w.Write(bytes.Repeat([]byte{1}, 100*z))
+		}
+	}))
+	defer server.Close()
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	proj := NewProjection(-180, -85, 180, 85, 1, 4, nil, 0)
+	estimates := estimateFromSample(server.URL+"/{z}/{x}/{y}.png", proj.TileList(), 1000, time.Second, rand.New(rand.NewSource(DETERMINISTIC_SEED)))
+	if len(estimates) != 4 {
+		t.Fatalf("estimates %+v", estimates)
+	}
+	for i, want := range []struct {
+		zoomEstimate
+		bytes int64
+		ok    bool
+	}{
+		{zoomEstimate{Zoom: 1, Tiles: 4, Sampled: 4, Bytes: 400}, 400, true},
+		{zoomEstimate{Zoom: 2, Tiles: 16, Sampled: 16, Missing: 8, Bytes: 8 * 200}, 1600, true},
+		{zoomEstimate{Zoom: 3, Tiles: 64, Failed: 64}, 0, false},
+		// The sample is capped.
+		{zoomEstimate{Zoom: 4, Tiles: 256, Sampled: ESTIMATE_SAMPLE_LIMIT, Bytes: ESTIMATE_SAMPLE_LIMIT * 400}, 256 * 400, true},
+	} {
+		if estimates[i] != want.zoomEstimate {
+			t.Errorf("zoom %d sampled as %+v, want %+v", want.Zoom, estimates[i], want.zoomEstimate)
+		}
+		if bytes, ok := estimates[i].Estimate(); bytes != want.bytes || ok != want.ok {
+			t.Errorf("zoom %d estimated at %d bytes, %v, want %d", want.Zoom, bytes, ok, want.bytes)
+		}
+	}
+	if count := atomic.LoadInt32(&requests[4]); count != ESTIMATE_SAMPLE_LIMIT {
+		t.Errorf("%d requests at zoom 4, want %d", count, ESTIMATE_SAMPLE_LIMIT)
+	}
+
+	var out bytes.Buffer
+	printEstimate(&out, estimates)
+	report := out.String()
+	for _, line := range []string{"zoom 2: 16 tiles", "(8 missing)", "zoom 3: 64 tiles, no estimate", "more than"} {
+		if !strings.Contains(report, line) {
+			t.Errorf("no %q in the estimate:\n%s", line, report)
+		}
+	}
+}
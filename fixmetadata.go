@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// FIXED_METADATA_KEYS are the metadata values fix-metadata recomputes, in
+// the order they are reported.
+var FIXED_METADATA_KEYS = []string{"bounds", "center", "minzoom", "maxzoom", "format"}
+
+// runFixMetadata implements "fix-metadata file.mbtile": it recomputes the
+// extent and format metadata from the tiles in the file, for files whose
+// metadata is stale, missing or wrong.
+func runFixMetadata(args []string) {
+	flags := flag.NewFlagSet("fix-metadata", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mbutil fix-metadata file.mbtile")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, err := openMBTile(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	// A -compact file stays without its indexes.
+	compact, err := isCompact(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !compact {
+		err = ensureIndexes(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	before, err := readMetadata(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	after, err := computeMetadata(db, flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	changed := 0
+	for _, name := range FIXED_METADATA_KEYS {
+		value, ok := after[name]
+		if !ok {
+			continue
+		}
+		if before[name] == value {
+			log.Printf("%s: %q, unchanged", name, value)
+			continue
+		}
+		log.Printf("%s: %q -> %q", name, before[name], value)
+		// Without the index on the names, "insert or replace" would add a
+		// second row.
+		_, err = db.Exec("delete from metadata where name = ?;", name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		_, err = db.Exec("insert into metadata (name, value) values (?, ?);", name, value)
+		if err != nil {
+			log.Fatal(err)
+		}
+		changed++
+	}
+	log.Println("Fixed", changed, "metadata values in", flags.Arg(0))
+}
+
+// computeMetadata derives FIXED_METADATA_KEYS from the tiles: the zoom
+// range, the area the highest zoom level covers with its middle as the
+// center at the lowest zoom, and the format of a tile's bytes, read through
+// the layout of filename. The format is left out when the bytes aren't
+// recognised, or when -zoom-formats gave the zoom levels different ones.
+func computeMetadata(db *sql.DB, filename string) (map[string]string, error) {
+	before, err := readMetadata(db)
+	if err != nil {
+		return nil, err
+	}
+	var minZoom, maxZoom sql.NullInt64
+	err = db.QueryRow("select min(zoom_level), max(zoom_level) from tiles;").Scan(&minZoom, &maxZoom)
+	if err != nil {
+		return nil, err
+	}
+	if !minZoom.Valid {
+		return nil, fmt.Errorf("the file has no tiles")
+	}
+	z := int(maxZoom.Int64)
+	var xmin, xmax, rowMin, rowMax int
+	err = db.QueryRow("select min(tile_column), max(tile_column), min(tile_row), max(tile_row) from tiles where zoom_level = ?;", z).Scan(&xmin, &xmax, &rowMin, &rowMax)
+	if err != nil {
+		return nil, err
+	}
+	// Rows are TMS, counted from the bottom.
+	top := (1 << uint(z)) - 1 - rowMax
+	bottom := (1 << uint(z)) - 1 - rowMin
+	west, north := tileToLonLat(z, float64(xmin), float64(top))
+	east, south := tileToLonLat(z, float64(xmax+1), float64(bottom+1))
+	metadata := map[string]string{
+		"bounds":  fmt.Sprintf("%f,%f,%f,%f", west, south, east, north),
+		"center":  fmt.Sprintf("%f,%f,%d", (west+east)/2, (south+north)/2, minZoom.Int64),
+		"minzoom": strconv.FormatInt(minZoom.Int64, 10),
+		"maxzoom": strconv.FormatInt(maxZoom.Int64, 10),
+	}
+
+	if zoomFormatsMetadata(before) != nil {
+		return metadata, nil
+	}
+	tile := Tile{}
+	err = db.QueryRow("select zoom_level, tile_column, tile_row from tiles limit 1;").Scan(&tile.z, &tile.x, &tile.y)
+	if err != nil {
+		return nil, err
+	}
+	tile.y = tile.flipped_y() // TMS row back to XYZ
+	content, err := readTile(db, tile, tileLayoutOf(filename, before))
+	if err != nil {
+		return nil, err
+	}
+	if tileFormat := sniffTileFormat(content); tileFormat != "" {
+		metadata["format"] = extensionForFormat(tileFormat)
+	}
+	return metadata, nil
+}
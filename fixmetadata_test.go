@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+func TestFixMetadata(t *testing.T) {
+	db, filename := newTestMBTiles(t, map[string]string{"format": "jpg", "bounds": "-180,-85,180,85", "minzoom": "0", "maxzoom": "18", "name": "Wrong"})
+	content := solidPNG(t, color.RGBA{0, 255, 0, 255})
+	addTestTile(t, db, 9, 81, 197, content)
+	for x := 163; x <= 164; x++ {
+		for y := 395; y <= 396; y++ {
+			addTestTile(t, db, 10, x, y, content)
+		}
+	}
+	db.Close()
+
+	output, err := runMain(t, "fix-metadata", filename)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if !strings.Contains(output, `bounds: "-180,-85,180,85" -> `) {
+		t.Errorf("the old bounds weren't reported:\n%s", output)
+	}
+	db, err = openMBTile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	metadata, err := readMetadata(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	west, north := tileToLonLat(10, 163, 395)
+	east, south := tileToLonLat(10, 165, 397)
+	want := map[string]string{
+		"bounds":  fmt.Sprintf("%f,%f,%f,%f", west, south, east, north),
+		"center":  fmt.Sprintf("%f,%f,9", (west+east)/2, (south+north)/2),
+		"minzoom": "9",
+		"maxzoom": "10",
+		"format":  PNG_EXTENSION,
+		"name":    "Wrong",
+	}
+	for name, value := range want {
+		if metadata[name] != value {
+			t.Errorf("%s is %q, want %q", name, metadata[name], value)
+		}
+	}
+}
+
+func TestComputeMetadataEmpty(t *testing.T) {
+	db, _ := newTestMBTiles(t, nil)
+	if _, err := computeMetadata(db, ""); err == nil {
+		t.Error("computed metadata for a file without tiles")
+	}
+}
+
+func TestFixMetadataCompact(t *testing.T) {
+	db, filename := newTestMBTiles(t, map[string]string{"format": "jpg", "minzoom": "0", COMPRESSION_KEY: COMPRESSION_ZSTD})
+	content := solidPNG(t, color.RGBA{0, 0, 255, 255})
+	err := storeTile(Tile{z: 3, x: 2, y: 1, Content: content}, db, WriterOptions{Compression: COMPRESSION_ZSTD})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = dropIndexes(db); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	output, err := runMain(t, "fix-metadata", filename)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	db, err = openMBTile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var indexes int
+	if err = db.QueryRow("select count(*) from sqlite_master where type = 'index';").Scan(&indexes); err != nil || indexes != 0 {
+		t.Errorf("%d indexes in the -compact file, %v", indexes, err)
+	}
+	// The format comes from the decompressed tile, and each value is
+	// written once.
+	for name, want := range map[string]string{"format": PNG_EXTENSION, "minzoom": "3"} {
+		var values []string
+		rows, err := db.Query("select value from metadata where name = ?;", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var value string
+			rows.Scan(&value)
+			values = append(values, value)
+		}
+		rows.Close()
+		if len(values) != 1 || values[0] != want {
+			t.Errorf("%s is %q, want %q", name, values, want)
+		}
+	}
+}
+
+func TestComputeMetadataZoomFormats(t *testing.T) {
+	db, _ := newTestMBTiles(t, map[string]string{"format": "jpg", "json": `{"zoom_formats": {"1": "jpg", "2": "png"}}`})
+	addTestTile(t, db, 2, 1, 1, solidPNG(t, color.RGBA{255, 0, 0, 255}))
+	metadata, err := computeMetadata(db, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if format, ok := metadata["format"]; ok {
+		t.Errorf("format %q computed for a file with a format per zoom level", format)
+	}
+}
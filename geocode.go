@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DEFAULT_GEOCODER is Nominatim's search, which -place queries. Its usage
+// policy asks for an identifying User-Agent, at most one request a second
+// and caching of results: -place makes a single request and keeps the
+// answer in the user cache directory.
+const DEFAULT_GEOCODER = "https://nominatim.openstreetmap.org/search?format=json&limit=1&q={query}"
+const GEOCODER_TIMEOUT = 30 * time.Second
+
+// geocodePlace resolves a place name to a bounding box with the geocoder at
+// geocoderUrl, a template where {query} is replaced with the place.
+func geocodePlace(place, geocoderUrl string) (xmin, ymin, xmax, ymax float64, err error) {
+	requestUrl := strings.Replace(geocoderUrl, "{query}", url.QueryEscape(place), -1)
+	cachePath := geocodeCachePath(requestUrl)
+	body, err := ioutil.ReadFile(cachePath)
+	if err != nil {
+		body, err = fetchGeocode(requestUrl)
+		if err != nil {
+			return 0, 0, 0, 0, err
+		}
+		if cachePath != "" && os.MkdirAll(filepath.Dir(cachePath), 0755) == nil {
+			ioutil.WriteFile(cachePath, body, 0644)
+		}
+	}
+	xmin, ymin, xmax, ymax, name, err := parseNominatimBounds(body)
+	if err != nil {
+		return 0, 0, 0, 0, fmt.Errorf("geocoding %q: %v", place, err)
+	}
+	log.Printf("Resolved %q to %s, bounds %f,%f,%f,%f", place, name, xmin, ymin, xmax, ymax)
+	return xmin, ymin, xmax, ymax, nil
+}
+
+func fetchGeocode(requestUrl string) ([]byte, error) {
+	req, err := http.NewRequest("GET", requestUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	agent := userAgent
+	if agent == DEFAULT_USER_AGENT {
+		// The default doesn't say who we are, which Nominatim requires.
+		agent = POLITE_USER_AGENT
+	}
+	req.Header.Set("User-Agent", agent)
+	client := &http.Client{Timeout: GEOCODER_TIMEOUT}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("geocoder answered %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// geocodeCachePath returns where the answer for requestUrl is cached, or ""
+// when there is no user cache directory.
+func geocodeCachePath(requestUrl string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(requestUrl))
+	return filepath.Join(dir, "mbtilego", "geocode", hex.EncodeToString(sum[:])+".json")
+}
+
+// parseNominatimBounds reads the bounding box of the first result of a
+// Nominatim search, given as strings in south, north, west, east order.
+func parseNominatimBounds(body []byte) (xmin, ymin, xmax, ymax float64, name string, err error) {
+	var results []struct {
+		DisplayName string   `json:"display_name"`
+		BoundingBox []string `json:"boundingbox"`
+	}
+	err = json.Unmarshal(body, &results)
+	if err != nil {
+		return 0, 0, 0, 0, "", fmt.Errorf("invalid geocoder answer: %v", err)
+	}
+	if len(results) == 0 {
+		return 0, 0, 0, 0, "", fmt.Errorf("no place found")
+	}
+	result := results[0]
+	if len(result.BoundingBox) != 4 {
+		return 0, 0, 0, 0, "", fmt.Errorf("invalid bounding box %v", result.BoundingBox)
+	}
+	var box [4]float64
+	for i, value := range result.BoundingBox {
+		box[i], err = strconv.ParseFloat(value, 64)
+		if err != nil {
+			return 0, 0, 0, 0, "", fmt.Errorf("invalid bounding box %v", result.BoundingBox)
+		}
+	}
+	return box[2], box[0], box[3], box[1], result.DisplayName, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+// NOMINATIM_BERLIN is a Nominatim search answer, trimmed.
+const NOMINATIM_BERLIN = `[{"place_id": 134140761, "licence": "Data © OpenStreetMap contributors, ODbL 1.0.", "osm_type": "relation", "osm_id": 62422, "boundingbox": ["52.3382448", "52.6755087", "13.0883450", "13.7611609"], "lat": "52.5170365", "lon": "13.3888599", "display_name": "Berlin, Deutschland", "class": "boundary", "type": "administrative", "importance": 0.8875}]`
+
+func TestParseNominatimBounds(t *testing.T) {
+	xmin, ymin, xmax, ymax, name, err := parseNominatimBounds([]byte(NOMINATIM_BERLIN))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if xmin != 13.0883450 || ymin != 52.3382448 || xmax != 13.7611609 || ymax != 52.6755087 {
+		t.Errorf("bounds %f,%f,%f,%f", xmin, ymin, xmax, ymax)
+	}
+	if name != "Berlin, Deutschland" {
+		t.Errorf("name %q", name)
+	}
+	for _, body := range []string{`[]`, `{"error": "Unable to geocode"}`, `[{"boundingbox": ["52.3", "52.6"]}]`, `[{"boundingbox": ["a", "b", "c", "d"]}]`, `<html>`} {
+		if _, _, _, _, _, err := parseNominatimBounds([]byte(body)); err == nil {
+			t.Errorf("%s parsed", body)
+		}
+	}
+}
+
+func TestGeocodePlace(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("HOME", t.TempDir())
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.URL.Query().Get("q") != "Berlin, Germany" {
+			t.Errorf("query %q", r.URL.RawQuery)
+		}
+		if agent := r.Header.Get("User-Agent"); agent != POLITE_USER_AGENT {
+			t.Errorf("User-Agent %q doesn't identify the program", agent)
+		}
+		w.Write([]byte(NOMINATIM_BERLIN))
+	}))
+	defer server.Close()
+	for i := 0; i < 2; i++ {
+		xmin, ymin, xmax, ymax, err := geocodePlace("Berlin, Germany", server.URL+"/search?format=json&limit=1&q={query}")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if xmin != 13.0883450 || ymin != 52.3382448 || xmax != 13.7611609 || ymax != 52.6755087 {
+			t.Errorf("bounds %f,%f,%f,%f", xmin, ymin, xmax, ymax)
+		}
+	}
+	if count := atomic.LoadInt32(&requests); count != 1 {
+		t.Errorf("%d requests to the geocoder, want the answer cached", count)
+	}
+}
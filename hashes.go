@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+)
+
+// TILE_HASHES_TABLE is the schema of the -store-hashes sidecar table: the
+// tileHash of every stored tile, keyed like tiles with TMS rows. It is a
+// table of its own so readers of the standard schema never see it.
+var TILE_HASHES_TABLE = []string{
+	"create table if not exists tile_hashes (zoom_level integer, tile_column integer, tile_row integer, tile_hash text);",
+	"create unique index if not exists tile_hashes_index on tile_hashes (zoom_level, tile_column, tile_row);",
+}
+
+// hasTileHashes reports whether the file was written with -store-hashes.
+func hasTileHashes(db *sql.DB) (bool, error) {
+	var count int
+	err := db.QueryRow("select count(*) from sqlite_master where type = 'table' and name = 'tile_hashes';").Scan(&count)
+	return count > 0, err
+}
+
+// createTileHashes adds the tile_hashes table and fills it for the tiles
+// already stored, for -store-hashes on a file written without it. layout is
+// how the file stores its tiles. It returns the number of tiles hashed.
+func createTileHashes(db *sql.DB, layout tileLayout) (int, error) {
+	for _, statement := range TILE_HASHES_TABLE {
+		_, err := db.Exec(statement)
+		if err != nil {
+			return 0, err
+		}
+	}
+	rows, err := db.Query("select zoom_level, tile_column, tile_row, tile_data from tiles where not exists (select 1 from tile_hashes where tile_hashes.zoom_level = tiles.zoom_level and tile_hashes.tile_column = tiles.tile_column and tile_hashes.tile_row = tiles.tile_row);")
+	if err != nil {
+		return 0, err
+	}
+	// Collected first: with a single connection the rows have to be closed
+	// before writing.
+	var tiles []Tile
+	for rows.Next() {
+		tile := Tile{}
+		err = rows.Scan(&tile.z, &tile.x, &tile.y, &tile.Content)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		tile.y = tile.flipped_y() // TMS row back to XYZ
+		if layout.Dir != "" {
+			tile.Content, err = readTileFile(layout.Dir, tile.Content)
+			if err != nil {
+				rows.Close()
+				return 0, err
+			}
+		}
+		tile.Content, err = decompressTile(tile.Content, layout.Compression)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		tiles = append(tiles, tile)
+	}
+	rows.Close()
+	err = rows.Err()
+	if err != nil {
+		return 0, err
+	}
+	for _, tile := range tiles {
+		err = storeTileHash(tile, db, false)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(tiles), nil
+}
+
+// storeTileHash records the hash of the content of tile. With keepExisting
+// the hash of a tile already stored is kept, like the tile itself.
+func storeTileHash(tile Tile, db sqlExecer, keepExisting bool) error {
+	verb := "insert or replace"
+	if keepExisting {
+		verb = "insert or ignore"
+	}
+	_, err := db.Exec(verb+" into tile_hashes (zoom_level, tile_column, tile_row, tile_hash) values (?, ?, ?, ?);", tile.z, tile.x, tile.flipped_y(), tileHash(tile.Content))
+	return err
+}
+
+// readStoredTileHashes returns the hashes of the tile_hashes table keyed by
+// XYZ coordinate, like readTileHashes computes them.
+func readStoredTileHashes(db *sql.DB) (map[[3]int]string, error) {
+	rows, err := db.Query("select zoom_level, tile_column, tile_row, tile_hash from tile_hashes;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := make(map[[3]int]string)
+	for rows.Next() {
+		tile := Tile{}
+		var hash string
+		err = rows.Scan(&tile.z, &tile.x, &tile.y, &hash)
+		if err != nil {
+			return nil, err
+		}
+		tile.y = tile.flipped_y() // TMS row back to XYZ
+		hashes[[3]int{tile.z, tile.x, tile.y}] = hash
+	}
+	return hashes, rows.Err()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// recomputeTileHashes hashes the tiles table itself, keyed by XYZ coordinate.
+func recomputeTileHashes(t *testing.T, db *sql.DB) map[[3]int]string {
+	rows, err := db.Query("select zoom_level, tile_column, tile_row, tile_data from tiles;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	hashes := make(map[[3]int]string)
+	for rows.Next() {
+		tile := Tile{}
+		if err = rows.Scan(&tile.z, &tile.x, &tile.y, &tile.Content); err != nil {
+			t.Fatal(err)
+		}
+		tile.y = tile.flipped_y()
+		hashes[[3]int{tile.z, tile.x, tile.y}] = tileHash(tile.Content)
+	}
+	if err = rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return hashes
+}
+
+func TestStoreHashes(t *testing.T) {
+	db, _ := newTestMBTiles(t, map[string]string{"format": "png"})
+	// Tiles stored before -store-hashes are hashed when it is turned on.
+	addTestTile(t, db, 1, 0, 0, []byte("before"))
+	count, err := createTileHashes(db, tileLayout{})
+	if err != nil || count != 1 {
+		t.Fatalf("hashed %d tiles, %v, want 1", count, err)
+	}
+	options := WriterOptions{Overwrite: true, StoreHashes: true}
+	for x := 0; x < 4; x++ {
+		for y := 0; y < 4; y++ {
+			err = storeTile(Tile{z: 2, x: x, y: y, Content: []byte(fmt.Sprintf("tile 2/%d/%d", x, y))}, db, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// An overwritten tile has the hash of its new content.
+	err = storeTile(Tile{z: 1, x: 0, y: 0, Content: []byte("after")}, db, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored, err := readStoredTileHashes(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := recomputeTileHashes(t, db); len(want) != 17 || !reflect.DeepEqual(stored, want) {
+		t.Errorf("stored hashes %v, want %v", stored, want)
+	}
+	// The sidecar table doesn't change the standard schema.
+	var columns int
+	if err = db.QueryRow("select count(*) from pragma_table_info('tiles');").Scan(&columns); err != nil || columns != 4 {
+		t.Errorf("tiles has %d columns, %v, want 4", columns, err)
+	}
+}
+
+func TestStoreHashesOfCompressedTiles(t *testing.T) {
+	db, _ := newTestMBTiles(t, map[string]string{"format": "png", COMPRESSION_KEY: COMPRESSION_ZSTD})
+	options := WriterOptions{StoreHashes: true, Compression: COMPRESSION_ZSTD}
+	_, err := createTileHashes(db, tileLayout{Compression: COMPRESSION_ZSTD})
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("tile 2/1/1")
+	err = storeTile(Tile{z: 2, x: 1, y: 1, Content: content}, db, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := readStoredTileHashes(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash := stored[[3]int{2, 1, 1}]; hash != tileHash(content) {
+		t.Errorf("stored hash %q, want the hash of the tile bytes %q", hash, tileHash(content))
+	}
+}
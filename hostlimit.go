@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// hostLimiter caps the requests in flight to each host, on top of the
+// global worker count, set with the repeatable -host-limit flag. A limit
+// for a host also covers its subdomains, so the {s} servers of a source
+// share it. A nil or empty limiter doesn't limit anything.
+type hostLimiter struct {
+	limits map[string]int
+	// defaultLimit applies to every other host, each on its own; 0 leaves
+	// them unlimited.
+	defaultLimit int
+	mutex        sync.Mutex
+	slots        map[string]chan struct{}
+}
+
+func newHostLimiter() *hostLimiter {
+	return &hostLimiter{limits: make(map[string]int), slots: make(map[string]chan struct{})}
+}
+
+func (limiter *hostLimiter) String() string {
+	if limiter == nil {
+		return ""
+	}
+	var parts []string
+	for host, limit := range limiter.limits {
+		parts = append(parts, host+"="+strconv.Itoa(limit))
+	}
+	sort.Strings(parts)
+	if limiter.defaultLimit > 0 {
+		parts = append(parts, strconv.Itoa(limiter.defaultLimit))
+	}
+	return strings.Join(parts, ",")
+}
+
+// Set parses "host=n", or a bare "n" for the default limit.
+func (limiter *hostLimiter) Set(value string) error {
+	host, count := "", value
+	if equals := strings.LastIndex(value, "="); equals >= 0 {
+		host, count = strings.ToLower(strings.TrimSpace(value[:equals])), value[equals+1:]
+		if host == "" {
+			return fmt.Errorf("expected host=n or n, got %q", value)
+		}
+	}
+	limit, err := strconv.Atoi(strings.TrimSpace(count))
+	if err != nil || limit < 1 {
+		return fmt.Errorf("expected host=n or n with n at least 1, got %q", value)
+	}
+	if host == "" {
+		limiter.defaultLimit = limit
+	} else {
+		limiter.limits[host] = limit
+	}
+	return nil
+}
+
+// Active reports whether any limit was set.
+func (limiter *hostLimiter) Active() bool {
+	return limiter != nil && (len(limiter.limits) > 0 || limiter.defaultLimit > 0)
+}
+
+// Acquire waits for a free slot for the host of tileUrl and returns the
+// function giving it back.
+func (limiter *hostLimiter) Acquire(tileUrl string) func() {
+	if !limiter.Active() {
+		return func() {}
+	}
+	parsed, err := url.Parse(tileUrl)
+	if err != nil {
+		return func() {}
+	}
+	slots := limiter.slotsFor(strings.ToLower(parsed.Host))
+	if slots == nil {
+		return func() {}
+	}
+	slots <- struct{}{}
+	return func() {
+		<-slots
+	}
+}
+
+// slotsFor returns the semaphore of the limit matching host, which may
+// include a port, or nil when it is unlimited.
+func (limiter *hostLimiter) slotsFor(host string) chan struct{} {
+	key, limit := host, limiter.defaultLimit
+	hostname := host
+	if colon := strings.LastIndex(host, ":"); colon >= 0 && !strings.HasSuffix(host, "]") {
+		hostname = host[:colon]
+	}
+	// The most specific rule wins: the host with its port, then the
+	// longest domain it is in.
+	if n, ok := limiter.limits[host]; ok {
+		key, limit = host, n
+	} else {
+		matched := ""
+		for rule, n := range limiter.limits {
+			if (hostname == rule || strings.HasSuffix(hostname, "."+rule)) && len(rule) > len(matched) {
+				matched, key, limit = rule, rule, n
+			}
+		}
+	}
+	if limit == 0 {
+		return nil
+	}
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	slots, ok := limiter.slots[key]
+	if !ok {
+		slots = make(chan struct{}, limit)
+		limiter.slots[key] = slots
+	}
+	return slots
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newConcurrencyServer serves content slowly, keeping the most requests it
+// had in flight at once in peak.
+func newConcurrencyServer(t *testing.T, content []byte, peak *int32) *httptest.Server {
+	var inFlight int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		current := atomic.AddInt32(&inFlight, 1)
+		defer atomic.AddInt32(&inFlight, -1)
+		for {
+			seen := atomic.LoadInt32(peak)
+			if current <= seen || atomic.CompareAndSwapInt32(peak, seen, current) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		w.Write(content)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHostLimitsAreIndependent(t *testing.T) {
+	content := solidPNG(t, color.RGBA{0, 128, 0, 255})
+	var slowPeak, fastPeak int32
+	slow := newConcurrencyServer(t, content, &slowPeak)
+	fast := newConcurrencyServer(t, content, &fastPeak)
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	limits := newHostLimiter()
+	for _, server := range []struct {
+		url   string
+		limit string
+	}{{slow.URL, "1"}, {fast.URL, "3"}} {
+		parsed, err := url.Parse(server.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := limits.Set(parsed.Host + "=" + server.limit); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, server := range []*httptest.Server{slow, fast} {
+		options := FetchOptions{UrlFormat: server.URL + "/{z}/{x}/{y}.png", HostLimits: limits}
+		for x := 0; x < 8; x++ {
+			wg.Add(1)
+			go func(x int) {
+				defer wg.Done()
+				if _, err := fetchTileWithRetry(Tile{z: 3, x: x, y: 0}, options); err != nil {
+					t.Errorf("tile 3/%d/0: %v", x, err)
+				}
+			}(x)
+		}
+	}
+	wg.Wait()
+	if peak := atomic.LoadInt32(&slowPeak); peak != 1 {
+		t.Errorf("%d requests at once to the host limited to 1", peak)
+	}
+	if peak := atomic.LoadInt32(&fastPeak); peak < 2 || peak > 3 {
+		t.Errorf("%d requests at once to the host limited to 3", peak)
+	}
+}
+
+func TestHostLimiterRules(t *testing.T) {
+	limits := newHostLimiter()
+	for _, value := range []string{"tile.openstreetmap.org=2", "mirror.example.com:8080=16", "4"} {
+		if err := limits.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, value := range []string{"osm=0", "=2", "many"} {
+		if err := newHostLimiter().Set(value); err == nil {
+			t.Errorf("-host-limit %s accepted", value)
+		}
+	}
+	// The {s} servers of a source share its limit.
+	osm := limits.slotsFor("a.tile.openstreetmap.org")
+	if cap(osm) != 2 || limits.slotsFor("b.tile.openstreetmap.org") != osm {
+		t.Errorf("subdomains don't share the limit of 2")
+	}
+	if mirror := limits.slotsFor("mirror.example.com:8080"); cap(mirror) != 16 {
+		t.Errorf("limit %d for the mirror, want 16", cap(mirror))
+	}
+	// Other hosts each get the default.
+	other := limits.slotsFor("tiles.example.org")
+	if cap(other) != 4 || limits.slotsFor("maps.example.net") == other {
+		t.Errorf("other hosts don't each get the default of 4")
+	}
+	if slots := newHostLimiter().slotsFor("tiles.example.org"); slots != nil {
+		t.Error("limited a host without any limit set")
+	}
+}
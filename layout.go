@@ -0,0 +1,149 @@
+package main
+
+import (
+	"database/sql"
+	"sort"
+)
+
+// optimizeLayout rewrites the tiles ordered by zoom level, column and row,
+// so tiles that are shown together are stored together. The map of the
+// deduplicated layout is instead ordered along a Hilbert curve within each
+// zoom level, which also keeps neighbouring rows close. It runs before the
+// final VACUUM, which keeps the order on disk.
+func optimizeLayout(db *sql.DB, dedup bool) error {
+	if dedup {
+		return optimizeDedupLayout(db)
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	for _, statement := range []string{
+		"create table tiles_sorted (zoom_level integer, tile_column integer, tile_row integer, tile_data blob);",
+		"insert into tiles_sorted select zoom_level, tile_column, tile_row, tile_data from tiles order by zoom_level, tile_column, tile_row;",
+		"drop table tiles;",
+		"alter table tiles_sorted rename to tiles;",
+		"create unique index tile_index on tiles (zoom_level, tile_column, tile_row);",
+	} {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// optimizeDedupLayout rebuilds the map table in pmtilesTileId order, zoom
+// level by zoom level along the Hilbert curve. SQLite can't compute the
+// curve, so the rows are sorted here. The indexes map had are recreated;
+// -compact, which drops them, can't be combined with -optimize-layout.
+func optimizeDedupLayout(db *sql.DB) error {
+	err := addInlineColumn(db)
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query("select zoom_level, tile_column, tile_row from map;")
+	if err != nil {
+		return err
+	}
+	var mapRows []Tile
+	for rows.Next() {
+		var row Tile
+		err = rows.Scan(&row.z, &row.x, &row.y)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		mapRows = append(mapRows, row)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	sort.Slice(mapRows, func(i, j int) bool {
+		a, b := mapRows[i], mapRows[j]
+		return pmtilesTileId(a.z, a.x, a.flipped_y()) < pmtilesTileId(b.z, b.x, b.flipped_y())
+	})
+	// The indexes go with the old table, map_tile_id of -dedupe-threshold
+	// included, so they are created again on the new one.
+	indexes, err := tableIndexes(db, "map")
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// The view goes while map is replaced, renaming checks it.
+	_, err = tx.Exec("drop view tiles;")
+	if err == nil {
+		_, err = tx.Exec("create table map_sorted (zoom_level integer, tile_column integer, tile_row integer, tile_id text, tile_data blob);")
+	}
+	for _, row := range mapRows {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("insert into map_sorted select zoom_level, tile_column, tile_row, tile_id, tile_data from map where zoom_level = ? and tile_column = ? and tile_row = ?;", row.z, row.x, row.y)
+	}
+	statements := []string{"drop table map;", "alter table map_sorted rename to map;"}
+	statements = append(statements, indexes...)
+	statements = append(statements, "create unique index if not exists map_index on map (zoom_level, tile_column, tile_row);", DEDUP_TILES_VIEW)
+	for _, statement := range statements {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(statement)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// tableIndexes returns the statements creating the indexes of table.
+func tableIndexes(db *sql.DB, table string) ([]string, error) {
+	rows, err := db.Query("select sql from sqlite_master where type = 'index' and tbl_name = ? and sql is not null;", table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var statements []string
+	for rows.Next() {
+		var statement string
+		err = rows.Scan(&statement)
+		if err != nil {
+			return nil, err
+		}
+		statements = append(statements, statement)
+	}
+	return statements, rows.Err()
+}
+
+// hilbertIndex returns the position of the XYZ tile along a Hilbert curve
+// through the tiles of zoom z.
+func hilbertIndex(z, x, y int) uint64 {
+	var index uint64
+	ux, uy := uint64(x), uint64(y)
+	for s := uint64(1) << uint(z) >> 1; s > 0; s >>= 1 {
+		var rx, ry uint64
+		if ux&s > 0 {
+			rx = 1
+		}
+		if uy&s > 0 {
+			ry = 1
+		}
+		index += s * s * ((3 * rx) ^ ry)
+		// Rotate the quadrant so the curve stays continuous.
+		if ry == 0 {
+			if rx == 1 {
+				ux = s - 1 - ux
+				uy = s - 1 - uy
+			}
+			ux, uy = uy, ux
+		}
+	}
+	return index
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func TestHilbertIndex(t *testing.T) {
+	for _, test := range []struct {
+		z, x, y int
+		index   uint64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 0}, {1, 0, 1, 1}, {1, 1, 1, 2}, {1, 1, 0, 3},
+		{2, 0, 0, 0}, {2, 1, 0, 1}, {2, 0, 3, 5}, {2, 3, 3, 10}, {2, 3, 0, 15},
+		{3, 7, 0, 63},
+		{8, 100, 200, 28272},
+		{16, 12345, 54321, 1555040834},
+	} {
+		if index := hilbertIndex(test.z, test.x, test.y); index != test.index {
+			t.Errorf("tile %d/%d/%d at %d, want %d", test.z, test.x, test.y, index, test.index)
+		}
+	}
+	// The curve visits every tile of a zoom level once, each next to the
+	// one before.
+	const z = 5
+	visited := make([][2]int, 1<<(2*z))
+	seen := make(map[uint64]bool)
+	for x := 0; x < 1<<z; x++ {
+		for y := 0; y < 1<<z; y++ {
+			index := hilbertIndex(z, x, y)
+			if seen[index] || index >= uint64(len(visited)) {
+				t.Fatalf("tile %d/%d/%d at %d, already taken or past the end", z, x, y, index)
+			}
+			seen[index] = true
+			visited[index] = [2]int{x, y}
+		}
+	}
+	for i := 1; i < len(visited); i++ {
+		dx, dy := visited[i][0]-visited[i-1][0], visited[i][1]-visited[i-1][1]
+		if dx*dx+dy*dy != 1 {
+			t.Fatalf("step %d jumps from %v to %v", i, visited[i-1], visited[i])
+		}
+	}
+}
+
+func TestOptimizeDedupLayout(t *testing.T) {
+	db, err := prepareDatabase(filepath.Join(t.TempDir(), "dedup.mbtiles"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = createDedupSchema(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hasher, err := newHasher("md5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Stored column by column, and half of them the same tile.
+	for z := 1; z <= 3; z++ {
+		for x := 0; x < 1<<uint(z); x++ {
+			for y := 0; y < 1<<uint(z); y++ {
+				content := []byte(fmt.Sprintf("tile %d/%d/%d", z, x, y))
+				if y%2 == 0 {
+					content = []byte("shared")
+				}
+				err = storeTile(Tile{z: z, x: x, y: y, Content: content}, db, WriterOptions{Hasher: hasher})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+	_, err = db.Exec("create index map_tile_id on map (tile_id);")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = optimizeLayout(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexes int
+	err = db.QueryRow("select count(*) from sqlite_master where type = 'index' and tbl_name = 'map' and name in ('map_index', 'map_tile_id');").Scan(&indexes)
+	if err != nil || indexes != 2 {
+		t.Errorf("%d of the map indexes left after the rebuild, %v", indexes, err)
+	}
+
+	rows, err := db.Query("select zoom_level, tile_column, tile_row from map order by rowid;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var lastId uint64
+	count := 0
+	for rows.Next() {
+		var tile Tile
+		err = rows.Scan(&tile.z, &tile.x, &tile.y)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := pmtilesTileId(tile.z, tile.x, tile.flipped_y())
+		if count > 0 && id <= lastId {
+			t.Fatalf("row %d/%d/%d is out of Hilbert order", tile.z, tile.x, tile.y)
+		}
+		lastId = id
+		count++
+	}
+	if count != 4+16+64 {
+		t.Errorf("%d rows in map after the rebuild", count)
+	}
+	var content []byte
+	tile := Tile{z: 3, x: 5, y: 3}
+	err = db.QueryRow("select tile_data from tiles where zoom_level = ? and tile_column = ? and tile_row = ?;", tile.z, tile.x, tile.flipped_y()).Scan(&content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(content, []byte("tile 3/5/3")) {
+		t.Errorf("tile 3/5/3 read back as %q", content)
+	}
+}
+
+// benchmarkWindowReads reads 5x5 windows across the 64x64 tiles of zoom 6,
+// stored in a random order as -shuffle does, with a one page cache.
+func benchmarkWindowReads(b *testing.B, optimize bool) {
+	db, err := prepareDatabase(filepath.Join(b.TempDir(), "windows.mbtiles"), false)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer db.Close()
+	if err = createMBTileSchema(db); err != nil {
+		b.Fatal(err)
+	}
+	var tiles []Tile
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			tiles = append(tiles, Tile{z: 6, x: x, y: y, Content: bytes.Repeat([]byte{byte(x ^ y)}, 1024)})
+		}
+	}
+	shuffleTiles(tiles, rand.New(rand.NewSource(DETERMINISTIC_SEED)))
+	for _, tile := range tiles {
+		if err = storeTile(tile, db, WriterOptions{}); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if optimize {
+		if err = optimizeLayout(db, false); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err = optimizeDatabase(db); err != nil {
+		b.Fatal(err)
+	}
+	if _, err = db.Exec("PRAGMA cache_size=1;"); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		read := 0
+		for x := 0; x < 64; x += 5 {
+			for y := 0; y < 64; y += 5 {
+				rows, err := db.Query("select tile_data from tiles where zoom_level = 6 and tile_column between ? and ? and tile_row between ? and ?;", x, x+4, y, y+4)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for rows.Next() {
+					var content []byte
+					if err = rows.Scan(&content); err != nil {
+						b.Fatal(err)
+					}
+					read++
+				}
+				rows.Close()
+			}
+		}
+		if read != len(tiles) {
+			b.Fatalf("read %d of %d tiles", read, len(tiles))
+		}
+	}
+}
+
+func BenchmarkWindowReadsShuffled(b *testing.B)       { benchmarkWindowReads(b, false) }
+func BenchmarkWindowReadsOptimizeLayout(b *testing.B) { benchmarkWindowReads(b, true) }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"time"
+)
+
+// LIVE_METADATA_INTERVAL is how often -live-metadata writes the extent of
+// the tiles stored so far, often enough for a viewer to follow along
+// without competing with the tile writes.
+const LIVE_METADATA_INTERVAL = 3 * time.Second
+
+// LIVE_METADATA_KEYS are the metadata values -live-metadata updates during
+// the download and restores at the end.
+var LIVE_METADATA_KEYS = []string{"bounds", "center", "minzoom", "maxzoom"}
+
+// liveMetadata writes the file in WAL mode, so it can be read while tiles
+// are being added, and keeps its extent metadata up to date. Set with
+// -live-metadata.
+var liveMetadata bool
+
+// extentTracker follows the extent of the stored tiles: the zoom levels,
+// and the area covered by the highest zoom level so far within the
+// requested bounds. Lower zooms are left out of the area, their tiles
+// reach far past the bounds.
+type extentTracker struct {
+	seen                   bool
+	minZoom, maxZoom       int
+	xmin, ymin, xmax, ymax float64
+	flushed                time.Time
+}
+
+func newExtentTracker() *extentTracker {
+	return &extentTracker{flushed: time.Now()}
+}
+
+func (extent *extentTracker) Add(proj *Projection, tile Tile) {
+	xmin, ymin, xmax, ymax := proj.TileBounds(tile.z, tile.x, tile.y)
+	xmin, ymin = math.Max(xmin, proj.xmin), math.Max(ymin, proj.ymin)
+	xmax, ymax = math.Min(xmax, proj.xmax), math.Min(ymax, proj.ymax)
+	if !extent.seen || tile.z > extent.maxZoom {
+		if !extent.seen {
+			extent.minZoom = tile.z
+		}
+		extent.seen = true
+		extent.maxZoom = tile.z
+		extent.xmin, extent.ymin, extent.xmax, extent.ymax = xmin, ymin, xmax, ymax
+		return
+	}
+	if tile.z < extent.minZoom {
+		extent.minZoom = tile.z
+	}
+	if tile.z == extent.maxZoom {
+		extent.xmin, extent.ymin = math.Min(extent.xmin, xmin), math.Min(extent.ymin, ymin)
+		extent.xmax, extent.ymax = math.Max(extent.xmax, xmax), math.Max(extent.ymax, ymax)
+	}
+}
+
+// Flush writes the extent so far, at most once per LIVE_METADATA_INTERVAL.
+func (extent *extentTracker) Flush(db *sql.DB) error {
+	if !extent.seen || time.Since(extent.flushed) < LIVE_METADATA_INTERVAL {
+		return nil
+	}
+	extent.flushed = time.Now()
+	values := map[string]string{
+		"bounds":  fmt.Sprintf("%f,%f,%f,%f", extent.xmin, extent.ymin, extent.xmax, extent.ymax),
+		"center":  fmt.Sprintf("%f,%f,%d", (extent.xmin+extent.xmax)/2, (extent.ymin+extent.ymax)/2, extent.minZoom),
+		"minzoom": strconv.Itoa(extent.minZoom),
+		"maxzoom": strconv.Itoa(extent.maxZoom),
+	}
+	for name, value := range values {
+		_, err := db.Exec("insert or replace into metadata (name, value) values (?, ?);", name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restoreLiveMetadata puts back the LIVE_METADATA_KEYS as they were before
+// the download and takes the file out of WAL mode, so it is a single file
+// again.
+func restoreLiveMetadata(db *sql.DB, before map[string]string) error {
+	for _, name := range LIVE_METADATA_KEYS {
+		var err error
+		if value, ok := before[name]; ok {
+			_, err = db.Exec("insert or replace into metadata (name, value) values (?, ?);", name, value)
+		} else {
+			_, err = db.Exec("delete from metadata where name = ?;", name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec("PRAGMA journal_mode=DELETE")
+	if err != nil {
+		log.Println("Leaving the file in WAL mode, it is still open elsewhere:", err)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestLiveMetadataExtent(t *testing.T) {
+	db, _ := newTestMBTiles(t, map[string]string{"format": "png", "bounds": "-180,-85,180,85", "maxzoom": "12"})
+	before, err := readMetadata(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proj := NewProjection(-122.52, 37.70, -122.35, 37.83, 10, 12, nil, 0)
+	extent := newExtentTracker()
+	// Mid-run: all of zoom 10 and the first column of zoom 11.
+	x0, _, _, _ := proj.tileRange(proj.xmin, proj.ymin, proj.xmax, proj.ymax, 11)
+	for _, tile := range proj.TileList() {
+		if tile.z == 10 || (tile.z == 11 && tile.x == x0) {
+			extent.Add(proj, tile)
+		}
+	}
+	extent.flushed = time.Now().Add(-LIVE_METADATA_INTERVAL)
+	err = extent.Flush(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := readMetadata(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, columnEast, _ := proj.TileBounds(11, x0, 0)
+	if want := fmt.Sprintf("%f,%f,%f,%f", proj.xmin, proj.ymin, columnEast, proj.ymax); metadata["bounds"] != want {
+		t.Errorf("bounds %q mid-run, want the first column %q", metadata["bounds"], want)
+	}
+	if metadata["minzoom"] != "10" || metadata["maxzoom"] != "11" {
+		t.Errorf("zoom levels %s-%s mid-run, want 10-11", metadata["minzoom"], metadata["maxzoom"])
+	}
+
+	// Flushed again only after LIVE_METADATA_INTERVAL.
+	extent.Add(proj, Tile{z: 12, x: 655, y: 1582})
+	err = extent.Flush(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata, _ := readMetadata(db); metadata["maxzoom"] != "11" {
+		t.Errorf("maxzoom %s right after a flush", metadata["maxzoom"])
+	}
+
+	err = restoreLiveMetadata(db, before)
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err = readMetadata(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["bounds"] != "-180,-85,180,85" || metadata["maxzoom"] != "12" {
+		t.Errorf("metadata %v after the download", metadata)
+	}
+	if _, ok := metadata["center"]; ok {
+		t.Error("center was left behind")
+	}
+}
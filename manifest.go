@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const MANIFEST_SUFFIX = ".manifest"
+const MANIFEST_SYNC_EVERY = 100
+
+// Manifest is an append-only log next to the output file recording every tile
+// a run has to fetch ("tile z/x/y") and every tile it has stored
+// ("done z/x/y"). A resumed run fetches the tiles that were never marked
+// done, regardless of what made it into the tiles table.
+type Manifest struct {
+	file     *os.File
+	unsynced int
+}
+
+func manifestPath(filename string) string {
+	return filename + MANIFEST_SUFFIX
+}
+
+// createManifest starts a new manifest listing tiles, synced to disk before
+// any of them are downloaded.
+func createManifest(filename string, tiles []Tile) (*Manifest, error) {
+	file, err := os.Create(manifestPath(filename))
+	if err != nil {
+		return nil, err
+	}
+	writer := bufio.NewWriter(file)
+	for _, tile := range tiles {
+		fmt.Fprintln(writer, "tile", tile)
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &Manifest{file: file}, nil
+}
+
+// openManifest reopens the manifest of an interrupted run and returns the
+// tiles that are not done yet. A last line without its newline was cut
+// short by a crash and is dropped from the file: "done 12/345/67" cut to
+// "done 12/345/6" would name another tile.
+func openManifest(filename string) (*Manifest, []Tile, error) {
+	file, err := os.OpenFile(manifestPath(filename), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var tiles []Tile
+	done := make(map[[3]int]bool)
+	reader := bufio.NewReader(file)
+	var complete int64
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			if line != "" {
+				err = file.Truncate(complete)
+				if err != nil {
+					file.Close()
+					return nil, nil, err
+				}
+			}
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, nil, err
+		}
+		complete += int64(len(line))
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+		tile, err := parseTileCoord(fields[1])
+		if err != nil {
+			continue
+		}
+		switch fields[0] {
+		case "tile":
+			tiles = append(tiles, tile)
+		case "done":
+			done[[3]int{tile.z, tile.x, tile.y}] = true
+		}
+	}
+	return &Manifest{file: file}, skipExistingTiles(tiles, done), nil
+}
+
+// MarkDone records that tile is stored. The manifest is synced every
+// MANIFEST_SYNC_EVERY tiles, so a crash loses at most that many entries, and
+// those tiles are simply fetched again.
+func (manifest *Manifest) MarkDone(tile Tile) error {
+	_, err := fmt.Fprintln(manifest.file, "done", tile)
+	if err != nil {
+		return err
+	}
+	manifest.unsynced++
+	if manifest.unsynced >= MANIFEST_SYNC_EVERY {
+		manifest.unsynced = 0
+		return manifest.file.Sync()
+	}
+	return nil
+}
+
+func (manifest *Manifest) Close() error {
+	err := manifest.file.Sync()
+	closeErr := manifest.file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// Remove deletes the manifest once every tile is stored.
+func (manifest *Manifest) Remove() error {
+	manifest.Close()
+	return os.Remove(manifest.file.Name())
+}
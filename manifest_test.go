@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestManifestResume(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "out.mbtiles")
+	tiles := []Tile{{z: 1, x: 0, y: 0}, {z: 1, x: 1, y: 0}, {z: 1, x: 1, y: 1}}
+	manifest, err := createManifest(filename, tiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = manifest.MarkDone(tiles[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Close()
+
+	manifest, remaining, err := openManifest(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifest.Close()
+	if want := []Tile{tiles[0], tiles[2]}; !reflect.DeepEqual(remaining, want) {
+		t.Errorf("remaining %v, want %v", remaining, want)
+	}
+}
+
+func TestManifestTruncatedLine(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "out.mbtiles")
+	short, long := Tile{z: 12, x: 345, y: 6}, Tile{z: 12, x: 345, y: 67}
+	manifest, err := createManifest(filename, []Tile{short, long})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Close()
+	// A crash while "done 12/345/67" was written.
+	file, err := os.OpenFile(manifestPath(filename), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("done 12/345/6")
+	file.Close()
+
+	manifest, remaining, err := openManifest(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []Tile{short, long}; !reflect.DeepEqual(remaining, want) {
+		t.Fatalf("remaining %v, want %v: the cut line marked a tile done", remaining, want)
+	}
+	// Entries after the cut line are read back whole.
+	err = manifest.MarkDone(long)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest.Close()
+	manifest, remaining, err = openManifest(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer manifest.Close()
+	if want := []Tile{short}; !reflect.DeepEqual(remaining, want) {
+		t.Errorf("remaining after the next run %v, want %v", remaining, want)
+	}
+}
+
+func TestInterruptedRunIsIncomplete(t *testing.T) {
+	db, filename := newTestMBTiles(t, map[string]string{"format": "png"})
+	tiles := []Tile{{z: 1, x: 0, y: 0}, {z: 1, x: 1, y: 0}}
+	manifest, err := createManifest(filename, tiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = setIncomplete(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestTile(t, db, 1, 0, 0, []byte("tile"))
+	// Killed before the second tile.
+	manifest.Close()
+	db.Close()
+	if !isIncomplete(filename) {
+		t.Fatal("an interrupted run wasn't detected")
+	}
+	// The metadata flag is enough when the manifest is lost.
+	err = os.Remove(manifestPath(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isIncomplete(filename) {
+		t.Fatal("the incomplete flag wasn't left set")
+	}
+
+	db, err = prepareDatabase(filename, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addTestTile(t, db, 1, 1, 0, []byte("tile"))
+	err = setIncomplete(db, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+	if isIncomplete(filename) {
+		t.Error("a finished run was taken for an interrupted one")
+	}
+}
@@ -1,21 +1,36 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/mattn/go-sqlite3"
 	"github.com/satori/go.uuid"
+	"io"
 	"io/ioutil"
 	"log"
 	"math"
+	"math/rand"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"runtime"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 const VERSION = "0.2.2"
 const DEG_TO_RAD = math.Pi / 180
@@ -23,18 +38,74 @@ const RAD_TO_DEG = 180 / math.Pi
 const MAX_LATITUDE = 85.0511287798
 const DEFAULT_TILE_SIZE = 256
 const MAX_ZOOM_LEVEL = 17
+const MAX_ZOOM_LEVEL_LIMIT = 30
 const PNG_IMAGE_FORMAT = "image/png"
 const JPG_IMAGE_FORMAT = "image/jpg"
+const WEBP_IMAGE_FORMAT = "image/webp"
+const PBF_FORMAT = "application/x-protobuf"
 const JPG_EXTENSION = "jpg"
 const PNG_EXTENSION = "png"
+const WEBP_EXTENSION = "webp"
+const PBF_EXTENSION = "pbf"
 const MBTILE_VERSION = "1.2"
+const DEFAULT_MAX_REDIRECTS = 5
+const DEFAULT_RETRIES = 3
+const RETRY_BACKOFF = 500 * time.Millisecond
+const DEFAULT_FAILURE_WINDOW = 50
+const DEFAULT_CACHE_TTL = 24 * time.Hour
+const DEFAULT_WORKERS = 20
+const DEFAULT_MIN_TILE_BYTES = 100
+const DETERMINISTIC_SEED = 1
+const DEFAULT_ATTEMPT_TIMEOUT = 30 * time.Second
+const DEFAULT_USER_AGENT = "MBTile_Bot/0.1"
+const DEFAULT_BUSY_TIMEOUT = 5 * time.Second
+const DB_BUSY_RETRIES = 5
+const DB_BUSY_BACKOFF = 100 * time.Millisecond
+const AUTO_VACUUM_INCREMENTAL = 2
+const MIN_PAGE_SIZE = 512
+const MAX_PAGE_SIZE = 65536
+const POLITE_USER_AGENT = "mbtilego/" + VERSION + " (+https://github.com/ragsagar/mbtilego)"
+const STDOUT_FILENAME = "-"
+const INCOMPLETE_KEY = "incomplete"
+const DEFAULT_SUBDOMAINS = "abc"
+const DEM_ENCODING_MAPBOX = "mapbox"
+const DEM_ENCODING_TERRARIUM = "terrarium"
 
-var MAPTYPES = []string{"http://mt2.google.com/vt/lyrs=y&x={x}&y={y}&z={z}", "http://tile.openstreetmap.org/{z}/{x}/{y}.png", "http://api.mapbox.com/v4/mapbox.satellite/{z}/{x}/{y}.png?access_token=pk.eyJ1IjoiYWVyb3Zpc2lvbmtlc3RyZWwiLCJhIjoiY2l5bDhzYTVqMDAxNDJ3bGp1ZHA2cmtiaCJ9.8o3pqTWKiOV8RhjNGFW0rg"}
-var MAP_IMAGE_TYPES = []string{JPG_IMAGE_FORMAT, PNG_IMAGE_FORMAT, PNG_IMAGE_FORMAT}
+// MapSource is a built-in tile source selected with -maptype.
+type MapSource struct {
+	Name        string
+	URLTemplate string
+	Format      string
+	// MaxWorkers and MaxRate are the most the provider's usage policy
+	// allows, 0 when it sets no limit. They also apply to a -url on the
+	// same host.
+	MaxWorkers int
+	MaxRate    float64
+	PolicyUrl  string
+}
+
+var MAPTYPES = []MapSource{
+	{Name: "Google satellite", URLTemplate: "http://mt2.google.com/vt/lyrs=y&x={x}&y={y}&z={z}", Format: JPG_IMAGE_FORMAT},
+	{Name: "OpenStreetMap", URLTemplate: "http://tile.openstreetmap.org/{z}/{x}/{y}.png", Format: PNG_IMAGE_FORMAT,
+		MaxWorkers: 2, MaxRate: 2, PolicyUrl: "https://operations.osmfoundation.org/policies/tiles/"},
+	{Name: "Mapbox satellite street", URLTemplate: "http://api.mapbox.com/v4/mapbox.satellite/{z}/{x}/{y}.png?access_token={token}", Format: PNG_IMAGE_FORMAT},
+}
 
 type Tile struct {
 	z, x, y int
 	Content []byte
+	// Overlay is the tile of the -overlay-url source, composited over
+	// Content by the writer.
+	Overlay []byte
+	// NotModified marks a tile that hasn't changed since -update-since and
+	// is passed through without being stored.
+	NotModified bool
+	// Skipped marks a tile a TileProcessor left out of the file.
+	Skipped bool
+}
+
+func (tile Tile) String() string {
+	return fmt.Sprintf("%d/%d/%d", tile.z, tile.x, tile.y)
 }
 
 func (tile *Tile) flipped_y() int {
@@ -42,17 +113,278 @@ func (tile *Tile) flipped_y() int {
 	return int(two_power_zoom) - 1 - tile.y
 }
 
-func mbTileWorker(db *sql.DB, tilePipe chan Tile, outputPipe chan Tile) {
-	for {
-		tile := <-tilePipe
-		err := addToMBTile(tile, db)
+// parseTileCoord parses a "z/x/y" string into a tile.
+func parseTileCoord(coord string) (Tile, error) {
+	parts := strings.Split(strings.TrimSpace(coord), "/")
+	if len(parts) != 3 {
+		return Tile{}, fmt.Errorf("invalid tile %q, expected z/x/y", coord)
+	}
+	var zxy [3]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return Tile{}, fmt.Errorf("invalid tile %q, expected z/x/y", coord)
+		}
+		zxy[i] = n
+	}
+	return newTileAt(zxy[0], zxy[1], zxy[2])
+}
+
+// newTileAt returns a tile for the given XYZ coordinate after checking that it
+// exists at that zoom level.
+func newTileAt(z, x, y int) (Tile, error) {
+	if z < 0 || z > MAX_ZOOM_LEVEL_LIMIT {
+		return Tile{}, fmt.Errorf("invalid tile %d/%d/%d, zoom out of range", z, x, y)
+	}
+	two_power_zoom := 1 << uint(z)
+	if x < 0 || x >= two_power_zoom || y < 0 || y >= two_power_zoom {
+		return Tile{}, fmt.Errorf("invalid tile %d/%d/%d, coordinate out of range", z, x, y)
+	}
+	return Tile{z: z, x: x, y: y}, nil
+}
+
+// readTileList reads the tiles to download from filename. The file either has
+// one "z/x/y" per line (blank lines and lines starting with # are ignored) or
+// is a JSON array of [z, x, y] triples. Coordinates are XYZ; the TMS flip is
+// applied when the tile is written.
+func readTileList(filename string) ([]Tile, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var tiles []Tile
+	if bytes.HasPrefix(bytes.TrimSpace(content), []byte("[")) {
+		var coords [][]int
+		err = json.Unmarshal(content, &coords)
+		if err != nil {
+			return nil, err
+		}
+		for _, coord := range coords {
+			if len(coord) != 3 {
+				return nil, errors.New("tile list entries must be [z, x, y]")
+			}
+			tile, err := newTileAt(coord[0], coord[1], coord[2])
+			if err != nil {
+				return nil, err
+			}
+			tiles = append(tiles, tile)
+		}
+		return tiles, nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		tile, err := parseTileCoord(line)
+		if err != nil {
+			return nil, err
+		}
+		tiles = append(tiles, tile)
+	}
+	return tiles, scanner.Err()
+}
+
+// zoomRange returns the lowest and highest zoom level present in tiles.
+func zoomRange(tiles []Tile) (int, int) {
+	minZoom, maxZoom := tiles[0].z, tiles[0].z
+	for _, tile := range tiles {
+		if tile.z < minZoom {
+			minZoom = tile.z
+		}
+		if tile.z > maxZoom {
+			maxZoom = tile.z
+		}
+	}
+	return minZoom, maxZoom
+}
+
+// WriterOptions controls how fetched tiles are stored.
+type WriterOptions struct {
+	// With DetectFormat the bytes of the first tile are checked against
+	// DeclaredFormat, and the format metadata is corrected if they differ.
+	DetectFormat   bool
+	DeclaredFormat string
+	// Compression, when set, compresses the tile bytes, see COMPRESSION_KEY.
+	Compression string
+	// Overwrite replaces tiles already stored at the same coordinate, which
+	// a resumed run may fetch again.
+	Overwrite bool
+	// SkipExisting keeps the tile already stored at a coordinate, so
+	// appending an overlapping area doesn't fail.
+	SkipExisting bool
+	// Stats receives the size of every stored tile.
+	Stats *Stats
+	// Hasher, when set, stores the tiles in the deduplicated layout.
+	Hasher Hasher
+	// Inline, when set, keeps rare tiles in map instead of images.
+	Inline *inlineCounter
+	// Processors run on every tile before it is stored.
+	Processors []TileProcessor
+	// TileDir, when set, gets the tile bytes as files and tile_data their
+	// paths, see TILE_FILES_KEY.
+	TileDir string
+	// StoreHashes records the hash of every tile in tile_hashes.
+	StoreHashes bool
+}
+
+func mbTileWorker(db *sql.DB, tilePipe chan Tile, outputPipe chan Tile, errorPipe chan TileError, options WriterOptions) {
+	detectFormat := options.DetectFormat
+	for tile := range tilePipe {
+		if tile.NotModified {
+			outputPipe <- tile
+			continue
+		}
+		prepared, err := prepareTile(tile, options)
+		if err == errSkipTile {
+			tile.Skipped = true
+			outputPipe <- tile
+			continue
+		}
+		if err != nil {
+			errorPipe <- TileError{Tile: tile, Err: err}
+			continue
+		}
+		tile = prepared
+		err = writeTile(tile, db, options)
+		if _, ok := err.(*tilePanic); ok {
+			errorPipe <- TileError{Tile: tile, Err: err}
+			continue
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
+		options.Stats.AddRawBytes(len(tile.Content))
+		if detectFormat {
+			detectFormat = false
+			err = fixFormatMetadata(db, tile, options.DeclaredFormat)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 		outputPipe <- tile
 	}
 }
 
+// prepareTile draws the overlay onto tile and runs the processors on it.
+func prepareTile(tile Tile, options WriterOptions) (prepared Tile, err error) {
+	defer recoverTile(tile, &err)
+	if tile.Overlay != nil {
+		content, err := compositeTile(tile.Content, tile.Overlay)
+		if err != nil {
+			return tile, err
+		}
+		tile.Content, tile.Overlay = content, nil
+	}
+	if len(options.Processors) > 0 {
+		return processTile(tile, options.Processors)
+	}
+	return tile, nil
+}
+
+// writeTile stores tile, waiting for the database if it is busy.
+func writeTile(tile Tile, db *sql.DB, options WriterOptions) (err error) {
+	defer recoverTile(tile, &err)
+	return retryWhileBusy(func() error {
+		return storeTile(tile, db, options)
+	})
+}
+
+func storeTile(tile Tile, db *sql.DB, options WriterOptions) error {
+	// Hashes are of the tile bytes, whatever the layout.
+	if options.StoreHashes {
+		err := storeTileHash(tile, db, options.SkipExisting && !options.Overwrite)
+		if err != nil {
+			return err
+		}
+	}
+	if options.Compression != "" {
+		content, err := compressTile(tile.Content, options.Compression)
+		if err != nil {
+			return err
+		}
+		tile.Content = content
+	}
+	if options.TileDir != "" {
+		relative, err := writeTileFile(options.TileDir, tile, options.DeclaredFormat)
+		if err != nil {
+			return err
+		}
+		tile.Content = []byte(relative)
+	}
+	if options.Hasher != nil {
+		verb := "insert"
+		if options.Overwrite {
+			verb = "insert or replace"
+		} else if options.SkipExisting {
+			verb = "insert or ignore"
+		}
+		return storeDedupTile(tile, db, options.Hasher, options.Inline, verb)
+	}
+	if options.Overwrite {
+		return replaceInMBTile(tile, db)
+	} else if options.SkipExisting {
+		return addMissingToMBTile(tile, db)
+	}
+	return addToMBTile(tile, db)
+}
+
+// retryWhileBusy runs write again, with a growing pause, for as long as it
+// fails because the database is locked. Networked filesystems and virus
+// scanners can hold the file for a moment even though we lock it
+// exclusively.
+func retryWhileBusy(write func() error) error {
+	pause := DB_BUSY_BACKOFF
+	err := write()
+	for attempt := 0; attempt < DB_BUSY_RETRIES && isBusy(err); attempt++ {
+		log.Println("Database is locked, retrying in", pause)
+		time.Sleep(pause)
+		pause *= 2
+		err = write()
+	}
+	return err
+}
+
+func isBusy(err error) bool {
+	if sqliteErr, ok := err.(sqlite3.Error); ok {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
+
+// fixFormatMetadata sniffs the format of tile and, if it is not the declared
+// one, rewrites the format metadata to match what the source really serves.
+func fixFormatMetadata(db *sql.DB, tile Tile, declaredFormat string) error {
+	actualFormat := sniffTileFormat(tile.Content)
+	if actualFormat == "" || actualFormat == declaredFormat {
+		return nil
+	}
+	log.Printf("Warning: tile %s is %s but the source is declared as %s, storing format %s", tile, actualFormat, declaredFormat, extensionForFormat(actualFormat))
+	_, err := db.Exec("update metadata set value = ? where name = 'format';", extensionForFormat(actualFormat))
+	return err
+}
+
+// sniffTileFormat returns the format of a tile from its leading bytes, or ""
+// if it isn't recognised.
+func sniffTileFormat(content []byte) string {
+	switch {
+	case bytes.HasPrefix(content, []byte("\x89PNG\r\n\x1a\n")):
+		return PNG_IMAGE_FORMAT
+	case bytes.HasPrefix(content, []byte{0xff, 0xd8, 0xff}):
+		return JPG_IMAGE_FORMAT
+	case len(content) >= 12 && bytes.Equal(content[0:4], []byte("RIFF")) && bytes.Equal(content[8:12], []byte("WEBP")):
+		return WEBP_IMAGE_FORMAT
+	case bytes.HasPrefix(content, []byte{0x1f, 0x8b}), bytes.HasPrefix(content, []byte{0x1a}):
+		// Vector tiles are usually gzipped; uncompressed ones start with
+		// the tag of the repeated layers field.
+		return PBF_FORMAT
+	}
+	return ""
+}
+
 func addToMBTile(tile Tile, db *sql.DB) error {
 	_, err := db.Exec("insert into tiles (zoom_level, tile_column, tile_row, tile_data) values (?, ?, ?, ?);", tile.z, tile.x, tile.flipped_y(), tile.Content)
 	if err != nil {
@@ -61,218 +393,2254 @@ func addToMBTile(tile Tile, db *sql.DB) error {
 	return nil
 }
 
-func tileFetcher(inputPipe chan Tile, tilePipe chan Tile, maptype int) {
-	url_format := MAPTYPES[maptype]
-	for {
-		tile := <-inputPipe
-		tileObj := fetchTile(tile.z, tile.x, tile.y, url_format)
+// replaceInMBTile stores the tile, overwriting any tile already stored at the
+// same coordinate.
+func replaceInMBTile(tile Tile, db sqlExecer) error {
+	_, err := db.Exec("insert or replace into tiles (zoom_level, tile_column, tile_row, tile_data) values (?, ?, ?, ?);", tile.z, tile.x, tile.flipped_y(), tile.Content)
+	return err
+}
+
+// addMissingToMBTile stores the tile unless one is already stored at the same
+// coordinate.
+func addMissingToMBTile(tile Tile, db *sql.DB) error {
+	_, err := db.Exec("insert or ignore into tiles (zoom_level, tile_column, tile_row, tile_data) values (?, ?, ?, ?);", tile.z, tile.x, tile.flipped_y(), tile.Content)
+	return err
+}
+
+// mergeExtentMetadata widens the bounds, minzoom and maxzoom metadata of an
+// existing file to also cover the ones in items.
+func mergeExtentMetadata(db *sql.DB, items map[string]string) error {
+	metadata, err := readMetadata(db)
+	if err != nil {
+		return err
+	}
+	merged := map[string]string{
+		"bounds":  items["bounds"],
+		"minzoom": items["minzoom"],
+		"maxzoom": items["maxzoom"],
+	}
+	bounds, err := parseBounds(items["bounds"])
+	if err != nil {
+		return err
+	}
+	minZoom, err := strconv.Atoi(items["minzoom"])
+	if err != nil {
+		return fmt.Errorf("invalid minzoom %q", items["minzoom"])
+	}
+	maxZoom, err := strconv.Atoi(items["maxzoom"])
+	if err != nil {
+		return fmt.Errorf("invalid maxzoom %q", items["maxzoom"])
+	}
+	// An existing value that doesn't parse is replaced.
+	if old, err := parseBounds(metadata["bounds"]); err == nil {
+		merged["bounds"] = fmt.Sprintf("%f,%f,%f,%f", math.Min(old[0], bounds[0]), math.Min(old[1], bounds[1]), math.Max(old[2], bounds[2]), math.Max(old[3], bounds[3]))
+	}
+	if old, err := strconv.Atoi(metadata["minzoom"]); err == nil {
+		merged["minzoom"] = strconv.Itoa(int(math.Min(float64(old), float64(minZoom))))
+	}
+	if old, err := strconv.Atoi(metadata["maxzoom"]); err == nil {
+		merged["maxzoom"] = strconv.Itoa(int(math.Max(float64(old), float64(maxZoom))))
+	}
+	for name, value := range merged {
+		_, err = db.Exec("delete from metadata where name = ?;", name)
+		if err != nil {
+			return err
+		}
+		_, err = db.Exec("insert into metadata (name, value) values (?, ?);", name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseBounds parses a "xmin,ymin,xmax,ymax" bounds metadata value.
+func parseBounds(value string) ([4]float64, error) {
+	var bounds [4]float64
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		return bounds, fmt.Errorf("invalid bounds %q", value)
+	}
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return bounds, fmt.Errorf("invalid bounds %q", value)
+		}
+		bounds[i] = n
+	}
+	return bounds, nil
+}
+
+// readTileCoords returns the XYZ coordinates of every stored tile.
+func readTileCoords(db *sql.DB) (map[[3]int]bool, error) {
+	rows, err := db.Query("select zoom_level, tile_column, tile_row from tiles;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	coords := make(map[[3]int]bool)
+	for rows.Next() {
+		tile := Tile{}
+		err = rows.Scan(&tile.z, &tile.x, &tile.y)
+		if err != nil {
+			return nil, err
+		}
+		coords[[3]int{tile.z, tile.x, tile.flipped_y()}] = true
+	}
+	return coords, rows.Err()
+}
+
+func skipExistingTiles(tiles []Tile, existing map[[3]int]bool) []Tile {
+	var remaining []Tile
+	for _, tile := range tiles {
+		if !existing[[3]int{tile.z, tile.x, tile.y}] {
+			remaining = append(remaining, tile)
+		}
+	}
+	return remaining
+}
+
+// shuffleTiles puts tiles in a random order. Requests for neighbouring tiles
+// then don't arrive in bursts, which some providers treat as scraping.
+func shuffleTiles(tiles []Tile, random *rand.Rand) {
+	random.Shuffle(len(tiles), func(i, j int) {
+		tiles[i], tiles[j] = tiles[j], tiles[i]
+	})
+}
+
+// readSourceUrl returns the source_url stored in the metadata of filename.
+func readSourceUrl(filename string) (string, error) {
+	db, err := openMBTile(filename)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	metadata, err := readMetadata(db)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(metadata["source_url"]), nil
+}
+
+// tileHash returns the hex SHA-256 of the tile content, used to compare and
+// deduplicate tiles.
+func tileHash(content []byte) string {
+	sum := sha256.Sum256(content)
+	return hex.EncodeToString(sum[:])
+}
+
+// TileError reports a tile that could not be fetched after all retries.
+type TileError struct {
+	Tile Tile
+	Err  error
+}
+
+// tilePanic is the error of a tile whose handling panicked.
+type tilePanic struct {
+	value interface{}
+}
+
+func (err *tilePanic) Error() string {
+	return fmt.Sprint("panic: ", err.value)
+}
+
+// recoverTile, deferred by the functions handling a single tile, turns a
+// panic into a *tilePanic in err. The tile then fails on its own, and can
+// be fetched again with -resume, instead of a bug tripped by one tile
+// ending the whole run without finishing the file.
+func recoverTile(tile Tile, err *error) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	log.Printf("Panic on tile %s: %v\n%s", tile, value, debug.Stack())
+	*err = &tilePanic{value: value}
+}
+
+// failureWindow keeps the outcome of the most recently finished tiles so the
+// failure rate reflects the current state of the source.
+type failureWindow struct {
+	outcomes []bool
+	next     int
+	count    int
+	failures int
+}
+
+func newFailureWindow(size int) *failureWindow {
+	return &failureWindow{outcomes: make([]bool, size)}
+}
+
+func (window *failureWindow) Add(failed bool) {
+	if window.count == len(window.outcomes) {
+		if window.outcomes[window.next] {
+			window.failures--
+		}
+	} else {
+		window.count++
+	}
+	window.outcomes[window.next] = failed
+	if failed {
+		window.failures++
+	}
+	window.next = (window.next + 1) % len(window.outcomes)
+}
+
+// Full reports whether enough tiles have finished for Rate to be meaningful.
+func (window *failureWindow) Full() bool {
+	return window.count == len(window.outcomes)
+}
+
+func (window *failureWindow) Rate() float64 {
+	if window.count == 0 {
+		return 0
+	}
+	return float64(window.failures) / float64(window.count)
+}
+
+// fetchByZoom fetches the tiles one zoom level at a time with
+// min(workers, tiles in the zoom) fetchers, so the few tiles of a low zoom
+// don't start a full set of mostly idle goroutines. Once ctx is done no
+// more tiles are started; the ones being fetched still finish. tilePipe is
+// closed once every tile has been fetched or given up on.
+func fetchByZoom(ctx context.Context, tiles []Tile, workers int, tilePipe chan Tile, errorPipe chan TileError, options FetchOptions) {
+	defer close(tilePipe)
+	for _, batch := range groupByZoom(tiles) {
+		if ctx.Err() != nil {
+			return
+		}
+		inputPipe := make(chan Tile, len(batch))
+		for _, tile := range batch {
+			inputPipe <- tile
+		}
+		close(inputPipe)
+
+		fetchers := workers
+		if len(batch) < fetchers {
+			fetchers = len(batch)
+		}
+		var wg sync.WaitGroup
+		for w := 0; w < fetchers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				tileFetcher(ctx, inputPipe, tilePipe, errorPipe, options)
+			}()
+		}
+		wg.Wait()
+	}
+}
+
+// groupByZoom splits tiles into one batch per zoom level, keeping the order in
+// which the zoom levels and the tiles within them first appear.
+func groupByZoom(tiles []Tile) [][]Tile {
+	var batches [][]Tile
+	index := make(map[int]int)
+	for _, tile := range tiles {
+		i, ok := index[tile.z]
+		if !ok {
+			i = len(batches)
+			index[tile.z] = i
+			batches = append(batches, nil)
+		}
+		batches[i] = append(batches[i], tile)
+	}
+	return batches
+}
+
+func tileFetcher(ctx context.Context, inputPipe chan Tile, tilePipe chan Tile, errorPipe chan TileError, options FetchOptions) {
+	for tile := range inputPipe {
+		fetchPause.Wait()
+		if ctx.Err() != nil {
+			continue
+		}
+		options.Controller.Acquire()
+		tileObj, err := fetchTileAndOverlay(tile, options)
+		options.Controller.Release()
+		if err == errNotModified {
+			tile.NotModified = true
+			tilePipe <- tile
+			continue
+		}
+		if err != nil {
+			errorPipe <- TileError{Tile: tile, Err: err}
+			continue
+		}
 		tilePipe <- tileObj
 	}
 }
 
-func httpGet(tileUrl string) (*http.Response, error) {
-	client := &http.Client{}
+// fetchTileAndOverlay fetches tile and, with an overlay source, its overlay.
+func fetchTileAndOverlay(tile Tile, options FetchOptions) (tileObj Tile, err error) {
+	defer recoverTile(tile, &err)
+	tileObj, err = fetchTileWithRetry(tile, options)
+	if err == nil && options.OverlayFormat != "" {
+		tileObj.Overlay, err = fetchOverlay(tile, options)
+	}
+	return tileObj, err
+}
+
+// fetchOverlay fetches the tile of the overlay source. The size check is
+// skipped, since a blank overlay tile is legitimately tiny.
+func fetchOverlay(tile Tile, options FetchOptions) ([]byte, error) {
+	options.UrlFormat = options.OverlayFormat
+	options.Mirrors = nil
+	options.MinTileBytes = 0
+	overlay, err := fetchTileWithRetry(tile, options)
+	return overlay.Content, err
+}
+
+// FetchOptions controls how tiles are downloaded.
+type FetchOptions struct {
+	UrlFormat string
+	// OverlayFormat, when set, is the url template of a second source whose
+	// tiles are drawn over the ones of UrlFormat.
+	OverlayFormat string
+	Retries       int
+	// Tiles smaller than MinTileBytes are treated as failed; servers tend to
+	// answer missing tiles with a tiny placeholder image and a 200.
+	MinTileBytes int
+	// RetryStatus are the unexpected statuses that are retried.
+	RetryStatus statusSet
+	// Timing, when set, records the duration of every attempt.
+	Timing *timingLog
+	// AttemptTimeout bounds a single attempt, so one hung request doesn't use
+	// up the time of all the retries. 0 means no limit.
+	AttemptTimeout time.Duration
+	// Limiter, when set, is shared by all fetchers to cap the request rate.
+	Limiter *rateLimiter
+	// Controller, when set, decides how many of the fetchers may work at once.
+	Controller *concurrencyController
+	// HostLimits, when set, caps the requests in flight to each host.
+	HostLimits *hostLimiter
+	// DecodeImages retries tiles that don't decode, for when the writer
+	// needs to decode them.
+	DecodeImages bool
+	// Mirrors, when set, replaces UrlFormat with a set of equivalent
+	// sources the attempts are spread over.
+	Mirrors *mirrorSet
+}
+
+// rateLimiter spaces requests out to at most rate per second.
+type rateLimiter struct {
+	ticker *time.Ticker
+}
+
+// newRateLimiter returns nil, which never waits, for a rate of 0.
+func newRateLimiter(rate float64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &rateLimiter{ticker: time.NewTicker(time.Duration(float64(time.Second) / rate))}
+}
+
+func (limiter *rateLimiter) Wait() {
+	if limiter == nil {
+		return
+	}
+	<-limiter.ticker.C
+}
+
+// fetchTileWithRetry fetches a tile, retrying up to options.Retries times with
+// an exponential backoff.
+func fetchTileWithRetry(tile Tile, options FetchOptions) (Tile, error) {
+	var err error
+	var mirrorsTried []int
+	for attempt := 0; attempt <= options.Retries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(RETRY_BACKOFF << uint(attempt-1))
+		}
+		var tileObj Tile
+		options.Limiter.Wait()
+		url_format, mirror := options.UrlFormat, 0
+		if options.Mirrors != nil {
+			mirror, url_format = options.Mirrors.Pick(mirrorsTried)
+			mirrorsTried = append(mirrorsTried, mirror)
+		}
+		// Each retry goes to the next subdomain, in case one is unhealthy.
+		url_format = strings.Replace(url_format, "{s}", subdomainFor(tile.x, tile.y, attempt), -1)
+		release := options.HostLimits.Acquire(getTileUrl(tile.z, tile.x, tile.y, url_format))
+		ctx, cancel := attemptContext(context.Background(), options.AttemptTimeout)
+		start := time.Now()
+		tileObj, err = fetchTile(ctx, tile.z, tile.x, tile.y, url_format)
+		cancel()
+		release()
+		options.Timing.Record(tile, attempt, time.Since(start), len(tileObj.Content), err)
+		if err == errNotModified {
+			options.Controller.Record(nil)
+			return tile, err
+		}
+		if err == nil && len(tileObj.Content) < options.MinTileBytes {
+			err = fmt.Errorf("tile is only %d bytes, below -min-tile-bytes %d", len(tileObj.Content), options.MinTileBytes)
+		}
+		if err == nil && options.DecodeImages {
+			err = checkImage(tileObj.Content)
+		}
+		if options.Mirrors != nil {
+			options.Mirrors.Record(mirror, err)
+		}
+		options.Controller.Record(err)
+		if err == nil {
+			return tileObj, nil
+		}
+		log.Println("Error in fetching tile", tile, "attempt", attempt+1, ":", err)
+		if !options.RetryStatus.retryable(err) {
+			break
+		}
+	}
+	return tile, err
+}
+
+// accessToken replaces {token} in tile urls, so templates (which are logged
+// and stored in the metadata) never contain it. Set with -mapbox-token or
+// the MAPBOX_ACCESS_TOKEN environment variable.
+var accessToken string
+
+// busyTimeout is how long SQLite itself waits on a locked database before
+// failing with SQLITE_BUSY, set with -busy-timeout.
+var busyTimeout = DEFAULT_BUSY_TIMEOUT
+
+// pageSize and cacheSize, when set, are passed on as PRAGMA page_size and
+// PRAGMA cache_size; set with -page-size and -cache-size.
+var pageSize, cacheSize int
+
+// incrementalVacuum finishes files with PRAGMA incremental_vacuum instead of
+// VACUUM, which copies the whole database and needs twice its size on disk.
+// Set with -incremental-vacuum.
+var incrementalVacuum bool
+
+// userAgent is sent with every request, set with -user-agent.
+var userAgent = DEFAULT_USER_AGENT
+
+// updateSince, set with -update-since, makes requests conditional so only
+// tiles modified after it are downloaded and stored.
+var updateSince time.Time
+
+// errNotModified is returned for a tile that hasn't changed since
+// updateSince.
+var errNotModified = errors.New("tile not modified")
+
+// parseSince parses the -update-since time, either RFC 3339 or a date.
+func parseSince(value string) (time.Time, error) {
+	since, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		since, err = time.Parse("2006-01-02", value)
+	}
+	if err != nil {
+		return since, fmt.Errorf("invalid -update-since %q, expected a date like 2006-01-02 or 2006-01-02T15:04:05Z", value)
+	}
+	return since, nil
+}
+
+// httpClient is shared by all the tile fetchers so connections are reused.
+var httpClient = newHttpClient(DEFAULT_MAX_REDIRECTS)
+
+// newHttpClient returns a client that follows at most maxRedirects redirects.
+// net/http copies the headers of the original request (User-Agent etc.) to
+// every hop, but drops Authorization and Cookie headers when a redirect leaves
+// the original host. We keep that behaviour so credentials meant for one tile
+// server are never handed to another.
+func newHttpClient(maxRedirects int) *http.Client {
+	return &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return nil
+		},
+	}
+}
+
+// localFileTransport answers file:// urls from the local filesystem and
+// passes everything else on, so a tile tree on disk goes through the same
+// fetching, retrying and checks as a server. Missing files are 404s.
+type localFileTransport struct {
+	files     http.RoundTripper
+	transport http.RoundTripper
+}
+
+func newLocalFileTransport(transport http.RoundTripper) *localFileTransport {
+	return &localFileTransport{files: http.NewFileTransport(http.Dir("/")), transport: transport}
+}
+
+func (local *localFileTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme == "file" {
+		return local.files.RoundTrip(req)
+	}
+	return local.transport.RoundTrip(req)
+}
+
+// attemptContext returns the context for one attempt at fetching a tile.
+func attemptContext(parent context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout > 0 {
+		return context.WithTimeout(parent, timeout)
+	}
+	return context.WithCancel(parent)
+}
+
+func httpGet(ctx context.Context, tileUrl string) (*http.Response, error) {
 	req, err := http.NewRequest("GET", tileUrl, nil)
-	req.Header.Set("User-Agent", "MBTile_Bot/0.1")
 	if err != nil {
 		return nil, err
 	}
-	resp, err := client.Do(req)
+	req = req.WithContext(ctx)
+	req.Header.Set("User-Agent", userAgent)
+	sourceCredentials.Apply(req)
+	if !updateSince.IsZero() {
+		req.Header.Set("If-Modified-Since", updateSince.UTC().Format(http.TimeFormat))
+	}
+	resp, err := httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
 	return resp, nil
 }
 
-func fetchTile(z, x, y int, url_format string) Tile {
+func fetchTile(ctx context.Context, z, x, y int, url_format string) (Tile, error) {
 	tile := Tile{}
 	tileUrl := getTileUrl(z, x, y, url_format)
-	resp, err := httpGet(tileUrl)
+	resp, err := httpGet(ctx, tileUrl)
 	if err != nil {
-		log.Fatal("Error in fetching tile")
+		return tile, err
 	}
 	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return tile, errNotModified
+	}
+	if resp.StatusCode != http.StatusOK {
+		return tile, &statusError{Code: resp.StatusCode, Status: resp.Status}
+	}
+	if !updateSince.IsZero() {
+		// Not every server honours If-Modified-Since.
+		modified, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+		if err == nil && !modified.After(updateSince) {
+			return tile, errNotModified
+		}
+	}
 	tile.x = x
 	tile.z = z
 	tile.y = y
 	tile.Content, err = ioutil.ReadAll(resp.Body)
-	return tile
+	return tile, err
 }
 
 func getTileUrl(z, x, y int, url_format string) string {
 	// url_format = "http://mt2.google.com/vt/lyrs=y&x={x}&y={y}&z={z}"
-	tile_url := strings.Replace(url_format, "{x}", strconv.Itoa(x), -1)
-	tile_url = strings.Replace(tile_url, "{y}", strconv.Itoa(y), -1)
-	tile_url = strings.Replace(tile_url, "{z}", strconv.Itoa(z), -1)
-	return tile_url
+	// All placeholders are replaced in a single pass, so braces that are part
+	// of the URL itself are left alone.
+	replacements := []string{
+		"{x}", strconv.Itoa(x),
+		"{y}", strconv.Itoa(y),
+		"{z}", strconv.Itoa(z),
+		"{q}", quadKey(z, x, y),
+		"{token}", accessToken,
+		"{s}", subdomainFor(x, y, 0),
+	}
+	if strings.Contains(url_format, "{bbox}") {
+		replacements = append(replacements, "{bbox}", mercatorBbox(z, x, y))
+	}
+	if strings.Contains(url_format, "{bbox4326}") {
+		replacements = append(replacements, "{bbox4326}", wgs84Bbox(z, x, y))
+	}
+	if strings.Contains(url_format, "{time}") {
+		replacements = append(replacements, "{time}", strconv.FormatInt(time.Now().Unix(), 10))
+	}
+	if strings.Contains(url_format, "{rand}") {
+		replacements = append(replacements, "{rand}", strconv.FormatInt(rand.Int63(), 10))
+	}
+	tileUrl := strings.NewReplacer(replacements...).Replace(url_format)
+	if len(extraQuery) > 0 {
+		separator := "?"
+		if strings.Contains(tileUrl, "?") {
+			separator = "&"
+		}
+		tileUrl += separator + extraQuery.Encode()
+	}
+	return tileUrl
 }
 
-func prepareDatabase(filename string) (*sql.DB, error) {
-	os.Remove(filename)
-	db, err := sql.Open("sqlite3", filename)
-	if err != nil {
-		return nil, err
+// subdomains fill the {s} placeholder, set with -subdomains.
+var subdomains = strings.Split(DEFAULT_SUBDOMAINS, "")
+
+// subdomainFor picks the subdomain of a tile like Leaflet does, from x+y, so
+// a tile always goes to the same host and neighbours are spread over all of
+// them. Retries move on to the next one.
+func subdomainFor(x, y, attempt int) string {
+	if len(subdomains) == 0 {
+		return ""
+	}
+	i := (x + y + attempt) % len(subdomains)
+	if i < 0 {
+		i += len(subdomains)
+	}
+	return subdomains[i]
+}
+
+// parseSubdomains parses -subdomains: either single letter subdomains run
+// together, like abc, or a comma separated list.
+func parseSubdomains(value string) ([]string, error) {
+	var parts []string
+	if strings.Contains(value, ",") {
+		parts = strings.Split(value, ",")
+	} else {
+		parts = strings.Split(value, "")
+	}
+	for _, part := range parts {
+		if strings.TrimSpace(part) == "" {
+			return nil, fmt.Errorf("invalid -subdomains %q, expected e.g. abc or a1,a2", value)
+		}
+	}
+	return parts, nil
+}
+
+// extraQuery is appended to every tile url, set with -query key=value.
+var extraQuery = url.Values{}
+
+// queryValue is the repeatable -query flag.
+type queryValue url.Values
+
+func (query queryValue) String() string {
+	return url.Values(query).Encode()
+}
+
+func (query queryValue) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return fmt.Errorf("expected key=value, got %q", value)
+	}
+	url.Values(query).Add(parts[0], parts[1])
+	return nil
+}
+
+// cacheBustingParams returns the query parameters the -cache-dir key leaves
+// out: the ones filled from {time} or {rand} and the ones added with -query,
+// which may change between runs without changing the tile.
+func cacheBustingParams(templates []string) map[string]bool {
+	params := make(map[string]bool)
+	for key := range extraQuery {
+		params[key] = true
+	}
+	for _, template := range templates {
+		parsed, err := url.Parse(template)
+		if err != nil {
+			continue
+		}
+		for key, values := range parsed.Query() {
+			for _, value := range values {
+				if strings.Contains(value, "{time}") || strings.Contains(value, "{rand}") {
+					params[key] = true
+				}
+			}
+		}
+	}
+	return params
+}
+
+// quadKey returns the Bing Maps quadkey of the XYZ tile.
+func quadKey(z, x, y int) string {
+	key := make([]byte, z)
+	for i := z; i > 0; i-- {
+		digit := byte('0')
+		mask := 1 << uint(i-1)
+		if x&mask != 0 {
+			digit++
+		}
+		if y&mask != 0 {
+			digit += 2
+		}
+		key[z-i] = digit
+	}
+	return string(key)
+}
+
+// validateTileUrl checks that url_format addresses a tile, either with all of
+// {z}, {x} and {y}, with a {q} quadkey or with a {bbox}/{bbox4326} extent,
+// and that it expands to an absolute http(s) or file URL.
+func validateTileUrl(url_format string) error {
+	hasXYZ := strings.Contains(url_format, "{z}") && strings.Contains(url_format, "{x}") && strings.Contains(url_format, "{y}")
+	hasOther := strings.Contains(url_format, "{q}") || strings.Contains(url_format, "{bbox}") || strings.Contains(url_format, "{bbox4326}")
+	if !hasXYZ && !hasOther {
+		var missing []string
+		for _, placeholder := range []string{"{z}", "{x}", "{y}"} {
+			if !strings.Contains(url_format, placeholder) {
+				missing = append(missing, placeholder)
+			}
+		}
+		return fmt.Errorf("tile url %q is missing %s (or a {q} quadkey or {bbox})", url_format, strings.Join(missing, ", "))
+	}
+	tileUrl, err := url.Parse(getTileUrl(0, 0, 0, url_format))
+	if err != nil {
+		return fmt.Errorf("invalid tile url %q: %v", url_format, err)
+	}
+	if tileUrl.Scheme == "file" {
+		if tileUrl.Host != "" || !strings.HasPrefix(tileUrl.Path, "/") {
+			return fmt.Errorf("file url %q must name an absolute path, like file:///data/tiles/{z}/{x}/{y}.png", url_format)
+		}
+		return nil
+	}
+	if (tileUrl.Scheme != "http" && tileUrl.Scheme != "https") || tileUrl.Host == "" {
+		return fmt.Errorf("tile url %q must be an absolute http, https or file url", url_format)
+	}
+	return nil
+}
+
+var secretQueryParam = regexp.MustCompile(`(?i)([?&](?:access_token|token|api_?key|key)=)[^&]*`)
+
+// redactUrl hides access tokens and keys in a tile url so it can be logged.
+func redactUrl(url_format string) string {
+	return secretQueryParam.ReplaceAllString(url_format, "${1}REDACTED")
+}
+
+// imageFormatForExtension returns the tile format for a png or jpg extension.
+func imageFormatForExtension(extension string) (string, error) {
+	switch strings.ToLower(extension) {
+	case PNG_EXTENSION:
+		return PNG_IMAGE_FORMAT, nil
+	case JPG_EXTENSION, "jpeg":
+		return JPG_IMAGE_FORMAT, nil
+	}
+	return "", fmt.Errorf("unknown tile format %q, expected png or jpg", extension)
+}
+
+// formatForUrlTemplate infers the tile format from the extension of the url
+// template's path, like the .png of .../{y}.png?key=...
+func formatForUrlTemplate(url_format string) (string, bool) {
+	path := url_format
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path = path[:i]
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case "." + PNG_EXTENSION:
+		return PNG_IMAGE_FORMAT, true
+	case "." + JPG_EXTENSION, ".jpeg":
+		return JPG_IMAGE_FORMAT, true
+	case "." + WEBP_EXTENSION:
+		return WEBP_IMAGE_FORMAT, true
+	case "." + PBF_EXTENSION, ".mvt":
+		return PBF_FORMAT, true
+	}
+	return "", false
+}
+
+// tempOutputFile returns the name of an empty temporary file to build the
+// output in when it is streamed to stdout.
+func tempOutputFile() (string, error) {
+	file, err := ioutil.TempFile("", "mbtilego-")
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	return file.Name(), nil
+}
+
+// streamFile copies the finished file at filename to out.
+func streamFile(filename string, out io.Writer) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(out, file)
+	return err
+}
+
+// prepareDatabase opens filename for writing tiles. The file is replaced
+// unless keep is set.
+func prepareDatabase(filename string, keep bool) (*sql.DB, error) {
+	if !keep {
+		os.Remove(filename)
+	}
+	db, err := sql.Open("sqlite3", filename)
+	if err != nil {
+		return nil, err
+	}
+	// The pragmas below are per connection, and with locking_mode=EXCLUSIVE a
+	// second connection would only ever see a locked database.
+	db.SetMaxOpenConns(1)
+
+	if incrementalVacuum && !keep {
+		// Only takes effect before the first table is created.
+		_, err = db.Exec("PRAGMA auto_vacuum=INCREMENTAL")
+		if err != nil {
+			return nil, err
+		}
+	}
+	err = optimizeConnection(db)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+func setupMBTileTables(db *sql.DB, proj *Projection, dedup bool) error {
+	var err error
+	if dedup {
+		err = createDedupSchema(db)
+	} else {
+		err = createMBTileSchema(db)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Load metadata. Values left by an earlier run are replaced, so running
+	// again over the same file updates them.
+	existing, err := readMetadata(db)
+	if err != nil {
+		return err
+	}
+	for name, value := range proj.MetaDataItems() {
+		if previous, ok := existing[name]; ok && previous != value {
+			log.Printf("Metadata %s changed from %q to %q", name, previous, value)
+		}
+		_, err := db.Exec("insert or replace into metadata (name, value) values (?, ?)", name, value)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func createMBTileSchema(db *sql.DB) error {
+	_, err := db.Exec("create table if not exists tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob);")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("create table if not exists metadata (name text, value text);")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("create unique index if not exists name on metadata (name);")
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("create unique index if not exists tile_index on tiles(zoom_level, tile_column, tile_row);")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func optimizeConnection(db *sql.DB) error {
+	_, err := db.Exec("PRAGMA synchronous=0")
+	if err != nil {
+		return err
+	}
+	if pageSize != 0 {
+		// Only applies to a new file before its first table, or to an
+		// existing one on the next VACUUM, and not in WAL mode.
+		_, err = db.Exec(fmt.Sprintf("PRAGMA page_size=%d", pageSize))
+		if err != nil {
+			return err
+		}
+	}
+	// -live-metadata lets viewers read the file while it is written.
+	lockingMode, journalMode := "EXCLUSIVE", "DELETE"
+	if liveMetadata {
+		lockingMode, journalMode = "NORMAL", "WAL"
+	}
+	_, err = db.Exec("PRAGMA locking_mode=" + lockingMode)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("PRAGMA journal_mode=" + journalMode)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(fmt.Sprintf("PRAGMA busy_timeout=%d", busyTimeout/time.Millisecond))
+	if err != nil {
+		return err
+	}
+	if cacheSize != 0 {
+		_, err = db.Exec(fmt.Sprintf("PRAGMA cache_size=%d", cacheSize))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validatePageSize checks a -page-size, which SQLite silently ignores unless
+// it is a power of two between 512 and 65536.
+func validatePageSize(size int) error {
+	if size != 0 && (size < MIN_PAGE_SIZE || size > MAX_PAGE_SIZE || size&(size-1) != 0) {
+		return fmt.Errorf("-page-size %d must be a power of two between %d and %d", size, MIN_PAGE_SIZE, MAX_PAGE_SIZE)
+	}
+	return nil
+}
+
+func optimizeDatabase(db *sql.DB) error {
+	_, err := db.Exec("ANALYZE;")
+	if err != nil {
+		return err
+	}
+
+	if incrementalVacuum {
+		var mode int
+		err = db.QueryRow("PRAGMA auto_vacuum;").Scan(&mode)
+		if err != nil {
+			return err
+		}
+		if mode == AUTO_VACUUM_INCREMENTAL {
+			// Pages are freed as the pragma is stepped; Exec would stop early.
+			rows, err := db.Query("PRAGMA incremental_vacuum;")
+			if err != nil {
+				return err
+			}
+			for rows.Next() {
+			}
+			rows.Close()
+			return rows.Err()
+		}
+		log.Println("The file wasn't created with -incremental-vacuum, running a full VACUUM")
+	}
+
+	_, err = db.Exec("VACUUM;")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// stripMetadata removes the named metadata keys from a finished file. With
+// stripUuid the random UUIDs name and description default to are replaced,
+// name by the file name and description by an empty string. A file streamed
+// to stdout has no name to use, so its name is kept.
+func stripMetadata(db *sql.DB, keys []string, stripUuid bool, filename string) error {
+	metadata, err := readMetadata(db)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		_, err = db.Exec("delete from metadata where name = ?;", strings.TrimSpace(key))
+		if err != nil {
+			return err
+		}
+	}
+	if !stripUuid {
+		return nil
+	}
+	replacements := map[string]string{"description": ""}
+	if filename != STDOUT_FILENAME {
+		replacements["name"] = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	}
+	for name, value := range replacements {
+		if _, err := uuid.FromString(metadata[name]); err != nil {
+			continue
+		}
+		_, err = db.Exec("update metadata set value = ? where name = ?;", value, name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// setIncomplete sets or clears the incomplete metadata flag, which is set
+// while tiles are being downloaded and cleared once all of them are stored.
+func setIncomplete(db *sql.DB, incomplete bool) error {
+	var err error
+	if incomplete {
+		_, err = db.Exec("insert or replace into metadata (name, value) values (?, '1');", INCOMPLETE_KEY)
+	} else {
+		_, err = db.Exec("delete from metadata where name = ?;", INCOMPLETE_KEY)
+	}
+	return err
+}
+
+// isIncomplete reports whether filename was left behind by a run that was
+// interrupted or gave up on some tiles.
+func isIncomplete(filename string) bool {
+	if _, err := os.Stat(manifestPath(filename)); err == nil {
+		return true
+	}
+	db, err := openMBTile(filename)
+	if err != nil {
+		return false
+	}
+	defer db.Close()
+	metadata, err := readMetadata(db)
+	return err == nil && metadata[INCOMPLETE_KEY] == "1"
+}
+
+// printMaptypes lists the index, name, format and url of every built-in map
+// type, with access tokens redacted.
+func printMaptypes(out io.Writer) {
+	for i, source := range MAPTYPES {
+		fmt.Fprintf(out, "%d\t%s\t%s\t%s\n", i, source.Name, extensionForFormat(source.Format), redactUrl(source.URLTemplate))
+	}
+}
+
+// sourceForUrl returns the built-in source serving url_format, matching on
+// the host so that subdomains like a.tile.openstreetmap.org count too.
+func sourceForUrl(url_format string) (MapSource, bool) {
+	parsed, err := url.Parse(getTileUrl(0, 0, 0, url_format))
+	if err != nil {
+		return MapSource{}, false
+	}
+	host := strings.ToLower(parsed.Hostname())
+	for _, source := range MAPTYPES {
+		sourceUrl, err := url.Parse(source.URLTemplate)
+		if err != nil {
+			continue
+		}
+		sourceHost := sourceUrl.Hostname()
+		if host == sourceHost || strings.HasSuffix(host, "."+sourceHost) {
+			return source, true
+		}
+	}
+	return MapSource{}, false
+}
+
+// checkUsagePolicy returns an error when workers or rate (0 is unlimited)
+// go beyond the usage policy of source.
+func checkUsagePolicy(source MapSource, workers int, rate float64) error {
+	if source.MaxWorkers > 0 && workers > source.MaxWorkers {
+		return fmt.Errorf("%s allows at most %d parallel downloads, -workers is %d (see %s)", source.Name, source.MaxWorkers, workers, source.PolicyUrl)
+	}
+	if source.MaxRate > 0 && (rate == 0 || rate > source.MaxRate) {
+		return fmt.Errorf("%s allows at most %g requests per second, set -rate to %g or less (see %s)", source.Name, source.MaxRate, source.MaxRate, source.PolicyUrl)
+	}
+	return nil
+}
+
+// politeRequested reports whether -polite is among the arguments. It has to
+// be known before flag.Parse so that the preset only changes defaults.
+func politeRequested(args []string) bool {
+	for _, arg := range args {
+		if arg == "--" {
+			break
+		}
+		name := strings.TrimLeft(arg, "-")
+		if strings.HasPrefix(arg, "-") && (name == "polite" || name == "polite=true" || name == "polite=1") {
+			return true
+		}
+	}
+	return false
+}
+
+// applyPolitePreset sets defaults in line with the usage policies of public
+// tile servers such as OpenStreetMap's.
+func applyPolitePreset() {
+	flag.Set("workers", "2")
+	flag.Set("rate", "2")
+	flag.Set("retries", "5")
+	flag.Set("user-agent", POLITE_USER_AGENT)
+}
+
+// commands maps the subcommands given as the first argument to their
+// implementation; without one, main downloads tiles.
+var commands = map[string]func(args []string){
+	"diff":         runDiff,
+	"patch":        runPatch,
+	"apply-patch":  runApplyPatch,
+	"serve":        runServe,
+	"dump":         runDump,
+	"repair":       runRepair,
+	"fix-metadata": runFixMetadata,
+}
+
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			command(os.Args[2:])
+			return
+		}
+	}
+
+	procs, procsSource := setMaxProcs()
+	log.Println("MbtileGo Version:", VERSION, "Number of CPUs:", runtime.NumCPU(), "GOMAXPROCS:", procs, "from the", procsSource)
+	var xmin, ymin, xmax, ymax, maxFailureRate float64
+	var maptype, maxRedirects, failureWindowSize, workers, maxZoomTiles, dedupeThreshold, tileRadius, estimateSample int
+	zoomlevel, max_zoomlevel := 19, MAX_ZOOM_LEVEL
+	var fetchOptions FetchOptions
+	var filename, tilesFrom, errorLogPath, configPath, cacheDir, url_format, format, bboxPadding, tileJSONUrl, statsJSON, coverageGeoJSON, hashName, since, center, outputFormat, mirrors, pinSha256, shapefile, stripKeys, tileJSONOut, packageFile, minSuccess, timingLogPath, retryStatus, place, geocoderUrl, watermark, zoomFormats, encoding, progressJSON, excludeZooms, subdomainList, bboxFromTile, tileFiles, tileIndexOut, name, description, attribution, includeTiles, excludeTiles, netrcFile, loginUrl, maxFileSize, compression string
+	var wmsEndpoint, wmsLayers, wmsStyles, wmsCrs string
+	var wmsSize int
+	var cacheTTL, tileMaxAge, maxRuntime time.Duration
+	var resume, appendTiles, shuffle, deterministic, polite, listMaptypes, concurrencyAuto, dedup, embedPreviewTile, force, stripUuid, optimizeLayoutFlag, checkSource, failFast, grayscale, raw, dryRun, storeHashes, compact bool
+	var rate, radius float64
+	var seed int64
+	var overzoomTo, displayMinZoom int
+	var writerOptions WriterOptions
+	hostLimits := newHostLimiter()
+
+	sigs := make(chan os.Signal, 1)
+
+	watched := []os.Signal{syscall.SIGKILL, syscall.SIGINT, syscall.SIGTERM}
+	if pauseSignal != nil {
+		watched = append(watched, pauseSignal, resumeSignal)
+	}
+	signal.Notify(sigs, watched...)
+	go func() {
+		for sig := range sigs {
+			switch sig {
+			case pauseSignal:
+				fetchPause.Pause()
+			case resumeSignal:
+				fetchPause.Resume()
+			default:
+				log.Println("Exit signal received.")
+				log.Println(sig)
+				os.Exit(1)
+			}
+		}
+	}()
+
+	flag.Float64Var(&xmin, "xmin", 55.397945, "Minimum longitude")
+	flag.Float64Var(&xmax, "xmax", 55.402741, "Maximum longitude")
+	flag.Float64Var(&ymin, "ymin", 25.291090, "Minimum latitude")
+	flag.Float64Var(&ymax, "ymax", 25.292889, "Maximum latitude")
+	flag.StringVar(&filename, "filename", "ouputFile.mbtile", "Output file to generate, or - to write it to stdout")
+	flag.Var((*zoomValue)(&zoomlevel), "zoomlevel", "Zoom `level`")
+	flag.IntVar(&maptype, "maptype", 0, "0 for Google, 1 for OSM, 2 for mapbox satellite street")
+	flag.Var(hostLimits, "host-limit", "Most requests in flight to a host and its subdomains, as `host=n`, or n for every other host; repeatable, on top of -workers")
+	flag.Var(queryValue(extraQuery), "query", "Query parameter `key=value` added to every tile url; repeatable")
+	flag.Var((*zoomValue)(&max_zoomlevel), "max_zoomlevel", "Maximum zoom `level` to which tiles should be added")
+	flag.StringVar(&excludeZooms, "exclude-zooms", "", "Comma separated zoom levels between zoomlevel and max_zoomlevel to leave out, e.g. 11,13")
+	flag.BoolVar(&listMaptypes, "list-maptypes", false, "List the built-in map types and exit")
+	flag.BoolVar(&dryRun, "dry-run-sources", false, "Fetch one tile from every built-in map type, report which answer and exit")
+	flag.StringVar(&accessToken, "mapbox-token", "", "Mapbox access token, substituted for {token} in the tile url (defaults to $MAPBOX_ACCESS_TOKEN)")
+	flag.StringVar(&subdomainList, "subdomains", DEFAULT_SUBDOMAINS, "Subdomains for the {s} placeholder of -url: letters like abc, or a comma separated list")
+	flag.StringVar(&url_format, "url", "", "Custom tile url template with {z}, {x} and {y} (or {q}) placeholders, instead of -maptype")
+	flag.StringVar(&pinSha256, "pin-sha256", "", "Only accept https servers whose certificate public key has this SHA-256 (hex or base64, comma separated for several); the system certificate store is not used")
+	flag.StringVar(&mirrors, "mirrors", "", "Comma separated url templates of sources equivalent to -url; retries go to the mirror with the fewest errors")
+	flag.StringVar(&fetchOptions.OverlayFormat, "overlay-url", "", "Url template of a second source whose tiles are drawn over the -url tiles, e.g. labels over satellite imagery; the result is stored as PNG")
+	flag.StringVar(&format, "format", "", "Tile format of the -url source, png or jpg")
+	flag.StringVar(&wmsEndpoint, "wms", "", "WMS endpoint to request each tile from with GetMap, instead of an XYZ -url")
+	flag.StringVar(&wmsLayers, "wms-layers", "", "Comma separated WMS layers to request")
+	flag.StringVar(&wmsStyles, "wms-styles", "", "Comma separated WMS styles to request")
+	flag.StringVar(&wmsCrs, "wms-crs", WMS_CRS_MERCATOR, "CRS of the WMS request, EPSG:3857 or EPSG:4326")
+	flag.IntVar(&wmsSize, "wms-size", DEFAULT_TILE_SIZE, "Width and height in pixels of the WMS images")
+	flag.BoolVar(&resume, "resume", false, "Continue an interrupted run, keeping the tiles already in the file and its stored source url")
+	flag.BoolVar(&storeHashes, "store-hashes", false, "Record the SHA-256 of every tile in a tile_hashes table next to the standard ones, which diff and patch use instead of hashing the tiles")
+	flag.BoolVar(&dedup, "dedup", false, "Store identical tiles once, in the deduplicated layout (map and images tables)")
+	flag.IntVar(&dedupeThreshold, "dedupe-threshold", 0, "With -dedup, keep a tile inline until more than this many copies were stored, so mostly unique tiles skip the images table (0 shares every tile)")
+	flag.StringVar(&hashName, "hash", DEFAULT_HASH, "Hash used to identify identical tiles with -dedup: fnv, xxhash, md5, sha1 or sha256")
+	flag.BoolVar(&writerOptions.DetectFormat, "detect-format", false, "Set the format metadata from the bytes of the first tile when the source mislabels it")
+	flag.BoolVar(&appendTiles, "append", false, "Add tiles to an existing file, keeping the tiles already in it and widening its bounds and zoom metadata")
+	flag.StringVar(&includeTiles, "include-tiles", "", "File of z/x/y tiles to download on top of the computed ones, with ranges like 10-20 or * for any within the bounds")
+	flag.StringVar(&excludeTiles, "exclude-tiles", "", "File of z/x/y tiles to leave out, with ranges like 10-20 or * for any, e.g. 14/*/*; wins over -include-tiles")
+	flag.StringVar(&tilesFrom, "tiles-from", "", "File listing the tiles to download (z/x/y per line or a JSON array), instead of computing them from the bounds")
+	flag.IntVar(&maxRedirects, "max-redirects", DEFAULT_MAX_REDIRECTS, "Maximum number of redirects to follow for a tile request")
+	flag.StringVar(&place, "place", "", "Take the bounds from a place name, like \"Berlin, Germany\", looked up with -geocoder")
+	flag.StringVar(&geocoderUrl, "geocoder", DEFAULT_GEOCODER, "Geocoder search url for -place, with {query} for the place; must answer like Nominatim")
+	flag.StringVar(&bboxFromTile, "bbox-from-tile", "", "Take the bounds from this z/x/y tile and -tile-radius tiles around it, at its zoom unless -zoomlevel or -max_zoomlevel is given")
+	flag.IntVar(&tileRadius, "tile-radius", 0, "Number of tiles around -bbox-from-tile to include on every side")
+	flag.StringVar(&center, "center", "", "Download the tiles around this lon,lat instead of the bounding box, used with -radius")
+	flag.Float64Var(&radius, "radius", 0, "Radius in km around -center; tiles whose center is farther away are skipped")
+	flag.StringVar(&bboxPadding, "bbox-padding", "0", "Margin added around the bounds, in degrees or as a percentage (e.g. 10%)")
+	flag.IntVar(&estimateSample, "estimate-from-sample", 0, "Fetch up to this many random tiles per zoom level (at most "+strconv.Itoa(ESTIMATE_SAMPLE_LIMIT)+"), print the download size they predict per zoom level and exit")
+	flag.BoolVar(&checkSource, "check-connectivity", false, "Fetch one tile before starting and stop with the server's answer if it fails")
+	flag.StringVar(&packageFile, "package", "", "Bundle the finished file with the -tilejson-out, -coverage-geojson and -stats-json files and their checksums into this zip archive")
+	flag.StringVar(&tileIndexOut, "manifest", "", "Write a JSON index of every stored tile with its z/x/y and size, for static hosting; it has a line per tile")
+	flag.StringVar(&tileJSONOut, "tilejson-out", "", "Write a TileJSON document describing the finished file, with tile urls pointing at mbutil serve")
+	flag.StringVar(&tileJSONUrl, "tilejson", "", "TileJSON url of the source, used to keep the zoom range and bounds within what it serves and to copy its name, description and attribution")
+	flag.StringVar(&name, "name", "", "Name metadata of the file (default the -tilejson name, or a UUID)")
+	flag.StringVar(&description, "description", "", "Description metadata of the file (default the -tilejson description, or a UUID)")
+	flag.StringVar(&attribution, "attribution", "", "Attribution metadata of the file, shown by viewers (default the -tilejson attribution)")
+	flag.StringVar(&configPath, "config", "", "JSON config file with per-zoom bounding box rules")
+	flag.BoolVar(&shuffle, "shuffle", false, "Download tiles in random order to spread the load on the tile server")
+	flag.BoolVar(&deterministic, "deterministic", false, "Use a fixed -seed so -shuffle and -estimate-from-sample runs are repeatable")
+	flag.Int64Var(&seed, "seed", 0, "Seed for -shuffle, to repeat the order of an earlier run (default random, logged at startup)")
+	flag.BoolVar(&polite, "polite", false, "Preset for public tile servers: 2 workers, 2 requests per second, 5 retries and a descriptive User-Agent; other flags still override it")
+	flag.BoolVar(&force, "force", false, "Run even when -workers or -rate exceed the usage policy of a known tile provider")
+	flag.Float64Var(&rate, "rate", 0, "Maximum number of tile requests per second (0 is unlimited)")
+	flag.StringVar(&netrcFile, "netrc", "", "Netrc file with the login and password of source hosts, e.g. ~/.netrc; "+CREDENTIALS_ENV_PREFIX+"<HOST>=user:pass and "+TOKEN_ENV_PREFIX+"<HOST>=token environment variables take precedence")
+	flag.StringVar(&loginUrl, "login-url", "", "Url fetched before the tiles to start a session, posting the -login-field values as a form; the cookies it sets are sent with the tile requests")
+	flag.Var(queryValue(loginForm), "login-field", "Form field `key=value` posted to -login-url, e.g. username=alice; repeatable")
+	flag.StringVar(&userAgent, "user-agent", DEFAULT_USER_AGENT, "User-Agent header sent with tile requests")
+	flag.IntVar(&maxZoomTiles, "max-zoom-tiles-per-level", 0, "Refuse to run when any single zoom level needs more than this many tiles (0 disables)")
+	flag.IntVar(&workers, "workers", DEFAULT_WORKERS, "Maximum number of tiles to fetch in parallel; independent of the number of CPUs, since fetchers mostly wait on the network")
+	flag.BoolVar(&concurrencyAuto, "concurrency-auto", false, "Start with few workers and add more while throughput improves, backing off on 429s and timeouts; -workers is the ceiling")
+	flag.IntVar(&fetchOptions.Retries, "retries", DEFAULT_RETRIES, "Number of times to retry a tile before giving up")
+	flag.DurationVar(&fetchOptions.AttemptTimeout, "attempt-timeout", DEFAULT_ATTEMPT_TIMEOUT, "Time limit for a single attempt at fetching a tile (0 disables)")
+	flag.IntVar(&fetchOptions.MinTileBytes, "min-tile-bytes", DEFAULT_MIN_TILE_BYTES, "Treat tiles smaller than this many bytes as failed")
+	flag.IntVar(&pageSize, "page-size", 0, "SQLite page size in bytes for a new file (default SQLite's, usually 4096); larger pages suit large tiles and big files, but waste space on small tiles")
+	flag.IntVar(&cacheSize, "cache-size", 0, "SQLite page cache, in pages, or in KiB when negative (default SQLite's); a bigger cache speeds up large builds at the cost of memory")
+	flag.BoolVar(&compact, "compact", false, "Drop the tile and metadata indexes when finishing, for a smaller archive; every tile lookup then scans the whole file")
+	flag.BoolVar(&optimizeLayoutFlag, "optimize-layout", false, "Rewrite the tiles ordered by zoom, column and row when finishing, so viewers panning the map read neighbouring tiles from nearby pages")
+	flag.BoolVar(&liveMetadata, "live-metadata", false, "Write the file in WAL mode and update its bounds, center and zoom metadata every few seconds, so a viewer can follow the download")
+	flag.BoolVar(&incrementalVacuum, "incremental-vacuum", false, "Only release free pages when finishing instead of a full VACUUM, which needs twice the file size in free disk space; the file may end up less compact")
+	flag.DurationVar(&maxRuntime, "max-runtime", 0, "Stop starting new tiles after this long and finish the file with what was downloaded, for -resume to continue later (0 disables)")
+	flag.DurationVar(&busyTimeout, "busy-timeout", DEFAULT_BUSY_TIMEOUT, "How long to wait for a locked database before retrying the write")
+	flag.DurationVar(&tileMaxAge, "tile-maxage", 0, "How long clients may cache the tiles, stored as the maxage metadata for tile servers (e.g. 24h)")
+	flag.StringVar(&shapefile, "shapefile", "", "Only download the tiles overlapping the polygons of this ESRI shapefile (.shp), e.g. an admin boundary")
+	flag.StringVar(&stripKeys, "strip-metadata", "", "Comma separated metadata keys to remove from the finished file, e.g. source_url")
+	flag.BoolVar(&stripUuid, "strip-metadata-uuid", false, "Replace the random UUID name and description with the file name and an empty description")
+	flag.IntVar(&displayMinZoom, "display-minzoom", -1, "Lowest zoom viewers should show, up to 4 levels below -zoomlevel; serve builds those tiles from the ones at -zoomlevel (-1 leaves it unset)")
+	flag.IntVar(&overzoomTo, "overzoom-to", 0, "Fill the zoom levels above -max_zoomlevel up to this one by enlarging the highest tiles (png and jpg only)")
+	flag.BoolVar(&raw, "raw", false, "Store png tiles byte for byte, refusing every option that re-encodes them; for terrain-RGB and other DEM tiles")
+	flag.StringVar(&encoding, "encoding", "", "Elevation encoding of -raw DEM tiles, mapbox or terrarium, recorded as the encoding metadata")
+	flag.StringVar(&zoomFormats, "zoom-formats", "", "Advanced, non-standard: convert the tiles of each zoom range to png or jpg, e.g. 0-8:jpg,9-14:png, recording the formats in the json metadata")
+	flag.BoolVar(&grayscale, "grayscale", false, "Convert png and jpg tiles to shades of gray before storing them")
+	flag.StringVar(&watermark, "watermark", "", "Draw this image over the bottom right corner of every png and jpg tile")
+	flag.BoolVar(&embedPreviewTile, "embed-preview", false, "Store the tile at the center of the lowest zoom level as base64 in the preview metadata")
+	flag.StringVar(&tileFiles, "tile-files", "", "Write the tile bytes as {z}/{x}/{y} files in this directory and only their paths into the MBTiles file (non-standard, read back by serve and dump)")
+	flag.StringVar(&maxFileSize, "max-file-size", "", "Split the finished file into numbered files of at most this size, e.g. 3.9G for FAT32, with an index of their tiles in name.shards.json. The split runs after the download and needs free space for a second copy of the tiles until the file is removed")
+	flag.StringVar(&outputFormat, "output-format", OUTPUT_MBTILES, "Format of the output file: mbtiles or pmtiles")
+	flag.StringVar(&coverageGeoJSON, "coverage-geojson", "", "File to write the outline of the stored tiles to as GeoJSON, one feature per zoom level")
+	flag.StringVar(&since, "update-since", "", "Only store tiles modified after this date (2006-01-02 or RFC 3339), using conditional requests; use with -append to update a file")
+	flag.StringVar(&retryStatus, "retry-status", DEFAULT_RETRY_STATUS, "HTTP statuses to retry, as codes and ranges; other statuses fail the tile at once")
+	flag.StringVar(&progressJSON, "progress-json", "", "Write a JSON line with the completed, total, rate, eta and error counts about every second to this file, stderr, or fd:N")
+	flag.StringVar(&timingLogPath, "timing-log", "", "Write the duration and size of every fetch attempt to this CSV file, and add the p50/p95/p99 durations to the summary")
+	flag.StringVar(&statsJSON, "stats-json", "", "File to write the run statistics to as JSON")
+	flag.StringVar(&errorLogPath, "error-log", "", "File to write the z/x/y of tiles that failed, usable with -tiles-from")
+	flag.StringVar(&minSuccess, "min-success", "", "Only finish the file when at least this many tiles succeeded: a count, a fraction like 0.9 or a percentage like 90%; otherwise exit with an error")
+	flag.BoolVar(&failFast, "fail-fast", false, "Exit with an error as soon as a tile fails after its retries, e.g. to catch a broken source in CI")
+	flag.Float64Var(&maxFailureRate, "max-failure-rate", 0, "Abort when the fraction of failed tiles in the failure window exceeds this (0 disables)")
+	flag.IntVar(&failureWindowSize, "failure-window", DEFAULT_FAILURE_WINDOW, "Number of recent tiles -max-failure-rate is computed over")
+	flag.StringVar(&compression, "compress", "", "Compress every tile with this codec, only zstd, to shrink archives (non-standard)")
+	flag.StringVar(&cacheDir, "cache-dir", "", "Directory to cache downloaded tiles in between runs")
+	flag.DurationVar(&cacheTTL, "cache-ttl", DEFAULT_CACHE_TTL, "How long cached tiles stay valid (0 never expires)")
+	if politeRequested(os.Args[1:]) {
+		applyPolitePreset()
+	}
+	flag.Parse()
+	if listMaptypes {
+		printMaptypes(os.Stdout)
+		return
+	}
+	if netrcFile != "" {
+		err := sourceCredentials.loadNetrc(netrcFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if dryRun {
+		if accessToken == "" {
+			accessToken = os.Getenv("MAPBOX_ACCESS_TOKEN")
+		}
+		httpClient = newHttpClient(maxRedirects)
+		if !dryRunSources(os.Stdout, fetchOptions.AttemptTimeout) {
+			os.Exit(1)
+		}
+		return
+	}
+	if failureWindowSize < 1 {
+		log.Fatal("-failure-window must be at least 1")
+	}
+	if workers < 1 {
+		log.Fatal("-workers must be at least 1")
+	}
+	if estimateSample < 0 {
+		log.Fatal("-estimate-from-sample must be at least 0")
+	}
+	var err error
+	err = validatePageSize(pageSize)
+	if err != nil {
+		log.Fatal(err)
+	}
+	_, err = minSuccessCount(minSuccess, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fetchOptions.RetryStatus, err = parseStatusSet(retryStatus)
+	if err != nil {
+		log.Fatal(err)
+	}
+	subdomains, err = parseSubdomains(subdomainList)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if raw {
+		// Elevations are read from the exact pixel values, so anything
+		// decoding and re-encoding the tiles would corrupt them.
+		conflicts := []struct {
+			name string
+			set  bool
+		}{
+			{"-overlay-url", fetchOptions.OverlayFormat != ""},
+			{"-overzoom-to", overzoomTo > 0},
+			{"-zoom-formats", zoomFormats != ""},
+			{"-grayscale", grayscale},
+			{"-watermark", watermark != ""},
+		}
+		for _, conflict := range conflicts {
+			if conflict.set {
+				log.Fatal(conflict.name, " re-encodes the tiles and can't be used with -raw")
+			}
+		}
+		if format != "" && format != PNG_EXTENSION {
+			log.Fatal("-raw stores png tiles, not ", format)
+		}
+		format = PNG_EXTENSION
+	}
+	if encoding != "" {
+		if !raw {
+			log.Fatal("-encoding needs -raw")
+		}
+		if encoding != DEM_ENCODING_MAPBOX && encoding != DEM_ENCODING_TERRARIUM {
+			log.Fatalf("unknown -encoding %q, expected %s or %s", encoding, DEM_ENCODING_MAPBOX, DEM_ENCODING_TERRARIUM)
+		}
+	}
+	var zoomFormatRules []zoomFormatRule
+	if zoomFormats != "" {
+		zoomFormatRules, err = parseZoomFormats(zoomFormats)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("WARNING: -zoom-formats writes a non-standard file; readers that only look at the format metadata will get some tiles in another format")
+	}
+	hasher, err := newHasher(hashName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if dedupeThreshold < 0 {
+		log.Fatal("-dedupe-threshold can't be negative")
+	}
+	if since != "" {
+		if fetchOptions.OverlayFormat != "" {
+			log.Fatal("-update-since can't be used with -overlay-url")
+		}
+		updateSince, err = parseSince(since)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if resume && appendTiles {
+		log.Fatal("-resume and -append can't be used together")
+	}
+	// -deterministic is a fixed -seed.
+	if deterministic {
+		if seed != 0 {
+			log.Fatal("-deterministic and -seed can't be used together")
+		}
+		seed = DETERMINISTIC_SEED
+	} else if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	if compact && optimizeLayoutFlag {
+		// -optimize-layout is for fast reads, which -compact gives up.
+		log.Fatal("-compact and -optimize-layout can't be used together")
+	}
+	err = validOutputFormat(outputFormat)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The MBTiles file is built in a temporary file when it is only a step
+	// on the way: to stdout, where it is copied at the end, or to PMTiles.
+	output := filename
+	pmtiles := strings.ToLower(outputFormat) == OUTPUT_PMTILES
+	temporary := output == STDOUT_FILENAME || pmtiles
+	if packageFile != "" && output == STDOUT_FILENAME {
+		log.Fatal("-package needs an output file, not stdout")
+	}
+	// These read or copy tile_data expecting the tile bytes.
+	tileFilesConflicts := []layoutConflict{
+		{"-dedup", dedup},
+		{"-compress", compression != ""},
+		{"-overzoom-to", overzoomTo > 0},
+		{"-embed-preview", embedPreviewTile},
+		{"-package", packageFile != ""},
+		{"-output-format " + OUTPUT_PMTILES, pmtiles},
+		{"-filename " + STDOUT_FILENAME, output == STDOUT_FILENAME},
+		{"-max-file-size", maxFileSize != ""},
+	}
+	// These decode the stored tiles.
+	compressConflicts := []layoutConflict{
+		{"-overzoom-to", overzoomTo > 0},
+		{"-embed-preview", embedPreviewTile},
+	}
+	if tileFiles != "" {
+		checkTileLayout("-tile-files", "their paths", tileFilesConflicts)
+	}
+	err = validCompression(compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if compression != "" {
+		checkTileLayout("-compress", compression+" data", compressConflicts)
+	}
+	var shardSize int64
+	if maxFileSize != "" {
+		shardSize, err = parseFileSize(maxFileSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if temporary || packageFile != "" {
+			log.Fatal("-max-file-size splits an MBTiles output file, it can't be used with -package, -output-format " + OUTPUT_PMTILES + " or stdout")
+		}
+	}
+	if temporary {
+		if resume || appendTiles {
+			log.Fatal("-resume and -append need an MBTiles output file")
+		}
+		filename, err = tempOutputFile()
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer os.Remove(filename)
+	}
+	if maptype < 0 || maptype >= len(MAPTYPES) {
+		log.Fatalf("-maptype must be between 0 and %d", len(MAPTYPES)-1)
+	}
+	if wmsEndpoint != "" {
+		if format == "" {
+			format = PNG_EXTENSION
+		}
+		tileFormat, err := imageFormatForExtension(format)
+		if err != nil {
+			log.Fatal(err)
+		}
+		url_format, err = wmsTemplate(wmsEndpoint, wmsLayers, wmsStyles, wmsCrs, tileFormat, wmsSize)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if resume && url_format == "" {
+		stored, err := readSourceUrl(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if stored == "" {
+			log.Fatal(filename, " has no stored source_url, pass -url to resume it")
+		}
+		url_format = stored
+		log.Println("Resuming with the stored source", redactUrl(url_format))
+	}
+	if url_format == "" {
+		url_format = MAPTYPES[maptype].URLTemplate
+	}
+	templates := []string{url_format}
+	if mirrors != "" {
+		templates = append(templates, strings.Split(mirrors, ",")...)
+	}
+	for _, template := range templates {
+		err = validateTileUrl(template)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if source, ok := sourceForUrl(template); ok {
+			err = checkUsagePolicy(source, workers, rate)
+			if err != nil && force {
+				log.Println("WARNING: ignoring the usage policy with -force:", err)
+			} else if err != nil {
+				log.Fatal(err, "; -polite stays within it, or pass -force to go ahead anyway")
+			}
+		}
+	}
+	if fetchOptions.OverlayFormat != "" {
+		err = validateTileUrl(fetchOptions.OverlayFormat)
+		if err != nil {
+			log.Fatal("-overlay-url: ", err)
+		}
+	}
+	if accessToken == "" {
+		accessToken = os.Getenv("MAPBOX_ACCESS_TOKEN")
+	}
+	if strings.Contains(strings.Join(templates, "")+fetchOptions.OverlayFormat, "{token}") && accessToken == "" {
+		log.Fatal("This source needs an access token, pass -mapbox-token or set MAPBOX_ACCESS_TOKEN")
+	}
+	httpClient = newHttpClient(maxRedirects)
+	var transport http.RoundTripper = http.DefaultTransport
+	if pinSha256 != "" {
+		pins, err := parsePins(pinSha256)
+		if err != nil {
+			log.Fatal(err)
+		}
+		transport = pinnedTransport(pins)
+	}
+	if cacheDir != "" {
+		transport, err = newCachingTransport(cacheDir, cacheTTL, transport, cacheBustingParams(append(templates, fetchOptions.OverlayFormat)))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	httpClient.Transport = newLocalFileTransport(transport)
+	if len(loginForm) > 0 && loginUrl == "" {
+		log.Fatal("-login-field needs a -login-url")
+	}
+	if loginUrl != "" {
+		cookies, err := login(loginUrl, loginForm)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Logged in at", redactUrl(loginUrl), "with", cookies, "session cookies")
+	}
+
+	var centerLon, centerLat float64
+	if center != "" {
+		if radius <= 0 {
+			log.Fatal("-center needs a -radius in km")
+		}
+		if configPath != "" {
+			log.Fatal("-center and -config can't be used together")
+		}
+		centerLon, centerLat, err = parseCenter(center)
+		if err != nil {
+			log.Fatal(err)
+		}
+		xmin, ymin, xmax, ymax = radiusBounds(centerLon, centerLat, radius)
+	} else if radius > 0 {
+		log.Fatal("-radius needs a -center")
+	}
+	if place != "" {
+		if configPath != "" || center != "" || shapefile != "" {
+			log.Fatal("-place can't be used with -config, -center or -shapefile")
+		}
+		xmin, ymin, xmax, ymax, err = geocodePlace(place, geocoderUrl)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if bboxFromTile != "" {
+		if configPath != "" || center != "" || place != "" || shapefile != "" {
+			log.Fatal("-bbox-from-tile can't be used with -config, -center, -place or -shapefile")
+		}
+		tile, err := parseTileCoord(bboxFromTile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tileRadius < 0 {
+			log.Fatal("-tile-radius can't be negative")
+		}
+		xmin, ymin, xmax, ymax = tileNeighborhoodBounds(tile, tileRadius)
+		zoomSet := false
+		flag.Visit(func(f *flag.Flag) {
+			zoomSet = zoomSet || f.Name == "zoomlevel" || f.Name == "max_zoomlevel"
+		})
+		if !zoomSet {
+			zoomlevel, max_zoomlevel = tile.z, tile.z
+		}
+		log.Printf("Bounds of %s and %d tiles around it: %f,%f,%f,%f", tile, tileRadius, xmin, ymin, xmax, ymax)
+	} else if tileRadius != 0 {
+		log.Fatal("-tile-radius needs a -bbox-from-tile")
+	}
+	var clip clipPolygon
+	if shapefile != "" {
+		if configPath != "" || center != "" {
+			log.Fatal("-shapefile can't be used with -config or -center")
+		}
+		clip, err = readShapefile(shapefile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		xmin, ymin, xmax, ymax = clip.Bounds()
+	}
+	err = validateBounds(xmin, ymin, xmax, ymax)
+	if err != nil {
+		log.Fatal(err)
+	}
+	padding, paddingPercent, err := parsePadding(bboxPadding)
+	if err != nil {
+		log.Fatal(err)
+	}
+	xmin, ymin, xmax, ymax = padBounds(xmin, ymin, xmax, ymax, padding, paddingPercent)
+
+	var config Config
+	if configPath != "" {
+		var err error
+		config, err = loadConfig(configPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for i, rule := range config.Rules {
+			bbox := rule.Bbox
+			config.Rules[i].Bbox[0], config.Rules[i].Bbox[1], config.Rules[i].Bbox[2], config.Rules[i].Bbox[3] = padBounds(bbox[0], bbox[1], bbox[2], bbox[3], padding, paddingPercent)
+		}
+		if len(config.Rules) > 0 {
+			zoomlevel, max_zoomlevel = config.ZoomRange()
+			xmin, ymin, xmax, ymax = config.Bounds()
+		}
+	}
+
+	if tileJSONUrl != "" {
+		tileJSON, err := fetchTileJSON(tileJSONUrl)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// The source's attribution is often a license requirement, so it
+		// comes along unless given explicitly.
+		if name == "" {
+			name = tileJSON.Name
+		}
+		if description == "" {
+			description = tileJSON.Description
+		}
+		if attribution == "" {
+			attribution = tileJSON.Attribution
+		}
+		zoomlevel, max_zoomlevel, err = tileJSON.ClampZoom(zoomlevel, max_zoomlevel)
+		if err != nil {
+			log.Fatal(err)
+		}
+		xmin, ymin, xmax, ymax, err = tileJSON.IntersectBounds(xmin, ymin, xmax, ymax)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var tiles []Tile
+	var manifest *Manifest
+	if _, statErr := os.Stat(manifestPath(filename)); resume && statErr == nil {
+		manifest, tiles, err = openManifest(filename)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Resuming from", manifestPath(filename), ",", len(tiles), "tiles left")
+		if len(tiles) == 0 {
+			manifest.Remove()
+			db, err := prepareDatabase(filename, true)
+			if err == nil {
+				err = setIncomplete(db, false)
+				db.Close()
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+		zoomlevel, max_zoomlevel = zoomRange(tiles)
+	} else if tilesFrom != "" {
+		var err error
+		tiles, err = readTileList(tilesFrom)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(tiles) > 0 {
+			zoomlevel, max_zoomlevel = zoomRange(tiles)
+		}
+	} else {
+		err = validateZoomRange(zoomlevel, max_zoomlevel)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var excluded map[int]bool
+	if excludeZooms != "" {
+		if tilesFrom != "" {
+			log.Fatal("-exclude-zooms can't be used with -tiles-from")
+		}
+		excluded, err = parseExcludeZooms(excludeZooms, zoomlevel, max_zoomlevel)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	proj := NewProjection(xmin, ymin, xmax, ymax, zoomlevel, max_zoomlevel, excluded, maptype)
+	if format != "" {
+		tileFormat, err := imageFormatForExtension(format)
+		if err != nil {
+			log.Fatal(err)
+		}
+		proj.SetTileFormat(tileFormat)
+	} else if url_format != MAPTYPES[maptype].URLTemplate {
+		// A custom source: guess from its url, or else from the first tile.
+		if tileFormat, ok := formatForUrlTemplate(url_format); ok {
+			proj.SetTileFormat(tileFormat)
+		} else {
+			log.Println("No -format given and the url has no tile extension, taking the format from the first tile")
+			writerOptions.DetectFormat = true
+		}
+	}
+	if fetchOptions.OverlayFormat != "" {
+		// Composited tiles are always encoded as PNG.
+		proj.SetTileFormat(PNG_IMAGE_FORMAT)
+	}
+	if displayMinZoom >= 0 {
+		if displayMinZoom >= zoomlevel || zoomlevel-displayMinZoom > MAX_UNDERZOOM_LEVELS {
+			log.Fatalf("-display-minzoom must be below zoomlevel (%d) by at most %d levels", zoomlevel, MAX_UNDERZOOM_LEVELS)
+		}
+		proj.SetDisplayMinZoom(displayMinZoom)
+	}
+	if overzoomTo > 0 {
+		if overzoomTo <= max_zoomlevel || overzoomTo > MAX_ZOOM_LEVEL_LIMIT {
+			log.Fatalf("-overzoom-to must be above max_zoomlevel (%d) and at most %d", max_zoomlevel, MAX_ZOOM_LEVEL_LIMIT)
+		}
+		if tileFormat := proj.metaData.TileFormat(); tileFormat != PNG_IMAGE_FORMAT && tileFormat != JPG_IMAGE_FORMAT {
+			log.Fatal("-overzoom-to only works with png and jpg tiles")
+		}
+	}
+	proj.SetSourceUrl(url_format)
+	proj.SetDescription(name, description, attribution)
+	if encoding != "" {
+		proj.SetEncoding(encoding)
+	}
+	if tileMaxAge > 0 {
+		proj.SetMaxAge(tileMaxAge)
+	}
+	if manifest == nil && tilesFrom == "" {
+		proj.SetZoomRules(config.Rules)
+		if maxZoomTiles > 0 {
+			for _, zoom := range proj.levels {
+				if count := proj.TileCount(zoom); count > maxZoomTiles {
+					log.Fatalf("Zoom level %d needs %d tiles, above -max-zoom-tiles-per-level %d; lower -max_zoomlevel or shrink the bounds", zoom, count, maxZoomTiles)
+				}
+			}
+		}
+		tiles = proj.TileList()
+		if center != "" {
+			tiles = tilesInRadius(proj, tiles, centerLon, centerLat, radius)
+		}
+		if shapefile != "" {
+			tiles = tilesInPolygon(proj, tiles, clip)
+		}
+	}
+	if manifest == nil && (includeTiles != "" || excludeTiles != "") {
+		var include, exclude []tilePattern
+		if includeTiles != "" {
+			include, err = readTilePatterns(includeTiles)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		if excludeTiles != "" {
+			exclude, err = readTilePatterns(excludeTiles)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		var added, removed int
+		tiles, added, removed, err = filterTiles(tiles, include, exclude, zoomlevel, max_zoomlevel, xmin, ymin, xmax, ymax)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if includeTiles != "" {
+			log.Println("Added", added, "tiles from", includeTiles)
+		}
+		if excludeTiles != "" {
+			log.Println("Left out", removed, "tiles matching", excludeTiles)
+		}
+	}
+	if len(tiles) == 0 {
+		log.Println("Not enough number of tiles. Please give proper bounds.")
+		os.Exit(1)
+	} else {
+		log.Println("Filename: ", filename, " Zoom level ", zoomlevel, "-", max_zoomlevel, "  Number of tiles ", len(tiles))
+	}
+	if checkSource {
+		err = checkConnectivity(url_format, preflightTile(tiles), proj.metaData.TileFormat(), fetchOptions.AttemptTimeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if estimateSample > 0 {
+		if estimateSample > ESTIMATE_SAMPLE_LIMIT {
+			log.Println("-estimate-from-sample is capped at", ESTIMATE_SAMPLE_LIMIT, "tiles per zoom level")
+			estimateSample = ESTIMATE_SAMPLE_LIMIT
+		}
+		log.Println("Fetching a sample of up to", estimateSample, "tiles per zoom level")
+		printEstimate(os.Stdout, estimateFromSample(url_format, tiles, estimateSample, fetchOptions.AttemptTimeout, rand.New(rand.NewSource(seed))))
+		return
+	}
+
+
+	var errorLog *os.File
+	if errorLogPath != "" {
+		var err error
+		errorLog, err = os.Create(errorLogPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer errorLog.Close()
+	}
+
+	_, statErr := os.Stat(filename)
+	appending := appendTiles && statErr == nil
+	if statErr == nil && !resume && !appending && isIncomplete(filename) {
+		log.Fatalf("%s is left over from an unfinished run; finish it with -resume, or remove it to start over", filename)
+	}
+	db, err := prepareDatabase(filename, resume || appending)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	if resume || appending {
+		// An existing file keeps the layout it was created with.
+		dedup, err = hasDedupLayout(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		metadata, err := readMetadata(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		writerOptions.TileDir = tileFilesDir(filename, metadata)
+		if writerOptions.TileDir == "" && tileFiles != "" {
+			log.Fatalf("%s stores its tiles inside, -tile-files can't be used to add to it", filename)
+		} else if writerOptions.TileDir != "" && tileFiles == "" {
+			log.Fatalf("%s keeps its tiles in %s, run again with -tile-files", filename, writerOptions.TileDir)
+		}
+		stored := metadata[COMPRESSION_KEY]
+		if compression != "" && compression != stored {
+			if stored == "" {
+				log.Fatalf("%s stores its tiles uncompressed, -compress can't be used to add to it", filename)
+			}
+			log.Fatalf("%s stores %s tiles, -compress %s can't be used to add to it", filename, stored, compression)
+		} else if compression == "" && stored != "" {
+			compression = stored
+			checkTileLayout("-compress", compression+" data", compressConflicts)
+		}
+		// A -compact file gets its indexes back for the writes.
+		err = ensureIndexes(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Once a file has hashes they have to follow every tile.
+		hashed, err := hasTileHashes(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		storeHashes = storeHashes || hashed
+	}
+
+	if resume && manifest == nil {
+		existing, err := readTileCoords(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tiles = skipExistingTiles(tiles, existing)
+		log.Println("Resuming,", len(existing), "tiles already stored,", len(tiles), "tiles left")
+		if len(tiles) == 0 {
+			err = setIncomplete(db, false)
+			if err != nil {
+				log.Fatal(err)
+			}
+			return
+		}
+	} else if appending {
+		err = mergeExtentMetadata(db, proj.MetaDataItems())
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else if !resume {
+		err = setupMBTileTables(db, proj, dedup)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if tileFiles != "" {
+			writerOptions.TileDir = tileFiles
+			err = recordTileFiles(db, filename, tileFiles)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	if compression != "" {
+		writerOptions.Compression = compression
+		_, err = db.Exec("insert or replace into metadata (name, value) values (?, ?);", COMPRESSION_KEY, compression)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if storeHashes {
+		count, err := createTileHashes(db, tileLayout{Dir: writerOptions.TileDir, Compression: writerOptions.Compression})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if count > 0 {
+			log.Println("Hashed the", count, "tiles already stored")
+		}
+		writerOptions.StoreHashes = true
+	}
+	if manifest == nil {
+		manifest, err = createManifest(filename, tiles)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	err = setIncomplete(db, true)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if zoomFormatRules != nil {
+		lastZoom := max_zoomlevel
+		if overzoomTo > 0 {
+			lastZoom = overzoomTo
+		}
+		err = recordZoomFormats(db, zoomFormatRules, proj.metaData.TileExtension(), zoomlevel, max_zoomlevel, lastZoom)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if shuffle {
+		log.Println("Shuffling tiles with -seed", seed)
+		shuffleTiles(tiles, rand.New(rand.NewSource(seed)))
+	}
+
+	writerOptions.DeclaredFormat = proj.metaData.TileFormat()
+	writerOptions.Overwrite = resume
+	writerOptions.SkipExisting = appending
+	if !updateSince.IsZero() {
+		// Changed tiles replace the ones already stored.
+		writerOptions.Overwrite = true
+	}
+	stats := &Stats{TilesTotal: int64(len(tiles))}
+	writerOptions.Stats = stats
+	if dedup {
+		writerOptions.Hasher = hasher
+		if dedupeThreshold > 0 {
+			err = addInlineColumn(db)
+			if err != nil {
+				log.Fatal(err)
+			}
+			_, err = db.Exec("create index if not exists map_tile_id on map (tile_id);")
+			if err != nil {
+				log.Fatal(err)
+			}
+			writerOptions.Inline = newInlineCounter(dedupeThreshold)
+		}
+	} else if dedupeThreshold > 0 {
+		log.Fatal("-dedupe-threshold needs the deduplicated layout of -dedup")
+	}
+	if grayscale {
+		writerOptions.Processors = append(writerOptions.Processors, grayscaleProcessor)
+	}
+	if zoomFormatRules != nil {
+		writerOptions.Processors = append(writerOptions.Processors, newZoomFormatProcessor(zoomFormatRules))
+	}
+	if watermark != "" {
+		processor, err := newWatermarkProcessor(watermark)
+		if err != nil {
+			log.Fatal(err)
+		}
+		writerOptions.Processors = append(writerOptions.Processors, processor)
+	}
+	tilePipe := make(chan Tile, len(tiles))
+	outputPipe := make(chan Tile, len(tiles))
+	errorPipe := make(chan TileError, len(tiles))
+
+	var writers sync.WaitGroup
+	for w := 0; w < 1; w++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			mbTileWorker(db, tilePipe, outputPipe, errorPipe, writerOptions)
+		}()
+	}
+	go func() {
+		// The writers are the last to send, after the fetchers are done, so
+		// the results end here even if a tile never produced one.
+		writers.Wait()
+		close(outputPipe)
+		close(errorPipe)
+	}()
+
+	fetchOptions.UrlFormat = url_format
+	if len(templates) > 1 {
+		fetchOptions.Mirrors = newMirrorSet(templates)
+		defer fetchOptions.Mirrors.LogSummary()
+	}
+	fetchOptions.Limiter = newRateLimiter(rate)
+	if hostLimits.Active() {
+		fetchOptions.HostLimits = hostLimits
+	}
+	if timingLogPath != "" {
+		fetchOptions.Timing, err = newTimingLog(timingLogPath)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	fetchOptions.DecodeImages = fetchOptions.OverlayFormat != ""
+	if concurrencyAuto {
+		fetchOptions.Controller = newConcurrencyController(workers)
+		fetchOptions.Controller.Start(AUTO_ADJUST_INTERVAL)
+		defer fetchOptions.Controller.Stop()
+	}
+	runCtx, cancelRun := context.WithCancel(context.Background())
+	if maxRuntime > 0 {
+		runCtx, cancelRun = context.WithTimeout(context.Background(), maxRuntime)
+	}
+	defer cancelRun()
+	var progress *progressReporter
+	if progressJSON != "" {
+		progress, err = newProgressReporter(progressJSON, len(tiles))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	go fetchByZoom(runCtx, tiles, workers, tilePipe, errorPipe, fetchOptions)
+
+	// abandon leaves the file for -resume, or removes it when it was only a
+	// temporary step, and exits with an error.
+	done := 0
+	abandon := func() {
+		progress.Finish(done, stats.Snapshot())
+		if temporary {
+			manifest.Remove()
+			os.Remove(filename)
+		} else {
+			manifest.Close()
+		}
+		os.Exit(1)
+	}
+	requiredSuccess, err := minSuccessCount(minSuccess, len(tiles))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var extent *extentTracker
+	var metadataBefore map[string]string
+	if liveMetadata {
+		extent = newExtentTracker()
+		metadataBefore, err = readMetadata(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// Waiting to complete the creation of db.
+	window := newFailureWindow(failureWindowSize)
+	for outputPipe != nil || errorPipe != nil {
+		select {
+		case tile, ok := <-outputPipe:
+			if !ok {
+				outputPipe = nil
+				continue
+			}
+			if tile.NotModified {
+				stats.AddUnchanged()
+			} else if tile.Skipped {
+				stats.AddSkipped()
+			} else {
+				stats.AddStored()
+			}
+			window.Add(false)
+			err = manifest.MarkDone(tile)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if extent != nil && !tile.Skipped {
+				extent.Add(proj, tile)
+				err = extent.Flush(db)
+				if err != nil {
+					log.Println("Updating the live metadata:", err)
+				}
+			}
+		case tileErr, ok := <-errorPipe:
+			if !ok {
+				errorPipe = nil
+				continue
+			}
+			stats.AddFailed()
+			window.Add(true)
+			log.Println("Giving up on tile", tileErr.Tile, ":", tileErr.Err)
+			if errorLog != nil {
+				fmt.Fprintln(errorLog, tileErr.Tile)
+			}
+			if failFast {
+				log.Println("Aborting on the first failed tile, -fail-fast is set")
+				abandon()
+			}
+		}
+		done++
+		progress.Update(done, stats.Snapshot())
+		if maxFailureRate > 0 && window.Full() && window.Rate() > maxFailureRate {
+			log.Printf("Aborting: %.0f%% of the last %d tiles failed, above -max-failure-rate %.2f", window.Rate()*100, failureWindowSize, maxFailureRate)
+			progress := stats.Snapshot()
+			log.Println("Stored", progress.TilesStored, "tiles, failed", progress.TilesFailed, "tiles,", len(tiles)-done, "tiles remaining in", filename)
+			abandon()
+		}
+	}
+	stopped := runCtx.Err() == context.DeadlineExceeded && done < len(tiles)
+	if stopped {
+		log.Printf("Stopped after -max-runtime %s with %d tiles remaining, run again with -resume to continue", maxRuntime, len(tiles)-done)
+	} else if done < len(tiles) {
+		// Should not happen; counted as failed so -resume fetches them.
+		log.Println(len(tiles)-done, "tiles were neither stored nor reported as failed")
+		for ; done < len(tiles); done++ {
+			stats.AddFailed()
+		}
 	}
-
-	err = optimizeConnection(db)
-	if err != nil {
-		return nil, err
+	progress.Finish(done, stats.Snapshot())
+	if liveMetadata {
+		err = restoreLiveMetadata(db, metadataBefore)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	return db, nil
-}
-
-func setupMBTileTables(db *sql.DB, proj *Projection) error {
-
-	_, err := db.Exec("create table if not exists tiles (zoom_level integer, tile_column integer, tile_row integer, tile_data blob);")
-	if err != nil {
-		return err
+	if progress := stats.Snapshot(); !stopped && int(progress.TilesStored+progress.TilesUnchanged) < requiredSuccess {
+		log.Printf("Only %d of %d tiles succeeded, below -min-success %s; not finishing %s", progress.TilesStored+progress.TilesUnchanged, len(tiles), minSuccess, output)
+		abandon()
 	}
-
-	_, err = db.Exec("create table if not exists metadata (name text, value text);")
-	if err != nil {
-		return err
+	if stopped && !temporary {
+		manifest.Close()
+	} else if failed := stats.Snapshot().TilesFailed; failed > 0 && !temporary {
+		log.Println("Failed to fetch", failed, "of", len(tiles), "tiles, run again with -resume to retry them")
+		manifest.Close()
+	} else {
+		manifest.Remove()
+		err = setIncomplete(db, false)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
 
-	_, err = db.Exec("create unique index name on metadata (name);")
-	if err != nil {
-		return err
+	if overzoomTo > 0 {
+		options := writerOptions
+		options.Overwrite, options.SkipExisting = false, true
+		count, err := overzoomTiles(db, proj, max_zoomlevel, overzoomTo, options)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Overzoomed", count, "tiles up to zoom", overzoomTo)
 	}
 
-	_, err = db.Exec("create unique index tile_index on tiles(zoom_level, tile_column, tile_row);")
-	if err != nil {
-		return err
+	if embedPreviewTile {
+		err = embedPreview(db, proj)
+		if err != nil {
+			log.Println("Not embedding a preview:", err)
+		}
 	}
 
-	// Load metadata.
-	for name, value := range proj.MetaDataItems() {
-		_, err := db.Exec("insert into metadata (name, value) values (?, ?)", name, value)
+	if stripKeys != "" || stripUuid {
+		var keys []string
+		if stripKeys != "" {
+			keys = strings.Split(stripKeys, ",")
+		}
+		err = stripMetadata(db, keys, stripUuid, output)
 		if err != nil {
-			return err
+			log.Fatal(err)
 		}
 	}
 
-	return nil
-}
-
-func optimizeConnection(db *sql.DB) error {
-	_, err := db.Exec("PRAGMA synchronous=0")
-	if err != nil {
-		return err
-	}
-	_, err = db.Exec("PRAGMA locking_mode=EXCLUSIVE")
-	if err != nil {
-		return err
+	if optimizeLayoutFlag {
+		err = optimizeLayout(db, dedup)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-	_, err = db.Exec("PRAGMA journal_mode=DELETE")
-	if err != nil {
-		return err
+	var shards []shardInfo
+	if shardSize > 0 {
+		if stopped || stats.Snapshot().TilesFailed > 0 {
+			log.Println("Not splitting", output, "until every tile is fetched")
+		} else {
+			shards, err = writeShards(db, output, shardSize, compact)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 	}
-	return nil
-}
-
-func optimizeDatabase(db *sql.DB) error {
-	_, err := db.Exec("ANALYZE;")
-	if err != nil {
-		return err
+	// The shards replace the file, vacuuming it would only take a third
+	// copy's worth of disk.
+	if len(shards) == 0 {
+		if compact {
+			err = dropIndexes(db)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		err = optimizeDatabase(db)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-
-	_, err = db.Exec("VACUUM;")
-	if err != nil {
-		return err
+	finalFile := filename
+	if pmtiles {
+		err = writePMTiles(db, output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if output != STDOUT_FILENAME {
+			finalFile = output
+		}
 	}
-
-	return nil
-}
-
-func main() {
-	numCpus := runtime.NumCPU()
-	log.Println("MbtileGo Version:", VERSION, "Number of CPUs:", numCpus)
-	runtime.GOMAXPROCS(numCpus)
-	var xmin, ymin, xmax, ymax float64
-	var zoomlevel, maptype, max_zoomlevel int
-	var filename string
-
-	sigs := make(chan os.Signal, 1)
-
-	signal.Notify(sigs, syscall.SIGKILL, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		sig := <-sigs
-		log.Println("Exit signal received.")
-		log.Println(sig)
-		os.Exit(1)
-	}()
-
-	flag.Float64Var(&xmin, "xmin", 55.397945, "Minimum longitude")
-	flag.Float64Var(&xmax, "xmax", 55.402741, "Maximum longitude")
-	flag.Float64Var(&ymin, "ymin", 25.291090, "Minimum latitude")
-	flag.Float64Var(&ymax, "ymax", 25.292889, "Maximum latitude")
-	flag.StringVar(&filename, "filename", "ouputFile.mbtile", "Output file to generate")
-	flag.IntVar(&zoomlevel, "zoomlevel", 19, "Zoom level")
-	flag.IntVar(&maptype, "maptype", 0, "0 for Google, 1 for OSM, 2 for mapbox satellite street")
-	flag.IntVar(&max_zoomlevel, "max_zoomlevel", MAX_ZOOM_LEVEL, "Maximum zoomlevel to which tiles should be added")
-	flag.Parse()
-
-	proj := NewProjection(xmin, ymin, xmax, ymax, zoomlevel, max_zoomlevel, maptype)
-	tiles := proj.TileList()
-	if len(tiles) == 0 {
-		log.Println("Not enough number of tiles. Please give proper bounds.")
-		os.Exit(1)
-	} else {
-		log.Println("Filename: ", filename, " Zoom level ", zoomlevel, "-", max_zoomlevel, "  Number of tiles ", len(tiles))
+	if output != STDOUT_FILENAME {
+		log.Println("Generated ", output)
 	}
 
-
-	db, err := prepareDatabase(filename)
+	final, err := stats.Finish(finalFile)
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
-
-	err = setupMBTileTables(db, proj)
-	if err != nil {
-		log.Fatal(err)
+	if fetchOptions.Timing != nil {
+		p50, p95, p99 := fetchOptions.Timing.Percentiles()
+		final.FetchP50Ms, final.FetchP95Ms, final.FetchP99Ms = p50.Seconds()*1000, p95.Seconds()*1000, p99.Seconds()*1000
+		err = fetchOptions.Timing.Close()
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-
-	inputPipe := make(chan Tile, len(tiles))
-	tilePipe := make(chan Tile, len(tiles))
-	outputPipe := make(chan Tile, len(tiles))
-
-	for w := 0; w < 20; w++ {
-		go tileFetcher(inputPipe, tilePipe, maptype)
+	log.Println(final)
+	if coverageGeoJSON != "" {
+		coords, err := readTileCoords(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = writeCoverageGeoJSON(coverageGeoJSON, coords)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-
-	for w := 0; w < 1; w++ {
-		go mbTileWorker(db, tilePipe, outputPipe)
+	if tileJSONOut != "" {
+		metadata, err := readMetadata(db)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = writeTileJSON(tileJSONOut, tileJSONForMetadata(metadata, "http://"+DEFAULT_SERVE_ADDR+"/xyz"))
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-
-	for _, tile := range tiles {
-		inputPipe <- tile
+	if tileIndexOut != "" {
+		count, err := writeTileIndex(tileIndexOut, db, writerOptions.TileDir)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Listed", count, "tiles in", tileIndexOut)
 	}
-
-	// Waiting to complete the creation of db.
-	for i := 0; i < len(tiles); i++ {
-		<-outputPipe
+	if statsJSON != "" {
+		err = writeStatsJSON(statsJSON, final)
+		if err != nil {
+			log.Fatal(err)
+		}
 	}
-
-	err = optimizeDatabase(db)
-	if err != nil {
-		log.Fatal(err)
+	if packageFile != "" {
+		files := []string{finalFile}
+		for _, sidecar := range []string{tileJSONOut, coverageGeoJSON, statsJSON, tileIndexOut} {
+			if sidecar != "" {
+				files = append(files, sidecar)
+			}
+		}
+		// Closed first so everything SQLite holds back is in the file.
+		db.Close()
+		err = writePackage(packageFile, files)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Packaged", strings.Join(files, ", "), "into", packageFile)
+	}
+	if output == STDOUT_FILENAME && !pmtiles {
+		db.Close()
+		err = streamFile(filename, os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(shards) > 0 {
+		// Only removed now that every shard and the index are written.
+		db.Close()
+		err = os.Remove(output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Split", output, "into", len(shards), "files of at most", formatBytes(shardSize), "listed in", shardIndexFilename(output))
 	}
-	log.Println("Generated ", filename)
-
 }
 
 type Projection struct {
 	Bc, Cc, Ac             []float64
 	Zc                     [][]float64
 	levels                 []int
+	rules                  []ZoomRule
 	xmin, ymin, xmax, ymax float64
 	metaData               MetaData
 }
 
-func NewProjection(xmin, ymin, xmax, ymax float64, zoomlevel, max_zoomlevel int, maptype int) *Projection {
+// NewProjection covers the zoom levels from zoomlevel to max_zoomlevel,
+// leaving out the excluded ones.
+func NewProjection(xmin, ymin, xmax, ymax float64, zoomlevel, max_zoomlevel int, excluded map[int]bool, maptype int) *Projection {
 	proj := Projection{xmin: xmin, ymin: ymin, xmax: xmax, ymax: ymax}
 	for i := zoomlevel; i <= max_zoomlevel; i++ {
+		if excluded[i] {
+			continue
+		}
 		proj.levels = append(proj.levels, i)
 	}
 
@@ -287,46 +2655,217 @@ func NewProjection(xmin, ymin, xmax, ymax float64, zoomlevel, max_zoomlevel int,
 		c = c * 2
 	}
 	bounds := fmt.Sprintf("%f,%f,%f,%f", xmin, ymin, xmax, ymax)
-	proj.metaData = NewMetaData(MAP_IMAGE_TYPES[maptype], zoomlevel, max_zoomlevel, bounds)
+	proj.metaData = NewMetaData(MAPTYPES[maptype].Format, zoomlevel, max_zoomlevel, bounds)
 	return &proj
 }
 
+// project_pixels returns the global pixel position of a longitude and
+// latitude at zoom. It is not rounded: a point belongs to the tile it falls
+// in, however close to the edge, which is how mercantile and other reference
+// tilers pick the tiles covering a bounding box. Rounding to whole pixels
+// dropped or added a tile when a bound was within half a pixel of a tile
+// edge.
 func (proj *Projection) project_pixels(x, y float64, zoom int) []float64 {
 	d := proj.Zc[zoom]
-	e := Round(d[0] + x*proj.Bc[zoom])
+	e := d[0] + x*proj.Bc[zoom]
 	f := minMax(math.Sin(DEG_TO_RAD*y), -0.9999, 0.9999)
-	g := Round(d[1] + 0.5*math.Log((1+f)/(1-f))*-proj.Cc[zoom])
+	g := d[1] + 0.5*math.Log((1+f)/(1-f))*-proj.Cc[zoom]
 	return []float64{e, g}
 }
 
+// TileBounds returns the longitude/latitude bounding box of the XYZ tile.
+func (proj *Projection) TileBounds(z, x, y int) (xmin, ymin, xmax, ymax float64) {
+	xmin, ymax = tileToLonLat(z, float64(x), float64(y))
+	xmax, ymin = tileToLonLat(z, float64(x+1), float64(y+1))
+	return xmin, ymin, xmax, ymax
+}
+
+// tileNeighborhoodBounds returns the bounds of the XYZ tile and radius tiles
+// around it on every side, cut off at the edges of the world. They are kept
+// a millionth of a tile inside the outer tile edges, which the round trip
+// through latitudes would otherwise move onto the tiles beyond.
+func tileNeighborhoodBounds(tile Tile, radius int) (xmin, ymin, xmax, ymax float64) {
+	const inset = 1e-6
+	last := (1 << uint(tile.z)) - 1
+	clamp := func(i int) int {
+		return int(math.Max(0, math.Min(float64(last), float64(i))))
+	}
+	x0, y0 := clamp(tile.x-radius), clamp(tile.y-radius)
+	x1, y1 := clamp(tile.x+radius), clamp(tile.y+radius)
+	xmin, ymax = tileToLonLat(tile.z, float64(x0)+inset, float64(y0)+inset)
+	xmax, ymin = tileToLonLat(tile.z, float64(x1+1)-inset, float64(y1+1)-inset)
+	return xmin, ymin, xmax, ymax
+}
+
+// TileCenter returns the longitude and latitude of the centre pixel of the
+// XYZ tile. Because of the Mercator stretch this is slightly poleward of the
+// midpoint of the tile's latitude range.
+func (proj *Projection) TileCenter(z, x, y int) (lon, lat float64) {
+	return tileToLonLat(z, float64(x)+0.5, float64(y)+0.5)
+}
+
+// tileToLonLat is the inverse Mercator projection of a fractional tile
+// coordinate at the given zoom.
+func tileToLonLat(zoom int, x, y float64) (lon, lat float64) {
+	n := math.Pow(2, float64(zoom))
+	lon = x/n*360.0 - 180.0
+	lat = RAD_TO_DEG * math.Atan(math.Sinh(math.Pi*(1-2*y/n)))
+	return lon, lat
+}
+
 func (proj *Projection) TileList() []Tile {
+	if len(proj.rules) > 0 {
+		return proj.ruleTileList()
+	}
 	var tilelist []Tile
+	for _, zoom := range proj.levels {
+		tilelist = append(tilelist, proj.tilesInBounds(proj.xmin, proj.ymin, proj.xmax, proj.ymax, zoom)...)
+	}
+	return tilelist
+}
+
+// SetZoomRules restricts each zoom level to the bounding boxes of the rules
+// covering it instead of the projection bounds.
+func (proj *Projection) SetZoomRules(rules []ZoomRule) {
+	proj.rules = rules
+}
 
+// ruleTileList returns the union of the tiles covered by each zoom rule.
+func (proj *Projection) ruleTileList() []Tile {
+	var tilelist []Tile
+	seen := make(map[[3]int]bool)
 	for _, zoom := range proj.levels {
-		two_power_zoom := math.Pow(2, float64(zoom))
-		px0 := proj.project_pixels(proj.xmin, proj.ymax, zoom) // left top
-		px1 := proj.project_pixels(proj.xmax, proj.ymin, zoom) // right bottom
-		xrangeStart := int(px0[0] / DEFAULT_TILE_SIZE)
-		xrangeEnd := int(px1[0] / DEFAULT_TILE_SIZE)
-		for x := xrangeStart; x <= xrangeEnd; x++ {
-			if x < 0 || float64(x) >= two_power_zoom {
+		for _, rule := range proj.rules {
+			if zoom < rule.MinZoom || zoom > rule.MaxZoom {
 				continue
 			}
-			yrangeStart := int(px0[1] / DEFAULT_TILE_SIZE)
-			yrangeEnd := int(px1[1] / DEFAULT_TILE_SIZE)
-			for y := yrangeStart; y <= yrangeEnd; y++ {
-				if y < 0 || float64(y) >= two_power_zoom {
+			for _, tile := range proj.tilesInBounds(rule.Bbox[0], rule.Bbox[1], rule.Bbox[2], rule.Bbox[3], zoom) {
+				key := [3]int{tile.z, tile.x, tile.y}
+				if seen[key] {
 					continue
 				}
-				// y = (int(two_power_zoom) - 1) - y
-				tilelist = append(tilelist, Tile{z: zoom, x: x, y: y})
+				seen[key] = true
+				tilelist = append(tilelist, tile)
 			}
 		}
+	}
+	return tilelist
+}
 
+func (proj *Projection) tilesInBounds(xmin, ymin, xmax, ymax float64, zoom int) []Tile {
+	var tilelist []Tile
+	xrangeStart, xrangeEnd, yrangeStart, yrangeEnd := proj.tileRange(xmin, ymin, xmax, ymax, zoom)
+	for x := xrangeStart; x <= xrangeEnd; x++ {
+		for y := yrangeStart; y <= yrangeEnd; y++ {
+			// y = (int(two_power_zoom) - 1) - y
+			tilelist = append(tilelist, Tile{z: zoom, x: x, y: y})
+		}
 	}
 	return tilelist
 }
 
+// tileRange returns the columns and rows of the tiles covering the bounds at
+// zoom, limited to the tiles that exist. The range is empty when the end is
+// before the start.
+func (proj *Projection) tileRange(xmin, ymin, xmax, ymax float64, zoom int) (x0, x1, y0, y1 int) {
+	last := int(math.Pow(2, float64(zoom))) - 1
+	px0 := proj.project_pixels(xmin, ymax, zoom) // left top
+	px1 := proj.project_pixels(xmax, ymin, zoom) // right bottom
+	x0 = int(math.Floor(px0[0] / DEFAULT_TILE_SIZE))
+	x1 = lastTileIndex(px1[0], x0)
+	y0 = int(math.Floor(px0[1] / DEFAULT_TILE_SIZE))
+	y1 = lastTileIndex(px1[1], y0)
+	if x0 < 0 {
+		x0 = 0
+	}
+	if y0 < 0 {
+		y0 = 0
+	}
+	if x1 > last {
+		x1 = last
+	}
+	if y1 > last {
+		y1 = last
+	}
+	return x0, x1, y0, y1
+}
+
+// TileCount returns the number of tiles TileList has at zoom without listing
+// them. With zoom rules it is an upper bound, since overlapping rules are
+// counted twice.
+func (proj *Projection) TileCount(zoom int) int {
+	bboxes := [][4]float64{{proj.xmin, proj.ymin, proj.xmax, proj.ymax}}
+	if len(proj.rules) > 0 {
+		bboxes = nil
+		for _, rule := range proj.rules {
+			if zoom >= rule.MinZoom && zoom <= rule.MaxZoom {
+				bboxes = append(bboxes, rule.Bbox)
+			}
+		}
+	}
+	count := 0
+	for _, bbox := range bboxes {
+		x0, x1, y0, y1 := proj.tileRange(bbox[0], bbox[1], bbox[2], bbox[3], zoom)
+		if x1 >= x0 && y1 >= y0 {
+			count += (x1 - x0 + 1) * (y1 - y0 + 1)
+		}
+	}
+	return count
+}
+
+// SetSourceUrl records the tile url template in the metadata, so a resumed
+// run can download from the same source.
+func (proj *Projection) SetSourceUrl(sourceUrl string) {
+	proj.metaData.sourceUrl = sourceUrl
+}
+
+// SetMaxAge records how long clients may cache the tiles, which tile servers
+// send on as Cache-Control: max-age.
+func (proj *Projection) SetMaxAge(maxAge time.Duration) {
+	proj.metaData.maxAge = strconv.Itoa(int(maxAge.Seconds()))
+}
+
+// SetDisplayMinZoom records the lowest zoom viewers should show, below the
+// lowest zoom with tiles.
+func (proj *Projection) SetDisplayMinZoom(zoom int) {
+	proj.metaData.displayMinZoom = strconv.Itoa(zoom)
+}
+
+// SetDescription sets the name, description and attribution metadata,
+// leaving the ones that are empty as they are.
+func (proj *Projection) SetDescription(name, description, attribution string) {
+	if name != "" {
+		proj.metaData.name = name
+	}
+	if description != "" {
+		proj.metaData.description = description
+	}
+	if attribution != "" {
+		proj.metaData.attribution = attribution
+	}
+}
+
+// SetEncoding records how DEM tiles encode the elevation in their colors.
+func (proj *Projection) SetEncoding(encoding string) {
+	proj.metaData.encoding = encoding
+}
+
+// SetTileFormat overrides the tile format recorded in the metadata.
+func (proj *Projection) SetTileFormat(tileFormat string) {
+	proj.metaData.tileFormat = tileFormat
+}
+
+// lastTileIndex returns the index of the tile holding the right or bottom
+// edge of a box at pixel px. An edge lying exactly on a tile boundary only
+// touches the next tile, so that tile is not included.
+func lastTileIndex(px float64, start int) int {
+	end := int(math.Ceil(px/DEFAULT_TILE_SIZE)) - 1
+	if end < start {
+		return start
+	}
+	return end
+}
+
 func (proj *Projection) MetaDataItems() map[string]string {
 	return proj.metaData.Items()
 }
@@ -340,6 +2879,12 @@ type MetaData struct {
 	bounds      string
 	_type       string
 	version     string
+	sourceUrl   string
+	maxAge      string
+	encoding    string
+	attribution string
+	// displayMinZoom is empty unless set with SetDisplayMinZoom.
+	displayMinZoom string
 }
 
 func NewMetaData(tileFormat string, minZoom int, maxZoom int, bounds string) MetaData {
@@ -358,10 +2903,19 @@ func NewMetaData(tileFormat string, minZoom int, maxZoom int, bounds string) Met
 }
 
 func (metaData MetaData) TileExtension() string {
-	if metaData.tileFormat == PNG_IMAGE_FORMAT {
+	return extensionForFormat(metaData.tileFormat)
+}
+
+func extensionForFormat(tileFormat string) string {
+	switch tileFormat {
+	case PNG_IMAGE_FORMAT:
 		return PNG_EXTENSION
-	} else if metaData.tileFormat == JPG_IMAGE_FORMAT {
+	case JPG_IMAGE_FORMAT:
 		return JPG_EXTENSION
+	case WEBP_IMAGE_FORMAT:
+		return WEBP_EXTENSION
+	case PBF_FORMAT:
+		return PBF_EXTENSION
 	}
 	return PNG_EXTENSION
 }
@@ -385,17 +2939,148 @@ func (metaData MetaData) Items() map[string]string {
 		"minzoom":     metaData.minZoom,
 		"maxzoom":     metaData.maxZoom,
 	}
+	if metaData.sourceUrl != "" {
+		data["source_url"] = metaData.sourceUrl
+	}
+	if metaData.maxAge != "" {
+		data["maxage"] = metaData.maxAge
+	}
+	if metaData.encoding != "" {
+		data["encoding"] = metaData.encoding
+	}
+	if metaData.attribution != "" {
+		data["attribution"] = metaData.attribution
+	}
+	if metaData.displayMinZoom != "" {
+		data[DISPLAY_MINZOOM_KEY] = metaData.displayMinZoom
+	}
 	return data
 }
 
-func minMax(a, b, c float64) float64 {
-	max_of_a_b := math.Max(a, b)
-	return math.Min(max_of_a_b, c)
+// zoomValue is a zoom level flag that explains why fractional zooms are
+// refused instead of reporting a bare parse error.
+type zoomValue int
+
+func (zoom *zoomValue) String() string {
+	return strconv.Itoa(int(*zoom))
+}
+
+func (zoom *zoomValue) Set(value string) error {
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		if _, floatErr := strconv.ParseFloat(value, 64); floatErr == nil {
+			return fmt.Errorf("zoom levels are whole numbers, got %s", value)
+		}
+		return fmt.Errorf("expected a whole number zoom level, got %q", value)
+	}
+	*zoom = zoomValue(n)
+	return nil
+}
+
+// validateZoomRange checks the zoom levels given on the command line.
+func validateZoomRange(zoomlevel, max_zoomlevel int) error {
+	if zoomlevel < 0 || zoomlevel > MAX_ZOOM_LEVEL_LIMIT {
+		return fmt.Errorf("zoomlevel (%d) must be between 0 and %d", zoomlevel, MAX_ZOOM_LEVEL_LIMIT)
+	}
+	if max_zoomlevel < 0 || max_zoomlevel > MAX_ZOOM_LEVEL_LIMIT {
+		return fmt.Errorf("max_zoomlevel (%d) must be between 0 and %d", max_zoomlevel, MAX_ZOOM_LEVEL_LIMIT)
+	}
+	if max_zoomlevel < zoomlevel {
+		return fmt.Errorf("max_zoomlevel (%d) must be >= zoomlevel (%d)", max_zoomlevel, zoomlevel)
+	}
+	return nil
+}
+
+// parseExcludeZooms parses -exclude-zooms. The zooms must lie strictly
+// between zoomlevel and max_zoomlevel, which stay the minzoom and maxzoom
+// of the file.
+func parseExcludeZooms(value string, zoomlevel, max_zoomlevel int) (map[int]bool, error) {
+	excluded := make(map[int]bool)
+	for _, part := range strings.Split(value, ",") {
+		zoom, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid -exclude-zooms %q, expected comma separated zoom levels", value)
+		}
+		if zoom <= zoomlevel || zoom >= max_zoomlevel {
+			return nil, fmt.Errorf("-exclude-zooms %d must be between zoomlevel (%d) and max_zoomlevel (%d); change those to drop the first or last level", zoom, zoomlevel, max_zoomlevel)
+		}
+		excluded[zoom] = true
+	}
+	return excluded, nil
+}
+
+// validateBounds checks the bounding box given on the command line.
+func validateBounds(xmin, ymin, xmax, ymax float64) error {
+	if xmin < -180 || xmax > 180 {
+		return fmt.Errorf("longitudes must be between -180 and 180, got xmin %v and xmax %v", xmin, xmax)
+	}
+	if ymin < -90 || ymax > 90 {
+		return fmt.Errorf("latitudes must be between -90 and 90, got ymin %v and ymax %v", ymin, ymax)
+	}
+	if xmin >= xmax {
+		return fmt.Errorf("xmin (%v) must be less than xmax (%v)", xmin, xmax)
+	}
+	if ymin >= ymax {
+		return fmt.Errorf("ymin (%v) must be less than ymax (%v)", ymin, ymax)
+	}
+	return nil
 }
 
-func Round(value float64) float64 {
-	if value < 0 {
-		return math.Ceil(value - 0.5)
+// parsePadding parses a -bbox-padding value, either degrees ("0.01") or a
+// percentage of the box size ("10%").
+func parsePadding(value string) (padding float64, percent bool, err error) {
+	value = strings.TrimSpace(value)
+	if strings.HasSuffix(value, "%") {
+		percent = true
+		value = strings.TrimSuffix(value, "%")
 	}
-	return math.Floor(value + 0.5)
+	padding, err = strconv.ParseFloat(value, 64)
+	if err != nil || padding < 0 {
+		return 0, false, fmt.Errorf("invalid -bbox-padding %q, expected degrees or a percentage", value)
+	}
+	return padding, percent, nil
+}
+
+// minSuccessCount returns how many of total tiles -min-success requires: a
+// count like 500, a fraction like 0.9 or a percentage like 90%.
+func minSuccessCount(value string, total int) (int, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, nil
+	}
+	if strings.HasSuffix(value, "%") || strings.Contains(value, ".") {
+		fraction, err := strconv.ParseFloat(strings.TrimSuffix(value, "%"), 64)
+		if strings.HasSuffix(value, "%") {
+			fraction /= 100
+		}
+		if err != nil || fraction < 0 || fraction > 1 {
+			return 0, fmt.Errorf("invalid -min-success %q, expected a tile count, a fraction or a percentage", value)
+		}
+		return int(math.Ceil(fraction * float64(total))), nil
+	}
+	count, err := strconv.Atoi(value)
+	if err != nil || count < 0 {
+		return 0, fmt.Errorf("invalid -min-success %q, expected a tile count, a fraction or a percentage", value)
+	}
+	return count, nil
+}
+
+// padBounds grows the bounding box by padding on every side, in degrees or as
+// a percentage of its width and height, clamped to the valid lon/lat range.
+func padBounds(xmin, ymin, xmax, ymax, padding float64, percent bool) (float64, float64, float64, float64) {
+	padX, padY := padding, padding
+	if percent {
+		padX = (xmax - xmin) * padding / 100
+		padY = (ymax - ymin) * padding / 100
+	}
+	xmin = minMax(xmin-padX, -180, 180)
+	xmax = minMax(xmax+padX, -180, 180)
+	ymin = minMax(ymin-padY, -MAX_LATITUDE, MAX_LATITUDE)
+	ymax = minMax(ymax+padY, -MAX_LATITUDE, MAX_LATITUDE)
+	return xmin, ymin, xmax, ymax
+}
+
+func minMax(a, b, c float64) float64 {
+	max_of_a_b := math.Max(a, b)
+	return math.Min(max_of_a_b, c)
 }
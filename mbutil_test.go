@@ -0,0 +1,1411 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// MAIN_ARGS_ENV makes the test binary run main with these arguments, one
+// per line, instead of the tests.
+const MAIN_ARGS_ENV = "MBTILEGO_MAIN_ARGS"
+
+func TestMain(m *testing.M) {
+	if args := os.Getenv(MAIN_ARGS_ENV); args != "" {
+		os.Args = append([]string{os.Args[0]}, strings.Split(args, "\n")...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runMain runs the program with args in a child process, since main exits
+// on errors, and returns its log and exit error.
+func runMain(t *testing.T, args ...string) (string, error) {
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), MAIN_ARGS_ENV+"="+strings.Join(args, "\n"))
+	output, err := cmd.CombinedOutput()
+	return string(output), err
+}
+
+// newTestMBTiles creates an MBTiles file with the standard schema and
+// metadata in a temporary directory. The database is closed at the end of
+// the test.
+func newTestMBTiles(t *testing.T, metadata map[string]string) (*sql.DB, string) {
+	filename := filepath.Join(t.TempDir(), "test.mbtiles")
+	db, err := prepareDatabase(filename, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	err = createMBTileSchema(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, value := range metadata {
+		_, err = db.Exec("insert into metadata (name, value) values (?, ?);", name, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db, filename
+}
+
+// solidPNG returns a 256x256 PNG filled with c.
+func solidPNG(t *testing.T, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for x := 0; x < 256; x++ {
+		for y := 0; y < 256; y++ {
+			img.Set(x, y, c)
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// useHttpClient makes the tile fetchers use client until the end of the
+// test.
+func useHttpClient(t testing.TB, client *http.Client) {
+	previous := httpClient
+	httpClient = client
+	t.Cleanup(func() { httpClient = previous })
+}
+
+// addTestTile stores content as the XYZ tile z/x/y.
+func addTestTile(t *testing.T, db *sql.DB, z, x, y int, content []byte) {
+	err := storeTile(Tile{z: z, x: x, y: y, Content: content}, db, WriterOptions{Overwrite: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAppendRegion(t *testing.T) {
+	db, _ := newTestMBTiles(t, nil)
+	red, blue := solidPNG(t, color.RGBA{255, 0, 0, 255}), solidPNG(t, color.RGBA{0, 0, 255, 255})
+	// San Francisco at z10-11, then Dubai at z9-10.
+	first := NewProjection(-122.45, 37.76, -122.40, 37.80, 10, 11, nil, 0)
+	err := setupMBTileTables(db, first, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tile := range first.TileList() {
+		addTestTile(t, db, tile.z, tile.x, tile.y, red)
+	}
+	second := NewProjection(55.27, 25.2, 55.28, 25.21, 9, 10, nil, 0)
+	err = mergeExtentMetadata(db, second.MetaDataItems())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tile := range second.TileList() {
+		addTestTile(t, db, tile.z, tile.x, tile.y, blue)
+	}
+
+	metadata, err := readMetadata(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bounds, err := parseBounds(metadata["bounds"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bounds[0] > -122.45 || bounds[1] > 25.2 || bounds[2] < 55.28 || bounds[3] < 37.80 {
+		t.Errorf("bounds %s don't cover both regions", metadata["bounds"])
+	}
+	if metadata["minzoom"] != "9" || metadata["maxzoom"] != "11" {
+		t.Errorf("zoom levels %s-%s, want 9-11", metadata["minzoom"], metadata["maxzoom"])
+	}
+	for _, region := range []struct {
+		proj    *Projection
+		content []byte
+	}{{first, red}, {second, blue}} {
+		for _, tile := range region.proj.TileList() {
+			content, err := readTile(db, tile, tileLayout{})
+			if err != nil {
+				t.Fatalf("tile %s: %v", tile, err)
+			}
+			// The regions share no tiles at these zoom levels.
+			if !bytes.Equal(content, region.content) {
+				t.Errorf("tile %s was overwritten", tile)
+			}
+		}
+	}
+}
+
+func TestMergeExtentMetadataErrors(t *testing.T) {
+	db, _ := newTestMBTiles(t, map[string]string{"bounds": "not bounds", "minzoom": "3", "maxzoom": "5"})
+	err := mergeExtentMetadata(db, map[string]string{"bounds": "1,2,3", "minzoom": "1", "maxzoom": "2"})
+	if err == nil {
+		t.Error("merged invalid bounds")
+	}
+	// An existing value that doesn't parse is replaced.
+	err = mergeExtentMetadata(db, map[string]string{"bounds": "1,2,3,4", "minzoom": "4", "maxzoom": "6"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metadata, err := readMetadata(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["bounds"] != "1,2,3,4" || metadata["minzoom"] != "3" || metadata["maxzoom"] != "6" {
+		t.Errorf("metadata %v", metadata)
+	}
+}
+
+func TestFetchTileRedirect(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/old/") {
+			http.Redirect(w, r, "/tiles/"+strings.TrimPrefix(r.URL.Path, "/old/"), http.StatusFound)
+			return
+		}
+		if r.Header.Get("User-Agent") != userAgent {
+			http.Error(w, "User-Agent dropped", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+
+	tile, err := fetchTile(context.Background(), 3, 2, 1, server.URL+"/old/{z}/{x}/{y}.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(tile.Content) != "/tiles/3/2/1.png" {
+		t.Errorf("fetched %q, want the tile redirected to", tile.Content)
+	}
+}
+
+func TestFetchTileRedirectLoop(t *testing.T) {
+	hops := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hops++
+		http.Redirect(w, r, r.URL.Path, http.StatusMovedPermanently)
+	}))
+	defer server.Close()
+	useHttpClient(t, newHttpClient(3))
+
+	if _, err := fetchTile(context.Background(), 3, 2, 1, server.URL+"/{z}/{x}/{y}.png"); err == nil {
+		t.Fatal("fetched a tile redirecting to itself")
+	}
+	if hops != 4 {
+		t.Errorf("%d requests, want the first and 3 redirects", hops)
+	}
+}
+
+func TestTileCenter(t *testing.T) {
+	proj := &Projection{}
+	for _, test := range []struct {
+		z, x, y  int
+		lon, lat float64
+	}{
+		{0, 0, 0, 0, 0},
+		{1, 1, 0, 90, 66.51326044311186},
+		{1, 0, 1, -90, -66.51326044311186},
+		// In San Francisco.
+		{12, 655, 1582, -122.3876953125, 37.82280243352756},
+	} {
+		lon, lat := proj.TileCenter(test.z, test.x, test.y)
+		if math.Abs(lon-test.lon) > 1e-9 || math.Abs(lat-test.lat) > 1e-9 {
+			t.Errorf("centre of %d/%d/%d is %f,%f, want %f,%f", test.z, test.x, test.y, lon, lat, test.lon, test.lat)
+		}
+		xmin, ymin, xmax, ymax := proj.TileBounds(test.z, test.x, test.y)
+		if lon <= xmin || lon >= xmax || lat <= ymin || lat >= ymax {
+			t.Errorf("centre of %d/%d/%d is outside of its bounds", test.z, test.x, test.y)
+		}
+	}
+}
+
+func TestValidateTileUrl(t *testing.T) {
+	for _, template := range []string{
+		"http://localhost:8080/tiles/{z}/{x}/{y}.png",
+		"https://example.com/prefix/{z}/{x}/{y}.png?style={literal}",
+		"http://example.com/tiles?q={q}",
+		"http://example.com/wms?bbox={bbox}",
+		"file:///data/tiles/{z}/{x}/{y}.png",
+	} {
+		if err := validateTileUrl(template); err != nil {
+			t.Errorf("%s: %v", template, err)
+		}
+	}
+	for _, template := range []string{
+		"http://example.com/{z}/{x}.png",
+		"http://example.com/tiles.png",
+		"example.com/{z}/{x}/{y}.png",
+		"ftp://example.com/{z}/{x}/{y}.png",
+		"file://data/{z}/{x}/{y}.png",
+		"http://[::1/{z}/{x}/{y}.png",
+	} {
+		if err := validateTileUrl(template); err == nil {
+			t.Errorf("%s is valid", template)
+		}
+	}
+}
+
+func TestGetTileUrl(t *testing.T) {
+	for template, want := range map[string]string{
+		"http://localhost:8080/prefix/{z}/{x}/{y}.png":    "http://localhost:8080/prefix/12/655/1582.png",
+		"http://example.com/{z}/{x}/{y}.png?style={dark}": "http://example.com/12/655/1582.png?style={dark}",
+		"http://example.com/{z}/{x}/{y}.png?x={x}&{{y}}":  "http://example.com/12/655/1582.png?x=655&{1582}",
+		"http://example.com/q/{q}.png":                    "http://example.com/q/023010203331.png",
+	} {
+		if got := getTileUrl(12, 655, 1582, template); got != want {
+			t.Errorf("%s expanded to %s, want %s", template, got, want)
+		}
+	}
+}
+
+// useExtraQuery sets the -query parameters until the end of the test.
+func useExtraQuery(t *testing.T, flags ...string) {
+	previous := extraQuery
+	extraQuery = url.Values{}
+	for _, flag := range flags {
+		if err := queryValue(extraQuery).Set(flag); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Cleanup(func() { extraQuery = previous })
+}
+
+func TestGetTileUrlTime(t *testing.T) {
+	before := time.Now().Unix()
+	got := getTileUrl(12, 655, 1582, "http://example.com/{z}/{x}/{y}.png?t={time}")
+	var stamp int64
+	if _, err := fmt.Sscanf(got, "http://example.com/12/655/1582.png?t=%d", &stamp); err != nil {
+		t.Fatalf("{time} expanded to %s", got)
+	}
+	if stamp < before || stamp > time.Now().Unix() {
+		t.Errorf("{time} is %d, not the current unix time", stamp)
+	}
+}
+
+func TestGetTileUrlRand(t *testing.T) {
+	seen := make(map[int64]bool)
+	for i := 0; i < 10; i++ {
+		got := getTileUrl(12, 655, 1582, "http://example.com/{z}/{x}/{y}.png?r={rand}")
+		var value int64
+		if _, err := fmt.Sscanf(got, "http://example.com/12/655/1582.png?r=%d", &value); err != nil {
+			t.Fatalf("{rand} expanded to %s", got)
+		}
+		seen[value] = true
+	}
+	if len(seen) < 2 {
+		t.Error("{rand} gave the same number every time")
+	}
+}
+
+func TestGetTileUrlQuery(t *testing.T) {
+	useExtraQuery(t, "session=abc", "v=2")
+	for template, want := range map[string]string{
+		"http://example.com/{z}/{x}/{y}.png":         "http://example.com/12/655/1582.png?session=abc&v=2",
+		"http://example.com/{z}/{x}/{y}.png?style=1": "http://example.com/12/655/1582.png?style=1&session=abc&v=2",
+	} {
+		if got := getTileUrl(12, 655, 1582, template); got != want {
+			t.Errorf("%s with -query expanded to %s, want %s", template, got, want)
+		}
+	}
+	for _, flag := range []string{"session", "=abc"} {
+		if err := queryValue(url.Values{}).Set(flag); err == nil {
+			t.Errorf("-query %s accepted", flag)
+		}
+	}
+}
+
+func TestMinTileBytes(t *testing.T) {
+	tiny := []byte("GIF89a\x01\x00\x01\x00\x80\x00\x00\xff\xff\xff\x00\x00\x00!\xf9\x04\x01\x00\x00\x00\x00,\x00\x00\x00\x00\x01\x00\x01\x00\x00\x02\x02D\x01\x00;")
+	tile := solidPNG(t, color.RGBA{255, 0, 0, 255})
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Tile 3/2/1 recovers on the second attempt, 3/2/2 never does.
+		if atomic.AddInt32(&requests, 1) == 2 && strings.HasSuffix(r.URL.Path, "/1.png") {
+			w.Write(tile)
+			return
+		}
+		w.Write(tiny)
+	}))
+	defer server.Close()
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	options := FetchOptions{UrlFormat: server.URL + "/{z}/{x}/{y}.png", Retries: 1, MinTileBytes: DEFAULT_MIN_TILE_BYTES}
+
+	fetched, err := fetchTileWithRetry(Tile{z: 3, x: 2, y: 1}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched.Content, tile) {
+		t.Error("fetched the tiny tile")
+	}
+	atomic.StoreInt32(&requests, 0)
+	if _, err = fetchTileWithRetry(Tile{z: 3, x: 2, y: 2}, options); err == nil || !strings.Contains(err.Error(), "-min-tile-bytes") {
+		t.Errorf("a %d byte tile was accepted: %v", len(tiny), err)
+	}
+	if count := atomic.LoadInt32(&requests); count != 2 {
+		t.Errorf("%d requests for the tiny tile, want 2 with the retry", count)
+	}
+}
+
+func TestBboxPadding(t *testing.T) {
+	xmin, ymin, xmax, ymax := -122.45, 37.76, -122.40, 37.80
+	plain := NewProjection(xmin, ymin, xmax, ymax, 14, 14, nil, 0).TileCount(14)
+	for _, value := range []string{"0.01", "50%"} {
+		padding, percent, err := parsePadding(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pxmin, pymin, pxmax, pymax := padBounds(xmin, ymin, xmax, ymax, padding, percent)
+		if pxmin >= xmin || pymin >= ymin || pxmax <= xmax || pymax <= ymax {
+			t.Errorf("-bbox-padding %s: %f,%f,%f,%f doesn't contain the bounds", value, pxmin, pymin, pxmax, pymax)
+		}
+		if padded := NewProjection(pxmin, pymin, pxmax, pymax, 14, 14, nil, 0).TileCount(14); padded <= plain {
+			t.Errorf("-bbox-padding %s: %d tiles, not more than the %d without", value, padded, plain)
+		}
+	}
+	// The world can't grow.
+	pxmin, pymin, pxmax, pymax := padBounds(-179, -84, 179, 84, 5, false)
+	if pxmin != -180 || pymin != -MAX_LATITUDE || pxmax != 180 || pymax != MAX_LATITUDE {
+		t.Errorf("padded world is %f,%f,%f,%f", pxmin, pymin, pxmax, pymax)
+	}
+	for _, value := range []string{"-1", "x", "10%%"} {
+		if _, _, err := parsePadding(value); err == nil {
+			t.Errorf("-bbox-padding %s parsed", value)
+		}
+	}
+}
+
+func TestAttemptTimeout(t *testing.T) {
+	tile := solidPNG(t, color.RGBA{0, 255, 0, 255})
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// Hangs until the attempt is given up on.
+			select {
+			case <-r.Context().Done():
+			case <-time.After(10 * time.Second):
+			}
+			return
+		}
+		w.Write(tile)
+	}))
+	defer server.Close()
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	options := FetchOptions{UrlFormat: server.URL + "/{z}/{x}/{y}.png", Retries: 1, AttemptTimeout: 200 * time.Millisecond}
+
+	start := time.Now()
+	fetched, err := fetchTileWithRetry(Tile{z: 3, x: 2, y: 1}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched.Content, tile) {
+		t.Error("fetched tile differs from the served one")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("took %s, the hung attempt wasn't cancelled", elapsed)
+	}
+	if count := atomic.LoadInt32(&requests); count != 2 {
+		t.Errorf("%d requests, want 2", count)
+	}
+}
+
+func TestTileListRange(t *testing.T) {
+	// Ranges from the reference slippy map formulas.
+	for _, test := range []struct {
+		name                   string
+		xmin, ymin, xmax, ymax float64
+		zoom                   int
+		x0, x1, y0, y1         int
+	}{
+		{"San Francisco", -122.45, 37.76, -122.40, 37.80, 12, 654, 655, 1582, 1583},
+		{"San Francisco", -122.45, 37.76, -122.40, 37.80, 15, 5238, 5242, 12662, 12667},
+		{"London", -0.2, 51.45, 0.05, 51.55, 10, 511, 512, 340, 340},
+		{"Sydney", 151.1, -33.95, 151.3, -33.8, 11, 1883, 1884, 1228, 1229},
+	} {
+		proj := NewProjection(test.xmin, test.ymin, test.xmax, test.ymax, test.zoom, test.zoom, nil, 0)
+		tiles := proj.TileList()
+		want := (test.x1 - test.x0 + 1) * (test.y1 - test.y0 + 1)
+		if len(tiles) != want {
+			t.Errorf("%s at z%d: %d tiles, want %d", test.name, test.zoom, len(tiles), want)
+		}
+		for _, tile := range tiles {
+			if tile.z != test.zoom || tile.x < test.x0 || tile.x > test.x1 || tile.y < test.y0 || tile.y > test.y1 {
+				t.Errorf("%s at z%d: tile %s outside of %d-%d, %d-%d", test.name, test.zoom, tile, test.x0, test.x1, test.y0, test.y1)
+			}
+		}
+	}
+}
+
+func TestTileListExactTileBounds(t *testing.T) {
+	// Bounds on tile edges don't reach into the neighbouring tiles.
+	for _, tile := range []Tile{{z: 10, x: 163, y: 395}, {z: 12, x: 654, y: 1582}, {z: 3, x: 0, y: 7}} {
+		xmin, ymin, xmax, ymax := (&Projection{}).TileBounds(tile.z, tile.x, tile.y)
+		tiles := NewProjection(xmin, ymin, xmax, ymax, tile.z, tile.z, nil, 0).TileList()
+		if len(tiles) != 1 || tiles[0].x != tile.x || tiles[0].y != tile.y {
+			t.Errorf("bounds of %s list %v", tile, tiles)
+		}
+	}
+}
+
+func TestZoomValue(t *testing.T) {
+	var zoom zoomValue
+	if err := zoom.Set("14"); err != nil || zoom != 14 {
+		t.Errorf("14 parsed as %d, %v", zoom, err)
+	}
+	for value, message := range map[string]string{
+		"14.5": "whole numbers",
+		"high": "whole number zoom level",
+	} {
+		if err := zoom.Set(value); err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("%s: error %v, want one about %s", value, err, message)
+		}
+	}
+}
+
+func TestValidateZoomRange(t *testing.T) {
+	if err := validateZoomRange(0, MAX_ZOOM_LEVEL_LIMIT); err != nil {
+		t.Error(err)
+	}
+	for _, test := range []struct {
+		zoomlevel, max_zoomlevel int
+		message                  string
+	}{
+		{20, 18, "max_zoomlevel (18) must be >= zoomlevel (20)"},
+		{-1, 5, "zoomlevel (-1) must be between 0 and"},
+		{0, MAX_ZOOM_LEVEL_LIMIT + 1, "max_zoomlevel"},
+	} {
+		err := validateZoomRange(test.zoomlevel, test.max_zoomlevel)
+		if err == nil || !strings.Contains(err.Error(), test.message) {
+			t.Errorf("%d-%d: error %v, want %q", test.zoomlevel, test.max_zoomlevel, err, test.message)
+		}
+	}
+}
+
+func TestValidateBounds(t *testing.T) {
+	if err := validateBounds(-122.45, 37.76, -122.40, 37.80); err != nil {
+		t.Error(err)
+	}
+	for _, bounds := range [][4]float64{
+		{-181, 0, 10, 10},
+		{0, -91, 10, 10},
+		{10, 0, 0, 10},
+		{0, 10, 10, 10},
+	} {
+		if err := validateBounds(bounds[0], bounds[1], bounds[2], bounds[3]); err == nil {
+			t.Errorf("bounds %v are valid", bounds)
+		}
+	}
+}
+
+func TestRetryWhileBusy(t *testing.T) {
+	db, filename := newTestMBTiles(t, nil)
+	db.Close()
+	open := func() *sql.DB {
+		conn, err := sql.Open("sqlite3", filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetMaxOpenConns(1)
+		t.Cleanup(func() { conn.Close() })
+		// Fail at once rather than wait in SQLite.
+		_, err = conn.Exec("PRAGMA busy_timeout=0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+	writer, other := open(), open()
+	tx, err := other.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tx.Exec("insert into metadata (name, value) values ('locked', 'by another connection');")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(250 * time.Millisecond)
+		tx.Commit()
+	}()
+
+	attempts := 0
+	err = retryWhileBusy(func() error {
+		attempts++
+		return addToMBTile(Tile{z: 1, x: 0, y: 0, Content: []byte("tile")}, writer)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts < 2 {
+		t.Errorf("%d attempts, the database wasn't locked", attempts)
+	}
+	if !isBusy(sqlite3.Error{Code: sqlite3.ErrBusy}) || isBusy(errors.New("disk I/O error")) {
+		t.Error("isBusy doesn't tell busy errors apart")
+	}
+}
+
+func TestSetupMBTileTablesTwice(t *testing.T) {
+	for _, dedup := range []bool{false, true} {
+		db, err := prepareDatabase(filepath.Join(t.TempDir(), "test.mbtiles"), false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		proj := NewProjection(-122.45, 37.76, -122.40, 37.80, 10, 12, nil, 0)
+		for run := 1; run <= 2; run++ {
+			if err = setupMBTileTables(db, proj, dedup); err != nil {
+				t.Fatalf("run %d with dedup %v: %v", run, dedup, err)
+			}
+		}
+		var count int
+		err = db.QueryRow("select count(*) from metadata where name = 'bounds';").Scan(&count)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("dedup %v: %d bounds rows after two runs", dedup, count)
+		}
+	}
+}
+
+func TestProjectPixelsAtTileEdges(t *testing.T) {
+	proj := NewProjection(-180, -MAX_LATITUDE, 180, MAX_LATITUDE, 0, 12, nil, 0)
+	for _, zoom := range []int{0, 5, 12} {
+		size := DEFAULT_TILE_SIZE * math.Pow(2, float64(zoom))
+		for _, x := range []int{0, 1, 1 << uint(zoom) / 2, 1 << uint(zoom)} {
+			lon, lat := tileToLonLat(zoom, float64(x), float64(x))
+			px := proj.project_pixels(lon, lat, zoom)
+			want := float64(x) * DEFAULT_TILE_SIZE
+			if math.Abs(px[0]-want) > 1e-6 || (x > 0 && x < 1<<uint(zoom) && math.Abs(px[1]-want) > 1e-6) {
+				t.Errorf("tile corner %d/%d/%d projects to %v, want %f", zoom, x, x, px, want)
+			}
+		}
+		if px := proj.project_pixels(0, 0, zoom); px[0] != size/2 || px[1] != size/2 {
+			t.Errorf("0,0 at z%d projects to %v, want the middle", zoom, px)
+		}
+	}
+}
+
+func TestLastTileIndex(t *testing.T) {
+	for _, test := range []struct {
+		px         float64
+		start, end int
+	}{
+		// A right or bottom edge on a tile boundary ends in the tile before.
+		{512, 1, 1},
+		{512.001, 1, 2},
+		{511.999, 1, 1},
+		// A zero width area still has its tile.
+		{256, 1, 1},
+		{0, 0, 0},
+	} {
+		if end := lastTileIndex(test.px, test.start); end != test.end {
+			t.Errorf("lastTileIndex(%v, %d) = %d, want %d", test.px, test.start, end, test.end)
+		}
+	}
+}
+
+func TestUsagePolicy(t *testing.T) {
+	source, ok := sourceForUrl("https://a.tile.openstreetmap.org/{z}/{x}/{y}.png")
+	if !ok || source.Name != "OpenStreetMap" {
+		t.Fatalf("an OSM subdomain matched %v, %v", source.Name, ok)
+	}
+	for _, test := range []struct {
+		workers int
+		rate    float64
+	}{{DEFAULT_WORKERS, 2}, {2, 0}, {2, 10}} {
+		if err := checkUsagePolicy(source, test.workers, test.rate); err == nil {
+			t.Errorf("-workers %d -rate %g accepted for OSM", test.workers, test.rate)
+		}
+	}
+	if err := checkUsagePolicy(source, 2, 2); err != nil {
+		t.Errorf("within the policy: %v", err)
+	}
+	if _, ok := sourceForUrl("https://tiles.example.com/{z}/{x}/{y}.png"); ok {
+		t.Error("an unknown host matched a built-in source")
+	}
+	if _, ok := sourceForUrl("https://nottile.openstreetmap.org/{z}/{x}/{y}.png"); ok {
+		t.Error("a host merely ending in a provider's name matched it")
+	}
+}
+
+func TestShuffleTilesSeed(t *testing.T) {
+	proj := NewProjection(-122.52, 37.70, -122.35, 37.83, 10, 13, nil, 0)
+	shuffled := func(seed int64) []Tile {
+		tiles := proj.TileList()
+		shuffleTiles(tiles, rand.New(rand.NewSource(seed)))
+		return tiles
+	}
+	first := shuffled(42)
+	if !reflect.DeepEqual(first, shuffled(42)) {
+		t.Error("two runs with -seed 42 downloaded in different orders")
+	}
+	if reflect.DeepEqual(first, shuffled(43)) {
+		t.Error("-seed 42 and 43 gave the same order")
+	}
+	if reflect.DeepEqual(first, proj.TileList()) {
+		t.Error("the tiles weren't shuffled")
+	}
+}
+
+func TestStripMetadata(t *testing.T) {
+	const id = "6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+	for filename, wantName := range map[string]string{"/maps/city.mbtiles": "city", STDOUT_FILENAME: id} {
+		db, _ := newTestMBTiles(t, map[string]string{"name": id, "description": id, "format": "png", "version": "1.0", "attribution": "someone"})
+		err := stripMetadata(db, []string{"version", " attribution"}, true, filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := db.Query("select name, value from metadata;")
+		if err != nil {
+			t.Fatal(err)
+		}
+		metadata := make(map[string]string)
+		for rows.Next() {
+			var name, value string
+			if err = rows.Scan(&name, &value); err != nil {
+				t.Fatal(err)
+			}
+			metadata[name] = value
+		}
+		rows.Close()
+		want := map[string]string{"name": wantName, "description": "", "format": "png"}
+		if !reflect.DeepEqual(metadata, want) {
+			t.Errorf("%s: metadata %v, want %v", filename, metadata, want)
+		}
+	}
+}
+
+func TestIncrementalVacuum(t *testing.T) {
+	incrementalVacuum = true
+	defer func() { incrementalVacuum = false }()
+	db, err := prepareDatabase(filepath.Join(t.TempDir(), "vacuum.mbtiles"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = createMBTileSchema(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var mode int
+	if err = db.QueryRow("PRAGMA auto_vacuum;").Scan(&mode); err != nil || mode != AUTO_VACUUM_INCREMENTAL {
+		t.Fatalf("auto_vacuum %d, %v, want incremental", mode, err)
+	}
+	content := bytes.Repeat([]byte("tile"), 4096)
+	for x := 0; x < 16; x++ {
+		addTestTile(t, db, 4, x, 0, content)
+	}
+	_, err = db.Exec("delete from tiles where tile_column < 12;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freePages := func() int {
+		var count int
+		if err := db.QueryRow("PRAGMA freelist_count;").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+	before := freePages()
+	if before == 0 {
+		t.Fatal("deleting tiles freed no pages")
+	}
+	err = optimizeDatabase(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after := freePages(); after >= before {
+		t.Errorf("%d free pages after the vacuum, %d before", after, before)
+	}
+	var integrity string
+	if err = db.QueryRow("PRAGMA integrity_check;").Scan(&integrity); err != nil || integrity != "ok" {
+		t.Errorf("integrity_check %q, %v", integrity, err)
+	}
+}
+
+// benchmarkPageSize stores 2375 tiles of 320 bytes and vacuums the file,
+// with -page-size size and -cache-size cache, and reports the file size.
+func benchmarkPageSize(b *testing.B, size, cache int) {
+	pageSize, cacheSize = size, cache
+	defer func() { pageSize, cacheSize = 0, 0 }()
+	content := bytes.Repeat([]byte{0x55}, 320)
+	var fileSize int64
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		filename := filepath.Join(b.TempDir(), "pages.mbtiles")
+		db, err := prepareDatabase(filename, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = createMBTileSchema(db); err != nil {
+			b.Fatal(err)
+		}
+		for n := 0; n < 2375; n++ {
+			if err = storeTile(Tile{z: 12, x: n % 64, y: n / 64, Content: content}, db, WriterOptions{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err = optimizeDatabase(db); err != nil {
+			b.Fatal(err)
+		}
+		db.Close()
+		info, err := os.Stat(filename)
+		if err != nil {
+			b.Fatal(err)
+		}
+		fileSize = info.Size()
+	}
+	b.ReportMetric(float64(fileSize), "file-bytes")
+}
+
+func BenchmarkPageSizeDefault(b *testing.B) { benchmarkPageSize(b, 0, 0) }
+func BenchmarkPageSize65536(b *testing.B)   { benchmarkPageSize(b, 65536, -200000) }
+func BenchmarkPageSize1024(b *testing.B)    { benchmarkPageSize(b, 1024, 0) }
+
+func TestDeterministicSeed(t *testing.T) {
+	content := solidPNG(t, color.RGBA{0, 0, 255, 255})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	run := func(filename string, flags ...string) (string, error) {
+		args := append([]string{"-url", server.URL + "/{z}/{x}/{y}.png", "-zoomlevel", "1", "-max_zoomlevel", "1",
+			"-xmin", "-180", "-ymin", "-85", "-xmax", "180", "-ymax", "85", "-filename", filepath.Join(dir, filename), "-shuffle"}, flags...)
+		return runMain(t, args...)
+	}
+	output, err := run("deterministic.mbtiles", "-deterministic")
+	if err != nil || !strings.Contains(output, fmt.Sprint("Shuffling tiles with -seed ", DETERMINISTIC_SEED)) {
+		t.Errorf("-deterministic didn't shuffle with -seed %d: %v\n%s", DETERMINISTIC_SEED, err, output)
+	}
+	output, err = run("both.mbtiles", "-deterministic", "-seed", "42")
+	if err == nil || !strings.Contains(output, "-deterministic and -seed") {
+		t.Errorf("-deterministic with -seed ran: %v\n%s", err, output)
+	}
+}
+
+func TestFailingTilesTerminate(t *testing.T) {
+	content := solidPNG(t, color.RGBA{0, 0, 255, 255})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var z, x, y int
+		fmt.Sscanf(r.URL.Path, "/%d/%d/%d.png", &z, &x, &y)
+		switch {
+		case x%3 == 1:
+			http.NotFound(w, r)
+		case x%3 == 2:
+			http.Error(w, "forbidden", http.StatusForbidden)
+		default:
+			w.Write(content)
+		}
+	}))
+	defer server.Close()
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	retryStatus, err := parseStatusSet(DEFAULT_RETRY_STATUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, _ := newTestMBTiles(t, map[string]string{"format": "png"})
+	proj := NewProjection(-180, -85, 180, 85, 2, 4, nil, 0)
+	tiles := proj.TileList()
+
+	// The pipeline of main.
+	tilePipe := make(chan Tile, len(tiles))
+	outputPipe := make(chan Tile, len(tiles))
+	errorPipe := make(chan TileError, len(tiles))
+	go func() {
+		mbTileWorker(db, tilePipe, outputPipe, errorPipe, WriterOptions{Overwrite: true, Stats: &Stats{}})
+		close(outputPipe)
+		close(errorPipe)
+	}()
+	options := FetchOptions{UrlFormat: server.URL + "/{z}/{x}/{y}.png", Retries: 3, RetryStatus: retryStatus}
+	go fetchByZoom(context.Background(), tiles, 4, tilePipe, errorPipe, options)
+
+	stored, failed := 0, 0
+	timeout := time.After(10 * time.Second)
+	for outputPipe != nil || errorPipe != nil {
+		select {
+		case _, ok := <-outputPipe:
+			if !ok {
+				outputPipe = nil
+			} else {
+				stored++
+			}
+		case tileErr, ok := <-errorPipe:
+			if !ok {
+				errorPipe = nil
+			} else if tileErr.Tile.x%3 == 0 {
+				t.Errorf("tile %s failed: %v", tileErr.Tile, tileErr.Err)
+			} else {
+				failed++
+			}
+		case <-timeout:
+			t.Fatalf("still waiting after %d stored and %d failed of %d tiles", stored, failed, len(tiles))
+		}
+	}
+	if stored+failed != len(tiles) || failed == 0 {
+		t.Errorf("%d stored and %d failed of %d tiles", stored, failed, len(tiles))
+	}
+}
+
+func TestMinSuccessCount(t *testing.T) {
+	for value, want := range map[string]int{"": 0, "500": 500, "0.9": 90, "90%": 90, "12.5%": 13, "1": 1} {
+		if count, err := minSuccessCount(value, 100); err != nil || count != want {
+			t.Errorf("-min-success %q of 100 tiles is %d, %v, want %d", value, count, err, want)
+		}
+	}
+	for _, value := range []string{"-1", "1.5", "120%", "most"} {
+		if _, err := minSuccessCount(value, 100); err == nil {
+			t.Errorf("-min-success %q accepted", value)
+		}
+	}
+}
+
+func TestMinSuccessSkipsFinalization(t *testing.T) {
+	content := solidPNG(t, color.RGBA{0, 0, 255, 255})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Only the western column of tiles is there.
+		if !strings.HasPrefix(r.URL.Path, "/2/0/") {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	run := func(filename, minSuccess string, extra ...string) (string, error) {
+		args := []string{"-url", server.URL + "/{z}/{x}/{y}.png", "-zoomlevel", "2", "-max_zoomlevel", "2",
+			"-xmin", "-180", "-ymin", "-85", "-xmax", "180", "-ymax", "85",
+			"-retries", "0", "-min-success", minSuccess, "-filename", filepath.Join(dir, filename)}
+		return runMain(t, append(args, extra...)...)
+	}
+
+	output, err := run("out.pmtiles", "50%", "-output-format", OUTPUT_PMTILES)
+	if err == nil {
+		t.Fatalf("4 of 16 tiles passed -min-success 50%%:\n%s", output)
+	}
+	if !strings.Contains(output, "below -min-success") {
+		t.Errorf("no reason given:\n%s", output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.pmtiles")); !os.IsNotExist(err) {
+		t.Error("the PMTiles file was written")
+	}
+	output, err = run("out.mbtiles", "50%")
+	if err == nil {
+		t.Fatalf("4 of 16 tiles passed -min-success 50%%:\n%s", output)
+	}
+	if !isIncomplete(filepath.Join(dir, "out.mbtiles")) {
+		t.Error("the MBTiles file wasn't left for -resume")
+	}
+
+	output, err = run("enough.pmtiles", "4", "-output-format", OUTPUT_PMTILES)
+	if err != nil {
+		t.Fatalf("4 of 16 tiles failed -min-success 4: %v\n%s", err, output)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "enough.pmtiles")); err != nil {
+		t.Error(err)
+	}
+}
+
+// writeTileTree writes content as every tile of zoom z under dir, in
+// {z}/{x}/{y}.png files.
+func writeTileTree(t *testing.T, dir string, z int, content []byte) {
+	for x := 0; x < 1<<uint(z); x++ {
+		err := os.MkdirAll(filepath.Join(dir, fmt.Sprint(z), fmt.Sprint(x)), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for y := 0; y < 1<<uint(z); y++ {
+			err = ioutil.WriteFile(filepath.Join(dir, fmt.Sprint(z), fmt.Sprint(x), fmt.Sprint(y)+".png"), content, 0644)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestFetchFileTile(t *testing.T) {
+	dir := t.TempDir()
+	content := solidPNG(t, color.RGBA{255, 255, 0, 255})
+	writeTileTree(t, dir, 1, content)
+	useHttpClient(t, &http.Client{Transport: newLocalFileTransport(http.DefaultTransport)})
+	retryStatus, err := parseStatusSet(DEFAULT_RETRY_STATUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := FetchOptions{UrlFormat: "file://" + dir + "/{z}/{x}/{y}.png", Retries: 1, RetryStatus: retryStatus}
+	tile, err := fetchTileWithRetry(Tile{z: 1, x: 1, y: 0}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tile.Content, content) {
+		t.Error("the tile doesn't match its file")
+	}
+	_, err = fetchTileWithRetry(Tile{z: 2, x: 1, y: 0}, options)
+	if status, ok := err.(*statusError); !ok || status.Code != http.StatusNotFound {
+		t.Errorf("a missing file gave %v, want a 404", err)
+	}
+}
+
+func TestPackFileTree(t *testing.T) {
+	dir := t.TempDir()
+	content := solidPNG(t, color.RGBA{255, 255, 0, 255})
+	writeTileTree(t, filepath.Join(dir, "tiles"), 2, content)
+	filename := filepath.Join(dir, "out.mbtiles")
+	output, err := runMain(t, "-url", "file://"+dir+"/tiles/{z}/{x}/{y}.png", "-zoomlevel", "2", "-max_zoomlevel", "2",
+		"-xmin", "-180", "-ymin", "-85", "-xmax", "180", "-ymax", "85", "-filename", filename)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	db, err := openMBTile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	err = db.QueryRow("select count(*) from tiles where tile_data = ?;", content).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 16 {
+		t.Errorf("%d of the 16 tiles of the tree were stored", count)
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	content := solidPNG(t, color.RGBA{0, 0, 255, 255})
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 1 {
+			http.Error(w, "internal error", http.StatusInternalServerError)
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+		w.Write(content)
+	}))
+	defer server.Close()
+	filename := filepath.Join(t.TempDir(), "out.mbtiles")
+	output, err := runMain(t, "-url", server.URL+"/{z}/{x}/{y}.png", "-zoomlevel", "3", "-max_zoomlevel", "3",
+		"-xmin", "-180", "-ymin", "-85", "-xmax", "180", "-ymax", "85",
+		"-workers", "1", "-retries", "0", "-fail-fast", "-filename", filename)
+	if err == nil {
+		t.Fatalf("a failed tile with -fail-fast exited successfully:\n%s", output)
+	}
+	if !strings.Contains(output, "-fail-fast") {
+		t.Errorf("no reason given:\n%s", output)
+	}
+	if count := atomic.LoadInt32(&requests); count >= 64 {
+		t.Errorf("all %d tiles were requested", count)
+	}
+	if !isIncomplete(filename) {
+		t.Error("the file wasn't left for -resume")
+	}
+}
+
+func TestSetupMBTileTablesChangedBounds(t *testing.T) {
+	db, _ := newTestMBTiles(t, nil)
+	for _, proj := range []*Projection{
+		NewProjection(-122.45, 37.76, -122.40, 37.80, 10, 12, nil, 0),
+		NewProjection(-0.2, 51.4, 0.1, 51.6, 10, 12, nil, 0),
+	} {
+		if err := setupMBTileTables(db, proj, false); err != nil {
+			t.Fatal(err)
+		}
+	}
+	metadata, err := readMetadata(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := NewProjection(-0.2, 51.4, 0.1, 51.6, 10, 12, nil, 0).MetaDataItems()["bounds"]; metadata["bounds"] != want {
+		t.Errorf("bounds %q after the second run, want %q", metadata["bounds"], want)
+	}
+}
+
+func TestFetchByZoomStopsWithContext(t *testing.T) {
+	content := solidPNG(t, color.RGBA{0, 0, 255, 255})
+	var requests int32
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) == 5 {
+			cancel()
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	proj := NewProjection(-180, -85, 180, 85, 1, 3, nil, 0)
+	tiles := proj.TileList()
+	tilePipe := make(chan Tile, len(tiles))
+	errorPipe := make(chan TileError, len(tiles))
+	fetchByZoom(ctx, tiles, 2, tilePipe, errorPipe, FetchOptions{UrlFormat: server.URL + "/{z}/{x}/{y}.png"})
+
+	fetched := 0
+	for tile := range tilePipe {
+		if tile.z == 3 {
+			t.Errorf("tile %s fetched after the run was stopped during zoom 2", tile)
+		}
+		fetched++
+	}
+	// The tiles being fetched when it stopped still finish.
+	if count := int(atomic.LoadInt32(&requests)); fetched != count || count < 5 || count > 6 {
+		t.Errorf("%d tiles fetched of %d requests, want 5 or 6", fetched, count)
+	}
+	if len(errorPipe) != 0 {
+		t.Errorf("%d tiles failed", len(errorPipe))
+	}
+}
+
+// fetchFlat is how tiles were fetched before fetchByZoom: one queue of all
+// the tiles and a fixed set of fetchers.
+func fetchFlat(ctx context.Context, tiles []Tile, workers int, tilePipe chan Tile, errorPipe chan TileError, options FetchOptions) {
+	defer close(tilePipe)
+	inputPipe := make(chan Tile, len(tiles))
+	for _, tile := range tiles {
+		inputPipe <- tile
+	}
+	close(inputPipe)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tileFetcher(ctx, inputPipe, tilePipe, errorPipe, options)
+		}()
+	}
+	wg.Wait()
+}
+
+// benchmarkFetch fetches z0-5 from a fake source answering after a
+// millisecond, with the default number of workers.
+func benchmarkFetch(b *testing.B, fetch func(context.Context, []Tile, int, chan Tile, chan TileError, FetchOptions)) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond)
+		w.Write([]byte("tile"))
+	}))
+	defer server.Close()
+	useHttpClient(b, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	tiles := NewProjection(-180, -85, 180, 85, 0, 5, nil, 0).TileList()
+	options := FetchOptions{UrlFormat: server.URL + "/{z}/{x}/{y}.png"}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tilePipe := make(chan Tile, len(tiles))
+		errorPipe := make(chan TileError, len(tiles))
+		fetch(context.Background(), tiles, DEFAULT_WORKERS, tilePipe, errorPipe, options)
+		if len(tilePipe) != len(tiles) {
+			b.Fatalf("%d of %d tiles fetched, %d failed", len(tilePipe), len(tiles), len(errorPipe))
+		}
+	}
+}
+
+func BenchmarkFetchByZoom(b *testing.B) {
+	benchmarkFetch(b, fetchByZoom)
+}
+
+func BenchmarkFetchFlat(b *testing.B) {
+	benchmarkFetch(b, fetchFlat)
+}
+
+func TestMaxRuntime(t *testing.T) {
+	content := solidPNG(t, color.RGBA{0, 0, 255, 255})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Write(content)
+	}))
+	defer server.Close()
+	filename := filepath.Join(t.TempDir(), "out.mbtiles")
+	args := []string{"-url", server.URL + "/{z}/{x}/{y}.png", "-zoomlevel", "3", "-max_zoomlevel", "3",
+		"-xmin", "-180", "-ymin", "-85", "-xmax", "180", "-ymax", "85", "-workers", "1", "-filename", filename}
+	countTiles := func() int {
+		db, err := openMBTile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		var count int
+		if err = db.QueryRow("select count(*) from tiles;").Scan(&count); err != nil {
+			t.Fatal(err)
+		}
+		return count
+	}
+
+	output, err := runMain(t, append(args, "-max-runtime", "300ms")...)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if !strings.Contains(output, "Stopped after -max-runtime") {
+		t.Errorf("the deadline wasn't reported:\n%s", output)
+	}
+	if count := countTiles(); count == 0 || count >= 64 {
+		t.Fatalf("%d of 64 tiles stored before the deadline", count)
+	}
+	if !isIncomplete(filename) {
+		t.Error("the file wasn't left for -resume")
+	}
+
+	output, err = runMain(t, append(args, "-resume")...)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if count := countTiles(); count != 64 {
+		t.Errorf("%d of 64 tiles stored after -resume", count)
+	}
+	if isIncomplete(filename) {
+		t.Error("the resumed file is still incomplete")
+	}
+}
+
+// terrainPNG returns a terrain-RGB like tile, compressed differently from
+// what this program would write, so re-encoding it changes its bytes.
+func terrainPNG(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for x := 0; x < 256; x++ {
+		for y := 0; y < 256; y++ {
+			img.Set(x, y, color.RGBA{1, uint8(x), uint8(x*y + 7), 255})
+		}
+	}
+	var buf bytes.Buffer
+	encoder := png.Encoder{CompressionLevel: png.BestSpeed}
+	if err := encoder.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRawStoresVerbatim(t *testing.T) {
+	content := terrainPNG(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	args := []string{"-url", server.URL + "/{z}/{x}/{y}.png", "-zoomlevel", "1", "-max_zoomlevel", "1",
+		"-xmin", "-180", "-ymin", "-85", "-xmax", "180", "-ymax", "85"}
+	filename := filepath.Join(dir, "dem.mbtiles")
+	output, err := runMain(t, append(args, "-raw", "-encoding", DEM_ENCODING_TERRARIUM, "-filename", filename)...)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	db, err := openMBTile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	err = db.QueryRow("select count(*) from tiles where tile_data = ?;", content).Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("%d of 4 tiles stored byte for byte", count)
+	}
+	metadata, err := readMetadata(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["format"] != PNG_EXTENSION || metadata["encoding"] != DEM_ENCODING_TERRARIUM {
+		t.Errorf("format %q and encoding %q", metadata["format"], metadata["encoding"])
+	}
+
+	for _, flags := range [][]string{
+		{"-raw", "-grayscale"},
+		{"-raw", "-zoom-formats", "0-1:png"},
+		{"-raw", "-overzoom-to", "3"},
+		{"-raw", "-format", "jpg"},
+		{"-encoding", DEM_ENCODING_MAPBOX},
+	} {
+		output, err := runMain(t, append(append(args, flags...), "-filename", filepath.Join(dir, "conflict.mbtiles"))...)
+		if err == nil || !strings.Contains(output, "-raw") {
+			t.Errorf("%v gave %v:\n%s", flags, err, output)
+		}
+	}
+}
+
+func TestFormatForUrlTemplate(t *testing.T) {
+	for template, want := range map[string]string{
+		"http://example.com/{z}/{x}/{y}.png":                PNG_IMAGE_FORMAT,
+		"http://example.com/{z}/{x}/{y}.JPG":                JPG_IMAGE_FORMAT,
+		"http://example.com/{z}/{x}/{y}.jpeg?key=abc":       JPG_IMAGE_FORMAT,
+		"http://example.com/{z}/{x}/{y}.webp":               WEBP_IMAGE_FORMAT,
+		"http://example.com/{z}/{x}/{y}.pbf?access_token=x": PBF_FORMAT,
+		"http://example.com/{z}/{x}/{y}.mvt":                PBF_FORMAT,
+		"http://example.com/{z}/{x}/{y}":                    "",
+		"http://example.com/tiles?x={x}&y={y}&z={z}&f=.png": "",
+	} {
+		format, ok := formatForUrlTemplate(template)
+		if format != want || ok != (want != "") {
+			t.Errorf("%s inferred as %q, %v, want %q", template, format, ok, want)
+		}
+	}
+}
+
+func TestSniffTileFormat(t *testing.T) {
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, image.NewRGBA(image.Rect(0, 0, 8, 8)), nil); err != nil {
+		t.Fatal(err)
+	}
+	for name, test := range map[string]struct {
+		content []byte
+		format  string
+	}{
+		"png":            {solidPNG(t, color.RGBA{0, 0, 0, 255}), PNG_IMAGE_FORMAT},
+		"jpg":            {jpg.Bytes(), JPG_IMAGE_FORMAT},
+		"webp":           {[]byte("RIFF\x24\x00\x00\x00WEBPVP8 "), WEBP_IMAGE_FORMAT},
+		"gzipped pbf":    {[]byte{0x1f, 0x8b, 0x08, 0x00}, PBF_FORMAT},
+		"pbf":            {[]byte{0x1a, 0x05, 0x0a, 0x03}, PBF_FORMAT},
+		"an error page":  {[]byte("<html>Not found</html>"), ""},
+		"an empty reply": {nil, ""},
+	} {
+		if format := sniffTileFormat(test.content); format != test.format {
+			t.Errorf("%s sniffed as %q, want %q", name, format, test.format)
+		}
+	}
+}
+
+func TestFormatFromFirstTile(t *testing.T) {
+	var jpg bytes.Buffer
+	if err := jpeg.Encode(&jpg, image.NewRGBA(image.Rect(0, 0, 256, 256)), nil); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(jpg.Bytes())
+	}))
+	defer server.Close()
+	filename := filepath.Join(t.TempDir(), "out.mbtiles")
+	output, err := runMain(t, "-url", server.URL+"/tiles/{z}/{x}/{y}", "-zoomlevel", "1", "-max_zoomlevel", "1",
+		"-xmin", "-180", "-ymin", "-85", "-xmax", "180", "-ymax", "85", "-filename", filename)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	db, err := openMBTile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	metadata, err := readMetadata(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["format"] != JPG_EXTENSION {
+		t.Errorf("format %q, want it taken from the first tile", metadata["format"])
+	}
+}
+
+func TestExcludeZooms(t *testing.T) {
+	excluded, err := parseExcludeZooms("11, 13", 10, 14)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proj := NewProjection(-122.52, 37.70, -122.35, 37.83, 10, 14, excluded, 0)
+	perZoom := make(map[int]int)
+	for _, tile := range proj.TileList() {
+		perZoom[tile.z]++
+	}
+	for zoom := 10; zoom <= 14; zoom++ {
+		if (perZoom[zoom] == 0) != (zoom == 11 || zoom == 13) {
+			t.Errorf("%d tiles at zoom %d", perZoom[zoom], zoom)
+		}
+	}
+	metadata := proj.MetaDataItems()
+	if metadata["minzoom"] != "10" || metadata["maxzoom"] != "14" {
+		t.Errorf("zoom levels %s-%s, want the whole range", metadata["minzoom"], metadata["maxzoom"])
+	}
+	for _, value := range []string{"10", "14", "9", "15", "11,x", ""} {
+		if _, err := parseExcludeZooms(value, 10, 14); err == nil {
+			t.Errorf("-exclude-zooms %q accepted for zooms 10-14", value)
+		}
+	}
+}
+
+func TestRetryOnNextSubdomain(t *testing.T) {
+	previous := subdomains
+	subdomains = []string{"a", "b"}
+	defer func() { subdomains = previous }()
+	content := solidPNG(t, color.RGBA{0, 0, 255, 255})
+	var unhealthy, healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/a/") {
+			atomic.AddInt32(&unhealthy, 1)
+			http.Error(w, "backend down", http.StatusInternalServerError)
+			return
+		}
+		atomic.AddInt32(&healthy, 1)
+		w.Write(content)
+	}))
+	defer server.Close()
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	retryStatus, err := parseStatusSet(DEFAULT_RETRY_STATUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Tile 3/2/4 goes to subdomain a first.
+	if subdomainFor(2, 4, 0) != "a" || subdomainFor(2, 4, 1) != "b" || subdomainFor(2, 4, 2) != "a" {
+		t.Fatal("the attempts at tile 3/2/4 don't alternate from a")
+	}
+	options := FetchOptions{UrlFormat: server.URL + "/{s}/{z}/{x}/{y}.png", Retries: 1, RetryStatus: retryStatus}
+	tile, err := fetchTileWithRetry(Tile{z: 3, x: 2, y: 4}, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(tile.Content, content) {
+		t.Error("wrong tile content")
+	}
+	if a, b := atomic.LoadInt32(&unhealthy), atomic.LoadInt32(&healthy); a != 1 || b != 1 {
+		t.Errorf("%d requests to a and %d to b, want one each", a, b)
+	}
+}
+
+func TestTileNeighborhoodBounds(t *testing.T) {
+	for _, test := range []struct {
+		tile           string
+		radius         int
+		x0, x1, y0, y1 int
+	}{
+		{"14/8192/5461", 0, 8192, 8192, 5461, 5461},
+		{"14/8192/5461", 2, 8190, 8194, 5459, 5463},
+		// Clamped at the edge of the world.
+		{"3/0/7", 1, 0, 1, 6, 7},
+	} {
+		tile, err := parseTileCoord(test.tile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		xmin, ymin, xmax, ymax := tileNeighborhoodBounds(tile, test.radius)
+		proj := NewProjection(xmin, ymin, xmax, ymax, tile.z, tile.z, nil, 0)
+		x0, x1, y0, y1 := proj.tileRange(xmin, ymin, xmax, ymax, tile.z)
+		if x0 != test.x0 || x1 != test.x1 || y0 != test.y0 || y1 != test.y1 {
+			t.Errorf("%s with radius %d covers %d-%d/%d-%d, want %d-%d/%d-%d", test.tile, test.radius, x0, x1, y0, y1, test.x0, test.x1, test.y0, test.y1)
+		}
+		if want := (test.x1 - test.x0 + 1) * (test.y1 - test.y0 + 1); len(proj.TileList()) != want {
+			t.Errorf("%s with radius %d lists %d tiles, want %d", test.tile, test.radius, len(proj.TileList()), want)
+		}
+	}
+	for _, coord := range []string{"14/8192", "14/16384/0", "a/b/c", "-1/0/0"} {
+		if _, err := parseTileCoord(coord); err == nil {
+			t.Errorf("tile %q parsed", coord)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+)
+
+// mirrorSet spreads the attempts at a tile over equivalent sources given
+// with -mirrors. Each attempt goes to the next mirror in order of error
+// rate, so a tile that keeps failing on one is tried on the others, and a
+// mirror that keeps failing drops to the back for every tile.
+type mirrorSet struct {
+	mu        sync.Mutex
+	templates []string
+	attempts  []int
+	failures  []int
+}
+
+func newMirrorSet(templates []string) *mirrorSet {
+	return &mirrorSet{
+		templates: templates,
+		attempts:  make([]int, len(templates)),
+		failures:  make([]int, len(templates)),
+	}
+}
+
+// Pick returns the index and url template of the mirror for the next
+// attempt at a tile, the one with the lowest error rate among those not in
+// tried, the mirrors of the earlier attempts. Once every mirror was tried
+// they take turns again.
+func (mirrors *mirrorSet) Pick(tried []int) (int, string) {
+	mirrors.mu.Lock()
+	defer mirrors.mu.Unlock()
+	order := make([]int, len(mirrors.templates))
+	for i := range order {
+		order[i] = i
+	}
+	// Mirrors that haven't been tried yet count as failing one attempt in
+	// two, so a couple of early failures don't bury a mirror for good.
+	rate := func(i int) float64 {
+		return float64(mirrors.failures[i]+1) / float64(mirrors.attempts[i]+2)
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return rate(order[a]) < rate(order[b])
+	})
+	round := make(map[int]bool)
+	for _, index := range tried[len(tried)/len(order)*len(order):] {
+		round[index] = true
+	}
+	for _, index := range order {
+		if !round[index] {
+			return index, mirrors.templates[index]
+		}
+	}
+	return order[0], mirrors.templates[order[0]]
+}
+
+// Record counts the outcome of an attempt on a mirror.
+func (mirrors *mirrorSet) Record(index int, err error) {
+	mirrors.mu.Lock()
+	defer mirrors.mu.Unlock()
+	mirrors.attempts[index]++
+	if err != nil {
+		mirrors.failures[index]++
+	}
+}
+
+// LogSummary logs how each mirror did.
+func (mirrors *mirrorSet) LogSummary() {
+	mirrors.mu.Lock()
+	defer mirrors.mu.Unlock()
+	for i, template := range mirrors.templates {
+		log.Println("Mirror", redactUrl(template), ":", mirrors.attempts[i], "attempts,", mirrors.failures[i], "failed")
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+)
+
+func TestMirrorRotation(t *testing.T) {
+	var flakyRequests, goodRequests int32
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&flakyRequests, 1)
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer flaky.Close()
+	content := solidPNG(t, color.RGBA{0, 0, 255, 255})
+	good := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&goodRequests, 1)
+		w.Write(content)
+	}))
+	defer good.Close()
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	retryStatus, err := parseStatusSet(DEFAULT_RETRY_STATUS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mirrors := newMirrorSet([]string{flaky.URL + "/{z}/{x}/{y}.png", good.URL + "/{z}/{x}/{y}.png"})
+	options := FetchOptions{Retries: 1, RetryStatus: retryStatus, Mirrors: mirrors}
+
+	for x := 0; x < 8; x++ {
+		if _, err := fetchTileWithRetry(Tile{z: 3, x: x, y: 1}, options); err != nil {
+			t.Fatalf("tile 3/%d/1: %v", x, err)
+		}
+	}
+	// The first tile fails over to the good mirror, which is tried first from
+	// then on.
+	if count := atomic.LoadInt32(&flakyRequests); count != 1 {
+		t.Errorf("%d requests to the flaky mirror, want 1", count)
+	}
+	if count := atomic.LoadInt32(&goodRequests); count != 8 {
+		t.Errorf("%d requests to the good mirror, want 8", count)
+	}
+}
+
+// pickAll picks the mirrors of count attempts at a tile.
+func pickAll(mirrors *mirrorSet, count int) []string {
+	var tried []int
+	var templates []string
+	for i := 0; i < count; i++ {
+		index, template := mirrors.Pick(tried)
+		tried = append(tried, index)
+		templates = append(templates, template)
+	}
+	return templates
+}
+
+func TestMirrorPick(t *testing.T) {
+	mirrors := newMirrorSet([]string{"a", "b", "c"})
+	if got := pickAll(mirrors, 4); !reflect.DeepEqual(got, []string{"a", "b", "c", "a"}) {
+		t.Errorf("attempts on %v, want a, b, c, a", got)
+	}
+	for i := 0; i < 10; i++ {
+		mirrors.Record(0, errors.New("timeout"))
+		mirrors.Record(1, nil)
+		mirrors.Record(2, nil)
+	}
+	mirrors.Record(1, errors.New("timeout"))
+	if got := pickAll(mirrors, 4); !reflect.DeepEqual(got, []string{"c", "b", "a", "c"}) {
+		t.Errorf("attempts after failures on %v, want c, b, a, c", got)
+	}
+	// A failure during the attempts at a tile doesn't send the next one
+	// back to the same mirror.
+	index, _ := mirrors.Pick(nil)
+	for i := 0; i < 10; i++ {
+		mirrors.Record(index, errors.New("timeout"))
+	}
+	if next, _ := mirrors.Pick([]int{index}); next == index {
+		t.Errorf("retried on the mirror %d that just failed", index)
+	}
+}
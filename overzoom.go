@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strconv"
+)
+
+const OVERZOOM_JPEG_QUALITY = 90
+
+// overzoomTiles fills the zoom levels above nativeZoom up to toZoom, within
+// the bounds of proj, by enlarging the matching part of each tile stored at
+// nativeZoom. Pixels are repeated rather than interpolated, so the tiles
+// look like the native ones viewed closer. The maxzoom metadata becomes
+// toZoom and maxnativezoom records where the real tiles end.
+func overzoomTiles(db *sql.DB, proj *Projection, nativeZoom, toZoom int, options WriterOptions) (int, error) {
+	var parents [][2]int
+	rows, err := db.Query("select tile_column, tile_row from tiles where zoom_level = ?;", nativeZoom)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var x, row int
+		err = rows.Scan(&x, &row)
+		if err != nil {
+			rows.Close()
+			return 0, err
+		}
+		parents = append(parents, [2]int{x, row})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var ranges [][4]int
+	for zoom := nativeZoom + 1; zoom <= toZoom; zoom++ {
+		x0, x1, y0, y1 := bboxTileRange(proj.xmin, proj.ymin, proj.xmax, proj.ymax, zoom)
+		ranges = append(ranges, [4]int{x0, x1, y0, y1})
+	}
+	count := 0
+	for _, parent := range parents {
+		var content []byte
+		err = db.QueryRow("select tile_data from tiles where zoom_level = ? and tile_column = ? and tile_row = ?;", nativeZoom, parent[0], parent[1]).Scan(&content)
+		if err != nil {
+			return count, err
+		}
+		img, format, err := image.Decode(bytes.NewReader(content))
+		if err != nil {
+			return count, fmt.Errorf("overzooming tile %d/%d/%d: %v", nativeZoom, parent[0], parent[1], err)
+		}
+		px, py := parent[0], (1<<uint(nativeZoom))-1-parent[1]
+		for zoom := nativeZoom + 1; zoom <= toZoom; zoom++ {
+			scale := 1 << uint(zoom-nativeZoom)
+			// Only the children within the bounds, a handful of the
+			// millions under a tile many levels down.
+			r := ranges[zoom-nativeZoom-1]
+			x0, x1 := maxInt(px*scale, r[0]), minInt(px*scale+scale-1, r[1])
+			y0, y1 := maxInt(py*scale, r[2]), minInt(py*scale+scale-1, r[3])
+			for x := x0; x <= x1; x++ {
+				for y := y0; y <= y1; y++ {
+					dx, dy := x-px*scale, y-py*scale
+					tile := Tile{z: zoom, x: x, y: y}
+					xmin, ymin, xmax, ymax := proj.TileBounds(tile.z, tile.x, tile.y)
+					if xmax <= proj.xmin || xmin >= proj.xmax || ymax <= proj.ymin || ymin >= proj.ymax {
+						continue
+					}
+					tile.Content, err = encodeTile(enlargePart(img, dx, dy, scale), format)
+					if err != nil {
+						return count, err
+					}
+					err = retryWhileBusy(func() error {
+						return storeTile(tile, db, options)
+					})
+					if err != nil {
+						return count, err
+					}
+					count++
+				}
+			}
+		}
+	}
+
+	for name, value := range map[string]string{"maxzoom": strconv.Itoa(toZoom), "maxnativezoom": strconv.Itoa(nativeZoom)} {
+		_, err = db.Exec("insert or replace into metadata (name, value) values (?, ?);", name, value)
+		if err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
+
+// bboxTileRange returns the columns and XYZ rows of the tiles at zoom that
+// may touch the bounding box. The Projection only has the constants of the
+// zoom levels it downloads, overzooming goes beyond them. The range can hold
+// a tile only touching an edge, which the bounds check then leaves out.
+func bboxTileRange(xmin, ymin, xmax, ymax float64, zoom int) (x0, x1, y0, y1 int) {
+	n := float64(int64(1) << uint(zoom))
+	column := func(lon float64) int {
+		return int(math.Floor((lon + 180) / 360 * n))
+	}
+	row := func(lat float64) int {
+		lat = minMax(lat, -MAX_LATITUDE, MAX_LATITUDE) * DEG_TO_RAD
+		return int(math.Floor((1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * n))
+	}
+	last := int(n) - 1
+	clamp := func(i int) int {
+		return maxInt(0, minInt(last, i))
+	}
+	return clamp(column(xmin)), clamp(column(xmax)), clamp(row(ymax)), clamp(row(ymin))
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// enlargePart returns the part (dx, dy) of img cut into scale x scale
+// squares, enlarged to the size of img.
+func enlargePart(img image.Image, dx, dy, scale int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	out := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		sy := bounds.Min.Y + (dy*height+y)/scale
+		for x := 0; x < width; x++ {
+			sx := bounds.Min.X + (dx*width+x)/scale
+			out.Set(x, y, img.At(sx, sy))
+		}
+	}
+	return out
+}
+
+// encodeTile encodes img in the format image.Decode reported for the tile.
+func encodeTile(img image.Image, format string) ([]byte, error) {
+	var out bytes.Buffer
+	var err error
+	switch format {
+	case "png":
+		err = png.Encode(&out, img)
+	case "jpeg":
+		err = jpeg.Encode(&out, img, &jpeg.Options{Quality: OVERZOOM_JPEG_QUALITY})
+	default:
+		return nil, fmt.Errorf("can't encode %s tiles", format)
+	}
+	return out.Bytes(), err
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+)
+
+var quadrantColors = [2][2]color.RGBA{
+	{{255, 0, 0, 255}, {0, 255, 0, 255}},
+	{{0, 0, 255, 255}, {255, 255, 0, 255}},
+}
+
+// quadrantPNG returns a 256x256 PNG whose quarter (dx, dy) has the colour
+// quadrantColors[dx][dy].
+func quadrantPNG(t *testing.T) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	for x := 0; x < 256; x++ {
+		for y := 0; y < 256; y++ {
+			img.Set(x, y, quadrantColors[x/128][y/128])
+		}
+	}
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOverzoomCrop(t *testing.T) {
+	db, _ := newTestMBTiles(t, nil)
+	parent := Tile{z: 5, x: 10, y: 12}
+	addTestTile(t, db, parent.z, parent.x, parent.y, quadrantPNG(t))
+	xmin, ymin, xmax, ymax := (&Projection{}).TileBounds(parent.z, parent.x, parent.y)
+	proj := NewProjection(xmin, ymin, xmax, ymax, parent.z, parent.z, nil, 0)
+
+	count, err := overzoomTiles(db, proj, parent.z, parent.z+1, WriterOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Fatalf("%d tiles overzoomed, want the 4 children", count)
+	}
+	for dx := 0; dx < 2; dx++ {
+		for dy := 0; dy < 2; dy++ {
+			child := Tile{z: parent.z + 1, x: parent.x*2 + dx, y: parent.y*2 + dy}
+			content, err := readTile(db, child, tileLayout{})
+			if err != nil {
+				t.Fatalf("child %s: %v", child, err)
+			}
+			img, _, err := image.Decode(bytes.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := quadrantColors[dx][dy]
+			for _, point := range []image.Point{{0, 0}, {255, 0}, {0, 255}, {255, 255}, {128, 128}} {
+				if got := color.RGBAModel.Convert(img.At(point.X, point.Y)); got != want {
+					t.Errorf("child %s at %v is %v, want %v", child, point, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestOverzoomManyLevels(t *testing.T) {
+	db, _ := newTestMBTiles(t, nil)
+	// About ten metres in Dubai, inside the z12 tile 12/2676/1751.
+	xmin, ymin, xmax, ymax := 55.27, 25.2, 55.2701, 25.2001
+	x0, _, y0, _ := bboxTileRange(xmin, ymin, xmax, ymax, 12)
+	addTestTile(t, db, 12, x0, y0, quadrantPNG(t))
+	proj := NewProjection(xmin, ymin, xmax, ymax, 12, 12, nil, 0)
+
+	done := make(chan error)
+	var count int
+	go func() {
+		var err error
+		count, err = overzoomTiles(db, proj, 12, 22, WriterOptions{})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(20 * time.Second):
+		t.Fatal("overzooming 10 levels over a small area didn't finish")
+	}
+	// One to a few tiles per level.
+	if count < 10 || count > 100 {
+		t.Errorf("%d tiles overzoomed, want a few per level", count)
+	}
+	x, _, y, _ := bboxTileRange(xmin, ymin, xmin, ymin, 22)
+	if _, err := readTile(db, Tile{z: 22, x: x, y: y}, tileLayout{}); err != nil {
+		t.Errorf("tile 22/%d/%d at the corner of the area: %v", x, y, err)
+	}
+}
+
+func TestBboxTileRange(t *testing.T) {
+	x0, x1, y0, y1 := bboxTileRange(-180, -MAX_LATITUDE, 180, MAX_LATITUDE, 3)
+	if x0 != 0 || x1 != 7 || y0 != 0 || y1 != 7 {
+		t.Errorf("whole world at z3: %d-%d, %d-%d, want 0-7, 0-7", x0, x1, y0, y1)
+	}
+	// Central San Francisco.
+	x0, x1, y0, y1 = bboxTileRange(-122.45, 37.76, -122.40, 37.80, 12)
+	if x0 != 654 || x1 != 655 || y0 != 1582 || y1 != 1583 {
+		t.Errorf("San Francisco at z12: %d-%d, %d-%d, want 654-655, 1582-1583", x0, x1, y0, y1)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// CHECKSUMS_FILENAME lists the SHA-256 of every other file in a -package
+// archive, in the format of sha256sum.
+const CHECKSUMS_FILENAME = "SHA256SUMS"
+
+// writePackage bundles files into the zip archive at filename, next to each
+// other under their base names, and adds their checksums. Files are
+// streamed in, so large tile files aren't held in memory.
+func writePackage(filename string, files []string) error {
+	out, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	archive := zip.NewWriter(out)
+	var checksums string
+	for _, file := range files {
+		sum, err := addToPackage(archive, file)
+		if err != nil {
+			out.Close()
+			os.Remove(filename)
+			return err
+		}
+		checksums += fmt.Sprintf("%s  %s\n", sum, filepath.Base(file))
+	}
+	entry, err := archive.Create(CHECKSUMS_FILENAME)
+	if err == nil {
+		_, err = io.WriteString(entry, checksums)
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(filename)
+	}
+	return err
+}
+
+// addToPackage copies file into the archive and returns its SHA-256.
+func addToPackage(archive *zip.Writer, file string) (string, error) {
+	in, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return "", err
+	}
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return "", err
+	}
+	header.Method = zip.Deflate
+	entry, err := archive.CreateHeader(header)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(entry, hash), in)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
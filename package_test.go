@@ -0,0 +1,79 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestWritePackage(t *testing.T) {
+	dir := t.TempDir()
+	_, filename := newTestMBTiles(t, map[string]string{"format": "png"})
+	tileJSON := filepath.Join(dir, "out.json")
+	err := ioutil.WriteFile(tileJSON, []byte(`{"tilejson": "2.2.0"}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archiveFile := filepath.Join(dir, "out.zip")
+	err = writePackage(archiveFile, []string{filename, tileJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := zip.OpenReader(archiveFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+	contents := make(map[string][]byte)
+	var names []string
+	for _, file := range archive.File {
+		reader, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(reader)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents[file.Name] = content
+		names = append(names, file.Name)
+	}
+	sort.Strings(names)
+	if want := []string{CHECKSUMS_FILENAME, "out.json", "test.mbtiles"}; strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("archive holds %v, want %v", names, want)
+	}
+	for _, file := range []string{filename, tileJSON} {
+		original, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := filepath.Base(file)
+		if string(contents[name]) != string(original) {
+			t.Errorf("%s changed in the archive", name)
+		}
+		sum := sha256.Sum256(original)
+		if line := hex.EncodeToString(sum[:]) + "  " + name + "\n"; !strings.Contains(string(contents[CHECKSUMS_FILENAME]), line) {
+			t.Errorf("%s has no line %q", CHECKSUMS_FILENAME, line)
+		}
+	}
+}
+
+func TestWritePackageMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	archiveFile := filepath.Join(dir, "out.zip")
+	err := writePackage(archiveFile, []string{filepath.Join(dir, "missing.mbtiles")})
+	if err == nil {
+		t.Fatal("packaged a file that doesn't exist")
+	}
+	if _, err := os.Stat(archiveFile); !os.IsNotExist(err) {
+		t.Error("a broken archive was left behind")
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+// A patch is an MBTiles file holding the tiles that were added or changed
+// between two versions of a file, the metadata of the newer version, and a
+// deletions table listing the coordinates (TMS rows, like the tiles table)
+// of the tiles that were removed.
+
+// runPatch implements "patch old.mbtile new.mbtile patch.mbtile".
+func runPatch(args []string) {
+	flags := flag.NewFlagSet("patch", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mbutil patch old.mbtile new.mbtile patch.mbtile")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 3 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	oldDb, err := openMBTile(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer oldDb.Close()
+	newDb, err := openMBTile(flags.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer newDb.Close()
+
+	diff, err := createPatch(oldDb, newDb, flags.Arg(2))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Wrote %s: %d added, %d changed, %d removed", flags.Arg(2), len(diff.Added), len(diff.Changed), len(diff.Removed))
+}
+
+// runApplyPatch implements "apply-patch base.mbtile patch.mbtile", updating
+// base in place.
+func runApplyPatch(args []string) {
+	flags := flag.NewFlagSet("apply-patch", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mbutil apply-patch base.mbtile patch.mbtile")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 2 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	baseDb, err := openMBTile(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer baseDb.Close()
+	err = ensureIndexes(baseDb)
+	if err != nil {
+		log.Fatal(err)
+	}
+	patchDb, err := openMBTile(flags.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer patchDb.Close()
+
+	replaced, deleted, err := applyPatch(baseDb, patchDb)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Updated %s: %d tiles written, %d removed", flags.Arg(0), replaced, deleted)
+}
+
+func createPatch(oldDb, newDb *sql.DB, filename string) (TileDiff, error) {
+	err := sameTileLayout(oldDb, newDb)
+	if err != nil {
+		return TileDiff{}, err
+	}
+	oldHashes, err := readTileHashes(oldDb)
+	if err != nil {
+		return TileDiff{}, err
+	}
+	newHashes, err := readTileHashes(newDb)
+	if err != nil {
+		return TileDiff{}, err
+	}
+	diff := diffTileHashes(oldHashes, newHashes)
+
+	patchDb, err := prepareDatabase(filename, false)
+	if err != nil {
+		return diff, err
+	}
+	defer patchDb.Close()
+	err = createMBTileSchema(patchDb)
+	if err != nil {
+		return diff, err
+	}
+	_, err = patchDb.Exec("create table if not exists deletions (zoom_level integer, tile_column integer, tile_row integer);")
+	if err != nil {
+		return diff, err
+	}
+
+	metadata, err := readMetadata(newDb)
+	if err != nil {
+		return diff, err
+	}
+	for name, value := range metadata {
+		_, err = patchDb.Exec("insert into metadata (name, value) values (?, ?)", name, value)
+		if err != nil {
+			return diff, err
+		}
+	}
+
+	for _, tiles := range [][]Tile{diff.Added, diff.Changed} {
+		for _, tile := range tiles {
+			err = newDb.QueryRow("select tile_data from tiles where zoom_level = ? and tile_column = ? and tile_row = ?;", tile.z, tile.x, tile.flipped_y()).Scan(&tile.Content)
+			if err != nil {
+				return diff, err
+			}
+			err = addToMBTile(tile, patchDb)
+			if err != nil {
+				return diff, err
+			}
+		}
+	}
+	for _, tile := range diff.Removed {
+		_, err = patchDb.Exec("insert into deletions (zoom_level, tile_column, tile_row) values (?, ?, ?);", tile.z, tile.x, tile.flipped_y())
+		if err != nil {
+			return diff, err
+		}
+	}
+	return diff, optimizeDatabase(patchDb)
+}
+
+// patchLayout returns the layout of a file patch and apply-patch work on.
+// A -tile-files file is refused, its tile_data are only paths.
+func patchLayout(db *sql.DB) (tileLayout, error) {
+	metadata, err := readMetadata(db)
+	if err != nil {
+		return tileLayout{}, err
+	}
+	layout := tileLayoutOf("", metadata)
+	if layout.Dir != "" {
+		return layout, fmt.Errorf("the tiles are kept with -tile-files, which patch can't compare or copy")
+	}
+	return layout, nil
+}
+
+// sameTileLayout refuses two files storing their tiles differently, since
+// tiles are copied from one to the other as stored.
+func sameTileLayout(a, b *sql.DB) error {
+	layoutA, err := patchLayout(a)
+	if err != nil {
+		return err
+	}
+	layoutB, err := patchLayout(b)
+	if err != nil {
+		return err
+	}
+	if layoutA != layoutB {
+		return fmt.Errorf("the files store their tiles with different compression, %q and %q", layoutA.Compression, layoutB.Compression)
+	}
+	return nil
+}
+
+// sqlExecer is a *sql.DB, or the *sql.Tx a patch is applied in.
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// applyPatch writes the tiles of patchDb into baseDb, removes its deletions
+// and takes over its metadata, in one transaction so a patch failing part
+// way leaves the base as it was. A -dedup base is refused, its tiles table
+// is a view over map and images, and so is a patch whose tiles are stored
+// differently from the base's.
+func applyPatch(baseDb, patchDb *sql.DB) (replaced, deleted int, err error) {
+	dedup, err := hasDedupLayout(baseDb)
+	if err != nil {
+		return 0, 0, err
+	}
+	if dedup {
+		return 0, 0, fmt.Errorf("the base uses the -dedup layout, which apply-patch can't update")
+	}
+	err = sameTileLayout(baseDb, patchDb)
+	if err != nil {
+		return 0, 0, err
+	}
+	// The hashes of a -store-hashes base follow its tiles.
+	hashes, err := hasTileHashes(baseDb)
+	if err != nil {
+		return 0, 0, err
+	}
+	tx, err := baseDb.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+			replaced, deleted = 0, 0
+		}
+	}()
+
+	rows, err := patchDb.Query("select zoom_level, tile_column, tile_row, tile_data from tiles;")
+	if err != nil {
+		return replaced, deleted, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		tile := Tile{}
+		err = rows.Scan(&tile.z, &tile.x, &tile.y, &tile.Content)
+		if err != nil {
+			return replaced, deleted, err
+		}
+		tile.y = tile.flipped_y() // TMS row back to XYZ
+		err = replaceInMBTile(tile, tx)
+		if err != nil {
+			return replaced, deleted, err
+		}
+		if hashes {
+			err = storeTileHash(tile, tx, false)
+			if err != nil {
+				return replaced, deleted, err
+			}
+		}
+		replaced++
+	}
+	err = rows.Err()
+	if err != nil {
+		return replaced, deleted, err
+	}
+
+	deletions, err := patchDb.Query("select zoom_level, tile_column, tile_row from deletions;")
+	if err != nil {
+		return replaced, deleted, fmt.Errorf("not a patch file: %v", err)
+	}
+	defer deletions.Close()
+	for deletions.Next() {
+		var z, x, row int
+		err = deletions.Scan(&z, &x, &row)
+		if err != nil {
+			return replaced, deleted, err
+		}
+		_, err = tx.Exec("delete from tiles where zoom_level = ? and tile_column = ? and tile_row = ?;", z, x, row)
+		if err != nil {
+			return replaced, deleted, err
+		}
+		if hashes {
+			_, err = tx.Exec("delete from tile_hashes where zoom_level = ? and tile_column = ? and tile_row = ?;", z, x, row)
+			if err != nil {
+				return replaced, deleted, err
+			}
+		}
+		deleted++
+	}
+	err = deletions.Err()
+	if err != nil {
+		return replaced, deleted, err
+	}
+
+	metadata, err := readMetadata(patchDb)
+	if err != nil {
+		return replaced, deleted, err
+	}
+	for name, value := range metadata {
+		_, err = tx.Exec("insert or replace into metadata (name, value) values (?, ?)", name, value)
+		if err != nil {
+			return replaced, deleted, err
+		}
+	}
+	err = tx.Commit()
+	return replaced, deleted, err
+}
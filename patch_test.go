@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// newPatchFiles returns a base and a target differing by a changed, an
+// added and a removed tile and by their metadata.
+func newPatchFiles(t *testing.T) (base, target *sql.DB) {
+	base, _ = newTestMBTiles(t, map[string]string{"name": "old", "format": "png"})
+	target, _ = newTestMBTiles(t, map[string]string{"name": "new", "format": "png", "attribution": "someone"})
+	addTestTile(t, base, 1, 0, 0, []byte("same"))
+	addTestTile(t, base, 1, 1, 0, []byte("old content"))
+	addTestTile(t, base, 1, 1, 1, []byte("removed"))
+	addTestTile(t, target, 1, 0, 0, []byte("same"))
+	addTestTile(t, target, 1, 1, 0, []byte("new content"))
+	addTestTile(t, target, 2, 3, 1, []byte("added"))
+	return base, target
+}
+
+func assertSameFile(t *testing.T, got, want *sql.DB) {
+	gotHashes, err := readTileHashes(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantHashes, err := readTileHashes(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotHashes, wantHashes) {
+		t.Errorf("tiles differ: %v, want %v", gotHashes, wantHashes)
+	}
+	gotMetadata, err := readMetadata(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantMetadata, err := readMetadata(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(gotMetadata, wantMetadata) {
+		t.Errorf("metadata %v, want %v", gotMetadata, wantMetadata)
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	base, target := newPatchFiles(t)
+	patchFile := filepath.Join(t.TempDir(), "patch.mbtiles")
+	diff, err := createPatch(base, target, patchFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Added) != 1 || len(diff.Changed) != 1 || len(diff.Removed) != 1 {
+		t.Fatalf("diff %+v, want one added, changed and removed tile", diff)
+	}
+	patch, err := openMBTile(patchFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer patch.Close()
+
+	replaced, deleted, err := applyPatch(base, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if replaced != 2 || deleted != 1 {
+		t.Errorf("%d written and %d removed, want 2 and 1", replaced, deleted)
+	}
+	assertSameFile(t, base, target)
+}
+
+func TestApplyPatchRollsBack(t *testing.T) {
+	base, _ := newPatchFiles(t)
+	before, _ := newPatchFiles(t)
+	// Tiles but no deletions table: fails after the tiles are written.
+	patch, _ := newTestMBTiles(t, map[string]string{"name": "broken"})
+	addTestTile(t, patch, 1, 1, 0, []byte("patched"))
+	addTestTile(t, patch, 3, 0, 0, []byte("patched"))
+
+	replaced, deleted, err := applyPatch(base, patch)
+	if err == nil {
+		t.Fatal("applying a patch without deletions succeeded")
+	}
+	if replaced != 0 || deleted != 0 {
+		t.Errorf("%d written and %d removed reported for a failed patch", replaced, deleted)
+	}
+	assertSameFile(t, base, before)
+}
+
+func TestApplyPatchRefusesDedupBase(t *testing.T) {
+	base, err := prepareDatabase(filepath.Join(t.TempDir(), "dedup.mbtiles"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer base.Close()
+	err = createDedupSchema(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	patch, _ := newTestMBTiles(t, nil)
+	_, _, err = applyPatch(base, patch)
+	if err == nil {
+		t.Error("patching a -dedup base succeeded")
+	}
+}
+
+func TestPatchRefusesOtherLayouts(t *testing.T) {
+	plain, _ := newTestMBTiles(t, map[string]string{"format": "png"})
+	compressed, _ := newTestMBTiles(t, map[string]string{"format": "png", COMPRESSION_KEY: COMPRESSION_ZSTD})
+	tileFiles, _ := newTestMBTiles(t, map[string]string{"format": "png", TILE_FILES_KEY: "tiles"})
+	for _, files := range [][2]*sql.DB{{plain, compressed}, {compressed, plain}, {tileFiles, tileFiles}} {
+		if _, err := createPatch(files[0], files[1], filepath.Join(t.TempDir(), "patch.mbtiles")); err == nil {
+			t.Error("created a patch between files storing their tiles differently")
+		}
+	}
+	// A patch of compressed files carries their compression.
+	patchFile := filepath.Join(t.TempDir(), "patch.mbtiles")
+	if _, err := createPatch(compressed, compressed, patchFile); err != nil {
+		t.Fatal(err)
+	}
+	patch, err := openMBTile(patchFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer patch.Close()
+	if _, _, err = applyPatch(plain, patch); err == nil {
+		t.Error("applied a compressed patch to an uncompressed base")
+	}
+	if _, _, err = applyPatch(compressed, patch); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"log"
+	"sync"
+)
+
+// pauseGate holds the fetchers while downloading is paused. Tiles already
+// being fetched when it closes are finished and written, so pausing loses
+// nothing; the fetchers just don't start on new ones until it opens again.
+type pauseGate struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	paused bool
+}
+
+func newPauseGate() *pauseGate {
+	gate := &pauseGate{}
+	gate.cond = sync.NewCond(&gate.mu)
+	return gate
+}
+
+func (gate *pauseGate) Pause() {
+	gate.mu.Lock()
+	gate.paused = true
+	gate.mu.Unlock()
+	log.Println("Pausing downloads, in-flight tiles will still be written")
+}
+
+func (gate *pauseGate) Resume() {
+	gate.mu.Lock()
+	gate.paused = false
+	gate.mu.Unlock()
+	gate.cond.Broadcast()
+	log.Println("Resuming downloads")
+}
+
+// Wait blocks while the gate is paused.
+func (gate *pauseGate) Wait() {
+	gate.mu.Lock()
+	for gate.paused {
+		gate.cond.Wait()
+	}
+	gate.mu.Unlock()
+}
+
+// fetchPause is toggled by pauseSignal and resumeSignal.
+var fetchPause = newPauseGate()
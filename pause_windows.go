@@ -0,0 +1,6 @@
+package main
+
+import "os"
+
+// Windows has no user signals, so downloads can't be paused there.
+var pauseSignal, resumeSignal os.Signal
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// newTestCert creates a certificate for 127.0.0.1, self-signed when parent
+// is nil.
+func newTestCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func pinOf(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hex.EncodeToString(sum[:])
+}
+
+// newChainServer serves TLS with the given chain, signed with key.
+func newChainServer(chain []*x509.Certificate, key *ecdsa.PrivateKey) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tile"))
+	}))
+	certificate := tls.Certificate{PrivateKey: key}
+	for _, cert := range chain {
+		certificate.Certificate = append(certificate.Certificate, cert.Raw)
+	}
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{certificate}}
+	server.StartTLS()
+	return server
+}
+
+func getPinned(t *testing.T, url, pin string) error {
+	pins, err := parsePins(pin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: pinnedTransport(pins)}
+	resp, err := client.Get(url)
+	if err == nil {
+		resp.Body.Close()
+	}
+	return err
+}
+
+func TestPinnedTransport(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("tile"))
+	}))
+	defer server.Close()
+	other, _ := newTestCert(t, "other", false, nil, nil)
+
+	if err := getPinned(t, server.URL, pinOf(server.Certificate())); err != nil {
+		t.Errorf("matching pin: %v", err)
+	}
+	if err := getPinned(t, server.URL, pinOf(other)); err == nil {
+		t.Error("mismatching pin: request succeeded")
+	}
+}
+
+func TestPinnedTransportAppendedCertificate(t *testing.T) {
+	// The real server's certificate, sent after the attacker's own leaf.
+	real, _ := newTestCert(t, "real", false, nil, nil)
+	attacker, attackerKey := newTestCert(t, "attacker", false, nil, nil)
+	server := newChainServer([]*x509.Certificate{attacker, real}, attackerKey)
+	defer server.Close()
+
+	if err := getPinned(t, server.URL, pinOf(real)); err == nil {
+		t.Error("a pinned certificate that doesn't sign the leaf was accepted")
+	}
+}
+
+func TestPinnedTransportIssuerPin(t *testing.T) {
+	ca, caKey := newTestCert(t, "ca", true, nil, nil)
+	leaf, leafKey := newTestCert(t, "leaf", false, ca, caKey)
+	server := newChainServer([]*x509.Certificate{leaf, ca}, leafKey)
+	defer server.Close()
+
+	if err := getPinned(t, server.URL, pinOf(ca)); err != nil {
+		t.Errorf("pinned issuer of the leaf: %v", err)
+	}
+	// A CA the leaf doesn't chain to, sent along with a pin on it.
+	otherCA, otherKey := newTestCert(t, "other ca", true, nil, nil)
+	otherLeaf, otherLeafKey := newTestCert(t, "other leaf", false, otherCA, otherKey)
+	mixed := newChainServer([]*x509.Certificate{otherLeaf, ca}, otherLeafKey)
+	defer mixed.Close()
+	if err := getPinned(t, mixed.URL, pinOf(ca)); err == nil {
+		t.Error("a pinned CA that didn't issue the leaf was accepted")
+	}
+}
+
+func TestParsePins(t *testing.T) {
+	hexPin := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	for _, value := range []string{hexPin, "sha256/" + hexPin, "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU=", hexPin + ", " + hexPin} {
+		if _, err := parsePins(value); err != nil {
+			t.Errorf("parsePins(%q): %v", value, err)
+		}
+	}
+	for _, value := range []string{"", "abc", hexPin[:62]} {
+		if _, err := parsePins(value); err == nil {
+			t.Errorf("parsePins(%q) succeeded", value)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Output formats accepted by -output-format.
+const (
+	OUTPUT_MBTILES = "mbtiles"
+	OUTPUT_PMTILES = "pmtiles"
+)
+
+// PMTiles v3, see https://github.com/protomaps/PMTiles/blob/main/spec/v3/spec.md
+const (
+	PMTILES_HEADER_LENGTH = 127
+	// The header and the root directory have to fit in the first 16 KiB.
+	PMTILES_ROOT_LIMIT     = 16384
+	PMTILES_LEAF_SIZE      = 4096
+	PMTILES_COMPRESSION_NO = 1
+	PMTILES_COMPRESSION_GZ = 2
+)
+
+// pmtilesTileType maps the MBTiles format metadata to the PMTiles tile type.
+var pmtilesTileType = map[string]uint8{
+	PBF_EXTENSION:  1,
+	PNG_EXTENSION:  2,
+	JPG_EXTENSION:  3,
+	"jpeg":         3,
+	WEBP_EXTENSION: 4,
+}
+
+// pmtilesEntry is a directory entry: RunLength tiles from TileId on that all
+// have the content at Offset, or with a RunLength of 0, a leaf directory.
+type pmtilesEntry struct {
+	TileId    uint64
+	Offset    uint64
+	Length    uint32
+	RunLength uint32
+}
+
+// pmtilesTileId returns the PMTiles id of an XYZ tile: the tiles of all lower
+// zooms come first, then the tiles of z along a Hilbert curve.
+func pmtilesTileId(z, x, y int) uint64 {
+	return (uint64(1)<<(2*uint(z))-1)/3 + hilbertIndex(z, x, y)
+}
+
+// pmtilesTile is a stored tile waiting to be placed in the archive.
+type pmtilesTile struct {
+	tile   Tile
+	id     uint64
+	hash   string
+	length int
+}
+
+// writePMTiles converts the MBTiles file open in db to a PMTiles archive at
+// filename, or on stdout for "-". Identical tiles are stored once, and the
+// tile data is laid out in tile id order. The tiles of a -compress file are
+// decompressed, PMTiles readers expect the bytes.
+func writePMTiles(db *sql.DB, filename string) error {
+	metadata, err := readMetadata(db)
+	if err != nil {
+		return err
+	}
+	layout := tileLayout{Compression: metadata[COMPRESSION_KEY]}
+	delete(metadata, COMPRESSION_KEY)
+	var tiles []pmtilesTile
+	rows, err := db.Query("select zoom_level, tile_column, tile_row, tile_data from tiles;")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var tile Tile
+		err = rows.Scan(&tile.z, &tile.x, &tile.y, &tile.Content)
+		if err != nil {
+			return err
+		}
+		tile.y = tile.flipped_y()
+		tile.Content, err = decompressTile(tile.Content, layout.Compression)
+		if err != nil {
+			return err
+		}
+		tiles = append(tiles, pmtilesTile{tile: Tile{z: tile.z, x: tile.x, y: tile.y}, id: pmtilesTileId(tile.z, tile.x, tile.y), hash: tileHash(tile.Content), length: len(tile.Content)})
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	rows.Close()
+	if len(tiles) == 0 {
+		return fmt.Errorf("no tiles to write")
+	}
+	sort.Slice(tiles, func(i, j int) bool { return tiles[i].id < tiles[j].id })
+
+	// Lay out the tile data, pointing repeated content at its first copy.
+	var entries []pmtilesEntry
+	var contents []pmtilesTile
+	offsets := make(map[string]uint64)
+	var dataLength uint64
+	for _, tile := range tiles {
+		offset, seen := offsets[tile.hash]
+		if !seen {
+			offset = dataLength
+			offsets[tile.hash] = offset
+			dataLength += uint64(tile.length)
+			contents = append(contents, tile)
+		}
+		last := len(entries) - 1
+		if last >= 0 && entries[last].Offset == offset && entries[last].TileId+uint64(entries[last].RunLength) == tile.id {
+			entries[last].RunLength++
+			continue
+		}
+		entries = append(entries, pmtilesEntry{TileId: tile.id, Offset: offset, Length: uint32(tile.length), RunLength: 1})
+	}
+
+	root, leaves, err := pmtilesDirectories(entries)
+	if err != nil {
+		return err
+	}
+	metadataJSON, err := pmtilesMetadata(metadata)
+	if err != nil {
+		return err
+	}
+
+	header := pmtilesHeader{
+		RootOffset:     PMTILES_HEADER_LENGTH,
+		RootLength:     uint64(len(root)),
+		AddressedTiles: uint64(len(tiles)),
+		TileEntries:    uint64(len(entries)),
+		TileContents:   uint64(len(contents)),
+		TileType:       pmtilesTileType[metadata["format"]],
+	}
+	header.MetadataOffset = header.RootOffset + header.RootLength
+	header.MetadataLength = uint64(len(metadataJSON))
+	header.LeavesOffset = header.MetadataOffset + header.MetadataLength
+	header.LeavesLength = uint64(len(leaves))
+	header.DataOffset = header.LeavesOffset + header.LeavesLength
+	header.DataLength = dataLength
+	header.TileCompression = PMTILES_COMPRESSION_NO
+	if header.TileType == pmtilesTileType[PBF_EXTENSION] {
+		// Vector tiles in MBTiles are gzipped.
+		header.TileCompression = PMTILES_COMPRESSION_GZ
+	}
+	header.MinZoom = uint8(tiles[0].tile.z)
+	header.MaxZoom = uint8(tiles[len(tiles)-1].tile.z)
+	if bounds, err := parseBounds(metadata["bounds"]); err == nil {
+		header.Bounds = bounds
+	} else {
+		header.Bounds = [4]float64{-180, -85.05112878, 180, 85.05112878}
+	}
+	header.CenterZoom = header.MinZoom
+	header.CenterLon = (header.Bounds[0] + header.Bounds[2]) / 2
+	header.CenterLat = (header.Bounds[1] + header.Bounds[3]) / 2
+
+	var out io.Writer = os.Stdout
+	if filename != STDOUT_FILENAME {
+		file, err := os.Create(filename)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	buffered := bufio.NewWriter(out)
+	for _, section := range [][]byte{header.Bytes(), root, metadataJSON, leaves} {
+		_, err = buffered.Write(section)
+		if err != nil {
+			return err
+		}
+	}
+	for _, content := range contents {
+		data, err := readTile(db, content.tile, layout)
+		if err != nil {
+			return err
+		}
+		_, err = buffered.Write(data)
+		if err != nil {
+			return err
+		}
+	}
+	return buffered.Flush()
+}
+
+// pmtilesDirectories serializes the entries as a root directory, moving them
+// into leaf directories when the root would not fit in the first 16 KiB.
+func pmtilesDirectories(entries []pmtilesEntry) (root []byte, leaves []byte, err error) {
+	root, err = serializePMTilesEntries(entries)
+	if err != nil || PMTILES_HEADER_LENGTH+len(root) <= PMTILES_ROOT_LIMIT {
+		return root, nil, err
+	}
+	for leafSize := PMTILES_LEAF_SIZE; ; leafSize += leafSize / 5 {
+		var rootEntries []pmtilesEntry
+		var leafBuffer bytes.Buffer
+		for start := 0; start < len(entries); start += leafSize {
+			end := start + leafSize
+			if end > len(entries) {
+				end = len(entries)
+			}
+			leaf, err := serializePMTilesEntries(entries[start:end])
+			if err != nil {
+				return nil, nil, err
+			}
+			rootEntries = append(rootEntries, pmtilesEntry{TileId: entries[start].TileId, Offset: uint64(leafBuffer.Len()), Length: uint32(len(leaf))})
+			leafBuffer.Write(leaf)
+		}
+		root, err = serializePMTilesEntries(rootEntries)
+		if err != nil {
+			return nil, nil, err
+		}
+		if PMTILES_HEADER_LENGTH+len(root) <= PMTILES_ROOT_LIMIT {
+			return root, leafBuffer.Bytes(), nil
+		}
+	}
+}
+
+// serializePMTilesEntries writes a gzipped directory: the entry count, then
+// the tile id deltas, run lengths, lengths and offsets as varints. An offset
+// is written as 0 when the content directly follows the previous entry's,
+// and as offset+1 otherwise.
+func serializePMTilesEntries(entries []pmtilesEntry) ([]byte, error) {
+	var raw bytes.Buffer
+	varint := make([]byte, binary.MaxVarintLen64)
+	put := func(value uint64) {
+		n := binary.PutUvarint(varint, value)
+		raw.Write(varint[:n])
+	}
+	put(uint64(len(entries)))
+	var lastId uint64
+	for _, entry := range entries {
+		put(entry.TileId - lastId)
+		lastId = entry.TileId
+	}
+	for _, entry := range entries {
+		put(uint64(entry.RunLength))
+	}
+	for _, entry := range entries {
+		put(uint64(entry.Length))
+	}
+	for i, entry := range entries {
+		if i > 0 && entry.Offset == entries[i-1].Offset+uint64(entries[i-1].Length) {
+			put(0)
+		} else {
+			put(entry.Offset + 1)
+		}
+	}
+	return gzipBytes(raw.Bytes())
+}
+
+// pmtilesMetadata returns the gzipped JSON metadata. The values of the json
+// metadata key (vector layers and so on) are merged in as JSON, the rest
+// are copied as strings.
+func pmtilesMetadata(metadata map[string]string) ([]byte, error) {
+	items := make(map[string]interface{})
+	for name, value := range metadata {
+		items[name] = value
+	}
+	if value, ok := metadata["json"]; ok {
+		var extra map[string]interface{}
+		if err := json.Unmarshal([]byte(value), &extra); err == nil {
+			delete(items, "json")
+			for name, value := range extra {
+				items[name] = value
+			}
+		}
+	}
+	content, err := json.Marshal(items)
+	if err != nil {
+		return nil, err
+	}
+	return gzipBytes(content)
+}
+
+func gzipBytes(content []byte) ([]byte, error) {
+	var out bytes.Buffer
+	writer := gzip.NewWriter(&out)
+	_, err := writer.Write(content)
+	if err != nil {
+		return nil, err
+	}
+	err = writer.Close()
+	return out.Bytes(), err
+}
+
+type pmtilesHeader struct {
+	RootOffset, RootLength         uint64
+	MetadataOffset, MetadataLength uint64
+	LeavesOffset, LeavesLength     uint64
+	DataOffset, DataLength         uint64
+	AddressedTiles, TileEntries    uint64
+	TileContents                   uint64
+	TileCompression, TileType      uint8
+	MinZoom, MaxZoom, CenterZoom   uint8
+	Bounds                         [4]float64
+	CenterLon, CenterLat           float64
+}
+
+// Bytes encodes the header, little endian, with positions in units of 1e-7
+// degrees.
+func (header pmtilesHeader) Bytes() []byte {
+	b := make([]byte, PMTILES_HEADER_LENGTH)
+	copy(b, "PMTiles")
+	b[7] = 3
+	for i, value := range []uint64{header.RootOffset, header.RootLength, header.MetadataOffset, header.MetadataLength, header.LeavesOffset, header.LeavesLength, header.DataOffset, header.DataLength, header.AddressedTiles, header.TileEntries, header.TileContents} {
+		binary.LittleEndian.PutUint64(b[8+8*i:], value)
+	}
+	b[96] = 1 // clustered
+	b[97] = PMTILES_COMPRESSION_GZ
+	b[98] = header.TileCompression
+	b[99] = header.TileType
+	b[100] = header.MinZoom
+	b[101] = header.MaxZoom
+	for i, value := range header.Bounds {
+		binary.LittleEndian.PutUint32(b[102+4*i:], uint32(e7(value)))
+	}
+	b[118] = header.CenterZoom
+	binary.LittleEndian.PutUint32(b[119:], uint32(e7(header.CenterLon)))
+	binary.LittleEndian.PutUint32(b[123:], uint32(e7(header.CenterLat)))
+	return b
+}
+
+func e7(degrees float64) int32 {
+	return int32(math.Round(degrees * 1e7))
+}
+
+// validOutputFormat checks -output-format.
+func validOutputFormat(format string) error {
+	switch strings.ToLower(format) {
+	case OUTPUT_MBTILES, OUTPUT_PMTILES:
+		return nil
+	}
+	return fmt.Errorf("unknown -output-format %q, expected %s or %s", format, OUTPUT_MBTILES, OUTPUT_PMTILES)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// pmtilesArchive reads a PMTiles archive back, the way a client does.
+type pmtilesArchive struct {
+	t       *testing.T
+	content []byte
+	header  []byte
+}
+
+func (archive pmtilesArchive) field(i int) uint64 {
+	return binary.LittleEndian.Uint64(archive.header[8+8*i:])
+}
+
+func gunzipBytes(t *testing.T, content []byte) []byte {
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw
+}
+
+// parsePMTilesEntries reverses serializePMTilesEntries.
+func parsePMTilesEntries(t *testing.T, content []byte) []pmtilesEntry {
+	raw := bytes.NewReader(gunzipBytes(t, content))
+	next := func() uint64 {
+		value, err := binary.ReadUvarint(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	entries := make([]pmtilesEntry, next())
+	var lastId uint64
+	for i := range entries {
+		lastId += next()
+		entries[i].TileId = lastId
+	}
+	for i := range entries {
+		entries[i].RunLength = uint32(next())
+	}
+	for i := range entries {
+		entries[i].Length = uint32(next())
+	}
+	for i := range entries {
+		offset := next()
+		if offset == 0 && i > 0 {
+			entries[i].Offset = entries[i-1].Offset + uint64(entries[i-1].Length)
+		} else {
+			entries[i].Offset = offset - 1
+		}
+	}
+	return entries
+}
+
+// findPMTilesEntry looks id up in a directory, descending into the leaves.
+func findPMTilesEntry(t *testing.T, directory []byte, leaves []byte, id uint64) (pmtilesEntry, bool) {
+	entries := parsePMTilesEntries(t, directory)
+	for i := len(entries) - 1; i >= 0; i-- {
+		entry := entries[i]
+		if entry.TileId > id {
+			continue
+		}
+		if entry.RunLength == 0 {
+			return findPMTilesEntry(t, leaves[entry.Offset:entry.Offset+uint64(entry.Length)], leaves, id)
+		}
+		return entry, id < entry.TileId+uint64(entry.RunLength)
+	}
+	return pmtilesEntry{}, false
+}
+
+func (archive pmtilesArchive) Tile(z, x, y int) ([]byte, bool) {
+	root := archive.content[archive.field(0) : archive.field(0)+archive.field(1)]
+	leaves := archive.content[archive.field(4) : archive.field(4)+archive.field(5)]
+	entry, ok := findPMTilesEntry(archive.t, root, leaves, pmtilesTileId(z, x, y))
+	if !ok {
+		return nil, false
+	}
+	start := archive.field(6) + entry.Offset
+	return archive.content[start : start+uint64(entry.Length)], true
+}
+
+func TestPMTilesTileId(t *testing.T) {
+	for _, test := range []struct {
+		z, x, y int
+		id      uint64
+	}{
+		{0, 0, 0, 0},
+		{1, 0, 0, 1}, {1, 0, 1, 2}, {1, 1, 1, 3}, {1, 1, 0, 4},
+		{2, 0, 0, 5},
+		{12, 3423, 1763, 19078479},
+	} {
+		if id := pmtilesTileId(test.z, test.x, test.y); id != test.id {
+			t.Errorf("tile %d/%d/%d has id %d, want %d", test.z, test.x, test.y, id, test.id)
+		}
+	}
+}
+
+func TestPMTilesRoundTrip(t *testing.T) {
+	db, _ := newTestMBTiles(t, map[string]string{"format": "png", "name": "Round trip", "bounds": "-10,35,30,60", "json": `{"vector_layers": []}`})
+	want := make(map[[3]int][]byte)
+	for z := 0; z <= 3; z++ {
+		for x := 0; x < 1<<uint(z); x++ {
+			for y := 0; y < 1<<uint(z); y++ {
+				// Every other tile of a zoom level is the same.
+				content := []byte(fmt.Sprintf("tile %d/%d/%d", z, x, y))
+				if (x+y)%2 == 0 {
+					content = []byte(fmt.Sprintf("shared %d", z))
+				}
+				addTestTile(t, db, z, x, y, content)
+				want[[3]int{z, x, y}] = content
+			}
+		}
+	}
+	filename := filepath.Join(t.TempDir(), "out.pmtiles")
+	err := writePMTiles(db, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(content, []byte("PMTiles\x03")) {
+		t.Fatalf("no PMTiles v3 magic: %q", content[:8])
+	}
+	archive := pmtilesArchive{t: t, content: content, header: content[:PMTILES_HEADER_LENGTH]}
+	if archive.field(8) != uint64(len(want)) {
+		t.Errorf("%d addressed tiles, want %d", archive.field(8), len(want))
+	}
+	if contents := archive.field(10); contents >= uint64(len(want)) {
+		t.Errorf("%d tile contents for %d tiles, identical tiles weren't stored once", contents, len(want))
+	}
+	if content[100] != 0 || content[101] != 3 || content[99] != pmtilesTileType[PNG_EXTENSION] {
+		t.Errorf("zoom levels %d-%d and tile type %d", content[100], content[101], content[99])
+	}
+	for key, tile := range want {
+		got, ok := archive.Tile(key[0], key[1], key[2])
+		if !ok || !bytes.Equal(got, tile) {
+			t.Errorf("tile %v read back as %q, want %q", key, got, tile)
+		}
+	}
+	if _, ok := archive.Tile(4, 0, 0); ok {
+		t.Error("found a tile that wasn't written")
+	}
+
+	metadataStart := archive.field(2)
+	var metadata map[string]interface{}
+	err = json.Unmarshal(gunzipBytes(t, content[metadataStart:metadataStart+archive.field(3)]), &metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata["name"] != "Round trip" || metadata["vector_layers"] == nil || metadata["json"] != nil {
+		t.Errorf("metadata %v", metadata)
+	}
+}
+
+func TestPMTilesLeafDirectories(t *testing.T) {
+	// Too many entries for the root directory, irregular enough not to
+	// compress away.
+	random := rand.New(rand.NewSource(DETERMINISTIC_SEED))
+	var entries []pmtilesEntry
+	var ids []uint64
+	var id, offset uint64
+	for i := 0; i < 20000; i++ {
+		length := uint32(100 + random.Intn(10000))
+		entries = append(entries, pmtilesEntry{TileId: id, Offset: offset, Length: length, RunLength: 1})
+		ids = append(ids, id)
+		id += 2 + uint64(random.Intn(1000))
+		offset += uint64(length)
+	}
+	root, leaves, err := pmtilesDirectories(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaves) == 0 || PMTILES_HEADER_LENGTH+len(root) > PMTILES_ROOT_LIMIT {
+		t.Fatalf("root of %d bytes with %d bytes of leaves", len(root), len(leaves))
+	}
+	for _, i := range []int{0, 4095, 4096, 19999} {
+		entry, ok := findPMTilesEntry(t, root, leaves, ids[i])
+		if !ok || entry != entries[i] {
+			t.Errorf("entry %d found as %+v, %v, want %+v", i, entry, ok, entries[i])
+		}
+		if _, ok := findPMTilesEntry(t, root, leaves, ids[i]+1); ok {
+			t.Errorf("found tile id %d between the entries", ids[i]+1)
+		}
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// PREFLIGHT_SNIPPET is how much of an error body -check-connectivity shows.
+const PREFLIGHT_SNIPPET = 200
+
+// checkConnectivity fetches a single tile from url_format before the
+// download starts, so a wrong url, a missing token or a refused login is
+// reported once instead of as thousands of failed tiles.
+func checkConnectivity(url_format string, tile Tile, declaredFormat string, timeout time.Duration) error {
+	probe, err := probeTile(url_format, tile, timeout)
+	if err != nil {
+		return fmt.Errorf("checking connectivity: %v", err)
+	}
+	if probe.Status == http.StatusNotModified {
+		return nil
+	}
+	if probe.Status != http.StatusOK {
+		hint := ""
+		if probe.Status == http.StatusUnauthorized || probe.Status == http.StatusForbidden {
+			hint = " (check the access token or login)"
+		}
+		return fmt.Errorf("checking connectivity: %s answered %s%s: %s", probe.Url, probe.StatusText, hint, bodySnippet(probe.Body))
+	}
+	if probe.Format == "" {
+		return fmt.Errorf("checking connectivity: %s answered with something that isn't a tile: %s", probe.Url, bodySnippet(probe.Body))
+	}
+	if probe.Format != declaredFormat {
+		log.Printf("Warning: tile %s is %s but the format is %s; see -format and -detect-format", tile, extensionForFormat(probe.Format), extensionForFormat(declaredFormat))
+	}
+	log.Println("Connectivity check passed, tile", tile, "is", len(probe.Body), "bytes of", extensionForFormat(probe.Format))
+	return nil
+}
+
+// tileProbe is the answer to a single tile request.
+type tileProbe struct {
+	// Url is the tile url with its tokens redacted.
+	Url        string
+	Status     int
+	StatusText string
+	Body       []byte
+	// Format is sniffed from the body, empty when it isn't a tile.
+	Format string
+}
+
+// probeTile requests one tile from url_format. Only failing to get an
+// answer at all is an error; the status is left to the caller.
+func probeTile(url_format string, tile Tile, timeout time.Duration) (tileProbe, error) {
+	tileUrl := getTileUrl(tile.z, tile.x, tile.y, url_format)
+	probe := tileProbe{Url: redactUrl(tileUrl)}
+	ctx, cancel := attemptContext(context.Background(), timeout)
+	defer cancel()
+	resp, err := httpGet(ctx, tileUrl)
+	if err != nil {
+		return probe, fmt.Errorf("fetching tile %s: %v", tile, redactUrl(err.Error()))
+	}
+	defer resp.Body.Close()
+	probe.Status, probe.StatusText = resp.StatusCode, resp.Status
+	probe.Body, err = ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return probe, fmt.Errorf("reading tile %s: %v", tile, err)
+	}
+	probe.Format = sniffTileFormat(probe.Body)
+	return probe, nil
+}
+
+// DRY_RUN_TILE is the tile -dry-run-sources fetches from every source, over
+// land in western Europe, which every built-in source covers.
+var DRY_RUN_TILE = Tile{z: 6, x: 32, y: 21}
+
+// dryRunSources fetches DRY_RUN_TILE from each built-in source and writes
+// a line per source with its status, format and size. It reports whether
+// all of them returned a tile.
+func dryRunSources(out io.Writer, timeout time.Duration) bool {
+	ok := true
+	for i, source := range MAPTYPES {
+		result := ""
+		probe, err := probeTile(source.URLTemplate, DRY_RUN_TILE, timeout)
+		switch {
+		case err != nil:
+			result = "FAILED " + err.Error()
+		case probe.Status != http.StatusOK:
+			result = fmt.Sprintf("FAILED %s: %s", probe.StatusText, bodySnippet(probe.Body))
+		case probe.Format == "":
+			result = "FAILED not a tile: " + bodySnippet(probe.Body)
+		default:
+			result = fmt.Sprintf("ok %s, %s, %d bytes", probe.StatusText, extensionForFormat(probe.Format), len(probe.Body))
+			if probe.Format != source.Format {
+				result += fmt.Sprintf(" (declared %s)", extensionForFormat(source.Format))
+			}
+		}
+		if !strings.HasPrefix(result, "ok") {
+			ok = false
+		}
+		fmt.Fprintf(out, "%d\t%s\t%s\t%s\n", i, source.Name, result, probe.Url)
+	}
+	return ok
+}
+
+// bodySnippet quotes the start of a response body for an error message.
+func bodySnippet(body []byte) string {
+	snippet := strings.TrimSpace(string(body))
+	if len(snippet) > PREFLIGHT_SNIPPET {
+		snippet = snippet[:PREFLIGHT_SNIPPET] + "..."
+	}
+	return fmt.Sprintf("%q", snippet)
+}
+
+// preflightTile picks the tile in the middle of the lowest zoom level.
+func preflightTile(tiles []Tile) Tile {
+	var lowest []Tile
+	for _, tile := range tiles {
+		if len(lowest) == 0 || tile.z < lowest[0].z {
+			lowest = []Tile{tile}
+		} else if tile.z == lowest[0].z {
+			lowest = append(lowest, tile)
+		}
+	}
+	return lowest[len(lowest)/2]
+}
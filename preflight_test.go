@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCheckConnectivityUnauthorized(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, `{"message": "Invalid access token"}`, http.StatusUnauthorized)
+	}))
+	defer server.Close()
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+
+	err := checkConnectivity(server.URL+"/{z}/{x}/{y}.png?access_token=secret", Tile{z: 2, x: 1, y: 1}, PNG_IMAGE_FORMAT, time.Second)
+	if err == nil {
+		t.Fatal("a source answering 401 passed the check")
+	}
+	for _, want := range []string{"401 Unauthorized", "access token or login", "Invalid access token", "/2/1/1.png"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("%q doesn't mention %q", err, want)
+		}
+	}
+	if strings.Contains(err.Error(), "secret") {
+		t.Errorf("%q shows the token", err)
+	}
+	if count := atomic.LoadInt32(&requests); count != 1 {
+		t.Errorf("%d requests, want a single one", count)
+	}
+}
+
+func TestCheckConnectivity(t *testing.T) {
+	content := solidPNG(t, color.RGBA{0, 255, 0, 255})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/html/") {
+			w.Write([]byte("<html>" + strings.Repeat("Welcome! ", 100) + "</html>"))
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+
+	if err := checkConnectivity(server.URL+"/{z}/{x}/{y}.png", Tile{z: 2, x: 1, y: 1}, PNG_IMAGE_FORMAT, time.Second); err != nil {
+		t.Errorf("a working source failed the check: %v", err)
+	}
+	err := checkConnectivity(server.URL+"/html/{z}/{x}/{y}.png", Tile{z: 2, x: 1, y: 1}, PNG_IMAGE_FORMAT, time.Second)
+	if err == nil || !strings.Contains(err.Error(), "isn't a tile") {
+		t.Errorf("a page instead of a tile gave %v", err)
+	}
+	if err != nil && len(err.Error()) > 2*PREFLIGHT_SNIPPET {
+		t.Errorf("the whole page is in the error: %d bytes", len(err.Error()))
+	}
+}
+
+func TestDryRunSources(t *testing.T) {
+	content := solidPNG(t, color.RGBA{0, 255, 0, 255})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/denied/") {
+			http.Error(w, "Invalid access token", http.StatusUnauthorized)
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	previous := MAPTYPES
+	MAPTYPES = []MapSource{
+		{Name: "Working", URLTemplate: server.URL + "/{z}/{x}/{y}.png", Format: PNG_IMAGE_FORMAT},
+		{Name: "Denied", URLTemplate: server.URL + "/denied/{z}/{x}/{y}.png?access_token=secret", Format: PNG_IMAGE_FORMAT},
+	}
+	defer func() { MAPTYPES = previous }()
+	dir, err := ioutil.TempDir("", "dryrun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	var out bytes.Buffer
+	if dryRunSources(&out, time.Second) {
+		t.Error("a source answering 401 passed the dry run")
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("%d report lines, want one per source:\n%s", len(lines), out.String())
+	}
+	for _, want := range []string{"0\tWorking\tok 200 OK, png, ", "/6/32/21.png"} {
+		if !strings.Contains(lines[0], want) {
+			t.Errorf("%q doesn't mention %q", lines[0], want)
+		}
+	}
+	for _, want := range []string{"1\tDenied\tFAILED 401 Unauthorized", "Invalid access token", "/denied/6/32/21.png"} {
+		if !strings.Contains(lines[1], want) {
+			t.Errorf("%q doesn't mention %q", lines[1], want)
+		}
+	}
+	if strings.Contains(out.String(), "secret") {
+		t.Errorf("the report shows the token:\n%s", out.String())
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		t.Errorf("the dry run wrote %s", file.Name())
+	}
+}
+
+func TestPreflightTile(t *testing.T) {
+	proj := NewProjection(-122.52, 37.70, -122.35, 37.83, 12, 14, nil, 0)
+	tile := preflightTile(proj.TileList())
+	if tile.z != 12 {
+		t.Errorf("preflight tile %s isn't at the lowest zoom level", tile)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+)
+
+// embedPreview stores the tile nearest the center of the bounds at the lowest
+// stored zoom as base64 in the preview metadata, and its z/x/y in
+// preview_tile, so viewers can show the file without reading the tiles.
+func embedPreview(db *sql.DB, proj *Projection) error {
+	metadata, err := readMetadata(db)
+	if err != nil {
+		return err
+	}
+	bounds, err := parseBounds(metadata["bounds"])
+	if err != nil {
+		return err
+	}
+	var zoom int
+	err = db.QueryRow("select min(zoom_level) from tiles;").Scan(&zoom)
+	if err != nil {
+		return err
+	}
+	lon, lat := (bounds[0]+bounds[2])/2, (bounds[1]+bounds[3])/2
+	centerX, _, centerY, _ := proj.tileRange(lon, lat, lon, lat, zoom)
+
+	rows, err := db.Query("select tile_column, tile_row, tile_data from tiles where zoom_level = ?;", zoom)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	var preview Tile
+	best := -1
+	for rows.Next() {
+		tile := Tile{z: zoom}
+		err = rows.Scan(&tile.x, &tile.y, &tile.Content)
+		if err != nil {
+			return err
+		}
+		tile.y = tile.flipped_y()
+		distance := (tile.x-centerX)*(tile.x-centerX) + (tile.y-centerY)*(tile.y-centerY)
+		if best < 0 || distance < best {
+			preview, best = tile, distance
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	rows.Close()
+	if best < 0 {
+		return errors.New("no tiles to take a preview from")
+	}
+
+	items := map[string]string{
+		"preview":      base64.StdEncoding.EncodeToString(preview.Content),
+		"preview_tile": preview.String(),
+	}
+	for name, value := range items {
+		_, err = db.Exec("insert or replace into metadata (name, value) values (?, ?);", name, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"os"
+)
+
+// TileProcessor changes a tile between fetching and storing it, e.g. to
+// recompress or watermark it. Returning errSkipTile drops the tile; any
+// other error fails it.
+type TileProcessor func(tile Tile) (Tile, error)
+
+// errSkipTile is returned by a TileProcessor to leave the tile out of the
+// file without counting it as failed.
+var errSkipTile = errors.New("tile skipped")
+
+// processTile runs the processors in order.
+func processTile(tile Tile, processors []TileProcessor) (Tile, error) {
+	var err error
+	for _, processor := range processors {
+		tile, err = processor(tile)
+		if err != nil {
+			return tile, err
+		}
+	}
+	return tile, nil
+}
+
+// grayscaleProcessor converts png and jpg tiles to shades of gray, keeping
+// their transparency.
+func grayscaleProcessor(tile Tile) (Tile, error) {
+	img, format, err := image.Decode(bytes.NewReader(tile.Content))
+	if err != nil {
+		return tile, fmt.Errorf("grayscale: %v", err)
+	}
+	bounds := img.Bounds()
+	gray := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			g := color.GrayModel.Convert(color.RGBA{c.R, c.G, c.B, 0xff}).(color.Gray)
+			gray.SetNRGBA(x, y, color.NRGBA{g.Y, g.Y, g.Y, c.A})
+		}
+	}
+	tile.Content, err = encodeTile(gray, format)
+	return tile, err
+}
+
+// newWatermarkProcessor returns a processor drawing the image in filename
+// over the bottom right corner of every tile.
+func newWatermarkProcessor(filename string) (TileProcessor, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	mark, _, err := image.Decode(file)
+	if err != nil {
+		return nil, fmt.Errorf("watermark %s: %v", filename, err)
+	}
+	return func(tile Tile) (Tile, error) {
+		img, format, err := image.Decode(bytes.NewReader(tile.Content))
+		if err != nil {
+			return tile, fmt.Errorf("watermark: %v", err)
+		}
+		bounds := img.Bounds()
+		canvas := image.NewRGBA(bounds)
+		draw.Draw(canvas, bounds, img, bounds.Min, draw.Src)
+		at := bounds.Max.Sub(mark.Bounds().Size())
+		draw.Draw(canvas, image.Rectangle{at, bounds.Max}, mark, mark.Bounds().Min, draw.Over)
+		tile.Content, err = encodeTile(canvas, format)
+		return tile, err
+	}, nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTileProcessors(t *testing.T) {
+	db, _ := newTestMBTiles(t, map[string]string{"format": "png"})
+	mutate := func(tile Tile) (Tile, error) {
+		tile.Content = append([]byte("processed "), tile.Content...)
+		return tile, nil
+	}
+	reject := func(tile Tile) (Tile, error) {
+		switch tile.x {
+		case 1:
+			return tile, errSkipTile
+		case 2:
+			return tile, errors.New("rejected")
+		}
+		return tile, nil
+	}
+	tilePipe := make(chan Tile, 3)
+	outputPipe := make(chan Tile, 3)
+	errorPipe := make(chan TileError, 3)
+	for x := 0; x < 3; x++ {
+		tilePipe <- Tile{z: 2, x: x, y: 1, Content: []byte("tile")}
+	}
+	close(tilePipe)
+	mbTileWorker(db, tilePipe, outputPipe, errorPipe, WriterOptions{Overwrite: true, Stats: &Stats{}, Processors: []TileProcessor{mutate, reject}})
+	close(outputPipe)
+	close(errorPipe)
+
+	var stored, skipped []int
+	for tile := range outputPipe {
+		if tile.Skipped {
+			skipped = append(skipped, tile.x)
+		} else {
+			stored = append(stored, tile.x)
+		}
+	}
+	if len(stored) != 1 || stored[0] != 0 || len(skipped) != 1 || skipped[0] != 1 {
+		t.Errorf("stored %v and skipped %v, want 0 and 1", stored, skipped)
+	}
+	if tileErr := <-errorPipe; tileErr.Tile.x != 2 {
+		t.Errorf("failed %v, want tile 2/2/1", tileErr)
+	}
+	rows, err := db.Query("select tile_column, tile_data from tiles;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		var x int
+		var content []byte
+		if err = rows.Scan(&x, &content); err != nil {
+			t.Fatal(err)
+		}
+		if x != 0 || string(content) != "processed tile" {
+			t.Errorf("tile %d stored as %q", x, content)
+		}
+		count++
+	}
+	if count != 1 {
+		t.Errorf("%d tiles stored, want 1", count)
+	}
+}
+
+func decodeTestPNG(t *testing.T, content []byte) image.Image {
+	img, err := png.Decode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func TestGrayscaleProcessor(t *testing.T) {
+	tile, err := grayscaleProcessor(Tile{Content: solidPNG(t, color.NRGBA{200, 40, 40, 128})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := color.NRGBAModel.Convert(decodeTestPNG(t, tile.Content).At(10, 10)).(color.NRGBA)
+	if c.R != c.G || c.G != c.B || c.A != 128 {
+		t.Errorf("pixel %v isn't gray with the alpha kept", c)
+	}
+	if _, err := grayscaleProcessor(Tile{Content: []byte("not an image")}); err == nil {
+		t.Error("converted something that isn't an image")
+	}
+}
+
+func TestWatermarkProcessor(t *testing.T) {
+	mark := image.NewRGBA(image.Rect(0, 0, 16, 16))
+	for x := 0; x < 16; x++ {
+		for y := 0; y < 16; y++ {
+			mark.Set(x, y, color.RGBA{255, 255, 255, 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, mark); err != nil {
+		t.Fatal(err)
+	}
+	filename := filepath.Join(t.TempDir(), "mark.png")
+	if err := ioutil.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	processor, err := newWatermarkProcessor(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tile, err := processor(Tile{Content: solidPNG(t, color.RGBA{0, 0, 0, 255})})
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := decodeTestPNG(t, tile.Content)
+	if r, _, _, _ := img.At(250, 250).RGBA(); r != 0xffff {
+		t.Error("no watermark in the bottom right corner")
+	}
+	if r, _, _, _ := img.At(10, 10).RGBA(); r != 0 {
+		t.Error("the watermark covers the rest of the tile")
+	}
+}
+
+func TestProcessorPanic(t *testing.T) {
+	db, _ := newTestMBTiles(t, map[string]string{"format": "png"})
+	var counts map[int]int
+	buggy := func(tile Tile) (Tile, error) {
+		if tile.x == 1 {
+			counts[tile.x]++
+		}
+		return tile, nil
+	}
+	tilePipe := make(chan Tile, 4)
+	outputPipe := make(chan Tile, 4)
+	errorPipe := make(chan TileError, 4)
+	for x := 0; x < 4; x++ {
+		tilePipe <- Tile{z: 2, x: x, y: 1, Content: []byte("tile")}
+	}
+	close(tilePipe)
+	done := make(chan bool)
+	go func() {
+		mbTileWorker(db, tilePipe, outputPipe, errorPipe, WriterOptions{Overwrite: true, Stats: &Stats{}, Processors: []TileProcessor{buggy}})
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the writer stopped at the panic")
+	}
+	if len(outputPipe) != 3 {
+		t.Errorf("%d tiles stored, want the 3 without the panic", len(outputPipe))
+	}
+	if len(errorPipe) != 1 {
+		t.Fatalf("%d tiles failed, want 1", len(errorPipe))
+	}
+	tileErr := <-errorPipe
+	if _, ok := tileErr.Err.(*tilePanic); !ok || tileErr.Tile.x != 1 {
+		t.Errorf("tile %s failed with %v, want the panic", tileErr.Tile, tileErr.Err)
+	}
+}
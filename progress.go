@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PROGRESS_JSON_INTERVAL is the least time between two -progress-json
+// records; the last one is always written.
+const PROGRESS_JSON_INTERVAL = time.Second
+
+// progressRecord is one line of -progress-json.
+type progressRecord struct {
+	Time      time.Time `json:"time"`
+	Completed int       `json:"completed"`
+	Total     int       `json:"total"`
+	Stored    int64     `json:"stored"`
+	Errors    int64     `json:"errors"`
+	// Rate is in tiles per second since the start of the download.
+	Rate       float64 `json:"rate"`
+	EtaSeconds float64 `json:"eta_seconds"`
+	Done       bool    `json:"done"`
+}
+
+// progressReporter writes progressRecords as JSON lines. A nil reporter
+// writes nothing.
+type progressReporter struct {
+	out     io.Writer
+	closer  io.Closer
+	total   int
+	started time.Time
+	last    time.Time
+}
+
+// newProgressReporter opens target, a file name, "stderr", or "fd:N" for an
+// inherited file descriptor.
+func newProgressReporter(target string, total int) (*progressReporter, error) {
+	reporter := &progressReporter{total: total, started: time.Now()}
+	switch {
+	case target == "stderr":
+		reporter.out = os.Stderr
+	case strings.HasPrefix(target, "fd:"):
+		fd, err := strconv.Atoi(strings.TrimPrefix(target, "fd:"))
+		if err != nil || fd < 0 {
+			return nil, fmt.Errorf("invalid -progress-json %q, expected fd:N", target)
+		}
+		file := os.NewFile(uintptr(fd), target)
+		reporter.out, reporter.closer = file, file
+	default:
+		file, err := os.Create(target)
+		if err != nil {
+			return nil, err
+		}
+		reporter.out, reporter.closer = file, file
+	}
+	return reporter, nil
+}
+
+// Update writes a record when PROGRESS_JSON_INTERVAL has passed since the
+// previous one.
+func (reporter *progressReporter) Update(completed int, stats Stats) {
+	if reporter == nil || time.Since(reporter.last) < PROGRESS_JSON_INTERVAL {
+		return
+	}
+	reporter.write(completed, stats, false)
+}
+
+// Finish writes the last record and closes the output.
+func (reporter *progressReporter) Finish(completed int, stats Stats) {
+	if reporter == nil {
+		return
+	}
+	reporter.write(completed, stats, true)
+	if reporter.closer != nil {
+		reporter.closer.Close()
+	}
+}
+
+func (reporter *progressReporter) write(completed int, stats Stats, done bool) {
+	now := time.Now()
+	reporter.last = now
+	record := progressRecord{
+		Time:      now,
+		Completed: completed,
+		Total:     reporter.total,
+		Stored:    stats.TilesStored,
+		Errors:    stats.TilesFailed,
+		Done:      done,
+	}
+	if elapsed := now.Sub(reporter.started).Seconds(); elapsed > 0 {
+		record.Rate = float64(completed) / elapsed
+	}
+	if record.Rate > 0 {
+		record.EtaSeconds = float64(reporter.total-completed) / record.Rate
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return
+	}
+	reporter.out.Write(append(line, '\n'))
+}
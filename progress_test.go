@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// readProgress parses the -progress-json records in content.
+func readProgress(t *testing.T, content []byte) []progressRecord {
+	var records []progressRecord
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		var record progressRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			t.Fatalf("%q: %v", scanner.Text(), err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestProgressReporter(t *testing.T) {
+	var buf bytes.Buffer
+	reporter := &progressReporter{out: &buf, total: 10, started: time.Now().Add(-time.Second)}
+	stats := Stats{TilesTotal: 10}
+	for completed := 1; completed <= 10; completed++ {
+		if completed%3 == 0 {
+			stats.TilesFailed++
+		} else {
+			stats.TilesStored++
+		}
+		reporter.Update(completed, stats)
+		if completed%2 == 0 {
+			// Let the next update through.
+			reporter.last = time.Time{}
+		}
+	}
+	reporter.Finish(10, stats)
+
+	records := readProgress(t, buf.Bytes())
+	if len(records) != 6 {
+		t.Fatalf("%d records, want 5 updates and the last one", len(records))
+	}
+	for i, record := range records {
+		if i > 0 && (record.Completed < records[i-1].Completed || record.Errors < records[i-1].Errors || record.Time.Before(records[i-1].Time)) {
+			t.Errorf("record %+v goes back from %+v", record, records[i-1])
+		}
+		if record.Done != (i == len(records)-1) || record.Total != 10 || record.Rate <= 0 {
+			t.Errorf("record %+v", record)
+		}
+	}
+	if last := records[len(records)-1]; last.Completed != 10 || last.Stored != 7 || last.Errors != 3 || last.EtaSeconds != 0 {
+		t.Errorf("last record %+v", last)
+	}
+}
+
+func TestProgressJSON(t *testing.T) {
+	content := solidPNG(t, color.RGBA{0, 0, 255, 255})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	progressFile := filepath.Join(dir, "progress.jsonl")
+	output, err := runMain(t, "-url", server.URL+"/{z}/{x}/{y}.png", "-zoomlevel", "2", "-max_zoomlevel", "2",
+		"-xmin", "-180", "-ymin", "-85", "-xmax", "180", "-ymax", "85",
+		"-progress-json", progressFile, "-filename", filepath.Join(dir, "out.mbtiles"))
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	progress, err := ioutil.ReadFile(progressFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := readProgress(t, progress)
+	if len(records) == 0 {
+		t.Fatal("no progress records")
+	}
+	if last := records[len(records)-1]; !last.Done || last.Completed != 16 || last.Total != 16 || last.Stored != 16 {
+		t.Errorf("last record %+v", last)
+	}
+}
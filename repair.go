@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// REPAIR_KEEP maps the -keep policies of repair to the order the rows of a
+// duplicated coordinate are sorted in; the first one is kept. row is the
+// table being repaired and size the expression for a row's tile size.
+var REPAIR_KEEP = map[string]string{
+	"first":   "row.rowid",
+	"last":    "row.rowid desc",
+	"largest": "%s desc, row.rowid desc",
+}
+
+// runRepair implements "repair file.mbtile": it removes the rows that
+// duplicate a tile coordinate, rebuilds the unique index that should have
+// prevented them and checks the integrity of the file.
+func runRepair(args []string) {
+	flags := flag.NewFlagSet("repair", flag.ExitOnError)
+	keep := flags.String("keep", "last", "Which of the duplicated rows to keep: first, last (the most recently written) or largest")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mbutil repair [options] file.mbtile")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if _, ok := REPAIR_KEEP[*keep]; !ok {
+		log.Fatalf("unknown -keep %q, expected first, last or largest", *keep)
+	}
+
+	db, err := openMBTile(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	coords, removed, err := repairDuplicates(db, *keep)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if removed > 0 {
+		log.Printf("Removed %d duplicate rows at %d coordinates, keeping the %s", removed, coords, *keep)
+	} else {
+		log.Println("No duplicate tiles found")
+	}
+	problems, err := integrityCheck(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(problems) > 0 {
+		log.Fatalf("Integrity check of %s failed:\n%s", flags.Arg(0), strings.Join(problems, "\n"))
+	}
+	log.Println("Rebuilt the tile index, integrity check ok")
+}
+
+// repairDuplicates deletes all but one row of every duplicated coordinate
+// and recreates the unique index. It returns the number of coordinates that
+// were duplicated and the number of rows removed.
+func repairDuplicates(db *sql.DB, keep string) (coords int, removed int64, err error) {
+	dedup, err := hasDedupLayout(db)
+	if err != nil {
+		return 0, 0, err
+	}
+	table, index, size := "tiles", "tile_index", "length(row.tile_data)"
+	if dedup {
+		table, index, size = "map", "map_index", "coalesce(length(row.tile_data), (select length(tile_data) from images where images.tile_id = row.tile_id))"
+		err = addInlineColumn(db)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	order := REPAIR_KEEP[keep]
+	if strings.Contains(order, "%s") {
+		order = fmt.Sprintf(order, size)
+	}
+
+	// A failure half way would otherwise leave the table without its index.
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			tx.Rollback()
+		}
+	}()
+	err = tx.QueryRow("select count(*) from (select 1 from " + table + " group by zoom_level, tile_column, tile_row having count(*) > 1);").Scan(&coords)
+	if err != nil {
+		return 0, 0, err
+	}
+	// The index is rebuilt either way, in case it is missing or was created
+	// without the unique constraint. A plain one speeds up the deletion.
+	statements := []string{
+		"drop index if exists " + index + ";",
+		"create index " + index + " on " + table + " (zoom_level, tile_column, tile_row);",
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	if coords > 0 {
+		result, err := tx.Exec("delete from " + table + " where rowid != (select row.rowid from " + table + " row where row.zoom_level = " + table + ".zoom_level and row.tile_column = " + table + ".tile_column and row.tile_row = " + table + ".tile_row order by " + order + " limit 1);")
+		if err != nil {
+			return 0, 0, err
+		}
+		removed, err = result.RowsAffected()
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	statements = []string{
+		"drop index " + index + ";",
+		"create unique index " + index + " on " + table + " (zoom_level, tile_column, tile_row);",
+	}
+	if dedup {
+		// Images no map row points at any more.
+		statements = append(statements, "delete from images where tile_id not in (select tile_id from map where tile_data is null);")
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, 0, err
+	}
+	return coords, removed, nil
+}
+
+// integrityCheck runs PRAGMA integrity_check and returns the problems it
+// reports, none when the file is fine.
+func integrityCheck(db *sql.DB) ([]string, error) {
+	rows, err := db.Query("PRAGMA integrity_check;")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var problems []string
+	for rows.Next() {
+		var line string
+		err = rows.Scan(&line)
+		if err != nil {
+			return nil, err
+		}
+		if line != "ok" {
+			problems = append(problems, line)
+		}
+	}
+	return problems, rows.Err()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// newDuplicatedMBTiles returns a file whose unique index was lost and that
+// has three rows for tile 3/2/1, "a", "long b" and "c" in that order, and
+// one for 3/2/2.
+func newDuplicatedMBTiles(t *testing.T) *sql.DB {
+	db, _ := newTestMBTiles(t, nil)
+	statements := []string{
+		"drop index tile_index;",
+		"insert into tiles (zoom_level, tile_column, tile_row, tile_data) values (3, 2, 6, 'a');",
+		"insert into tiles (zoom_level, tile_column, tile_row, tile_data) values (3, 2, 6, 'long b');",
+		"insert into tiles (zoom_level, tile_column, tile_row, tile_data) values (3, 2, 6, 'c');",
+		"insert into tiles (zoom_level, tile_column, tile_row, tile_data) values (3, 2, 5, 'd');",
+	}
+	for _, statement := range statements {
+		_, err := db.Exec(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return db
+}
+
+func hasTileIndex(t *testing.T, db *sql.DB) bool {
+	var count int
+	err := db.QueryRow("select count(*) from sqlite_master where type = 'index' and name = 'tile_index';").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return count > 0
+}
+
+func TestRepairDuplicates(t *testing.T) {
+	for keep, want := range map[string]string{"first": "a", "last": "c", "largest": "long b"} {
+		db := newDuplicatedMBTiles(t)
+		coords, removed, err := repairDuplicates(db, keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if coords != 1 || removed != 2 {
+			t.Errorf("-keep %s: removed %d rows at %d coordinates, want 2 at 1", keep, removed, coords)
+		}
+		content, err := readTile(db, Tile{z: 3, x: 2, y: 1}, tileLayout{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != want {
+			t.Errorf("-keep %s kept %q, want %q", keep, content, want)
+		}
+		if content, err := readTile(db, Tile{z: 3, x: 2, y: 2}, tileLayout{}); err != nil || string(content) != "d" {
+			t.Errorf("-keep %s: the tile without duplicates is %q, %v", keep, content, err)
+		}
+		_, err = db.Exec("insert into tiles (zoom_level, tile_column, tile_row, tile_data) values (3, 2, 6, 'e');")
+		if err == nil {
+			t.Errorf("-keep %s: the unique index wasn't recreated", keep)
+		}
+	}
+}
+
+func TestRepairDuplicatesRollsBack(t *testing.T) {
+	db := newDuplicatedMBTiles(t)
+	statements := []string{
+		"create index tile_index on tiles (zoom_level, tile_column, tile_row);",
+		// Keeps the duplicates, so the unique index can't be created after
+		// the plain one was dropped.
+		"create trigger keep_rows before delete on tiles begin select raise(ignore); end;",
+	}
+	for _, statement := range statements {
+		_, err := db.Exec(statement)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, _, err := repairDuplicates(db, "last"); err == nil {
+		t.Fatal("repair succeeded despite the duplicates left")
+	}
+	if !hasTileIndex(t, db) {
+		t.Error("the failed repair left the tiles without their index")
+	}
+	var count int
+	err := db.QueryRow("select count(*) from tiles;").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Errorf("%d rows left by the failed repair, want all 4", count)
+	}
+}
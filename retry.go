@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// DEFAULT_RETRY_STATUS are the statuses worth retrying: rate limiting and
+// server errors. Others, like 403 or 404, won't change on a second try.
+const DEFAULT_RETRY_STATUS = "429,500-599"
+
+// statusSet is a set of HTTP status codes given as a list of codes and
+// ranges, like "429,500-599".
+type statusSet [][2]int
+
+func parseStatusSet(value string) (statusSet, error) {
+	var set statusSet
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		low, err := strconv.Atoi(strings.TrimSpace(bounds[0]))
+		high := low
+		if err == nil && len(bounds) == 2 {
+			high, err = strconv.Atoi(strings.TrimSpace(bounds[1]))
+		}
+		if err != nil || low < 100 || high > 599 || low > high {
+			return nil, fmt.Errorf("invalid status %q, expected codes like 429 or ranges like 500-599", part)
+		}
+		set = append(set, [2]int{low, high})
+	}
+	return set, nil
+}
+
+func (set statusSet) Contains(code int) bool {
+	for _, bounds := range set {
+		if code >= bounds[0] && code <= bounds[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// retryable reports whether a failed attempt is worth repeating. Only
+// unexpected statuses are limited by the set; network errors and bad
+// tiles are always retried.
+func (set statusSet) retryable(err error) bool {
+	if status, ok := err.(*statusError); ok {
+		return set.Contains(status.Code)
+	}
+	return true
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+)
+
+func TestParseStatusSet(t *testing.T) {
+	set, err := parseStatusSet("429, 500-503,418")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for code, want := range map[int]bool{429: true, 418: true, 500: true, 502: true, 503: true, 504: false, 403: false, 404: false, 428: false} {
+		if set.Contains(code) != want {
+			t.Errorf("%d in the set: %v, want %v", code, !want, want)
+		}
+	}
+	for _, value := range []string{"abc", "500-", "503-500", "99", "600", "429,x"} {
+		if _, err := parseStatusSet(value); err == nil {
+			t.Errorf("-retry-status %q accepted", value)
+		}
+	}
+	if !set.retryable(errors.New("connection reset")) {
+		t.Error("a network error isn't retried")
+	}
+	if set.retryable(&statusError{Code: 403, Status: "403 Forbidden"}) {
+		t.Error("a 403 is retried")
+	}
+}
+
+func TestRetryStatus(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer server.Close()
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	for value, want := range map[string]int32{DEFAULT_RETRY_STATUS: 1, "403": 2} {
+		retryStatus, err := parseStatusSet(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		atomic.StoreInt32(&requests, 0)
+		options := FetchOptions{UrlFormat: server.URL + "/{z}/{x}/{y}.png", Retries: 1, RetryStatus: retryStatus}
+		if _, err := fetchTileWithRetry(Tile{z: 1, x: 0, y: 0}, options); err == nil {
+			t.Fatal("a 403 tile was fetched")
+		}
+		if count := atomic.LoadInt32(&requests); count != want {
+			t.Errorf("-retry-status %s: %d requests, want %d", value, count, want)
+		}
+	}
+}
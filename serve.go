@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const DEFAULT_SERVE_ADDR = "localhost:8080"
+
+// runServe implements "serve file.mbtile": it serves the tiles over HTTP at
+// /xyz/{z}/{x}/{y}.ext and /tms/{z}/{x}/{y}.ext, with a TileJSON document at
+// /index.json.
+func runServe(args []string) {
+	flags := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := flags.String("addr", DEFAULT_SERVE_ADDR, "Address to listen on")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: mbutil serve [options] file.mbtile")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	db, err := openMBTile(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+	server, err := newTileServer(db, flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Serving", flags.Arg(0), "at http://"+*addr+"/index.json")
+	log.Fatal(http.ListenAndServe(*addr, server))
+}
+
+// tileServer serves the tiles of an MBTiles file. The metadata is read once
+// when it starts.
+type tileServer struct {
+	db       *sql.DB
+	metadata map[string]string
+	// zoomFormats are the per zoom formats of a -zoom-formats file.
+	zoomFormats map[int]string
+	// layout is read from the metadata, for -tile-files and -compress files.
+	layout tileLayout
+	// Tiles from displayMinZoom up to below dataMinZoom are built from the
+	// ones at dataMinZoom. Without a display_minzoom both are 0.
+	displayMinZoom, dataMinZoom int
+	mux                         *http.ServeMux
+}
+
+func newTileServer(db *sql.DB, filename string) (*tileServer, error) {
+	metadata, err := readMetadata(db)
+	if err != nil {
+		return nil, err
+	}
+	server := &tileServer{db: db, metadata: metadata, zoomFormats: zoomFormatsMetadata(metadata), layout: tileLayoutOf(filename, metadata), mux: http.NewServeMux()}
+	if dataMinZoom, err := strconv.Atoi(metadata["minzoom"]); err == nil {
+		if displayMinZoom, err := strconv.Atoi(metadata[DISPLAY_MINZOOM_KEY]); err == nil && displayMinZoom < dataMinZoom && dataMinZoom-displayMinZoom <= MAX_UNDERZOOM_LEVELS {
+			server.displayMinZoom, server.dataMinZoom = displayMinZoom, dataMinZoom
+		}
+	}
+	server.mux.HandleFunc("/xyz/", func(w http.ResponseWriter, r *http.Request) {
+		server.serveTile(w, r, "/xyz/", false)
+	})
+	server.mux.HandleFunc("/tms/", func(w http.ResponseWriter, r *http.Request) {
+		server.serveTile(w, r, "/tms/", true)
+	})
+	server.mux.HandleFunc("/index.json", server.serveTileJSON)
+	return server, nil
+}
+
+func (server *tileServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	server.mux.ServeHTTP(w, r)
+}
+
+// serveTile answers prefix/{z}/{x}/{y}.ext, where y is a TMS row under /tms/.
+func (server *tileServer) serveTile(w http.ResponseWriter, r *http.Request, prefix string, tms bool) {
+	tile, err := parseTilePath(strings.TrimPrefix(r.URL.Path, prefix))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if tms {
+		tile.y = tile.flipped_y()
+	}
+	content, err := readTile(server.db, tile, server.layout)
+	if err == sql.ErrNoRows && tile.z >= server.displayMinZoom && tile.z < server.dataMinZoom {
+		content, err = underzoomTile(server.db, tile, server.dataMinZoom, server.layout)
+	}
+	if err == sql.ErrNoRows {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		log.Println("Reading tile", r.URL.Path, ":", err)
+		http.Error(w, "internal error", http.StatusInternalServerError)
+		return
+	}
+	format := server.metadata["format"]
+	if zoomFormat, ok := server.zoomFormats[tile.z]; ok {
+		format = zoomFormat
+	}
+	w.Header().Set("Content-Type", contentTypeForExtension(format))
+	if bytes.HasPrefix(content, []byte{0x1f, 0x8b}) {
+		// Vector tiles are usually stored gzipped.
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+	if maxAge, ok := server.metadata["maxage"]; ok {
+		w.Header().Set("Cache-Control", "max-age="+maxAge)
+	}
+	w.Write(content)
+}
+
+// readTile returns the content of the XYZ tile, or sql.ErrNoRows. Tiles are
+// stored with TMS rows, so the y is flipped first. With a layout Dir the
+// row holds the path of the tile under it, which is read instead, and with
+// a Compression the bytes are decompressed.
+func readTile(db *sql.DB, tile Tile, layout tileLayout) ([]byte, error) {
+	var content []byte
+	err := db.QueryRow("select tile_data from tiles where zoom_level = ? and tile_column = ? and tile_row = ?;", tile.z, tile.x, tile.flipped_y()).Scan(&content)
+	if err != nil {
+		return content, err
+	}
+	if layout.Dir != "" {
+		content, err = readTileFile(layout.Dir, content)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return decompressTile(content, layout.Compression)
+}
+
+// parseTilePath parses "{z}/{x}/{y}.ext"; the extension is optional.
+func parseTilePath(path string) (Tile, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) != 3 {
+		return Tile{}, fmt.Errorf("invalid tile path %q, expected {z}/{x}/{y}.ext", path)
+	}
+	if dot := strings.Index(parts[2], "."); dot >= 0 {
+		parts[2] = parts[2][:dot]
+	}
+	var coord [3]int
+	for i, part := range parts {
+		value, err := strconv.Atoi(part)
+		if err != nil {
+			return Tile{}, fmt.Errorf("invalid tile path %q, expected {z}/{x}/{y}.ext", path)
+		}
+		coord[i] = value
+	}
+	return newTileAt(coord[0], coord[1], coord[2])
+}
+
+func contentTypeForExtension(extension string) string {
+	switch extension {
+	case JPG_EXTENSION, "jpeg":
+		return JPG_IMAGE_FORMAT
+	case WEBP_EXTENSION:
+		return WEBP_IMAGE_FORMAT
+	case PBF_EXTENSION, "mvt":
+		return PBF_FORMAT
+	}
+	return PNG_IMAGE_FORMAT
+}
+
+// serveTileJSON describes the file as TileJSON, pointing at the XYZ routes.
+func (server *tileServer) serveTileJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tileJSONForMetadata(server.metadata, "http://"+r.Host+"/xyz"))
+}
+
+// tileJSONForMetadata builds a TileJSON document from MBTiles metadata, with
+// tile urls under baseUrl.
+func tileJSONForMetadata(metadata map[string]string, baseUrl string) TileJSON {
+	extension := metadata["format"]
+	if extension == "" {
+		extension = PNG_EXTENSION
+	}
+	tileJSON := TileJSON{
+		TileJSON:    TILEJSON_VERSION,
+		Name:        metadata["name"],
+		Description: metadata["description"],
+		Attribution: metadata["attribution"],
+		Tiles:       []string{baseUrl + "/{z}/{x}/{y}." + extension},
+	}
+	if minZoom, err := strconv.Atoi(metadata["minzoom"]); err == nil {
+		tileJSON.MinZoom = &minZoom
+	}
+	if displayMinZoom, err := strconv.Atoi(metadata[DISPLAY_MINZOOM_KEY]); err == nil && tileJSON.MinZoom != nil && displayMinZoom < *tileJSON.MinZoom && *tileJSON.MinZoom-displayMinZoom <= MAX_UNDERZOOM_LEVELS {
+		// serve fills in the levels below the data.
+		tileJSON.MinZoom = &displayMinZoom
+	}
+	if maxZoom, err := strconv.Atoi(metadata["maxzoom"]); err == nil {
+		tileJSON.MaxZoom = &maxZoom
+	}
+	if bounds, err := parseBounds(metadata["bounds"]); err == nil {
+		tileJSON.Bounds = bounds[:]
+	}
+	tileJSON.Format = extension
+	if center, err := parseCenterMetadata(metadata["center"]); err == nil {
+		tileJSON.Center = center
+	} else if tileJSON.Bounds != nil {
+		// The middle of the bounds at the lowest zoom level.
+		zoom := 0
+		if tileJSON.MinZoom != nil {
+			zoom = *tileJSON.MinZoom
+		}
+		tileJSON.Center = []float64{(tileJSON.Bounds[0] + tileJSON.Bounds[2]) / 2, (tileJSON.Bounds[1] + tileJSON.Bounds[3]) / 2, float64(zoom)}
+	}
+	return tileJSON
+}
+
+// parseCenterMetadata parses the "lon,lat,zoom" center metadata value.
+func parseCenterMetadata(value string) ([]float64, error) {
+	parts := strings.Split(value, ",")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid center %q, expected lon,lat,zoom", value)
+	}
+	center := make([]float64, 3)
+	for i, part := range parts {
+		number, err := strconv.ParseFloat(strings.TrimSpace(part), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid center %q, expected lon,lat,zoom", value)
+		}
+		center[i] = number
+	}
+	return center, nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/color"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestTileServer(t *testing.T, metadata map[string]string) (*tileServer, []byte) {
+	db, filename := newTestMBTiles(t, metadata)
+	content := solidPNG(t, color.RGBA{255, 0, 0, 255})
+	addTestTile(t, db, 3, 2, 1, content)
+	server, err := newTileServer(db, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return server, content
+}
+
+func serveTestPath(server *tileServer, path string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	server.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+	return recorder
+}
+
+func TestServeXYZAndTMS(t *testing.T) {
+	server, content := newTestTileServer(t, map[string]string{"format": "png", "maxage": "3600"})
+	for _, path := range []string{"/xyz/3/2/1.png", "/tms/3/2/6.png", "/xyz/3/2/1"} {
+		recorder := serveTestPath(server, path)
+		if recorder.Code != 200 {
+			t.Fatalf("%s: status %d", path, recorder.Code)
+		}
+		if !bytes.Equal(recorder.Body.Bytes(), content) {
+			t.Errorf("%s: served another tile", path)
+		}
+		if contentType := recorder.Header().Get("Content-Type"); contentType != PNG_IMAGE_FORMAT {
+			t.Errorf("%s: Content-Type %s", path, contentType)
+		}
+		if cacheControl := recorder.Header().Get("Cache-Control"); cacheControl != "max-age=3600" {
+			t.Errorf("%s: Cache-Control %s", path, cacheControl)
+		}
+	}
+	// The same rows the other way round.
+	for path, status := range map[string]int{"/xyz/3/2/6.png": 404, "/tms/3/2/1.png": 404, "/xyz/3/2.png": 400, "/xyz/3/9/1.png": 400} {
+		if recorder := serveTestPath(server, path); recorder.Code != status {
+			t.Errorf("%s: status %d, want %d", path, recorder.Code, status)
+		}
+	}
+}
+
+func TestServeTileJSON(t *testing.T) {
+	server, _ := newTestTileServer(t, map[string]string{"format": "jpg", "name": "Test", "minzoom": "3", "maxzoom": "5", "bounds": "-10,35,30,60"})
+	recorder := serveTestPath(server, "/index.json")
+	if recorder.Code != 200 {
+		t.Fatalf("status %d", recorder.Code)
+	}
+	var tileJSON TileJSON
+	err := json.Unmarshal(recorder.Body.Bytes(), &tileJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tileJSON.Name != "Test" || len(tileJSON.Tiles) != 1 || tileJSON.Tiles[0] != "http://example.com/xyz/{z}/{x}/{y}.jpg" {
+		t.Errorf("TileJSON %+v", tileJSON)
+	}
+	if tileJSON.MinZoom == nil || *tileJSON.MinZoom != 3 || tileJSON.MaxZoom == nil || *tileJSON.MaxZoom != 5 {
+		t.Errorf("TileJSON zoom levels %v-%v", tileJSON.MinZoom, tileJSON.MaxZoom)
+	}
+	if len(tileJSON.Bounds) != 4 || tileJSON.Bounds[0] != -10 || tileJSON.Bounds[3] != 60 {
+		t.Errorf("TileJSON bounds %v", tileJSON.Bounds)
+	}
+}
+
+func TestServeDisplayMinZoom(t *testing.T) {
+	proj := NewProjection(-10, 35, 30, 60, 3, 5, nil, 0)
+	proj.SetDisplayMinZoom(1)
+	metadata := proj.MetaDataItems()
+	if metadata[DISPLAY_MINZOOM_KEY] != "1" || metadata["minzoom"] != "3" {
+		t.Fatalf("display_minzoom %q and minzoom %q written", metadata[DISPLAY_MINZOOM_KEY], metadata["minzoom"])
+	}
+
+	server, _ := newTestTileServer(t, map[string]string{"format": "png", "minzoom": "3", "maxzoom": "5", DISPLAY_MINZOOM_KEY: "1"})
+	for path, status := range map[string]int{"/xyz/2/1/0.png": 200, "/xyz/1/0/0.png": 200, "/xyz/2/0/0.png": 404, "/xyz/0/0/0.png": 404} {
+		if recorder := serveTestPath(server, path); recorder.Code != status {
+			t.Errorf("%s: status %d, want %d", path, recorder.Code, status)
+		}
+	}
+	// Tile 3/2/1 is the bottom left quarter of 2/1/0.
+	img := decodeTestPNG(t, serveTestPath(server, "/xyz/2/1/0.png").Body.Bytes())
+	if _, _, _, a := img.At(64, 64).RGBA(); a != 0 {
+		t.Error("the top left quarter isn't empty")
+	}
+	if r, _, _, a := img.At(64, 192).RGBA(); r != 0xffff || a != 0xffff {
+		t.Error("the bottom left quarter isn't the stored tile")
+	}
+	var tileJSON TileJSON
+	if err := json.Unmarshal(serveTestPath(server, "/index.json").Body.Bytes(), &tileJSON); err != nil {
+		t.Fatal(err)
+	}
+	if tileJSON.MinZoom == nil || *tileJSON.MinZoom != 1 {
+		t.Errorf("TileJSON minzoom %v, want 1", tileJSON.MinZoom)
+	}
+
+	// Without display_minzoom nothing is built below the data.
+	server, _ = newTestTileServer(t, map[string]string{"format": "png", "minzoom": "3", "maxzoom": "5"})
+	if recorder := serveTestPath(server, "/xyz/2/1/0.png"); recorder.Code != 404 {
+		t.Errorf("status %d below the data without display_minzoom", recorder.Code)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+)
+
+// loginForm is posted to -login-url, set with -login-field key=value.
+var loginForm = url.Values{}
+
+// login hits loginUrl with the shared client before any tile is fetched:
+// a form post of form, or a plain GET without fields. The cookies the
+// server sets, on the answer or on a redirect, stay in a cookie jar on the
+// client and go with every tile request after. It returns the number of
+// cookies the jar holds for loginUrl.
+func login(loginUrl string, form url.Values) (int, error) {
+	parsed, err := url.Parse(loginUrl)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+		return 0, fmt.Errorf("login url %q must be an absolute http or https url", redactUrl(loginUrl))
+	}
+	if httpClient.Jar == nil {
+		httpClient.Jar, err = cookiejar.New(nil)
+		if err != nil {
+			return 0, err
+		}
+	}
+	var req *http.Request
+	if len(form) > 0 {
+		req, err = http.NewRequest("POST", loginUrl, strings.NewReader(form.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	} else {
+		req, err = http.NewRequest("GET", loginUrl, nil)
+	}
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	sourceCredentials.Apply(req)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("login at %s: %v", redactUrl(loginUrl), redactUrl(err.Error()))
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return 0, fmt.Errorf("login at %s failed: %s", redactUrl(loginUrl), resp.Status)
+	}
+	return len(httpClient.Jar.Cookies(parsed)), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newSessionServer issues a session cookie on a form login as alice and
+// only serves tiles to requests carrying it.
+func newSessionServer(t *testing.T) *httptest.Server {
+	content := solidPNG(t, color.RGBA{255, 255, 0, 255})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			if r.Method != "POST" || r.PostFormValue("username") != "alice" || r.PostFormValue("password") != "secret" {
+				http.Error(w, "wrong login", http.StatusUnauthorized)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "s3ss10n", Path: "/"})
+			return
+		}
+		if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "s3ss10n" {
+			http.Error(w, "log in first", http.StatusForbidden)
+			return
+		}
+		w.Write(content)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestLoginSession(t *testing.T) {
+	server := newSessionServer(t)
+	run := func(flags ...string) (string, string, error) {
+		filename := filepath.Join(t.TempDir(), "out.mbtiles")
+		args := append([]string{"-url", server.URL + "/{z}/{x}/{y}.png", "-zoomlevel", "0", "-max_zoomlevel", "2",
+			"-xmin", "-180", "-ymin", "-85", "-xmax", "180", "-ymax", "85", "-filename", filename}, flags...)
+		output, err := runMain(t, args...)
+		return filename, output, err
+	}
+
+	filename, output, err := run("-login-url", server.URL+"/login", "-login-field", "username=alice", "-login-field", "password=secret")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	db, err := openMBTile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	if err = db.QueryRow("select count(*) from tiles;").Scan(&count); err != nil || count != 1+4+16 {
+		t.Errorf("%d tiles stored with the session, %v, want 21", count, err)
+	}
+
+	if _, output, err = run("-login-url", server.URL+"/login", "-login-field", "username=alice", "-login-field", "password=wrong"); err == nil || !strings.Contains(output, "401 Unauthorized") {
+		t.Errorf("ran with a failed login: %v\n%s", err, output)
+	}
+	if _, output, err = run("-login-field", "username=alice"); err == nil || !strings.Contains(output, "-login-field needs a -login-url") {
+		t.Errorf("ran with -login-field alone: %v\n%s", err, output)
+	}
+}
+
+func TestLoginCookieJar(t *testing.T) {
+	server := newSessionServer(t)
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	url_format := server.URL + "/{z}/{x}/{y}.png"
+	if _, err := fetchTile(context.Background(), 1, 0, 0, url_format); err == nil {
+		t.Error("fetched a tile before logging in")
+	}
+	form := map[string][]string{"username": {"alice"}, "password": {"secret"}}
+	cookies, err := login(server.URL+"/login", form)
+	if err != nil || cookies != 1 {
+		t.Fatalf("logged in with %d cookies, %v", cookies, err)
+	}
+	if _, err := fetchTile(context.Background(), 1, 0, 0, url_format); err != nil {
+		t.Errorf("tile after logging in: %v", err)
+	}
+	if _, err := login("/login", form); err == nil {
+		t.Error("logged in at a relative url")
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+)
+
+const (
+	SHAPEFILE_CODE     = 9994
+	SHAPEFILE_HEADER   = 100
+	SHAPE_NULL         = 0
+	SHAPE_POLYGON      = 5
+	SHAPE_POLYGON_Z    = 15
+	SHAPE_POLYGON_M    = 25
+	SHAPE_RECORD_START = 8
+)
+
+// readShapefile reads the polygons of an ESRI shapefile (.shp) as one
+// clipPolygon. Coordinates must be WGS84 longitude and latitude or Web
+// Mercator, which is converted; the .prj file next to it tells which.
+func readShapefile(filename string) (clipPolygon, error) {
+	var polygon clipPolygon
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return polygon, err
+	}
+	if len(content) < SHAPEFILE_HEADER || binary.BigEndian.Uint32(content) != SHAPEFILE_CODE {
+		return polygon, fmt.Errorf("%s is not a shapefile", filename)
+	}
+	mercator, err := shapefileIsMercator(filename)
+	if err != nil {
+		return polygon, err
+	}
+
+	for offset := SHAPEFILE_HEADER; offset+SHAPE_RECORD_START <= len(content); {
+		length := int(binary.BigEndian.Uint32(content[offset+4:])) * 2
+		record := content[offset+SHAPE_RECORD_START:]
+		offset += SHAPE_RECORD_START + length
+		if length < 4 || len(record) < length {
+			return polygon, fmt.Errorf("%s is truncated", filename)
+		}
+		record = record[:length]
+		shapeType := binary.LittleEndian.Uint32(record)
+		switch shapeType {
+		case SHAPE_NULL:
+			continue
+		case SHAPE_POLYGON, SHAPE_POLYGON_Z, SHAPE_POLYGON_M:
+		default:
+			return polygon, fmt.Errorf("%s has shape type %d, only polygons can be used to clip", filename, shapeType)
+		}
+		// Type, then the bounding box, then the part and point counts.
+		if len(record) < 44 {
+			return polygon, fmt.Errorf("%s has a truncated polygon", filename)
+		}
+		numParts := int(binary.LittleEndian.Uint32(record[36:]))
+		numPoints := int(binary.LittleEndian.Uint32(record[40:]))
+		pointsStart := 44 + 4*numParts
+		if numParts < 0 || numPoints < 0 || len(record) < pointsStart+16*numPoints {
+			return polygon, fmt.Errorf("%s has a truncated polygon", filename)
+		}
+		for part := 0; part < numParts; part++ {
+			start := int(binary.LittleEndian.Uint32(record[44+4*part:]))
+			end := numPoints
+			if part+1 < numParts {
+				end = int(binary.LittleEndian.Uint32(record[44+4*(part+1):]))
+			}
+			if start < 0 || end > numPoints || start >= end {
+				return polygon, fmt.Errorf("%s has an invalid polygon part", filename)
+			}
+			var ring [][2]float64
+			for i := start; i < end; i++ {
+				x := math.Float64frombits(binary.LittleEndian.Uint64(record[pointsStart+16*i:]))
+				y := math.Float64frombits(binary.LittleEndian.Uint64(record[pointsStart+16*i+8:]))
+				if mercator {
+					x, y = mercatorToLonLat(x, y)
+				}
+				ring = append(ring, [2]float64{x, y})
+			}
+			polygon.rings = append(polygon.rings, ring)
+		}
+	}
+	if len(polygon.rings) == 0 {
+		return polygon, fmt.Errorf("%s has no polygons", filename)
+	}
+	xmin, ymin, xmax, ymax := polygon.Bounds()
+	if xmin < -180 || xmax > 180 || ymin < -90 || ymax > 90 {
+		return polygon, fmt.Errorf("%s is not in longitude and latitude; reproject it first, e.g. with ogr2ogr -t_srs EPSG:4326", filename)
+	}
+	return polygon, nil
+}
+
+// shapefileIsMercator reads the .prj file of a shapefile. Without one the
+// coordinates are taken to be WGS84.
+func shapefileIsMercator(filename string) (bool, error) {
+	prj, err := ioutil.ReadFile(strings.TrimSuffix(filename, ".shp") + ".prj")
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	wkt := string(prj)
+	if !strings.HasPrefix(wkt, "PROJCS") {
+		return false, nil
+	}
+	for _, name := range []string{"Mercator_Auxiliary_Sphere", "Pseudo-Mercator", "Popular Visualisation", "Web_Mercator"} {
+		if strings.Contains(wkt, name) {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("%s uses a projection other than Web Mercator; reproject it first, e.g. with ogr2ogr -t_srs EPSG:4326", filename)
+}
+
+// mercatorToLonLat converts Web Mercator meters to longitude and latitude.
+func mercatorToLonLat(x, y float64) (lon, lat float64) {
+	lon = x / EARTH_RADIUS * RAD_TO_DEG
+	lat = (2*math.Atan(math.Exp(y/EARTH_RADIUS)) - math.Pi/2) * RAD_TO_DEG
+	return lon, lat
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+// writeShapefile writes a .shp of polygon records, each a list of rings.
+func writeShapefile(t *testing.T, filename string, records [][][][2]float64) {
+	var body []byte
+	for number, parts := range records {
+		numPoints := 0
+		for _, ring := range parts {
+			numPoints += len(ring)
+		}
+		record := make([]byte, 44+4*len(parts)+16*numPoints)
+		binary.LittleEndian.PutUint32(record, SHAPE_POLYGON)
+		binary.LittleEndian.PutUint32(record[36:], uint32(len(parts)))
+		binary.LittleEndian.PutUint32(record[40:], uint32(numPoints))
+		point := 0
+		for i, ring := range parts {
+			binary.LittleEndian.PutUint32(record[44+4*i:], uint32(point))
+			for _, p := range ring {
+				start := 44 + 4*len(parts) + 16*point
+				binary.LittleEndian.PutUint64(record[start:], math.Float64bits(p[0]))
+				binary.LittleEndian.PutUint64(record[start+8:], math.Float64bits(p[1]))
+				point++
+			}
+		}
+		header := make([]byte, SHAPE_RECORD_START)
+		binary.BigEndian.PutUint32(header, uint32(number+1))
+		binary.BigEndian.PutUint32(header[4:], uint32(len(record)/2))
+		body = append(append(body, header...), record...)
+	}
+	content := make([]byte, SHAPEFILE_HEADER)
+	binary.BigEndian.PutUint32(content, SHAPEFILE_CODE)
+	binary.BigEndian.PutUint32(content[24:], uint32((SHAPEFILE_HEADER+len(body))/2))
+	binary.LittleEndian.PutUint32(content[28:], 1000)
+	binary.LittleEndian.PutUint32(content[32:], SHAPE_POLYGON)
+	err := ioutil.WriteFile(filename, append(content, body...), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func square(xmin, ymin, xmax, ymax float64) [][2]float64 {
+	return [][2]float64{{xmin, ymin}, {xmin, ymax}, {xmax, ymax}, {xmax, ymin}, {xmin, ymin}}
+}
+
+// A square with a hole, and a second square apart from it.
+var testShapes = [][][][2]float64{
+	{square(0, 0, 40, 40), square(10, 10, 30, 30)},
+	{square(50, 0, 55, 5)},
+}
+
+func TestReadShapefile(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "boundary.shp")
+	writeShapefile(t, filename, testShapes)
+	polygon, err := readShapefile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(polygon.rings) != 3 {
+		t.Fatalf("%d rings, want 3", len(polygon.rings))
+	}
+	if xmin, ymin, xmax, ymax := polygon.Bounds(); xmin != 0 || ymin != 0 || xmax != 55 || ymax != 40 {
+		t.Errorf("bounds %f,%f,%f,%f", xmin, ymin, xmax, ymax)
+	}
+	for _, test := range []struct {
+		x, y   float64
+		inside bool
+	}{{5, 5, true}, {20, 20, false}, {52, 2, true}, {45, 2, false}, {60, 60, false}} {
+		if inside := polygon.Contains(test.x, test.y); inside != test.inside {
+			t.Errorf("%f,%f inside: %v, want %v", test.x, test.y, inside, test.inside)
+		}
+	}
+
+	xmin, ymin, xmax, ymax := polygon.Bounds()
+	proj := NewProjection(xmin, ymin, xmax, ymax, 5, 5, nil, 0)
+	kept := make(map[[2]int]bool)
+	for _, tile := range tilesInPolygon(proj, proj.TileList(), polygon) {
+		kept[[2]int{tile.x, tile.y}] = true
+	}
+	// 5/17/14 lies in the hole, 5/16/14 overlaps the ring around it and
+	// 5/20/15 the second square, while 5/20/14 is beside both.
+	for tile, want := range map[[2]int]bool{{17, 14}: false, {16, 14}: true, {20, 15}: true, {20, 14}: false} {
+		if kept[tile] != want {
+			t.Errorf("tile 5/%d/%d kept: %v, want %v", tile[0], tile[1], kept[tile], want)
+		}
+	}
+}
+
+func TestReadMercatorShapefile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "boundary.shp")
+	// The square of 0,0 to 10,10 degrees in Web Mercator metres.
+	top := math.Log(math.Tan(math.Pi/4+10*DEG_TO_RAD/2)) * EARTH_RADIUS
+	right := 10 * DEG_TO_RAD * EARTH_RADIUS
+	writeShapefile(t, filename, [][][][2]float64{{square(0, 0, right, top)}})
+	err := ioutil.WriteFile(filepath.Join(dir, "boundary.prj"), []byte(`PROJCS["WGS_1984_Web_Mercator_Auxiliary_Sphere",GEOGCS["GCS_WGS_1984"]]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	polygon, err := readShapefile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	xmin, ymin, xmax, ymax := polygon.Bounds()
+	if math.Abs(xmin) > 1e-9 || math.Abs(ymin) > 1e-9 || math.Abs(xmax-10) > 1e-9 || math.Abs(ymax-10) > 1e-9 {
+		t.Errorf("bounds %f,%f,%f,%f, want 0,0,10,10", xmin, ymin, xmax, ymax)
+	}
+
+	// Other projections are refused.
+	err = ioutil.WriteFile(filepath.Join(dir, "boundary.prj"), []byte(`PROJCS["OSGB_1936_British_National_Grid"]`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = readShapefile(filename); err == nil {
+		t.Error("read a shapefile in British National Grid")
+	}
+}
+
+func TestReadShapefileErrors(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "broken.shp")
+	writeShapefile(t, filename, testShapes)
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, broken := range map[string][]byte{
+		"truncated":       content[:len(content)-10],
+		"not a shapefile": append([]byte("PK"), content[2:]...),
+	} {
+		err = ioutil.WriteFile(filename, broken, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = readShapefile(filename); err == nil {
+			t.Errorf("read a %s file", name)
+		}
+	}
+}
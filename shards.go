@@ -0,0 +1,260 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// SHARD_TILE_OVERHEAD is about what SQLite adds to each tile of a shard for
+// its row and index entry, and SHARD_FIXED_OVERHEAD what the schema,
+// metadata and statistics take. Both only size the first attempt at a
+// shard: a shard written above -max-file-size is written again with fewer
+// tiles.
+const SHARD_TILE_OVERHEAD = 64
+const SHARD_FIXED_OVERHEAD = 64 * 1024
+
+// shardTile is a tile of the shard index, in XYZ coordinates.
+type shardTile struct {
+	Z int `json:"z"`
+	X int `json:"x"`
+	Y int `json:"y"`
+}
+
+// shardInfo describes one shard: the tiles from First to Last, both
+// included, in the order of the index. File is relative to the index, so
+// the shards can be copied elsewhere together.
+type shardInfo struct {
+	File    string    `json:"file"`
+	Tiles   int       `json:"tiles"`
+	Size    int64     `json:"size"`
+	MinZoom int       `json:"minzoom"`
+	MaxZoom int       `json:"maxzoom"`
+	Bounds  string    `json:"bounds"`
+	First   shardTile `json:"first"`
+	Last    shardTile `json:"last"`
+}
+
+// shardIndex is written next to the shards, so a reader can find the
+// shard of a tile without opening them all.
+type shardIndex struct {
+	Order  string      `json:"order"`
+	Shards []shardInfo `json:"shards"`
+}
+
+// parseFileSize parses a -max-file-size: bytes, or a number followed by K,
+// M or G (powers of 1024, KiB etc. also accepted), e.g. 3900M.
+func parseFileSize(value string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSpace(value))
+	number = strings.TrimSuffix(strings.TrimSuffix(number, "B"), "I")
+	multiplier := int64(1)
+	if number != "" {
+		switch number[len(number)-1] {
+		case 'K':
+			multiplier = 1 << 10
+		case 'M':
+			multiplier = 1 << 20
+		case 'G':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			number = number[:len(number)-1]
+		}
+	}
+	size, err := strconv.ParseFloat(strings.TrimSpace(number), 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid -max-file-size %q, expected bytes or a size like 500M or 3.9G", value)
+	}
+	return int64(size * float64(multiplier)), nil
+}
+
+// shardFilename numbers filename: tiles.mbtiles becomes tiles.1.mbtiles.
+func shardFilename(filename string, n int) string {
+	ext := filepath.Ext(filename)
+	return strings.TrimSuffix(filename, ext) + "." + strconv.Itoa(n) + ext
+}
+
+// shardIndexFilename is where the index of the shards of filename goes:
+// tiles.mbtiles has tiles.shards.json.
+func shardIndexFilename(filename string) string {
+	return strings.TrimSuffix(filename, filepath.Ext(filename)) + ".shards.json"
+}
+
+// writeShards splits the tiles of db over numbered copies of filename of at
+// most maxSize bytes each, and writes their index. Tiles are taken ordered
+// by zoom level, column and row, so a shard holds whole zoom levels or
+// neighbouring columns of one, and each shard is a complete MBTiles file
+// with the metadata of db and its own bounds and zoom range. It runs on the
+// finished file, so the disk needs room for the tiles twice until the caller
+// removes filename; an error leaves filename in place.
+func writeShards(db *sql.DB, filename string, maxSize int64, compact bool) ([]shardInfo, error) {
+	budget := maxSize - SHARD_FIXED_OVERHEAD
+	if budget <= 0 {
+		return nil, fmt.Errorf("-max-file-size %s leaves no room for tiles", formatBytes(maxSize))
+	}
+	metadata, err := readMetadata(db)
+	if err != nil {
+		return nil, err
+	}
+	// Descending rows are ascending XYZ y.
+	rows, err := db.Query("select zoom_level, tile_column, tile_row, length(tile_data) from tiles order by zoom_level, tile_column, tile_row desc;")
+	if err != nil {
+		return nil, err
+	}
+	var tiles []Tile
+	var sizes []int64
+	for rows.Next() {
+		var tile Tile
+		var size int64
+		err = rows.Scan(&tile.z, &tile.x, &tile.y, &size)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		tiles = append(tiles, tile)
+		sizes = append(sizes, size)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(tiles) == 0 {
+		return nil, fmt.Errorf("%s has no tiles to split", filename)
+	}
+
+	var shards []shardInfo
+	for start := 0; start < len(tiles); {
+		end := start
+		var total int64
+		for end < len(tiles) && (end == start || total+sizes[end]+SHARD_TILE_OVERHEAD <= budget) {
+			total += sizes[end] + SHARD_TILE_OVERHEAD
+			end++
+		}
+		for {
+			shard, err := writeShard(db, shardFilename(filename, len(shards)+1), tiles[start:end], metadata, compact)
+			if err != nil {
+				return shards, err
+			}
+			if shard.Size <= maxSize {
+				shards = append(shards, shard)
+				break
+			}
+			count := end - start
+			if count == 1 {
+				os.Remove(shardFilename(filename, len(shards)+1))
+				return shards, fmt.Errorf("tile %d/%d/%d alone makes a %s file, above -max-file-size %s", shard.First.Z, shard.First.X, shard.First.Y, formatBytes(shard.Size), formatBytes(maxSize))
+			}
+			// Leave out the share of tiles the file is over by, and a bit more.
+			fewer := int(float64(count) * float64(maxSize) / float64(shard.Size) * 0.98)
+			if fewer < 1 {
+				fewer = 1
+			} else if fewer >= count {
+				fewer = count - 1
+			}
+			end = start + fewer
+		}
+		start = end
+	}
+	// An earlier split of the same file may have left more shards.
+	for n := len(shards) + 1; ; n++ {
+		if os.Remove(shardFilename(filename, n)) != nil {
+			break
+		}
+	}
+
+	content, err := json.MarshalIndent(shardIndex{Order: "z, x, y", Shards: shards}, "", "  ")
+	if err != nil {
+		return shards, err
+	}
+	return shards, ioutil.WriteFile(shardIndexFilename(filename), append(content, '\n'), 0644)
+}
+
+// writeShard copies tiles, ordered as in writeShards, from db into a new
+// MBTiles file.
+func writeShard(db *sql.DB, filename string, tiles []Tile, metadata map[string]string, compact bool) (shardInfo, error) {
+	first, last := tiles[0], tiles[len(tiles)-1]
+	shard := shardInfo{
+		File:  filepath.Base(filename),
+		Tiles: len(tiles),
+		First: shardTile{Z: first.z, X: first.x, Y: first.flipped_y()},
+		Last:  shardTile{Z: last.z, X: last.x, Y: last.flipped_y()},
+	}
+	out, err := prepareDatabase(filename, false)
+	if err != nil {
+		return shard, err
+	}
+	defer out.Close()
+	err = createMBTileSchema(out)
+	if err != nil {
+		return shard, err
+	}
+	tx, err := out.Begin()
+	if err != nil {
+		return shard, err
+	}
+	for _, tile := range tiles {
+		var content []byte
+		err = db.QueryRow("select tile_data from tiles where zoom_level = ? and tile_column = ? and tile_row = ?;", tile.z, tile.x, tile.y).Scan(&content)
+		if err == nil {
+			_, err = tx.Exec("insert into tiles (zoom_level, tile_column, tile_row, tile_data) values (?, ?, ?, ?);", tile.z, tile.x, tile.y, content)
+		}
+		if err != nil {
+			tx.Rollback()
+			return shard, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return shard, err
+	}
+
+	// The format is that of the whole file, the extent the shard's own.
+	computed, err := computeMetadata(out, filename)
+	if err != nil {
+		return shard, err
+	}
+	items := make(map[string]string, len(metadata))
+	for name, value := range metadata {
+		items[name] = value
+	}
+	for name, value := range computed {
+		if name != "format" {
+			items[name] = value
+		}
+	}
+	for name, value := range items {
+		_, err = out.Exec("insert or replace into metadata (name, value) values (?, ?);", name, value)
+		if err != nil {
+			return shard, err
+		}
+	}
+	shard.Bounds = computed["bounds"]
+	shard.MinZoom, _ = strconv.Atoi(computed["minzoom"])
+	shard.MaxZoom, _ = strconv.Atoi(computed["maxzoom"])
+
+	if compact {
+		err = dropIndexes(out)
+		if err != nil {
+			return shard, err
+		}
+	}
+	err = optimizeDatabase(out)
+	if err != nil {
+		return shard, err
+	}
+	err = out.Close()
+	if err != nil {
+		return shard, err
+	}
+	info, err := os.Stat(filename)
+	if err != nil {
+		return shard, err
+	}
+	shard.Size = info.Size()
+	return shard, nil
+}
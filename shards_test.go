@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// noisyTile is a tile that doesn't compress: a PNG signature and random
+// bytes seeded by its coordinates.
+func noisyTile(z, x, y int) []byte {
+	random := rand.New(rand.NewSource(int64(z<<40 | x<<20 | y)))
+	content := make([]byte, 4096)
+	random.Read(content)
+	return append([]byte("\x89PNG\r\n\x1a\n"), content...)
+}
+
+func TestMaxFileSize(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var z, x, y int
+		if _, err := fmt.Sscanf(r.URL.Path, "/%d/%d/%d.png", &z, &x, &y); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Write(noisyTile(z, x, y))
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "tiles.mbtiles")
+	const maxSize = 300 * 1024
+	output, err := runMain(t, "-url", server.URL+"/{z}/{x}/{y}.png", "-zoomlevel", "0", "-max_zoomlevel", "4",
+		"-xmin", "-180", "-ymin", "-85", "-xmax", "180", "-ymax", "85", "-filename", filename, "-max-file-size", "300K")
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	if _, err = os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("the shards don't replace the file: %v", err)
+	}
+	content, err := ioutil.ReadFile(shardIndexFilename(filename))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index shardIndex
+	if err = json.Unmarshal(content, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Shards) < 2 {
+		t.Fatalf("%d shards, want the tiles split", len(index.Shards))
+	}
+
+	// Every tile is in exactly one shard, the one the index lists it in.
+	found := make(map[[3]int]bool)
+	for n, shard := range index.Shards {
+		if shard.File != filepath.Base(shardFilename(filename, n+1)) {
+			t.Errorf("shard %d is %s", n+1, shard.File)
+		}
+		info, err := os.Stat(filepath.Join(dir, shard.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Size() > maxSize || info.Size() != shard.Size {
+			t.Errorf("%s has %d bytes, listed as %d, limit %d", shard.File, info.Size(), shard.Size, maxSize)
+		}
+		db, err := openMBTile(filepath.Join(dir, shard.File))
+		if err != nil {
+			t.Fatal(err)
+		}
+		first := [3]int{shard.First.Z, shard.First.X, shard.First.Y}
+		last := [3]int{shard.Last.Z, shard.Last.X, shard.Last.Y}
+		rows, err := db.Query("select zoom_level, tile_column, tile_row, tile_data from tiles;")
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := 0
+		for rows.Next() {
+			tile := Tile{}
+			if err = rows.Scan(&tile.z, &tile.x, &tile.y, &tile.Content); err != nil {
+				t.Fatal(err)
+			}
+			tile.y = tile.flipped_y()
+			key := [3]int{tile.z, tile.x, tile.y}
+			if found[key] {
+				t.Errorf("tile %s in more than one shard", tile)
+			}
+			found[key] = true
+			if lessTile(key, first) || lessTile(last, key) {
+				t.Errorf("tile %s in %s, outside of %v to %v", tile, shard.File, first, last)
+			}
+			if !bytes.Equal(tile.Content, noisyTile(tile.z, tile.x, tile.y)) {
+				t.Errorf("tile %s changed in %s", tile, shard.File)
+			}
+			count++
+		}
+		rows.Close()
+		if count != shard.Tiles {
+			t.Errorf("%s has %d tiles, listed as %d", shard.File, count, shard.Tiles)
+		}
+		metadata, err := readMetadata(db)
+		if err != nil || metadata["format"] != "png" || metadata["minzoom"] != fmt.Sprint(shard.MinZoom) {
+			t.Errorf("%s metadata %v, %v", shard.File, metadata, err)
+		}
+		db.Close()
+	}
+	if len(found) != 1+4+16+64+256 {
+		t.Errorf("%d tiles across the shards, want 341", len(found))
+	}
+	if _, err = os.Stat(shardFilename(filename, len(index.Shards)+1)); !os.IsNotExist(err) {
+		t.Errorf("a shard beyond the index: %v", err)
+	}
+}
+
+// lessTile orders tiles like the shard index: by zoom level, column and row.
+func lessTile(a, b [3]int) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+func TestParseFileSize(t *testing.T) {
+	for value, want := range map[string]int64{"1000": 1000, "300K": 300 << 10, "1.5G": 3 << 29, "500MiB": 500 << 20, "2mb": 2 << 20} {
+		if size, err := parseFileSize(value); err != nil || size != want {
+			t.Errorf("-max-file-size %s parsed as %d, %v, want %d", value, size, err, want)
+		}
+	}
+	for _, value := range []string{"", "M", "-5M", "lots"} {
+		if _, err := parseFileSize(value); err == nil {
+			t.Errorf("-max-file-size %q parsed", value)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+)
+
+// Stats summarises a run. It is logged at the end and written as JSON with
+// -stats-json. The writer and main both count into it while tiles are
+// downloaded, so the counters are only changed through the Add methods and
+// read through Snapshot, which use sync/atomic. The int64 fields come first
+// to keep them 64-bit aligned for atomic on 32-bit platforms.
+type Stats struct {
+	TilesTotal  int64 `json:"tiles_total"`
+	TilesStored int64 `json:"tiles_stored"`
+	TilesFailed int64 `json:"tiles_failed"`
+	// TilesUnchanged counts the tiles skipped by -update-since.
+	TilesUnchanged int64 `json:"tiles_unchanged"`
+	// TilesSkipped counts the tiles a TileProcessor left out.
+	TilesSkipped int64 `json:"tiles_skipped"`
+	// RawBytes is the total size of the stored tiles as downloaded.
+	RawBytes     int64   `json:"raw_bytes"`
+	FileBytes    int64   `json:"file_bytes"`
+	AvgTileBytes float64 `json:"avg_tile_bytes"`
+	// CompressionRatio is FileBytes / RawBytes, below 1 when the file takes
+	// less space than the tiles in it.
+	CompressionRatio float64 `json:"compression_ratio"`
+	// The fetch duration percentiles, in milliseconds, with -timing-log.
+	FetchP50Ms float64 `json:"fetch_p50_ms,omitempty"`
+	FetchP95Ms float64 `json:"fetch_p95_ms,omitempty"`
+	FetchP99Ms float64 `json:"fetch_p99_ms,omitempty"`
+}
+
+func (stats *Stats) AddStored()    { atomic.AddInt64(&stats.TilesStored, 1) }
+func (stats *Stats) AddFailed()    { atomic.AddInt64(&stats.TilesFailed, 1) }
+func (stats *Stats) AddUnchanged() { atomic.AddInt64(&stats.TilesUnchanged, 1) }
+func (stats *Stats) AddSkipped()   { atomic.AddInt64(&stats.TilesSkipped, 1) }
+
+func (stats *Stats) AddRawBytes(n int) {
+	atomic.AddInt64(&stats.RawBytes, int64(n))
+}
+
+// Snapshot returns a copy of the counters that is safe to read while the
+// run goes on.
+func (stats *Stats) Snapshot() Stats {
+	return Stats{
+		TilesTotal:     atomic.LoadInt64(&stats.TilesTotal),
+		TilesStored:    atomic.LoadInt64(&stats.TilesStored),
+		TilesFailed:    atomic.LoadInt64(&stats.TilesFailed),
+		TilesUnchanged: atomic.LoadInt64(&stats.TilesUnchanged),
+		TilesSkipped:   atomic.LoadInt64(&stats.TilesSkipped),
+		RawBytes:       atomic.LoadInt64(&stats.RawBytes),
+	}
+}
+
+// Finish returns the final stats, with the sizes filled in, once the output
+// file is complete.
+func (stats *Stats) Finish(filename string) (Stats, error) {
+	final := stats.Snapshot()
+	info, err := os.Stat(filename)
+	if err != nil {
+		return final, err
+	}
+	final.FileBytes = info.Size()
+	if final.TilesStored > 0 {
+		final.AvgTileBytes = float64(final.RawBytes) / float64(final.TilesStored)
+	}
+	if final.RawBytes > 0 {
+		final.CompressionRatio = float64(final.FileBytes) / float64(final.RawBytes)
+	}
+	return final, nil
+}
+
+func (stats Stats) String() string {
+	summary := fmt.Sprintf("%d of %d tiles stored, %d failed, %s of tiles (%.0f bytes per tile) in a %s file, ratio %.2f",
+		stats.TilesStored, stats.TilesTotal, stats.TilesFailed, formatBytes(stats.RawBytes), stats.AvgTileBytes, formatBytes(stats.FileBytes), stats.CompressionRatio)
+	if stats.TilesUnchanged > 0 {
+		summary += fmt.Sprintf(", %d tiles unchanged", stats.TilesUnchanged)
+	}
+	if stats.TilesSkipped > 0 {
+		summary += fmt.Sprintf(", %d tiles skipped", stats.TilesSkipped)
+	}
+	if stats.FetchP50Ms > 0 {
+		summary += fmt.Sprintf(", fetches took %.0fms p50, %.0fms p95, %.0fms p99", stats.FetchP50Ms, stats.FetchP95Ms, stats.FetchP99Ms)
+	}
+	return summary
+}
+
+func writeStatsJSON(filename string, stats Stats) error {
+	content, err := json.MarshalIndent(stats, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, append(content, '\n'), 0644)
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestStatsConcurrent is meant to be run with -race: fetchers and the
+// writer count into the same Stats while progress reads it.
+func TestStatsConcurrent(t *testing.T) {
+	const goroutines, tiles = 8, 1000
+	stats := &Stats{TilesTotal: goroutines * tiles}
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < tiles; j++ {
+				switch j % 4 {
+				case 0, 1:
+					stats.AddStored()
+					stats.AddRawBytes(100)
+				case 2:
+					stats.AddFailed()
+				default:
+					stats.AddUnchanged()
+				}
+			}
+		}()
+	}
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				if snapshot := stats.Snapshot(); snapshot.TilesStored > snapshot.TilesTotal {
+					t.Error("more tiles stored than there are")
+				}
+			}
+		}
+	}()
+	wg.Wait()
+	close(done)
+
+	snapshot := stats.Snapshot()
+	if snapshot.TilesStored != goroutines*tiles/2 || snapshot.TilesFailed != goroutines*tiles/4 || snapshot.TilesUnchanged != goroutines*tiles/4 {
+		t.Errorf("counted %+v", snapshot)
+	}
+	if snapshot.RawBytes != goroutines*tiles/2*100 {
+		t.Errorf("%d raw bytes, want %d", snapshot.RawBytes, goroutines*tiles/2*100)
+	}
+}
+
+func TestStatsFinish(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "out.mbtiles")
+	err := ioutil.WriteFile(filename, make([]byte, 2000), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := &Stats{TilesTotal: 5}
+	for i := 0; i < 4; i++ {
+		stats.AddStored()
+		stats.AddRawBytes(1000)
+	}
+	stats.AddFailed()
+	final, err := stats.Finish(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if final.FileBytes != 2000 || final.AvgTileBytes != 1000 || final.CompressionRatio != 0.5 {
+		t.Errorf("final stats %+v", final)
+	}
+	if summary := final.String(); !strings.HasPrefix(summary, "4 of 5 tiles stored, 1 failed") {
+		t.Errorf("summary %q", summary)
+	}
+}
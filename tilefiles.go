@@ -0,0 +1,81 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// TILE_FILES_KEY is the metadata key of a -tile-files file: the directory
+// holding the tiles, relative to the MBTiles file. Such a file is
+// non-standard: tile_data holds the path of the tile under that directory
+// instead of its bytes, which only serve and dump resolve.
+const TILE_FILES_KEY = "tile_files"
+
+// writeTileFile writes the content of tile to {z}/{x}/{y}.ext under dir, with
+// XYZ rows, and returns that path relative to dir.
+func writeTileFile(dir string, tile Tile, declaredFormat string) (string, error) {
+	tileFormat := sniffTileFormat(tile.Content)
+	if tileFormat == "" {
+		tileFormat = declaredFormat
+	}
+	relative := fmt.Sprintf("%d/%d/%d.%s", tile.z, tile.x, tile.y, extensionForFormat(tileFormat))
+	filename := filepath.Join(dir, filepath.FromSlash(relative))
+	err := os.MkdirAll(filepath.Dir(filename), 0755)
+	if err != nil {
+		return "", err
+	}
+	return relative, ioutil.WriteFile(filename, tile.Content, 0644)
+}
+
+// tileFilesDir returns the directory the tiles of the MBTiles file filename
+// are in, or "" when they are stored in the file itself.
+func tileFilesDir(filename string, metadata map[string]string) string {
+	dir, ok := metadata[TILE_FILES_KEY]
+	if !ok {
+		return ""
+	}
+	if filepath.IsAbs(dir) {
+		return dir
+	}
+	return filepath.Join(filepath.Dir(filename), dir)
+}
+
+// readTileFile reads the tile whose tile_data is reference.
+func readTileFile(dir string, reference []byte) ([]byte, error) {
+	filename, err := tileFilePath(dir, reference)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(filename)
+}
+
+// tileFilePath returns the file of the tile whose tile_data is reference, a
+// path under dir. Paths leaving dir are refused, so a crafted file can't be
+// used to read anything else through serve.
+func tileFilePath(dir string, reference []byte) (string, error) {
+	relative := path.Clean(string(reference))
+	if path.IsAbs(relative) || relative == ".." || strings.HasPrefix(relative, "../") {
+		return "", fmt.Errorf("tile path %q is outside of %s", reference, dir)
+	}
+	return filepath.Join(dir, filepath.FromSlash(relative)), nil
+}
+
+// recordTileFiles stores dir in the metadata of the MBTiles file filename,
+// relative to it when possible so both can be moved together.
+func recordTileFiles(db *sql.DB, filename, dir string) error {
+	value := dir
+	absFile, fileErr := filepath.Abs(filename)
+	absDir, dirErr := filepath.Abs(dir)
+	if fileErr == nil && dirErr == nil {
+		if relative, err := filepath.Rel(filepath.Dir(absFile), absDir); err == nil {
+			value = filepath.ToSlash(relative)
+		}
+	}
+	_, err := db.Exec("insert or replace into metadata (name, value) values (?, ?);", TILE_FILES_KEY, value)
+	return err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTileFilesThroughServe(t *testing.T) {
+	tiles := make(map[string][]byte)
+	for x := 0; x < 2; x++ {
+		for y := 0; y < 2; y++ {
+			tiles[fmt.Sprintf("1/%d/%d", x, y)] = solidPNG(t, color.RGBA{uint8(100 * x), uint8(100 * y), 0, 255})
+		}
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var z, x, y int
+		fmt.Sscanf(r.URL.Path, "/%d/%d/%d.png", &z, &x, &y)
+		w.Write(tiles[fmt.Sprintf("%d/%d/%d", z, x, y)])
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "out.mbtiles")
+	output, err := runMain(t, "-url", server.URL+"/{z}/{x}/{y}.png", "-zoomlevel", "1", "-max_zoomlevel", "1",
+		"-xmin", "-180", "-ymin", "-85", "-xmax", "180", "-ymax", "85",
+		"-tile-files", filepath.Join(dir, "tiles"), "-filename", filename)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+
+	db, err := openMBTile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var reference []byte
+	err = db.QueryRow("select tile_data from tiles where zoom_level = 1 and tile_column = 1 and tile_row = 1;").Scan(&reference)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(reference) != "1/1/0.png" {
+		t.Errorf("tile_data %q, want the path of the tile", reference)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "tiles", "1", "1", "0.png")); err != nil {
+		t.Error(err)
+	}
+
+	// Moved together, the file still finds its tiles.
+	moved := filepath.Join(t.TempDir(), "moved")
+	db.Close()
+	if err = os.Rename(dir, moved); err != nil {
+		t.Fatal(err)
+	}
+	db, err = openMBTile(filepath.Join(moved, "out.mbtiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	tileServer, err := newTileServer(db, filepath.Join(moved, "out.mbtiles"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, content := range tiles {
+		recorder := serveTestPath(tileServer, "/xyz/"+key+".png")
+		if recorder.Code != 200 || !bytes.Equal(recorder.Body.Bytes(), content) {
+			t.Errorf("tile %s served with status %d and other bytes", key, recorder.Code)
+		}
+	}
+}
+
+func TestTileFilePathStaysInDir(t *testing.T) {
+	for _, reference := range []string{"../secret", "/etc/passwd", "1/../../secret"} {
+		if _, err := tileFilePath("/data/tiles", []byte(reference)); err == nil {
+			t.Errorf("tile path %q accepted", reference)
+		}
+	}
+	if path, err := tileFilePath("/data/tiles", []byte("3/2/1.png")); err != nil || path != filepath.FromSlash("/data/tiles/3/2/1.png") {
+		t.Errorf("tile path 3/2/1.png resolved to %s, %v", path, err)
+	}
+}
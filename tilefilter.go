@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// tilePattern matches tiles by z/x/y. Each part is a number, an inclusive
+// range "a-b" or "*", stored as its lowest and highest value; the highest
+// is -1 for "*".
+type tilePattern [3][2]int
+
+// parseTilePattern parses a z/x/y pattern like "14/8000-8010/*".
+func parseTilePattern(value string) (tilePattern, error) {
+	var pattern tilePattern
+	parts := strings.Split(strings.TrimSpace(value), "/")
+	if len(parts) != 3 {
+		return pattern, fmt.Errorf("invalid tile pattern %q, expected z/x/y with numbers, ranges like 10-20 or *", value)
+	}
+	for i, part := range parts {
+		if part == "*" {
+			pattern[i] = [2]int{0, -1}
+			continue
+		}
+		bounds := strings.SplitN(part, "-", 2)
+		low, err := strconv.Atoi(bounds[0])
+		high := low
+		if err == nil && len(bounds) == 2 {
+			high, err = strconv.Atoi(bounds[1])
+		}
+		if err != nil || low < 0 || high < low {
+			return pattern, fmt.Errorf("invalid tile pattern %q, expected z/x/y with numbers, ranges like 10-20 or *", value)
+		}
+		pattern[i] = [2]int{low, high}
+	}
+	return pattern, nil
+}
+
+// readTilePatterns reads one pattern per line from filename, skipping blank
+// lines and lines starting with #.
+func readTilePatterns(filename string) ([]tilePattern, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var patterns []tilePattern
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		pattern, err := parseTilePattern(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", filename, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, scanner.Err()
+}
+
+func (pattern tilePattern) Matches(tile Tile) bool {
+	for i, value := range [3]int{tile.z, tile.x, tile.y} {
+		if value < pattern[i][0] || (pattern[i][1] >= 0 && value > pattern[i][1]) {
+			return false
+		}
+	}
+	return true
+}
+
+// Tiles lists the tiles of a pattern. A "*" stands for the run's zoom
+// levels zoomlevel-max_zoomlevel, or for the columns or rows of its bounds
+// at each zoom level, rather than for a whole zoom level.
+func (pattern tilePattern) Tiles(zoomlevel, max_zoomlevel int, xmin, ymin, xmax, ymax float64) ([]Tile, error) {
+	zooms := pattern[0]
+	if zooms[1] < 0 {
+		zooms = [2]int{maxInt(zooms[0], zoomlevel), max_zoomlevel}
+	}
+	var tiles []Tile
+	for z := zooms[0]; z <= zooms[1]; z++ {
+		columns, rows := pattern[1], pattern[2]
+		if columns[1] < 0 || rows[1] < 0 {
+			x0, x1, y0, y1 := bboxTileRange(xmin, ymin, xmax, ymax, z)
+			if columns[1] < 0 {
+				columns = [2]int{maxInt(columns[0], x0), x1}
+			}
+			if rows[1] < 0 {
+				rows = [2]int{maxInt(rows[0], y0), y1}
+			}
+		}
+		for x := columns[0]; x <= columns[1]; x++ {
+			for y := rows[0]; y <= rows[1]; y++ {
+				tile, err := newTileAt(z, x, y)
+				if err != nil {
+					return nil, err
+				}
+				tiles = append(tiles, tile)
+			}
+		}
+	}
+	return tiles, nil
+}
+
+func (pattern tilePattern) String() string {
+	parts := make([]string, 3)
+	for i, part := range pattern {
+		switch {
+		case part[1] < 0:
+			parts[i] = "*"
+		case part[0] == part[1]:
+			parts[i] = strconv.Itoa(part[0])
+		default:
+			parts[i] = fmt.Sprintf("%d-%d", part[0], part[1])
+		}
+	}
+	return strings.Join(parts, "/")
+}
+
+// filterTiles adds the tiles of include missing from tiles, which must be
+// within the zoom range, and then removes the ones matching exclude, so a
+// tile in both is left out. A "*" in include is limited to the bounds. It
+// returns the new list with the number of tiles added and removed.
+func filterTiles(tiles []Tile, include, exclude []tilePattern, zoomlevel, max_zoomlevel int, xmin, ymin, xmax, ymax float64) ([]Tile, int, int, error) {
+	added := 0
+	if len(include) > 0 {
+		listed := make(map[[3]int]bool, len(tiles))
+		for _, tile := range tiles {
+			listed[[3]int{tile.z, tile.x, tile.y}] = true
+		}
+		for _, pattern := range include {
+			// Checked before listing, a * at a deep zoom level is a lot of tiles.
+			if pattern[0][1] >= 0 && (pattern[0][0] < zoomlevel || pattern[0][1] > max_zoomlevel) {
+				return nil, 0, 0, fmt.Errorf("included tiles %s are outside of the zoom levels %d-%d", pattern, zoomlevel, max_zoomlevel)
+			}
+			patternTiles, err := pattern.Tiles(zoomlevel, max_zoomlevel, xmin, ymin, xmax, ymax)
+			if err != nil {
+				return nil, 0, 0, err
+			}
+			for _, tile := range patternTiles {
+				if !listed[[3]int{tile.z, tile.x, tile.y}] {
+					listed[[3]int{tile.z, tile.x, tile.y}] = true
+					tiles = append(tiles, tile)
+					added++
+				}
+			}
+		}
+	}
+	if len(exclude) == 0 {
+		return tiles, added, 0, nil
+	}
+	kept := tiles[:0]
+	for _, tile := range tiles {
+		excluded := false
+		for _, pattern := range exclude {
+			if pattern.Matches(tile) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			kept = append(kept, tile)
+		}
+	}
+	return kept, added, len(tiles) - len(kept), nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+// Central San Francisco, tiles 654-655, 1582-1583 at z12.
+var sfBounds = [4]float64{-122.45, 37.76, -122.40, 37.80}
+
+func sortedTiles(tiles []Tile) []string {
+	names := make([]string, len(tiles))
+	for i, tile := range tiles {
+		names[i] = tile.String()
+	}
+	sort.Strings(names)
+	return names
+}
+
+func mustParseTilePatterns(t *testing.T, values ...string) []tilePattern {
+	patterns := make([]tilePattern, len(values))
+	for i, value := range values {
+		pattern, err := parseTilePattern(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		patterns[i] = pattern
+	}
+	return patterns
+}
+
+func TestParseTilePattern(t *testing.T) {
+	for _, value := range []string{"14/8000-8010/*", "0/0/0", "*/*/*"} {
+		pattern, err := parseTilePattern(value)
+		if err != nil {
+			t.Errorf("%s: %v", value, err)
+		} else if pattern.String() != value {
+			t.Errorf("%s parsed as %s", value, pattern)
+		}
+	}
+	for _, value := range []string{"14/8000", "14/10-5/1", "14/-1/1", "a/b/c"} {
+		if _, err := parseTilePattern(value); err == nil {
+			t.Errorf("%s parsed", value)
+		}
+	}
+}
+
+func TestIncludeTilesWithinBounds(t *testing.T) {
+	for _, test := range []struct {
+		pattern string
+		want    []string
+	}{
+		{"12/*/*", []string{"12/654/1582", "12/654/1583", "12/655/1582", "12/655/1583"}},
+		// Explicit numbers aren't limited to the bounds.
+		{"12/700/*", []string{"12/700/1582", "12/700/1583"}},
+		{"*/654/1582", []string{"12/654/1582"}},
+	} {
+		include := mustParseTilePatterns(t, test.pattern)
+		tiles, added, _, err := filterTiles(nil, include, nil, 12, 12, sfBounds[0], sfBounds[1], sfBounds[2], sfBounds[3])
+		if err != nil {
+			t.Errorf("%s: %v", test.pattern, err)
+			continue
+		}
+		if got := sortedTiles(tiles); len(got) != len(test.want) || added != len(got) {
+			t.Errorf("%s: added %d tiles %v, want %v", test.pattern, added, got, test.want)
+		} else {
+			for i := range got {
+				if got[i] != test.want[i] {
+					t.Errorf("%s: added %v, want %v", test.pattern, got, test.want)
+					break
+				}
+			}
+		}
+	}
+}
+
+func TestIncludeTilesOutsideZoomLevels(t *testing.T) {
+	include := mustParseTilePatterns(t, "20/*/*")
+	_, _, _, err := filterTiles(nil, include, nil, 10, 12, sfBounds[0], sfBounds[1], sfBounds[2], sfBounds[3])
+	if err == nil {
+		t.Error("tiles at z20 included in a z10-12 run")
+	}
+}
+
+func TestExcludeTiles(t *testing.T) {
+	proj := NewProjection(sfBounds[0], sfBounds[1], sfBounds[2], sfBounds[3], 11, 12, nil, 0)
+	tiles := proj.TileList()
+	computed := len(tiles)
+	include := mustParseTilePatterns(t, "12/700/1582", "12/701/1582")
+	exclude := mustParseTilePatterns(t, "12/654/*", "12/701/1582", "11/*/*")
+	tiles, added, removed, err := filterTiles(tiles, include, exclude, 11, 12, sfBounds[0], sfBounds[1], sfBounds[2], sfBounds[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"12/655/1582", "12/655/1583", "12/700/1582"}
+	got := sortedTiles(tiles)
+	if len(got) != len(want) {
+		t.Fatalf("tiles %v, want %v", got, want)
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Fatalf("tiles %v, want %v", got, want)
+		}
+	}
+	if added != 2 || removed != computed+added-len(want) {
+		t.Errorf("added %d and removed %d of %d tiles", added, removed, computed)
+	}
+}
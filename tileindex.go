@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"os"
+	"strconv"
+)
+
+// tileIndexEntry is one tile of the -manifest index, in XYZ coordinates.
+type tileIndexEntry struct {
+	Z    int   `json:"z"`
+	X    int   `json:"x"`
+	Y    int   `json:"y"`
+	Size int64 `json:"size"`
+}
+
+// writeTileIndex writes every stored tile with its size in bytes to
+// filename, as {"tiles": [...], "count": n}, for static hosts and clients
+// that need to know what exists without opening the file. The index is
+// streamed, since it has a line per tile. tileDir is the directory of a
+// -tile-files file, whose sizes are those of the files. It returns the
+// number of tiles listed.
+func writeTileIndex(filename string, db *sql.DB, tileDir string) (int, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	out := bufio.NewWriter(file)
+	rows, err := db.Query("select zoom_level, tile_column, tile_row, length(tile_data), tile_data from tiles order by zoom_level, tile_column, tile_row;")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	out.WriteString("{\"tiles\": [")
+	count := 0
+	for rows.Next() {
+		var tile Tile
+		var size int64
+		var reference []byte
+		err = rows.Scan(&tile.z, &tile.x, &tile.y, &size, &reference)
+		if err != nil {
+			return count, err
+		}
+		// Rows are stored TMS.
+		tile.y = tile.flipped_y()
+		if tileDir != "" {
+			path, err := tileFilePath(tileDir, reference)
+			if err != nil {
+				return count, err
+			}
+			info, err := os.Stat(path)
+			if err != nil {
+				return count, err
+			}
+			size = info.Size()
+		}
+		line, err := json.Marshal(tileIndexEntry{Z: tile.z, X: tile.x, Y: tile.y, Size: size})
+		if err != nil {
+			return count, err
+		}
+		if count > 0 {
+			out.WriteString(",")
+		}
+		out.WriteString("\n  ")
+		out.Write(line)
+		count++
+	}
+	err = rows.Err()
+	if err != nil {
+		return count, err
+	}
+	_, err = out.WriteString("\n], \"count\": " + strconv.Itoa(count) + "}\n")
+	if err != nil {
+		return count, err
+	}
+	err = out.Flush()
+	if err != nil {
+		return count, err
+	}
+	return count, file.Close()
+}
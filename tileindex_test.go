@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestTileIndex(t *testing.T) {
+	content := solidPNG(t, color.RGBA{255, 128, 0, 255})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	filename, indexFile := filepath.Join(dir, "out.mbtiles"), filepath.Join(dir, "tiles.json")
+	output, err := runMain(t, "-url", server.URL+"/{z}/{x}/{y}.png", "-zoomlevel", "1", "-max_zoomlevel", "3",
+		"-xmin", "0", "-ymin", "0", "-xmax", "90", "-ymax", "60", "-filename", filename, "-manifest", indexFile)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	raw, err := ioutil.ReadFile(indexFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index struct {
+		Tiles []tileIndexEntry
+		Count int
+	}
+	if err = json.Unmarshal(raw, &index); err != nil {
+		t.Fatalf("%v\n%s", err, raw)
+	}
+
+	db, err := openMBTile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var stored int
+	if err = db.QueryRow("select count(*) from tiles;").Scan(&stored); err != nil {
+		t.Fatal(err)
+	}
+	if stored == 0 || len(index.Tiles) != stored || index.Count != stored {
+		t.Errorf("%d tiles listed with a count of %d, %d stored", len(index.Tiles), index.Count, stored)
+	}
+	// Tiles are listed in XYZ, the north east quarter at z1.
+	listed := make(map[[3]int]bool)
+	for _, entry := range index.Tiles {
+		listed[[3]int{entry.Z, entry.X, entry.Y}] = true
+		if entry.Size != int64(len(content)) {
+			t.Errorf("tile %d/%d/%d listed with %d bytes, want %d", entry.Z, entry.X, entry.Y, entry.Size, len(content))
+		}
+	}
+	if !listed[[3]int{1, 1, 0}] || listed[[3]int{1, 1, 1}] {
+		t.Errorf("z1 tiles listed in TMS: %v", index.Tiles)
+	}
+}
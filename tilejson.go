@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+)
+
+// TILEJSON_VERSION is the spec version of the TileJSON documents we write.
+const TILEJSON_VERSION = "2.2.0"
+
+// TileJSON holds the fields of a TileJSON document that mbtilego reads, to
+// check a download against what the source serves, and writes for serve.
+type TileJSON struct {
+	TileJSON    string    `json:"tilejson"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Attribution string    `json:"attribution"`
+	Tiles       []string  `json:"tiles"`
+	MinZoom     *int      `json:"minzoom"`
+	MaxZoom     *int      `json:"maxzoom"`
+	Bounds      []float64 `json:"bounds"`
+	Center      []float64 `json:"center,omitempty"`
+	Format      string    `json:"format,omitempty"`
+}
+
+func fetchTileJSON(tileJSONUrl string) (TileJSON, error) {
+	var tileJSON TileJSON
+	resp, err := httpGet(context.Background(), tileJSONUrl)
+	if err != nil {
+		return tileJSON, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return tileJSON, fmt.Errorf("fetching %s: unexpected status %s", redactUrl(tileJSONUrl), resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tileJSON)
+	if err != nil {
+		return tileJSON, fmt.Errorf("invalid TileJSON from %s: %v", redactUrl(tileJSONUrl), err)
+	}
+	if tileJSON.Bounds != nil && len(tileJSON.Bounds) != 4 {
+		return tileJSON, fmt.Errorf("invalid TileJSON bounds %v", tileJSON.Bounds)
+	}
+	return tileJSON, nil
+}
+
+// writeTileJSON writes the TileJSON document to filename.
+func writeTileJSON(filename string, tileJSON TileJSON) error {
+	content, err := json.MarshalIndent(tileJSON, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, content, 0644)
+}
+
+// ClampZoom limits the zoom range to the zoom levels the source has.
+func (tileJSON TileJSON) ClampZoom(zoomlevel, max_zoomlevel int) (int, int, error) {
+	if tileJSON.MinZoom != nil && zoomlevel < *tileJSON.MinZoom {
+		log.Printf("Warning: the source starts at zoom %d, raising zoomlevel from %d", *tileJSON.MinZoom, zoomlevel)
+		zoomlevel = *tileJSON.MinZoom
+	}
+	if tileJSON.MaxZoom != nil && max_zoomlevel > *tileJSON.MaxZoom {
+		log.Printf("Warning: the source stops at zoom %d, lowering max_zoomlevel from %d", *tileJSON.MaxZoom, max_zoomlevel)
+		max_zoomlevel = *tileJSON.MaxZoom
+	}
+	if zoomlevel > max_zoomlevel {
+		return zoomlevel, max_zoomlevel, fmt.Errorf("the source has no tiles between zoom %d and %d", zoomlevel, max_zoomlevel)
+	}
+	return zoomlevel, max_zoomlevel, nil
+}
+
+// IntersectBounds limits the bounding box to the area the source covers.
+func (tileJSON TileJSON) IntersectBounds(xmin, ymin, xmax, ymax float64) (float64, float64, float64, float64, error) {
+	if tileJSON.Bounds == nil {
+		return xmin, ymin, xmax, ymax, nil
+	}
+	b := tileJSON.Bounds
+	newXmin, newYmin := math.Max(xmin, b[0]), math.Max(ymin, b[1])
+	newXmax, newYmax := math.Min(xmax, b[2]), math.Min(ymax, b[3])
+	if newXmin >= newXmax || newYmin >= newYmax {
+		return xmin, ymin, xmax, ymax, fmt.Errorf("the bounds don't overlap the source bounds %v", b)
+	}
+	if newXmin != xmin || newYmin != ymin || newXmax != xmax || newYmax != ymax {
+		log.Printf("Warning: the source only covers %v, limiting the bounds to %f,%f,%f,%f", b, newXmin, newYmin, newXmax, newYmax)
+	}
+	return newXmin, newYmin, newXmax, newYmax, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"image/color"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+const SAMPLE_TILEJSON = `{
+	"tilejson": "2.2.0",
+	"name": "Streets",
+	"tiles": ["https://tiles.example.com/streets/{z}/{x}/{y}.png"],
+	"minzoom": 2,
+	"maxzoom": 14,
+	"bounds": [-10, 35, 30, 60],
+	"center": [10, 50, 6]
+}`
+
+func newTileJSONServer(t *testing.T, document string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(document))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFetchTileJSON(t *testing.T) {
+	server := newTileJSONServer(t, SAMPLE_TILEJSON)
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	tileJSON, err := fetchTileJSON(server.URL + "/streets.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tileJSON.Name != "Streets" || *tileJSON.MinZoom != 2 || *tileJSON.MaxZoom != 14 || len(tileJSON.Tiles) != 1 {
+		t.Errorf("parsed %+v", tileJSON)
+	}
+
+	zoomlevel, max_zoomlevel, err := tileJSON.ClampZoom(0, 18)
+	if err != nil || zoomlevel != 2 || max_zoomlevel != 14 {
+		t.Errorf("zoom 0-18 clamped to %d-%d, %v, want 2-14", zoomlevel, max_zoomlevel, err)
+	}
+	if _, _, err = tileJSON.ClampZoom(15, 18); err == nil {
+		t.Error("zoom 15-18 is beyond the source")
+	}
+
+	xmin, ymin, xmax, ymax, err := tileJSON.IntersectBounds(-20, 40, 0, 70)
+	if err != nil || xmin != -10 || ymin != 40 || xmax != 0 || ymax != 60 {
+		t.Errorf("bounds intersected to %f,%f,%f,%f, %v", xmin, ymin, xmax, ymax, err)
+	}
+	if _, _, _, _, err = tileJSON.IntersectBounds(100, 0, 110, 10); err == nil {
+		t.Error("bounds outside of the source intersected")
+	}
+}
+
+func TestFetchTileJSONErrors(t *testing.T) {
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	for _, document := range []string{`{"bounds": [1, 2, 3]}`, `not json`} {
+		server := newTileJSONServer(t, document)
+		if _, err := fetchTileJSON(server.URL); err == nil {
+			t.Errorf("parsed %s", document)
+		}
+	}
+	var tileJSON TileJSON
+	xmin, ymin, xmax, ymax, err := tileJSON.IntersectBounds(1, 2, 3, 4)
+	if err != nil || xmin != 1 || ymin != 2 || xmax != 3 || ymax != 4 {
+		t.Error("bounds changed by a TileJSON without bounds")
+	}
+}
+
+func TestTileJSONMetadata(t *testing.T) {
+	content := solidPNG(t, color.RGBA{0, 0, 255, 255})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/streets.json" {
+			w.Write([]byte(`{"name": "Streets", "description": "Streets of the world", "attribution": "© Example contributors", "minzoom": 0, "maxzoom": 4}`))
+			return
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+	run := func(flags ...string) map[string]string {
+		filename := filepath.Join(t.TempDir(), "out.mbtiles")
+		args := append([]string{"-url", server.URL + "/{z}/{x}/{y}.png", "-tilejson", server.URL + "/streets.json",
+			"-zoomlevel", "1", "-max_zoomlevel", "1", "-xmin", "0", "-ymin", "0", "-xmax", "90", "-ymax", "60",
+			"-filename", filename}, flags...)
+		output, err := runMain(t, args...)
+		if err != nil {
+			t.Fatalf("%v\n%s", err, output)
+		}
+		db, err := openMBTile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		metadata, err := readMetadata(db)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return metadata
+	}
+
+	metadata := run()
+	if metadata["name"] != "Streets" || metadata["description"] != "Streets of the world" || metadata["attribution"] != "© Example contributors" {
+		t.Errorf("metadata from the TileJSON %v", metadata)
+	}
+	// Flags aren't overwritten.
+	metadata = run("-attribution", "Mine", "-name", "Local streets")
+	if metadata["name"] != "Local streets" || metadata["description"] != "Streets of the world" || metadata["attribution"] != "Mine" {
+		t.Errorf("metadata with flags %v", metadata)
+	}
+}
+
+func TestTileJSONOut(t *testing.T) {
+	content := solidPNG(t, color.RGBA{0, 128, 0, 255})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+	dir := t.TempDir()
+	out := filepath.Join(dir, "out.json")
+	output, err := runMain(t, "-url", server.URL+"/{z}/{x}/{y}.png", "-zoomlevel", "2", "-max_zoomlevel", "3",
+		"-xmin", "-10", "-ymin", "35", "-xmax", "30", "-ymax", "60", "-filename", filepath.Join(dir, "out.mbtiles"), "-tilejson-out", out)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	raw, err := ioutil.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document map[string]interface{}
+	if err = json.Unmarshal(raw, &document); err != nil {
+		t.Fatalf("%v\n%s", err, raw)
+	}
+	for _, key := range []string{"tilejson", "tiles", "minzoom", "maxzoom", "bounds", "center"} {
+		if _, ok := document[key]; !ok {
+			t.Errorf("no %s in %s", key, raw)
+		}
+	}
+	tiles, _ := document["tiles"].([]interface{})
+	if document["tilejson"] != TILEJSON_VERSION || len(tiles) != 1 || tiles[0] != "http://"+DEFAULT_SERVE_ADDR+"/xyz/{z}/{x}/{y}.png" {
+		t.Errorf("tilejson %v and tiles %v", document["tilejson"], document["tiles"])
+	}
+	if document["minzoom"] != 2.0 || document["maxzoom"] != 3.0 {
+		t.Errorf("zoom levels %v-%v, want 2-3", document["minzoom"], document["maxzoom"])
+	}
+	bounds, _ := document["bounds"].([]interface{})
+	center, _ := document["center"].([]interface{})
+	if len(bounds) != 4 || bounds[0] != -10.0 || bounds[3] != 60.0 {
+		t.Errorf("bounds %v", document["bounds"])
+	}
+	if len(center) != 3 || center[0] != 10.0 || center[2] != 2.0 {
+		t.Errorf("center %v", document["center"])
+	}
+}
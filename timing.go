@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/csv"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// timingLog records how long every fetch attempt took, for -timing-log. A
+// nil *timingLog records nothing, so it costs nothing when disabled.
+type timingLog struct {
+	mu        sync.Mutex
+	file      *os.File
+	writer    *csv.Writer
+	durations []time.Duration
+}
+
+func newTimingLog(filename string) (*timingLog, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	timing := &timingLog{file: file, writer: csv.NewWriter(file)}
+	timing.writer.Write([]string{"z", "x", "y", "attempt", "duration_ms", "bytes", "error"})
+	return timing, nil
+}
+
+// Record logs one attempt at fetching tile.
+func (timing *timingLog) Record(tile Tile, attempt int, duration time.Duration, bytes int, err error) {
+	if timing == nil {
+		return
+	}
+	errText := ""
+	if err != nil {
+		errText = err.Error()
+	}
+	timing.mu.Lock()
+	defer timing.mu.Unlock()
+	timing.durations = append(timing.durations, duration)
+	timing.writer.Write([]string{
+		strconv.Itoa(tile.z), strconv.Itoa(tile.x), strconv.Itoa(tile.y), strconv.Itoa(attempt + 1),
+		strconv.FormatFloat(duration.Seconds()*1000, 'f', 1, 64), strconv.Itoa(bytes), errText,
+	})
+}
+
+// Percentiles returns the 50th, 95th and 99th percentile fetch durations.
+func (timing *timingLog) Percentiles() (p50, p95, p99 time.Duration) {
+	if timing == nil {
+		return 0, 0, 0
+	}
+	timing.mu.Lock()
+	defer timing.mu.Unlock()
+	if len(timing.durations) == 0 {
+		return 0, 0, 0
+	}
+	sorted := append([]time.Duration(nil), timing.durations...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	at := func(percentile int) time.Duration {
+		return sorted[(len(sorted)-1)*percentile/100]
+	}
+	return at(50), at(95), at(99)
+}
+
+func (timing *timingLog) Close() error {
+	if timing == nil {
+		return nil
+	}
+	timing.mu.Lock()
+	defer timing.mu.Unlock()
+	timing.writer.Flush()
+	err := timing.writer.Error()
+	if closeErr := timing.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
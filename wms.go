@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const EARTH_RADIUS = 6378137.0
+const WMS_CRS_MERCATOR = "EPSG:3857"
+const WMS_CRS_WGS84 = "EPSG:4326"
+
+// wmsTemplate builds a tile url template for a WMS GetMap request covering
+// each tile, for servers that don't offer XYZ tiles.
+func wmsTemplate(endpoint, layers, styles, crs, tileFormat string, size int) (string, error) {
+	if layers == "" {
+		return "", fmt.Errorf("-wms-layers is required with -wms")
+	}
+	var bbox string
+	switch crs {
+	case WMS_CRS_MERCATOR:
+		bbox = "{bbox}"
+	case WMS_CRS_WGS84:
+		bbox = "{bbox4326}"
+	default:
+		return "", fmt.Errorf("unsupported -wms-crs %q, expected %s or %s", crs, WMS_CRS_MERCATOR, WMS_CRS_WGS84)
+	}
+
+	params := url.Values{}
+	params.Set("SERVICE", "WMS")
+	params.Set("VERSION", "1.3.0")
+	params.Set("REQUEST", "GetMap")
+	params.Set("LAYERS", layers)
+	params.Set("STYLES", styles)
+	params.Set("CRS", crs)
+	params.Set("WIDTH", strconv.Itoa(size))
+	params.Set("HEIGHT", strconv.Itoa(size))
+	params.Set("FORMAT", tileFormat)
+	separator := "?"
+	if strings.Contains(endpoint, "?") {
+		separator = "&"
+	}
+	// The bbox placeholder is appended after encoding so its braces survive.
+	return endpoint + separator + params.Encode() + "&BBOX=" + bbox, nil
+}
+
+// mercatorBbox returns the EPSG:3857 bounds of the XYZ tile in metres as
+// "minx,miny,maxx,maxy".
+func mercatorBbox(z, x, y int) string {
+	extent := 2 * math.Pi * EARTH_RADIUS
+	size := extent / math.Pow(2, float64(z))
+	minx := -extent/2 + float64(x)*size
+	maxy := extent/2 - float64(y)*size
+	return formatBbox(minx, maxy-size, minx+size, maxy)
+}
+
+// wgs84Bbox returns the EPSG:4326 bounds of the XYZ tile in the axis order
+// WMS 1.3.0 uses for that CRS, "minlat,minlon,maxlat,maxlon".
+func wgs84Bbox(z, x, y int) string {
+	xmin, ymax := tileToLonLat(z, float64(x), float64(y))
+	xmax, ymin := tileToLonLat(z, float64(x+1), float64(y+1))
+	return formatBbox(ymin, xmin, ymax, xmax)
+}
+
+func formatBbox(a, b, c, d float64) string {
+	values := []string{}
+	for _, value := range []float64{a, b, c, d} {
+		values = append(values, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	return strings.Join(values, ",")
+}
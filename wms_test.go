@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// newFakeWMS answers GetMap requests with the BBOX it was asked for.
+func newFakeWMS(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if query.Get("SERVICE") != "WMS" || query.Get("REQUEST") != "GetMap" || query.Get("LAYERS") != "roads,water" || query.Get("WIDTH") != "256" {
+			http.Error(w, "unexpected request "+r.URL.RawQuery, http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(query.Get("CRS") + " " + query.Get("BBOX")))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func parseBboxValues(t *testing.T, value string) [4]float64 {
+	var bbox [4]float64
+	parts := strings.Split(value, ",")
+	if len(parts) != 4 {
+		t.Fatalf("bbox %q", value)
+	}
+	for i, part := range parts {
+		n, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			t.Fatalf("bbox %q: %v", value, err)
+		}
+		bbox[i] = n
+	}
+	return bbox
+}
+
+func TestWMSTiles(t *testing.T) {
+	server := newFakeWMS(t)
+	useHttpClient(t, newHttpClient(DEFAULT_MAX_REDIRECTS))
+	const half = 20037508.342789244
+	for _, test := range []struct {
+		crs  string
+		want [4]float64
+	}{
+		{WMS_CRS_MERCATOR, [4]float64{half / 2, half / 2, half, half}},
+		// Latitude first for EPSG:4326 in WMS 1.3.0.
+		{WMS_CRS_WGS84, [4]float64{66.51326044311186, 90, 85.0511287798066, 180}},
+	} {
+		template, err := wmsTemplate(server.URL+"/wms?map=test", "roads,water", "", test.crs, "image/png", 256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = validateTileUrl(template); err != nil {
+			t.Fatal(err)
+		}
+		// The north-east corner tile of the world at z2.
+		tile, err := fetchTile(context.Background(), 2, 3, 0, template)
+		if err != nil {
+			t.Fatalf("%s: %v", test.crs, err)
+		}
+		parts := strings.SplitN(string(tile.Content), " ", 2)
+		if parts[0] != test.crs {
+			t.Errorf("requested CRS %s, want %s", parts[0], test.crs)
+		}
+		bbox := parseBboxValues(t, parts[1])
+		for i := range bbox {
+			if diff := bbox[i] - test.want[i]; diff > 1e-6 || diff < -1e-6 {
+				t.Errorf("%s: BBOX %v, want %v", test.crs, bbox, test.want)
+				break
+			}
+		}
+	}
+}
+
+func TestWMSTemplateErrors(t *testing.T) {
+	if _, err := wmsTemplate("http://example.com/wms", "", "", WMS_CRS_MERCATOR, "image/png", 256); err == nil {
+		t.Error("template without layers")
+	}
+	if _, err := wmsTemplate("http://example.com/wms", "roads", "", "EPSG:27700", "image/png", 256); err == nil {
+		t.Error("template for an unsupported CRS")
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/binary"
+	"hash"
+	"math/bits"
+)
+
+// XXH64 (https://github.com/Cyan4973/xxHash) with seed 0, for the tile ids
+// of -dedup. The vendored zstd package has a copy, but it is internal.
+const XXH_PRIME1 uint64 = 11400714785074694791
+const XXH_PRIME2 uint64 = 14029467366897019727
+const XXH_PRIME3 uint64 = 1609587929392839161
+const XXH_PRIME4 uint64 = 9650029242287828579
+const XXH_PRIME5 uint64 = 2870177450012600261
+
+// xxhash64 implements hash.Hash64, keeping a partial 32 byte stripe in mem
+// between writes.
+type xxhash64 struct {
+	v     [4]uint64
+	total uint64
+	mem   [32]byte
+	n     int
+}
+
+func newXXHash64() hash.Hash {
+	h := &xxhash64{}
+	h.Reset()
+	return h
+}
+
+func (h *xxhash64) Reset() {
+	// Variables, since the sums overflow, which constants can't.
+	prime1, prime2 := XXH_PRIME1, XXH_PRIME2
+	h.v = [4]uint64{prime1 + prime2, prime2, 0, -prime1}
+	h.total, h.n = 0, 0
+}
+
+func (h *xxhash64) Size() int      { return 8 }
+func (h *xxhash64) BlockSize() int { return 32 }
+
+func (h *xxhash64) Write(b []byte) (int, error) {
+	written := len(b)
+	h.total += uint64(written)
+	if h.n+len(b) < 32 {
+		h.n += copy(h.mem[h.n:], b)
+		return written, nil
+	}
+	if h.n > 0 {
+		b = b[copy(h.mem[h.n:], b):]
+		h.stripe(h.mem[:])
+		h.n = 0
+	}
+	for ; len(b) >= 32; b = b[32:] {
+		h.stripe(b)
+	}
+	h.n = copy(h.mem[:], b)
+	return written, nil
+}
+
+// stripe mixes 32 bytes into the four lanes.
+func (h *xxhash64) stripe(b []byte) {
+	for i := range h.v {
+		h.v[i] = xxhRound(h.v[i], binary.LittleEndian.Uint64(b[8*i:]))
+	}
+}
+
+func (h *xxhash64) Sum(b []byte) []byte {
+	var sum [8]byte
+	binary.BigEndian.PutUint64(sum[:], h.Sum64())
+	return append(b, sum[:]...)
+}
+
+func (h *xxhash64) Sum64() uint64 {
+	var acc uint64
+	if h.total >= 32 {
+		acc = bits.RotateLeft64(h.v[0], 1) + bits.RotateLeft64(h.v[1], 7) + bits.RotateLeft64(h.v[2], 12) + bits.RotateLeft64(h.v[3], 18)
+		for _, v := range h.v {
+			acc = (acc^xxhRound(0, v))*XXH_PRIME1 + XXH_PRIME4
+		}
+	} else {
+		acc = XXH_PRIME5
+	}
+	acc += h.total
+
+	b := h.mem[:h.n]
+	for ; len(b) >= 8; b = b[8:] {
+		acc ^= xxhRound(0, binary.LittleEndian.Uint64(b))
+		acc = bits.RotateLeft64(acc, 27)*XXH_PRIME1 + XXH_PRIME4
+	}
+	if len(b) >= 4 {
+		acc ^= uint64(binary.LittleEndian.Uint32(b)) * XXH_PRIME1
+		acc = bits.RotateLeft64(acc, 23)*XXH_PRIME2 + XXH_PRIME3
+		b = b[4:]
+	}
+	for _, c := range b {
+		acc ^= uint64(c) * XXH_PRIME5
+		acc = bits.RotateLeft64(acc, 11) * XXH_PRIME1
+	}
+
+	acc ^= acc >> 33
+	acc *= XXH_PRIME2
+	acc ^= acc >> 29
+	acc *= XXH_PRIME3
+	acc ^= acc >> 32
+	return acc
+}
+
+func xxhRound(acc, input uint64) uint64 {
+	acc += input * XXH_PRIME2
+	return bits.RotateLeft64(acc, 31) * XXH_PRIME1
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"image"
+	"strconv"
+	"strings"
+)
+
+// ZOOM_FORMATS_KEY is the key of the json metadata object mapping each zoom
+// level to the format of its tiles, written by -zoom-formats. MBTiles only
+// has a single format value, so this is an extension of this tool.
+const ZOOM_FORMATS_KEY = "zoom_formats"
+
+// zoomFormatRule converts the tiles of zooms min to max to format.
+type zoomFormatRule struct {
+	min, max int
+	format   string
+}
+
+// parseZoomFormats parses -zoom-formats, e.g. "0-8:jpg,9-14:png".
+func parseZoomFormats(value string) ([]zoomFormatRule, error) {
+	var rules []zoomFormatRule
+	for _, part := range strings.Split(value, ",") {
+		fields := strings.SplitN(strings.TrimSpace(part), ":", 2)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid -zoom-formats rule %q, expected zooms:format", part)
+		}
+		format := strings.ToLower(fields[1])
+		if format == "jpeg" {
+			format = JPG_EXTENSION
+		}
+		if format != PNG_EXTENSION && format != JPG_EXTENSION {
+			return nil, fmt.Errorf("invalid -zoom-formats rule %q, the format must be png or jpg", part)
+		}
+		zooms := strings.SplitN(fields[0], "-", 2)
+		min, err := strconv.Atoi(zooms[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid -zoom-formats rule %q: %v", part, err)
+		}
+		max := min
+		if len(zooms) == 2 {
+			max, err = strconv.Atoi(zooms[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid -zoom-formats rule %q: %v", part, err)
+			}
+		}
+		if min < 0 || max < min {
+			return nil, fmt.Errorf("invalid -zoom-formats rule %q, expected min-max zooms", part)
+		}
+		rules = append(rules, zoomFormatRule{min, max, format})
+	}
+	return rules, nil
+}
+
+// zoomFormat returns the format of zoom, or "" when no rule covers it.
+func zoomFormat(rules []zoomFormatRule, zoom int) string {
+	for _, rule := range rules {
+		if zoom >= rule.min && zoom <= rule.max {
+			return rule.format
+		}
+	}
+	return ""
+}
+
+// newZoomFormatProcessor returns a processor converting each tile to the
+// format of its zoom. Tiles already in that format are kept as they are.
+func newZoomFormatProcessor(rules []zoomFormatRule) TileProcessor {
+	return func(tile Tile) (Tile, error) {
+		format := zoomFormat(rules, tile.z)
+		if format == "" {
+			return tile, nil
+		}
+		img, current, err := image.Decode(bytes.NewReader(tile.Content))
+		if err != nil {
+			return tile, fmt.Errorf("converting to %s: %v", format, err)
+		}
+		target := "png"
+		if format == JPG_EXTENSION {
+			target = "jpeg"
+		}
+		if current == target {
+			return tile, nil
+		}
+		tile.Content, err = encodeTile(img, target)
+		return tile, err
+	}
+}
+
+// recordZoomFormats stores the format of every zoom from minZoom to
+// maxZoom under ZOOM_FORMATS_KEY in the json metadata, keeping the other
+// keys already there. Zooms no rule covers have the declared format, and
+// overzoomed levels above nativeMaxZoom the format of nativeMaxZoom.
+func recordZoomFormats(db *sql.DB, rules []zoomFormatRule, declared string, minZoom, nativeMaxZoom, maxZoom int) error {
+	items := make(map[string]interface{})
+	var value string
+	err := db.QueryRow("select value from metadata where name = 'json';").Scan(&value)
+	if err == nil {
+		json.Unmarshal([]byte(value), &items)
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	formats := make(map[string]string)
+	for z := minZoom; z <= maxZoom; z++ {
+		format := zoomFormat(rules, z)
+		if z > nativeMaxZoom {
+			format = zoomFormat(rules, nativeMaxZoom)
+		}
+		if format == "" {
+			format = declared
+		}
+		formats[strconv.Itoa(z)] = format
+	}
+	items[ZOOM_FORMATS_KEY] = formats
+	content, err := json.Marshal(items)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("insert or replace into metadata (name, value) values ('json', ?);", string(content))
+	return err
+}
+
+// zoomFormatsMetadata reads the per zoom formats back from the json
+// metadata value, or returns nil when there are none.
+func zoomFormatsMetadata(metadata map[string]string) map[int]string {
+	var items struct {
+		ZoomFormats map[string]string `json:"zoom_formats"`
+	}
+	if json.Unmarshal([]byte(metadata["json"]), &items) != nil || len(items.ZoomFormats) == 0 {
+		return nil
+	}
+	formats := make(map[int]string)
+	for zoom, format := range items.ZoomFormats {
+		if z, err := strconv.Atoi(zoom); err == nil {
+			formats[z] = format
+		}
+	}
+	return formats
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseZoomFormats(t *testing.T) {
+	rules, err := parseZoomFormats("0-8:jpeg, 9-14:PNG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for zoom, want := range map[int]string{0: JPG_EXTENSION, 8: JPG_EXTENSION, 9: PNG_EXTENSION, 14: PNG_EXTENSION, 15: ""} {
+		if format := zoomFormat(rules, zoom); format != want {
+			t.Errorf("zoom %d is %q, want %q", zoom, format, want)
+		}
+	}
+	for _, value := range []string{"0-8", "0-8:webp", "8-0:png", "a:png", "0-b:jpg"} {
+		if _, err := parseZoomFormats(value); err == nil {
+			t.Errorf("-zoom-formats %q accepted", value)
+		}
+	}
+}
+
+func TestZoomFormats(t *testing.T) {
+	content := solidPNG(t, color.RGBA{0, 128, 255, 255})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer server.Close()
+	filename := filepath.Join(t.TempDir(), "out.mbtiles")
+	output, err := runMain(t, "-url", server.URL+"/{z}/{x}/{y}.png", "-zoomlevel", "0", "-max_zoomlevel", "2",
+		"-xmin", "-180", "-ymin", "-85", "-xmax", "180", "-ymax", "85",
+		"-zoom-formats", "0-1:jpg,2:png", "-filename", filename)
+	if err != nil {
+		t.Fatalf("%v\n%s", err, output)
+	}
+	db, err := openMBTile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	rows, err := db.Query("select zoom_level, tile_data from tiles;")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	count := 0
+	for rows.Next() {
+		var zoom int
+		var tile []byte
+		if err = rows.Scan(&zoom, &tile); err != nil {
+			t.Fatal(err)
+		}
+		want := "jpeg"
+		if zoom == 2 {
+			want = "png"
+		}
+		if _, format, err := image.Decode(bytes.NewReader(tile)); err != nil || format != want {
+			t.Errorf("a zoom %d tile decodes as %q, %v, want %s", zoom, format, err, want)
+		}
+		count++
+	}
+	if count != 1+4+16 {
+		t.Errorf("%d tiles stored", count)
+	}
+	metadata, err := readMetadata(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	formats := zoomFormatsMetadata(metadata)
+	if formats[0] != JPG_EXTENSION || formats[1] != JPG_EXTENSION || formats[2] != PNG_EXTENSION {
+		t.Errorf("zoom formats %v recorded", formats)
+	}
+}